@@ -21,6 +21,7 @@ package commonmark
 import (
 	"bytes"
 	"math"
+	"strings"
 )
 
 // RootBlock represents a "top-level" block,
@@ -47,6 +48,26 @@ type RootBlock struct {
 	Block
 }
 
+// Clone returns a deep copy of the root block and its descendants
+// like [*Block.Clone].
+// If copySource is true, then the copy's Source is a copy of root.Source.
+// Otherwise, the copy's Source refers to the same bytes as root.Source,
+// which is safe as long as neither Source is modified.
+// (The methods in this package and the transform package never modify Source.)
+// Calling Clone on nil returns nil.
+func (root *RootBlock) Clone(copySource bool) *RootBlock {
+	if root == nil {
+		return nil
+	}
+	clone := new(RootBlock)
+	*clone = *root
+	if copySource && root.Source != nil {
+		clone.Source = append([]byte(nil), root.Source...)
+	}
+	clone.cloneChildren()
+	return clone
+}
+
 // A Block is a structural element in a CommonMark document.
 type Block struct {
 	kind BlockKind
@@ -65,18 +86,20 @@ type Block struct {
 
 	// n is a kind-specific datum.
 	// For [ATXHeadingKind] and [SetextHeadingKind], it is the level of the heading.
-	// For [FencedCodeBlockKind], it is the number of characters used in the starting code fence.
+	// For [FencedCodeBlockKind] and [DirectiveBlockKind],
+	// it is the number of characters used in the starting fence.
 	// For [HTMLBlockKind], it is the index in [htmlBlockConditions]
 	// that started this block.
 	n int
 
 	// char is a kind-specific datum.
 	// For [ListKind] and [ListItemKind], it is the character at the end of the list marker.
-	// For [FencedCodeBlockKind], it is the character of the fence.
+	// For [FencedCodeBlockKind] and [DirectiveBlockKind], it is the character of the fence.
 	char byte
 
-	listLoose     bool // valid for [ListKind] and [ListItemKind]
-	lastLineBlank bool
+	listLoose      bool // valid for [ListKind] and [ListItemKind]
+	listBlankStart bool // valid for [ListItemKind]
+	lastLineBlank  bool
 }
 
 // Kind returns the type of block node
@@ -96,6 +119,60 @@ func (b *Block) Span() Span {
 	return b.span
 }
 
+// SourceText returns the bytes of source that the block spans.
+// source must be the Source of the [RootBlock] that contains the block.
+// For blocks inside a container like a block quote,
+// the returned bytes include the container's markers on any continuation lines.
+// The span of an [IndentedCodeBlockKind] block starts after the indentation of its first line,
+// so its SourceText does not include that indentation.
+// SourceText returns nil if the block is nil or its span is not valid within source.
+// The returned slice aliases source.
+func (b *Block) SourceText(source []byte) []byte {
+	span := b.Span()
+	if !span.IsValid() || span.End > len(source) {
+		return nil
+	}
+	return spanSlice(source, span)
+}
+
+// Raw returns the verbatim bytes of source that the block spans,
+// which is useful for partial re-parsing, source maps,
+// or passing through blocks that a renderer does not understand.
+// Raw is equivalent to [*Block.SourceText].
+func (b *Block) Raw(source []byte) []byte {
+	return b.SourceText(source)
+}
+
+// InlineText returns the plain text content of the block's inline children,
+// using the same rules as image descriptions:
+// markup is removed, character references are resolved,
+// line breaks become spaces,
+// and link destinations, titles, and raw HTML are omitted.
+// The contents of code blocks are returned verbatim.
+// If the block's children have not been parsed by [*InlineParser.Rewrite],
+// then InlineText parses them with a default [InlineParser]
+// that uses refs to resolve links.
+// The block itself is not modified.
+// source must be the Source of the [RootBlock] that contains the block.
+// InlineText returns the empty string for blocks that contain other blocks.
+func (b *Block) InlineText(source []byte, refs ReferenceMatcher) string {
+	if b == nil || len(b.inlineChildren) == 0 {
+		return ""
+	}
+	children := b.inlineChildren
+	if hasUnparsed(b) {
+		children = (&InlineParser{ReferenceMatcher: refs}).parse(source, b)
+	}
+	sb := new(strings.Builder)
+	for _, child := range children {
+		if child.Kind() == InfoStringKind {
+			continue
+		}
+		sb.WriteString(plainText(source, child))
+	}
+	return sb.String()
+}
+
 // ChildCount returns the number of children the node has.
 // Calling ChildCount on nil returns 0.
 func (b *Block) ChildCount() int {
@@ -118,6 +195,17 @@ func (b *Block) Child(i int) Node {
 	}
 }
 
+// DescendantsOfKind returns the descendant blocks of the node
+// (not including the node itself) that are of the given kind, in pre-order.
+// DescendantsOfKind returns nil if there are no such descendants.
+func (b *Block) DescendantsOfKind(kind BlockKind) []*Block {
+	var result []*Block
+	for _, child := range b.blockChildren {
+		result = append(result, CollectBlocks(child.AsNode(), kind)...)
+	}
+	return result
+}
+
 // HeadingLevel returns the 1-based level for an [ATXHeadingKind] or [SetextHeadingKind],
 // or zero otherwise.
 func (b *Block) HeadingLevel() int {
@@ -129,6 +217,99 @@ func (b *Block) HeadingLevel() int {
 	}
 }
 
+// SetHeadingLevel changes the level of an [ATXHeadingKind] or [SetextHeadingKind] block.
+// SetHeadingLevel panics if the block is not a heading
+// or if level is not in the range [1, 6].
+func (b *Block) SetHeadingLevel(level int) {
+	if !b.IsHeading() {
+		panic("SetHeadingLevel called on non-heading block")
+	}
+	if level < 1 || level > 6 {
+		panic("SetHeadingLevel level out of range")
+	}
+	b.n = level
+}
+
+// RemoveChildren removes the children in the range [i, j) from the block.
+// RemoveChildren panics if i or j are out of range.
+func (b *Block) RemoveChildren(i, j int) {
+	if i < 0 || j < i || j > b.ChildCount() {
+		panic("RemoveChildren range out of bounds")
+	}
+	if len(b.blockChildren) > 0 {
+		b.blockChildren = deleteBlockNodes(b.blockChildren, i, j)
+	} else {
+		b.inlineChildren = deleteInlineNodes(b.inlineChildren, i, j)
+	}
+}
+
+// Clone returns a deep copy of the block and its descendants.
+// The copy does not share any nodes or child slices with b,
+// so either tree can be modified (for example, by a transform)
+// without affecting the other.
+// Spans are copied as-is,
+// so the copy must be used with the same source as b.
+// Calling Clone on nil returns nil.
+func (b *Block) Clone() *Block {
+	if b == nil {
+		return nil
+	}
+	clone := new(Block)
+	*clone = *b
+	clone.cloneChildren()
+	return clone
+}
+
+// cloneChildren replaces b's children with deep copies.
+func (b *Block) cloneChildren() {
+	if b.blockChildren != nil {
+		children := make([]*Block, len(b.blockChildren))
+		for i, child := range b.blockChildren {
+			children[i] = child.Clone()
+		}
+		b.blockChildren = children
+	}
+	if b.inlineChildren != nil {
+		children := make([]*Inline, len(b.inlineChildren))
+		for i, child := range b.inlineChildren {
+			children[i] = child.Clone()
+		}
+		b.inlineChildren = children
+	}
+}
+
+func deleteBlockNodes(slice []*Block, i, j int) []*Block {
+	copy(slice[i:], slice[j:])
+	newEnd := len(slice) - (j - i)
+	clear := slice[newEnd:]
+	for ci := range clear {
+		clear[ci] = nil
+	}
+	return slice[:newEnd]
+}
+
+// IsHeading reports whether the block is
+// an [ATXHeadingKind] or [SetextHeadingKind] block.
+func (b *Block) IsHeading() bool {
+	return b.Kind().IsHeading()
+}
+
+// IsCode reports whether the block is
+// an [IndentedCodeBlockKind] or [FencedCodeBlockKind] block.
+func (b *Block) IsCode() bool {
+	return b.Kind().IsCode()
+}
+
+// IsList reports whether the block is a [ListKind] block.
+func (b *Block) IsList() bool {
+	return b.Kind() == ListKind
+}
+
+// IsListItem reports whether the block is a [ListItemKind] block.
+func (b *Block) IsListItem() bool {
+	return b.Kind() == ListItemKind
+}
+
 // IsOrderedList reports whether the block is
 // an ordered list or an ordered list item.
 func (b *Block) IsOrderedList() bool {
@@ -137,10 +318,27 @@ func (b *Block) IsOrderedList() bool {
 
 // IsTightList reports whether the block is
 // a tight list or a tight list item.
+// As described in the [specification],
+// a list is loose if any of its items are separated by blank lines
+// or if any of its items directly contain two block-level elements
+// with a blank line between them.
+// Blank lines inside a nested list or block quote
+// do not make the enclosing list loose.
+// List items have the same looseness as their parent list.
+//
+// [specification]: https://spec.commonmark.org/0.30/#loose
 func (b *Block) IsTightList() bool {
 	return b != nil && (b.kind == ListKind || b.kind == ListItemKind) && !b.listLoose
 }
 
+// ListLoose reports whether the block is a loose list or a loose list item.
+// ListLoose returns false for blocks that are not
+// [ListKind] or [ListItemKind] blocks.
+// For lists and list items, ListLoose is the opposite of [*Block.IsTightList].
+func (b *Block) ListLoose() bool {
+	return b != nil && (b.kind == ListKind || b.kind == ListItemKind) && b.listLoose
+}
+
 // ListItemNumber returns the number of a [ListItemKind] block
 // or -1 if the block does not represent an ordered list item.
 func (b *Block) ListItemNumber(source []byte) int {
@@ -158,6 +356,42 @@ func (b *Block) ListItemNumber(source []byte) int {
 	return parsed.n
 }
 
+// ListStartNumber returns the number of the first item of a [ListKind] block
+// or -1 if the block does not represent an ordered list.
+func (b *Block) ListStartNumber(source []byte) int {
+	if b.Kind() != ListKind {
+		return -1
+	}
+	return b.firstChild().Block().ListItemNumber(source)
+}
+
+// IsEmptyListItem reports whether the block is a [ListItemKind] block
+// that contains nothing other than its list marker.
+func (b *Block) IsEmptyListItem() bool {
+	return b.Kind() == ListItemKind && b.ChildCount() <= 1
+}
+
+// ListItemStartsWithBlankLine reports whether the block is a [ListItemKind] block
+// whose list marker was followed by a blank line.
+// Such a list item is empty
+// unless its content begins on the following line (e.g. "-\n  foo").
+func (b *Block) ListItemStartsWithBlankLine() bool {
+	return b.Kind() == ListItemKind && b.listBlankStart
+}
+
+// ListMarkerSpan returns the span of the list marker of a [ListItemKind] block
+// or [NullSpan] if the block is not a list item.
+func (b *Block) ListMarkerSpan() Span {
+	if b.Kind() != ListItemKind {
+		return NullSpan()
+	}
+	marker := b.firstChild().Block()
+	if marker.Kind() != ListMarkerKind {
+		return NullSpan()
+	}
+	return marker.Span()
+}
+
 // InfoString returns the info string node for a [FencedCodeBlockKind] block
 // or nil otherwise.
 func (b *Block) InfoString() *Inline {
@@ -171,6 +405,61 @@ func (b *Block) InfoString() *Inline {
 	return c
 }
 
+// FenceChar returns the character used in the opening fence
+// of a [FencedCodeBlockKind] block ('`' or '~')
+// or a [DirectiveBlockKind] block (':'),
+// or 0 otherwise.
+func (b *Block) FenceChar() byte {
+	if k := b.Kind(); k != FencedCodeBlockKind && k != DirectiveBlockKind {
+		return 0
+	}
+	return b.char
+}
+
+// FenceLength returns the number of characters in the opening fence
+// of a [FencedCodeBlockKind] or [DirectiveBlockKind] block
+// or 0 otherwise.
+func (b *Block) FenceLength() int {
+	if k := b.Kind(); k != FencedCodeBlockKind && k != DirectiveBlockKind {
+		return 0
+	}
+	return b.n
+}
+
+// DirectiveName returns the name of a [DirectiveBlockKind] block,
+// or the empty string if the block has no name or is of a different kind.
+func (b *Block) DirectiveName(source []byte) string {
+	line, f := b.directiveFence(source)
+	if !f.name.IsValid() {
+		return ""
+	}
+	return string(spanSlice(line, f.name))
+}
+
+// DirectiveAttributes returns the text between the braces
+// in the opening fence of a [DirectiveBlockKind] block,
+// or the empty string if the block has no attributes or is of a different kind.
+// The text is returned verbatim: its interpretation is left to the application.
+func (b *Block) DirectiveAttributes(source []byte) string {
+	line, f := b.directiveFence(source)
+	if !f.attrs.IsValid() {
+		return ""
+	}
+	return string(spanSlice(line, f.attrs))
+}
+
+// directiveFence parses the opening fence of a [DirectiveBlockKind] block.
+func (b *Block) directiveFence(source []byte) (line []byte, f directiveFence) {
+	if b.Kind() != DirectiveBlockKind {
+		return nil, directiveFence{name: NullSpan(), attrs: NullSpan()}
+	}
+	line = source[b.span.Start:]
+	if i := bytes.IndexAny(line, "\r\n"); i >= 0 {
+		line = line[:i]
+	}
+	return line, parseDirectiveFence(line)
+}
+
 func (b *Block) firstChild() Node {
 	if b.ChildCount() == 0 {
 		return Node{}
@@ -245,6 +534,13 @@ const (
 	// ListMarkerKind is used to contain the marker in a [ListItemKind] node.
 	// It is typically not rendered directly.
 	ListMarkerKind
+	// DirectiveBlockKind is used for container directives
+	// (e.g. "::: warning"),
+	// which are only recognized if [BlockParser.Directives] is true.
+	// Its children are the blocks inside the directive.
+	// The [*Block.DirectiveName] and [*Block.DirectiveAttributes] methods
+	// can be used to retrieve the parts of the opening fence.
+	DirectiveBlockKind
 
 	documentKind
 )
@@ -267,9 +563,11 @@ func (k BlockKind) IsHeading() bool {
 // In the future, lineParser could be exported to permit custom block rules,
 // but it's unclear how often this is needed.
 type lineParser struct {
-	source    []byte
-	root      Block
-	container *Block
+	source     []byte
+	root       Block
+	container  *Block
+	directives bool
+	disabled   Constructs
 
 	lineStart    int // number of bytes from beginning of root block to start of line
 	line         []byte
@@ -352,9 +650,9 @@ func (p *lineParser) Advance(n int) {
 		panic("index out of bounds")
 	}
 	if p.i < len(p.line) && p.line[p.i] == '\t' {
-		p.col += int(p.tabRemaining) + columnWidth(p.col, p.line[p.i+1:newIndex])
+		p.col += int(p.tabRemaining) + ColumnWidth(p.col, p.line[p.i+1:newIndex])
 	} else {
-		p.col += columnWidth(p.col, p.line[p.i:newIndex])
+		p.col += ColumnWidth(p.col, p.line[p.i:newIndex])
 	}
 	p.i = newIndex
 	p.updateTabRemaining()
@@ -362,7 +660,7 @@ func (p *lineParser) Advance(n int) {
 
 func (p *lineParser) updateTabRemaining() {
 	if p.i < len(p.line) && p.line[p.i] == '\t' {
-		p.tabRemaining = int8(columnWidth(p.col, p.line[p.i:p.i+1]))
+		p.tabRemaining = int8(ColumnWidth(p.col, p.line[p.i:p.i+1]))
 	} else {
 		p.tabRemaining = 0
 	}
@@ -397,7 +695,7 @@ func (p *lineParser) Indent() int {
 		return 0
 	}
 	rest := p.line[p.i+1:]
-	return firstCharWidth + columnWidth(p.col+firstCharWidth, rest[:indentLength(rest)])
+	return firstCharWidth + ColumnWidth(p.col+firstCharWidth, rest[:IndentLength(rest)])
 }
 
 // ConsumeIndent advances the parser by n columns of whitespace.
@@ -473,6 +771,32 @@ func (p *lineParser) ContainerCodeFence() (c byte, n int) {
 	return p.container.char, p.container.n
 }
 
+// ContainerDirectiveFence returns the number of characters
+// used to start the directive being currently matched.
+func (p *lineParser) ContainerDirectiveFence() int {
+	if p.ContainerKind() != DirectiveBlockKind {
+		return 0
+	}
+	return p.container.n
+}
+
+// ContainerHasOpenDirectiveChild reports whether the last child
+// of the container block is an open [DirectiveBlockKind] block.
+func (p *lineParser) ContainerHasOpenDirectiveChild() bool {
+	child := p.container.lastChild().Block()
+	return child.isOpen() && child.Kind() == DirectiveBlockKind
+}
+
+// AllowsDirectives reports whether directive blocks are recognized.
+func (p *lineParser) AllowsDirectives() bool {
+	return p.directives
+}
+
+// AllowsConstruct reports whether the given constructs are recognized.
+func (p *lineParser) AllowsConstruct(c Constructs) bool {
+	return p.disabled&c == 0
+}
+
 func (p *lineParser) ContainerHTMLCondition() int {
 	if p.ContainerKind() != HTMLBlockKind {
 		return -1
@@ -482,7 +806,7 @@ func (p *lineParser) ContainerHTMLCondition() int {
 
 // OpenBlock starts a new block at the current position.
 func (p *lineParser) OpenBlock(kind BlockKind) {
-	if kind == ListKind || kind == ListItemKind || kind == FencedCodeBlockKind || kind == HTMLBlockKind || kind.IsHeading() {
+	if kind == ListKind || kind == ListItemKind || kind == FencedCodeBlockKind || kind == DirectiveBlockKind || kind == HTMLBlockKind || kind.IsHeading() {
 		panic("OpenBlock cannot be called with this kind")
 	}
 	p.openBlock(kind)
@@ -502,6 +826,12 @@ func (p *lineParser) OpenFencedCodeBlock(fenceChar byte, numChars int) {
 	p.container.n = numChars
 }
 
+func (p *lineParser) OpenDirectiveBlock(numChars int) {
+	p.openBlock(DirectiveBlockKind)
+	p.container.char = directiveFenceChar
+	p.container.n = numChars
+}
+
 func (p *lineParser) OpenHeadingBlock(kind BlockKind, level int) {
 	if !kind.IsHeading() {
 		panic("OpenHeadingBlock must be called with ATXHeadingKind or SetextHeadingKind")
@@ -546,6 +876,21 @@ func (p *lineParser) openBlock(kind BlockKind) {
 	p.container = newChild
 }
 
+// SetListItemBlankStart records that the list item container
+// began with a blank line.
+func (p *lineParser) SetListItemBlankStart() {
+	switch p.state {
+	case stateOpening:
+		panic("SetListItemBlankStart cannot be called before a match")
+	case stateDescending, stateDescendTerminated:
+		panic("SetListItemBlankStart cannot be called in this context")
+	}
+	if p.ContainerKind() != ListItemKind {
+		panic("can't set blank start for this block type")
+	}
+	p.container.listBlankStart = true
+}
+
 // SetContainerIndent sets the container's indentation.
 func (p *lineParser) SetContainerIndent(indent int) {
 	switch p.state {
@@ -574,7 +919,7 @@ func (p *lineParser) CollectInline(kind InlineKind, n int) {
 
 	if indent := p.Indent(); indent > 0 {
 		indentStart := p.lineStart + p.i
-		p.Advance(indentLength(p.line[p.i:]))
+		p.Advance(IndentLength(p.line[p.i:]))
 		p.container.inlineChildren = append(p.container.inlineChildren, &Inline{
 			kind: IndentKind,
 			span: Span{
@@ -682,12 +1027,31 @@ var blockStarts = []func(*lineParser){
 		p.ConsumeLine()
 	},
 
-	// HTML block.
+	// Directive.
 	func(p *lineParser) {
+		if !p.AllowsDirectives() {
+			return
+		}
 		indent := p.Indent()
 		if indent >= codeBlockIndentLimit {
 			return
 		}
+		f := parseDirectiveFence(p.BytesAfterIndent())
+		if f.n == 0 || f.isClosing() {
+			return
+		}
+
+		p.ConsumeIndent(indent)
+		p.OpenDirectiveBlock(f.n)
+		p.ConsumeLine()
+	},
+
+	// HTML block.
+	func(p *lineParser) {
+		indent := p.Indent()
+		if indent >= codeBlockIndentLimit || !p.AllowsConstruct(ConstructRawHTML) {
+			return
+		}
 		line := p.BytesAfterIndent()
 		if len(line) == 0 || line[0] != '<' {
 			return
@@ -710,6 +1074,10 @@ var blockStarts = []func(*lineParser){
 
 	// Setext heading.
 	func(p *lineParser) {
+		// The container is the paragraph itself
+		// only if the line matched all of the paragraph's enclosing containers
+		// (e.g. "> ---" inside a block quote),
+		// so a lazy continuation line can never become an underline.
 		if p.ContainerKind() != ParagraphKind {
 			return
 		}
@@ -769,6 +1137,7 @@ var blockStarts = []func(*lineParser){
 		p.EndBlock()
 		if p.IsRestBlank() {
 			p.SetContainerIndent(indent + m.end + 1)
+			p.SetListItemBlankStart()
 			p.ConsumeLine()
 			return
 		}
@@ -790,6 +1159,9 @@ var blockStarts = []func(*lineParser){
 		if p.Indent() < codeBlockIndentLimit || p.IsRestBlank() || p.TipKind() == ParagraphKind {
 			return
 		}
+		if !p.AllowsConstruct(ConstructIndentedCode) {
+			return
+		}
 		p.ConsumeIndent(codeBlockIndentLimit)
 		p.OpenBlock(IndentedCodeBlockKind)
 	},
@@ -888,6 +1260,9 @@ var blockRules = map[BlockKind]blockRule{
 	},
 	FencedCodeBlockKind: {
 		match: func(p *lineParser) bool {
+			// The enclosing containers have already consumed their indentation,
+			// so lineIndent is relative to the fence's container,
+			// not to the opening fence.
 			lineIndent := p.Indent()
 			if lineIndent < codeBlockIndentLimit {
 				startChar, startCharCount := p.ContainerCodeFence()
@@ -907,6 +1282,28 @@ var blockRules = map[BlockKind]blockRule{
 		},
 		acceptsLines: true,
 	},
+	DirectiveBlockKind: {
+		match: func(p *lineParser) bool {
+			if p.Indent() >= codeBlockIndentLimit {
+				return true
+			}
+			if tip := p.TipKind(); tip == FencedCodeBlockKind || tip == HTMLBlockKind {
+				// Fences inside code and HTML blocks are content.
+				return true
+			}
+			f := parseDirectiveFence(p.BytesAfterIndent())
+			if f.isClosing() && p.ContainerHasOpenDirectiveChild() {
+				// The innermost open directive claims the closing fence.
+				return true
+			}
+			if f.isClosing() && f.n >= p.ContainerDirectiveFence() {
+				p.ConsumeLine()
+				return false
+			}
+			return true
+		},
+		canContain: func(childKind BlockKind) bool { return childKind != ListItemKind },
+	},
 	IndentedCodeBlockKind: {
 		match: func(p *lineParser) bool {
 			indent := p.Indent()
@@ -922,6 +1319,16 @@ var blockRules = map[BlockKind]blockRule{
 		},
 		onClose: func(source []byte, block *Block) []*Block {
 			// "Blank lines preceding or following an indented code block are not included in it."
+			// If the last line does not end in a line ending,
+			// it is followed by an empty line break.
+			if n := len(block.inlineChildren); n >= 2 &&
+				block.inlineChildren[n-1].Kind() == SoftLineBreakKind &&
+				block.inlineChildren[n-1].Span().Len() == 0 &&
+				block.inlineChildren[n-2].Kind() == TextKind &&
+				isBlankLine(spanSlice(source, block.inlineChildren[n-2].Span())) {
+				block.inlineChildren[n-1] = nil // free for GC
+				block.inlineChildren = block.inlineChildren[: n-1 : n-1]
+			}
 			for i := block.ChildCount() - 1; i >= 0; i-- {
 				child := block.inlineChildren[i]
 				if child.Kind() != TextKind || !isBlankLine(spanSlice(source, child.Span())) {
@@ -940,9 +1347,12 @@ var blockRules = map[BlockKind]blockRule{
 	HTMLBlockKind: {
 		match: func(p *lineParser) bool {
 			if htmlBlockConditions[p.ContainerHTMLCondition()].endCondition(p.BytesAfterIndent()) {
-				if !p.IsRestBlank() {
-					p.CollectInline(RawHTMLKind, len(p.BytesAfterIndent()))
+				if p.IsRestBlank() {
+					// The blank line is not part of the block,
+					// but it still counts toward list looseness.
+					return false
 				}
+				p.CollectInline(RawHTMLKind, len(p.BytesAfterIndent()))
 				p.ConsumeLine()
 				return false
 			}
@@ -1161,6 +1571,78 @@ func parseCodeFence(line []byte) codeFence {
 	return f
 }
 
+// directiveFenceChar is the character used in directive fences.
+const directiveFenceChar = ':'
+
+type directiveFence struct {
+	n     int  // number of colons, or 0 if the line is not a fence
+	name  Span // null if the fence does not have a name
+	attrs Span // contents of the braces, or null if the fence does not have attributes
+}
+
+// parseDirectiveFence attempts to parse the line as a directive fence:
+// three or more colons,
+// optionally followed by a name and attributes in braces
+// (e.g. "::: warning {.big}").
+// A fence with neither a name nor attributes closes a directive.
+// [directiveFence.n] is 0 if the line is not a fence.
+// parseDirectiveFence assumes that the caller has stripped any leading indentation.
+func parseDirectiveFence(line []byte) directiveFence {
+	const minConsecutive = 3
+	noFence := directiveFence{name: NullSpan(), attrs: NullSpan()}
+	f := noFence
+	for f.n < len(line) && line[f.n] == directiveFenceChar {
+		f.n++
+	}
+	if f.n < minConsecutive {
+		return noFence
+	}
+	i := f.n
+	for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+		i++
+	}
+	if end := parseDirectiveName(line[i:]); end > 0 {
+		f.name = Span{Start: i, End: i + end}
+		i += end
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+	}
+	if i < len(line) && line[i] == '{' {
+		end := bytes.IndexAny(line[i+1:], "{}\r\n")
+		if end < 0 || line[i+1+end] != '}' {
+			return noFence
+		}
+		f.attrs = Span{Start: i + 1, End: i + 1 + end}
+		i = f.attrs.End + 1
+	}
+	if !isBlankLine(line[i:]) {
+		return noFence
+	}
+	return f
+}
+
+// isClosing reports whether f is a fence that closes a directive.
+func (f directiveFence) isClosing() bool {
+	return f.n > 0 && !f.name.IsValid() && !f.attrs.IsValid()
+}
+
+// parseDirectiveName returns the length of the directive name
+// at the beginning of text
+// or zero if text does not begin with a name.
+// A directive name is an ASCII letter
+// followed by any number of ASCII letters, digits, hyphens, or underscores.
+func parseDirectiveName(text []byte) (end int) {
+	if len(text) == 0 || !isASCIILetter(text[0]) {
+		return 0
+	}
+	end = 1
+	for end < len(text) && (isASCIILetter(text[end]) || isASCIIDigit(text[end]) || text[end] == '-' || text[end] == '_') {
+		end++
+	}
+	return end
+}
+
 type listMarker struct {
 	delim byte // one of '-', '+', '*', '.', or ')'
 	n     int
@@ -1242,160 +1724,154 @@ func onCloseParagraph(source []byte, originalBlock *Block) []*Block {
 			}},
 		}
 	}
-	r := newInlineByteReader(source, originalBlock.inlineChildren, contentStart)
 	var result []*Block
 	for {
-		// At a minimum, a link reference definition must have a label and a destination.
-		label := parseLinkLabel(r)
-		if !label.span.IsValid() {
-			return append(result, originalBlock)
-		}
-		if r.current() != ':' {
-			return append(result, originalBlock)
-		}
-		r.next()
-		if !skipLinkSpace(r) {
+		def, next := parseLinkReferenceDefinition(source, originalBlock.inlineChildren, contentStart)
+		if def == nil {
 			return append(result, originalBlock)
 		}
-		destination := parseLinkDestination(r)
-		if !destination.span.IsValid() {
-			return append(result, originalBlock)
-		}
-
-		// Check if we're at the end of the line.
-		// The title may be on the next line,
-		// but if it isn't, then we may need to back up.
-		sepPoint := r.pos
-		destinationEOL := readEOL(r)
-		cloned := *r
-		if destinationEOL < 0 && r.pos == sepPoint && r.current() != 0 {
-			// Title must be separated by at least one space.
-			// Abandon this definition.
-			return append(result, originalBlock)
-		}
-
-		// We likely have a new link reference definition, so prep it.
-		newBlock := &Block{
-			kind: LinkReferenceDefinitionKind,
-			span: Span{Start: label.span.Start, End: destination.span.End},
-		}
-
-		labelInline := &Inline{
-			kind: LinkLabelKind,
-			span: label.inner,
-			ref:  transformLinkReferenceSpan(source, originalBlock.inlineChildren, label.inner),
-		}
-		collectLinkLabelText(
-			labelInline,
-			newInlineByteReader(source, originalBlock.inlineChildren, label.inner.Start),
-			label.inner.End,
-		)
-		newBlock.inlineChildren = append(newBlock.inlineChildren, labelInline)
-
-		destinationInline := &Inline{
-			kind: LinkDestinationKind,
-			span: destination.span,
-		}
-		collectLinkAttributeText(
-			destinationInline,
-			newInlineByteReader(source, originalBlock.inlineChildren, destination.text.Start),
-			destination.text.End,
-		)
-		newBlock.inlineChildren = append(newBlock.inlineChildren, destinationInline)
-
-		// Consume whitespace before the title (only if we moved to a subsequent line).
-		if !skipLinkSpace(r) {
-			// We hit EOF before encountering anything else.
-			newBlock.span.End = destinationEOL
-			result = append(result, newBlock)
+		result = append(result, def)
+		if !trimParagraphStart(source, originalBlock, next) {
+			// The definitions consumed the entire paragraph.
 			if setextOrphanParagraph != nil {
 				result = append(result, setextOrphanParagraph)
 			}
 			return result
 		}
+		contentStart = originalBlock.inlineChildren[0].Span().Start
+	}
+}
 
-		// Parse title, if present.
-		title := parseLinkTitle(r)
-		if !title.span.IsValid() {
-			if destinationEOL < 0 {
-				// There were non-space characters after the destination and it wasn't a title:
-				// abandon this definition.
-				return append(result, originalBlock)
-			}
-
-			// We have a complete link reference definition,
-			// we just need to rewind to the beginning of the line.
-			newBlock.span.End = destinationEOL
-			result = append(result, newBlock)
-
-			originalBlock.span.Start = cloned.pos
-			firstChild := nodeIndexForPosition(originalBlock.inlineChildren, cloned.pos)
-			if firstChild < 0 {
-				if setextOrphanParagraph != nil {
-					result = append(result, setextOrphanParagraph)
-				}
-				return result
-			}
-			originalBlock.inlineChildren = originalBlock.inlineChildren[firstChild:]
-			*r = cloned
-			continue
+// parseLinkReferenceDefinition attempts to parse a link reference definition
+// from the paragraph content in nodes, starting at the given position.
+// If successful, parseLinkReferenceDefinition returns the definition
+// and the position of the line after the definition.
+// Otherwise, it returns nil.
+func parseLinkReferenceDefinition(source []byte, nodes []*Inline, start int) (def *Block, next int) {
+	r := newInlineByteReader(source, nodes, start)
+
+	// At a minimum, a link reference definition must have a label and a destination.
+	label := parseLinkLabel(r)
+	if !label.span.IsValid() || r.current() != ':' {
+		return nil, -1
+	}
+	r.next()
+	if !skipLinkSpace(r) {
+		return nil, -1
+	}
+	destination := parseLinkDestination(r)
+	if !destination.span.IsValid() {
+		return nil, -1
+	}
+
+	def = &Block{
+		kind: LinkReferenceDefinitionKind,
+		span: Span{Start: label.span.Start, End: destination.span.End},
+	}
+	labelInline := &Inline{
+		kind: LinkLabelKind,
+		span: label.inner,
+		ref:  transformLinkReferenceSpan(source, nodes, label.inner),
+	}
+	collectLinkLabelText(
+		labelInline,
+		newInlineByteReader(source, nodes, label.inner.Start),
+		label.inner.End,
+	)
+	def.inlineChildren = append(def.inlineChildren, labelInline)
+	destinationInline := &Inline{
+		kind: LinkDestinationKind,
+		span: destination.span,
+	}
+	collectLinkAttributeText(
+		destinationInline,
+		newInlineByteReader(source, nodes, destination.text.Start),
+		destination.text.End,
+	)
+	def.inlineChildren = append(def.inlineChildren, destinationInline)
+
+	// Checkpoint: if the destination ends its line,
+	// then the definition can end there
+	// if the title is missing or invalid.
+	// Otherwise, a title is required on the same line.
+	destinationEnd := r.pos
+	destinationEOL := readEOL(r)
+	if destinationEOL < 0 && r.pos == destinationEnd {
+		// Title must be separated by at least one space.
+		return nil, -1
+	}
+	afterDestination := r.pos
+	withoutTitle := func() (*Block, int) {
+		if destinationEOL < 0 {
+			// There were non-space characters after the destination
+			// and they weren't a valid title.
+			return nil, -1
 		}
+		def.span.End = destinationEOL
+		return def, afterDestination
+	}
 
-		// We have a title. Now ensure there are no more characters on the line.
-		titleEOL := readEOL(r)
-		if titleEOL < 0 {
-			// No dice. If the title wasn't cleanly on another line,
-			// then we don't have a definition.
-			if destinationEOL < 0 {
-				return append(result, originalBlock)
-			}
+	// Consume whitespace before the title (only if we moved to a subsequent line).
+	if !skipLinkSpace(r) {
+		// We hit EOF before encountering anything else.
+		return withoutTitle()
+	}
+	title := parseLinkTitle(r)
+	if !title.span.IsValid() {
+		return withoutTitle()
+	}
+	// The title must be the last thing on its line.
+	titleEOL := readEOL(r)
+	if titleEOL < 0 {
+		return withoutTitle()
+	}
 
-			// We have a valid link reference definition without a title.
-			// Any line that starts with a valid title
-			// can't possibly be another link reference definition
-			// (titles can't start with a '['),
-			// so we know we're done.
-			newBlock.span.End = destinationEOL
-			result = append(result, newBlock)
-
-			originalBlock.span.Start = cloned.pos
-			firstChild := nodeIndexForPosition(originalBlock.inlineChildren, cloned.pos)
-			if firstChild < 0 {
-				if setextOrphanParagraph != nil {
-					result = append(result, setextOrphanParagraph)
-				}
-				return result
-			}
-			originalBlock.inlineChildren = originalBlock.inlineChildren[firstChild:]
-			return append(result, originalBlock)
-		}
+	titleInline := &Inline{
+		kind: LinkTitleKind,
+		span: title.span,
+	}
+	collectLinkAttributeText(
+		titleInline,
+		newInlineByteReader(source, nodes, title.text.Start),
+		title.text.End,
+	)
+	def.inlineChildren = append(def.inlineChildren, titleInline)
+	def.span.End = titleEOL
+	return def, r.pos
+}
 
-		// We now have a link reference definition with all three parts:
-		// label, destination, and title.
-		// Collect it up, shorten the block, and loop through again.
-		titleInline := &Inline{
-			kind: LinkTitleKind,
-			span: title.span,
-		}
-		collectLinkAttributeText(
-			titleInline,
-			newInlineByteReader(source, originalBlock.inlineChildren, title.text.Start),
-			title.text.End,
-		)
-		newBlock.inlineChildren = append(newBlock.inlineChildren, titleInline)
-		newBlock.span.End = titleEOL
-		result = append(result, newBlock)
-
-		originalBlock.span.Start = r.pos
-		firstChild := nodeIndexForPosition(originalBlock.inlineChildren, r.pos)
-		if firstChild < 0 {
-			if setextOrphanParagraph != nil {
-				result = append(result, setextOrphanParagraph)
-			}
-			return result
+// trimParagraphStart removes the content before pos from a paragraph block,
+// along with any indentation at the beginning of the line at pos.
+// It reports whether the paragraph has any content remaining.
+func trimParagraphStart(source []byte, block *Block, pos int) bool {
+	i := nodeIndexForPosition(block.inlineChildren, pos)
+	if i < 0 {
+		return false
+	}
+	for i < len(block.inlineChildren) && block.inlineChildren[i].Kind() == IndentKind {
+		i++
+	}
+	if i >= len(block.inlineChildren) {
+		return false
+	}
+	first := block.inlineChildren[i]
+	lineStart := first.Span().Start
+	if pos > lineStart {
+		lineStart = pos
+	}
+	for lineStart < first.Span().End && (source[lineStart] == ' ' || source[lineStart] == '\t') {
+		lineStart++
+	}
+	block.inlineChildren = block.inlineChildren[i:]
+	if lineStart > first.Span().Start {
+		// Don't modify the original node, since the spans are shared.
+		block.inlineChildren[0] = &Inline{
+			kind: first.Kind(),
+			span: Span{Start: lineStart, End: first.Span().End},
 		}
-		originalBlock.inlineChildren = originalBlock.inlineChildren[firstChild:]
 	}
+	block.span.Start = lineStart
+	return true
 }
 
 // skipLinkSpace skips over spaces and tabs
@@ -17,9 +17,15 @@
 package commonmark
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/commonmark/internal/normhtml"
+	"zombiezen.com/go/commonmark/internal/spec"
 )
 
 func TestParseThematicBreak(t *testing.T) {
@@ -95,3 +101,1177 @@ func TestParseATXHeading(t *testing.T) {
 		}
 	}
 }
+
+func TestBlockDescendantsOfKind(t *testing.T) {
+	tests := []struct {
+		input string
+		kind  BlockKind
+		want  []string
+	}{
+		{input: "> a\n", kind: ATXHeadingKind, want: nil},
+		{input: "> # A\n> ## B\n", kind: ATXHeadingKind, want: []string{"# A\n", "## B\n"}},
+		{input: "> - a\n>   ```\n>   b\n>   ```\n", kind: FencedCodeBlockKind, want: []string{"```\n>   b\n>   ```\n"}},
+		{input: "- a\n  - b\n", kind: ListKind, want: []string{"- b\n"}},
+		{input: "> > a\n", kind: BlockQuoteKind, want: []string{"> a\n"}},
+	}
+	for _, test := range tests {
+		blocks, _ := Parse([]byte(test.input))
+		if len(blocks) != 1 {
+			t.Errorf("Parse(%q) returned %d blocks; want 1", test.input, len(blocks))
+			continue
+		}
+		descendants := blocks[0].Block.DescendantsOfKind(test.kind)
+		if descendants != nil && len(descendants) == 0 {
+			t.Errorf("%q: DescendantsOfKind(%v) = []*Block{}; want nil", test.input, test.kind)
+		}
+		var got []string
+		for _, d := range descendants {
+			got = append(got, string(spanSlice(blocks[0].Source, d.Span())))
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%q: DescendantsOfKind(%v) (-want +got):\n%s", test.input, test.kind, diff)
+		}
+	}
+}
+
+func TestListLooseness(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		// tight is IsTightList for each list in the document, in pre-order.
+		tight []bool
+	}{
+		{
+			name:  "Tight",
+			input: "- a\n- b\n",
+			tight: []bool{true},
+		},
+		{
+			name:  "BlankBetweenItems",
+			input: "- a\n\n- b\n",
+			tight: []bool{false},
+		},
+		{
+			name:  "BlankBetweenBlocksInItem",
+			input: "- a\n\n  b\n- c\n",
+			tight: []bool{false},
+		},
+		{
+			name:  "BlankAfterLastItem",
+			input: "- a\n- b\n\n",
+			tight: []bool{true},
+		},
+		{
+			name:  "BlankInSubList",
+			input: "- a\n  - b\n\n    c\n- d\n",
+			tight: []bool{true, false},
+		},
+		{
+			name:  "BlankInSubSubList",
+			input: "- a\n  - b\n    - c\n\n      d\n- e\n",
+			tight: []bool{true, true, false},
+		},
+		{
+			name:  "BlankAfterSubList",
+			input: "- a\n  - b\n\n- c\n",
+			tight: []bool{false, true},
+		},
+		{
+			name:  "BlankAfterSubSubList",
+			input: "- a\n  - b\n    - c\n\n- d\n",
+			tight: []bool{false, true, true},
+		},
+		{
+			name:  "BlankBeforeSubList",
+			input: "1. a\n\n   - b\n   - c\n2. d\n",
+			tight: []bool{false, true},
+		},
+		{
+			name:  "BlankInBlockQuote",
+			input: "- a\n  > b\n  >\n  > c\n- d\n",
+			tight: []bool{true},
+		},
+		{
+			name:  "BlankAfterHTMLBlock",
+			input: "- <div>\n\n  b\n",
+			tight: []bool{false},
+		},
+		{
+			name:  "BlankAfterHTMLBlockBetweenItems",
+			input: "- <div>\n\n- b\n",
+			tight: []bool{false},
+		},
+		{
+			name:  "BlankInFencedCode",
+			input: "- a\n  ```\n  b\n\n\n  ```\n- c\n",
+			tight: []bool{true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, _ := Parse([]byte(test.input))
+			var got []bool
+			for _, root := range blocks {
+				Walk(root.AsNode(), &WalkOptions{
+					Pre: func(c *Cursor) bool {
+						b := c.Node().Block()
+						if b == nil {
+							return false
+						}
+						if want := (b.IsList() || b.IsListItem()) && !b.IsTightList(); b.ListLoose() != want {
+							t.Errorf("%v: ListLoose() = %t; want %t", b.Kind(), b.ListLoose(), want)
+						}
+						if b.Kind() == ListKind {
+							got = append(got, b.IsTightList())
+							for i := 0; i < b.ChildCount(); i++ {
+								if item := b.Child(i).Block(); item.IsTightList() != b.IsTightList() {
+									t.Errorf("item %d of list %d: IsTightList() = %t; want %t",
+										i, len(got)-1, item.IsTightList(), b.IsTightList())
+								}
+							}
+						}
+						return true
+					},
+				})
+			}
+			if diff := cmp.Diff(test.tight, got); diff != "" {
+				t.Errorf("lists IsTightList (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestListStartNumber(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int
+	}{
+		{input: "1. a\n2. b\n", want: 1},
+		{input: "3) a\n", want: 3},
+		{input: "0. a\n", want: 0},
+		{input: "007. a\n8. b\n", want: 7},
+		{input: "123456789. a\n", want: 123456789},
+		{input: "- a\n- b\n", want: -1},
+		{input: "* a\n", want: -1},
+	}
+	for _, test := range tests {
+		blocks, _ := Parse([]byte(test.input))
+		if len(blocks) != 1 || blocks[0].Kind() != ListKind {
+			t.Errorf("Parse(%q) did not return a single list", test.input)
+			continue
+		}
+		if got := blocks[0].ListStartNumber(blocks[0].Source); got != test.want {
+			t.Errorf("Parse(%q).ListStartNumber(...) = %d; want %d", test.input, got, test.want)
+		}
+		if item := blocks[0].Child(0).Block(); item.ListStartNumber(blocks[0].Source) != -1 {
+			t.Errorf("Parse(%q).Child(0).ListStartNumber(...) = %d; want -1",
+				test.input, item.ListStartNumber(blocks[0].Source))
+		}
+	}
+}
+
+func TestListItems(t *testing.T) {
+	type listItem struct {
+		Marker     string
+		Empty      bool
+		BlankStart bool
+	}
+	tests := []struct {
+		name  string
+		input string
+		items []listItem
+		html  string
+	}{
+		{
+			name:  "Empty",
+			input: "-\n-\n- x\n",
+			items: []listItem{
+				{Marker: "-", Empty: true, BlankStart: true},
+				{Marker: "-", Empty: true, BlankStart: true},
+				{Marker: "-"},
+			},
+			html: "<ul><li></li><li></li><li>x</li></ul>",
+		},
+		{
+			name:  "EmptyInMiddle",
+			input: "- foo\n-\n- bar\n",
+			items: []listItem{
+				{Marker: "-"},
+				{Marker: "-", Empty: true, BlankStart: true},
+				{Marker: "-"},
+			},
+			html: "<ul><li>foo</li><li></li><li>bar</li></ul>",
+		},
+		{
+			name:  "EmptyOrdered",
+			input: "1.\n2. a\n",
+			items: []listItem{
+				{Marker: "1.", Empty: true, BlankStart: true},
+				{Marker: "2."},
+			},
+			html: "<ol><li></li><li>a</li></ol>",
+		},
+		{
+			name:  "ContentOnNextLine",
+			input: "-\n  foo\n",
+			items: []listItem{
+				{Marker: "-", BlankStart: true},
+			},
+			html: "<ul><li>foo</li></ul>",
+		},
+		{
+			name:  "TwoBlankLines",
+			input: "-\n\n  foo\n",
+			items: []listItem{
+				{Marker: "-", Empty: true, BlankStart: true},
+			},
+			html: "<ul><li></li></ul>\n\n<p>foo</p>",
+		},
+		{
+			name:  "TrailingSpaces",
+			input: "*   \n",
+			items: []listItem{
+				{Marker: "*", Empty: true, BlankStart: true},
+			},
+			html: "<ul><li></li></ul>",
+		},
+		{
+			name:  "NestedList",
+			input: "- - a\n",
+			items: []listItem{
+				{Marker: "-"},
+				{Marker: "-"},
+			},
+			html: "<ul><li><ul><li>a</li></ul></li></ul>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			var got []listItem
+			for _, root := range blocks {
+				for _, item := range CollectBlocks(root.AsNode(), ListItemKind) {
+					got = append(got, listItem{
+						Marker:     string(spanSlice(root.Source, item.ListMarkerSpan())),
+						Empty:      item.IsEmptyListItem(),
+						BlankStart: item.ListItemStartsWithBlankLine(),
+					})
+				}
+			}
+			if diff := cmp.Diff(test.items, got); diff != "" {
+				t.Errorf("list items (-want +got):\n%s", diff)
+			}
+
+			html := new(strings.Builder)
+			if err := RenderHTML(html, blocks, refMap); err != nil {
+				t.Error("RenderHTML:", err)
+			}
+			if diff := cmp.Diff(test.html, html.String()); diff != "" {
+				t.Errorf("HTML (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("NotListItem", func(t *testing.T) {
+		blocks, _ := Parse([]byte("- a\n"))
+		list := &blocks[0].Block
+		if list.IsEmptyListItem() {
+			t.Error("IsEmptyListItem() on list = true")
+		}
+		if list.ListItemStartsWithBlankLine() {
+			t.Error("ListItemStartsWithBlankLine() on list = true")
+		}
+		if got := list.ListMarkerSpan(); got.IsValid() {
+			t.Errorf("ListMarkerSpan() on list = %v; want invalid span", got)
+		}
+	})
+}
+
+func TestFence(t *testing.T) {
+	tests := []struct {
+		input      string
+		wantChar   byte
+		wantLength int
+	}{
+		{"```\ncode\n```\n", '`', 3},
+		{"~~~~~ go\ncode\n~~~~~~\n", '~', 5},
+		{"  ````\n  code\n", '`', 4},
+		{"    code\n", 0, 0},
+		{"paragraph\n", 0, 0},
+	}
+	for _, test := range tests {
+		blocks, _ := Parse([]byte(test.input))
+		if len(blocks) != 1 {
+			t.Errorf("Parse(%q) returned %d blocks; want 1", test.input, len(blocks))
+			continue
+		}
+		b := &blocks[0].Block
+		if got := b.FenceChar(); got != test.wantChar {
+			t.Errorf("Parse(%q)[0].FenceChar() = %q; want %q", test.input, got, test.wantChar)
+		}
+		if got := b.FenceLength(); got != test.wantLength {
+			t.Errorf("Parse(%q)[0].FenceLength() = %d; want %d", test.input, got, test.wantLength)
+		}
+	}
+
+	var nilBlock *Block
+	if got := nilBlock.FenceChar(); got != 0 {
+		t.Errorf("(*Block)(nil).FenceChar() = %q; want 0", got)
+	}
+	if got := nilBlock.FenceLength(); got != 0 {
+		t.Errorf("(*Block)(nil).FenceLength() = %d; want 0", got)
+	}
+}
+
+func TestFencedCodeBlockClosingFence(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		// code is the content of each fenced code block in the document.
+		code []string
+	}{
+		{name: "Example129", input: "```\n\n  \n```\n", code: []string{"\n  \n"}},
+		{name: "Example130", input: "```\n```\n", code: []string{""}},
+		{name: "Example131", input: " ```\n aaa\naaa\n```\n", code: []string{"aaa\naaa\n"}},
+		{name: "Example132", input: "  ```\naaa\n  aaa\naaa\n  ```\n", code: []string{"aaa\naaa\naaa\n"}},
+		{name: "Example133", input: "   ```\n   aaa\n    aaa\n  aaa\n   ```\n", code: []string{"aaa\n aaa\naaa\n"}},
+		{name: "Example134", input: "    ```\n    aaa\n    ```\n", code: nil},
+		{name: "Example135", input: "```\naaa\n  ```\n", code: []string{"aaa\n"}},
+		{name: "Example136", input: "   ```\naaa\n  ```\n", code: []string{"aaa\n"}},
+		{name: "Example137", input: "```\naaa\n    ```\n", code: []string{"aaa\n    ```\n"}},
+		{name: "Example138", input: "``` ```\naaa\n", code: nil},
+		{name: "Example139", input: "~~~~~~\naaa\n~~~ ~~\n", code: []string{"aaa\n~~~ ~~\n"}},
+		{name: "Example140", input: "foo\n```\nbar\n```\nbaz\n", code: []string{"bar\n"}},
+		{name: "Example141", input: "foo\n---\n~~~\nbar\n~~~\n# baz\n", code: []string{"bar\n"}},
+		{name: "Example142", input: "```ruby\ndef foo(x)\n  return 3\nend\n```\n", code: []string{"def foo(x)\n  return 3\nend\n"}},
+		{name: "Example143", input: "~~~~    ruby startline=3 $%@#$\ndef foo(x)\n  return 3\nend\n~~~~~~~\n", code: []string{"def foo(x)\n  return 3\nend\n"}},
+		{name: "Example144", input: "````;\n````\n", code: []string{""}},
+		{name: "Example145", input: "``` aa ```\nfoo\n", code: nil},
+		{name: "Example146", input: "~~~ aa ``` ~~~\nfoo\n~~~\n", code: []string{"foo\n"}},
+		{name: "Example147", input: "```\n``` aaa\n```\n", code: []string{"``` aaa\n"}},
+		{
+			name:  "ListItem",
+			input: "- ```\n  x\n     ```\n  y\n",
+			code:  []string{"x\n"},
+		},
+		{
+			name:  "ListItemContentIndent",
+			input: "- ```\n  x\n      ```\n  y\n",
+			code:  []string{"x\n    ```\ny\n"},
+		},
+		{
+			name:  "NestedList",
+			input: "- a\n  - b\n\n    ```\n    code\n    ```\n    after\n",
+			code:  []string{"code\n"},
+		},
+		{
+			name:  "NestedListIndentedClose",
+			input: "- a\n  - b\n\n    ```\n    code\n       ```\n    after\n",
+			code:  []string{"code\n"},
+		},
+		{
+			name:  "NestedListOverIndentedClose",
+			input: "- a\n  - b\n\n    ```\n    code\n        ```\n    after\n",
+			code:  []string{"code\n    ```\nafter\n"},
+		},
+		{
+			name:  "NestedListIndentedOpen",
+			input: "- a\n  - b\n\n      ```\n      code\n    ```\n      after\n",
+			code:  []string{"code\n"},
+		},
+		{
+			name:  "CloseOutsideListItem",
+			input: "1. a\n\n   ```\n   x\n  ```\n",
+			code:  []string{"x\n", ""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, _ := Parse([]byte(test.input))
+			var got []string
+			for _, root := range blocks {
+				for _, b := range CollectBlocks(root.AsNode(), FencedCodeBlockKind) {
+					sb := new(strings.Builder)
+					for i, n := 0, b.ChildCount(); i < n; i++ {
+						if child := b.Child(i).Inline(); child.Kind() != InfoStringKind {
+							sb.WriteString(child.Text(root.Source))
+						}
+					}
+					got = append(got, sb.String())
+				}
+			}
+			if diff := cmp.Diff(test.code, got); diff != "" {
+				t.Errorf("Parse(%q) code block contents (-want +got):\n%s", test.input, diff)
+			}
+		})
+	}
+}
+
+func TestFencedCodeBlockInListItem(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "NestedList",
+			input: "- a\n  - b\n\n    ```\n    code\n    ```\n    after\n",
+			want:  "<ul>\n<li>a\n<ul>\n<li>\n<p>b</p>\n<pre><code>code\n</code></pre>\n<p>after</p>\n</li>\n</ul>\n</li>\n</ul>\n",
+		},
+		{
+			name:  "NestedListIndentedClose",
+			input: "- a\n  - b\n\n    ```\n    code\n       ```\n    after\n",
+			want:  "<ul>\n<li>a\n<ul>\n<li>\n<p>b</p>\n<pre><code>code\n</code></pre>\n<p>after</p>\n</li>\n</ul>\n</li>\n</ul>\n",
+		},
+		{
+			name:  "NestedListOverIndentedClose",
+			input: "- a\n  - b\n\n    ```\n    code\n        ```\n    after\n",
+			want:  "<ul>\n<li>a\n<ul>\n<li>\n<p>b</p>\n<pre><code>code\n    ```\nafter\n</code></pre>\n</li>\n</ul>\n</li>\n</ul>\n",
+		},
+		{
+			name:  "NestedListIndentedOpen",
+			input: "- a\n  - b\n\n      ```\n      code\n    ```\n      after\n",
+			want:  "<ul>\n<li>a\n<ul>\n<li>\n<p>b</p>\n<pre><code>code\n</code></pre>\n<p>after</p>\n</li>\n</ul>\n</li>\n</ul>\n",
+		},
+		{
+			name:  "CloseOutsideListItem",
+			input: "1. a\n\n   ```\n   x\n  ```\n",
+			want:  "<ol>\n<li>\n<p>a</p>\n<pre><code>x\n</code></pre>\n</li>\n</ol>\n<pre><code></code></pre>\n",
+		},
+		{
+			name:  "ThreeLevels",
+			input: "1. a\n   - b\n     * ```\n       c\n        ```\n       d\n",
+			want:  "<ol>\n<li>a\n<ul>\n<li>b\n<ul>\n<li>\n<pre><code>c\n</code></pre>\nd</li>\n</ul>\n</li>\n</ul>\n</li>\n</ol>\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			got := new(strings.Builder)
+			if err := RenderHTML(got, blocks, refMap); err != nil {
+				t.Error("RenderHTML:", err)
+			}
+			if diff := cmp.Diff(string(normhtml.NormalizeHTML([]byte(test.want))), string(normhtml.NormalizeHTML([]byte(got.String())))); diff != "" {
+				t.Errorf("Input:\n%s\nOutput (-want +got):\n%s", test.input, diff)
+			}
+		})
+	}
+}
+
+func TestBlockInlineText(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "Heading",
+			input: "# Hello *world* &amp; [x][ref]\n",
+			want:  "Hello world & x",
+		},
+		{
+			name:  "Paragraph",
+			input: "foo\nbar  \nbaz <b>hi</b> ![img *a*](/x \"title\")\n",
+			want:  "foo bar baz hi img a",
+		},
+		{
+			name:  "UnresolvedReference",
+			input: "[x][nope]\n",
+			want:  "[x][nope]",
+		},
+		{
+			name:  "FencedCode",
+			input: "```go\na\n  *b*\n```\n",
+			want:  "a\n  *b*\n",
+		},
+		{
+			name:  "BlockQuote",
+			input: "> foo\n",
+			want:  "",
+		},
+	}
+	refMap := ReferenceMap{"ref": {Destination: "/url"}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := NewBlockParser(strings.NewReader(test.input))
+			root, err := p.NextBlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			unparsed := hasUnparsed(&root.Block)
+			if got := root.InlineText(root.Source, refMap); got != test.want {
+				t.Errorf("InlineText(...) before Rewrite = %q; want %q", got, test.want)
+			}
+			if got := hasUnparsed(&root.Block); got != unparsed {
+				t.Errorf("InlineText modified block (has unparsed = %t; want %t)", got, unparsed)
+			}
+
+			(&InlineParser{ReferenceMatcher: refMap}).Rewrite(root)
+			if got := root.InlineText(root.Source, nil); got != test.want {
+				t.Errorf("InlineText(...) after Rewrite = %q; want %q", got, test.want)
+			}
+		})
+	}
+
+	if got := (*Block)(nil).InlineText(nil, nil); got != "" {
+		t.Errorf("(*Block)(nil).InlineText(nil, nil) = %q; want \"\"", got)
+	}
+}
+
+func TestIndentedCodeBlockTrailingBlankLines(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "    a\n\n", want: "<pre><code>a\n</code></pre>"},
+		{input: "    a\n \n", want: "<pre><code>a\n</code></pre>"},
+		{input: "    a\n ", want: "<pre><code>a\n</code></pre>"},
+		{input: "    a\n\n      ", want: "<pre><code>a\n</code></pre>"},
+		{input: "    a\n    \n    b ", want: "<pre><code>a\n\nb \n</code></pre>"},
+		{input: "    a", want: "<pre><code>a\n</code></pre>"},
+	}
+	for _, test := range tests {
+		blocks, refMap := Parse([]byte(test.input))
+		buf := new(bytes.Buffer)
+		if err := RenderHTML(buf, blocks, refMap); err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("%q renders %q; want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// TestSetextHeadingInContainers verifies that setext heading underlines
+// are distinguished from thematic breaks and list items
+// inside of block quotes and list items.
+func TestSetextHeadingInContainers(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "BlockQuote",
+			input: "> foo\n> ---\n",
+			want:  "<blockquote><h2>foo</h2></blockquote>",
+		},
+		{
+			name:  "BlockQuoteEquals",
+			input: "> foo\n> bar\n> ===\n",
+			want:  "<blockquote><h1>foo\nbar</h1></blockquote>",
+		},
+		{
+			name:  "BlockQuoteLazy",
+			input: "> foo\n---\n",
+			want:  "<blockquote><p>foo</p></blockquote><hr>",
+		},
+		{
+			name:  "BlockQuoteLazyEquals",
+			input: "> foo\n===\n",
+			want:  "<blockquote><p>foo\n===</p></blockquote>",
+		},
+		{
+			name:  "BlockQuoteStars",
+			input: "> foo\n> ***\n",
+			want:  "<blockquote><p>foo</p><hr></blockquote>",
+		},
+		{
+			name:  "BlockQuoteSpacedDashes",
+			input: "> foo\n> - - -\n",
+			want:  "<blockquote><p>foo</p><hr></blockquote>",
+		},
+		{
+			name:  "ListItem",
+			input: "- foo\n  ---\n",
+			want:  "<ul><li><h2>foo</h2></li></ul>",
+		},
+		{
+			name:  "ListItemUnindented",
+			input: "- foo\n---\n",
+			want:  "<ul><li>foo</li></ul><hr>",
+		},
+		{
+			name:  "ListItemSpacedDashes",
+			input: "- foo\n  - - -\n",
+			want:  "<ul><li>foo<hr></li></ul>",
+		},
+		{
+			name:  "ListItemInBlockQuote",
+			input: "> - foo\n>   ---\n",
+			want:  "<blockquote><ul><li><h2>foo</h2></li></ul></blockquote>",
+		},
+		{
+			name:  "ListItemInBlockQuoteUnindented",
+			input: "> - foo\n> ---\n",
+			want:  "<blockquote><ul><li>foo</li></ul><hr></blockquote>",
+		},
+		{
+			name:  "BlockQuoteInListItem",
+			input: "- > foo\n  > ---\n",
+			want:  "<ul><li><blockquote><h2>foo</h2></blockquote></li></ul>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			buf := new(bytes.Buffer)
+			if err := RenderHTML(buf, blocks, refMap); err != nil {
+				t.Fatal(err)
+			}
+			got := string(normhtml.NormalizeHTML(buf.Bytes()))
+			want := string(normhtml.NormalizeHTML([]byte(test.want)))
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("Input:\n%s\nOutput (-want +got):\n%s", test.input, diff)
+			}
+		})
+	}
+}
+
+func TestClone(t *testing.T) {
+	examples, err := spec.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	render := func(blocks []*RootBlock, refMap ReferenceMap) string {
+		buf := new(bytes.Buffer)
+		if err := RenderHTML(buf, blocks, refMap); err != nil {
+			t.Error("RenderHTML:", err)
+		}
+		return buf.String()
+	}
+	nodeSet := func(blocks []*RootBlock) map[Node]struct{} {
+		m := make(map[Node]struct{})
+		for _, root := range blocks {
+			WalkPre(root.AsNode(), func(c *Cursor) bool {
+				m[c.Node()] = struct{}{}
+				return true
+			})
+		}
+		return m
+	}
+
+	for _, ex := range examples {
+		for _, copySource := range []bool{false, true} {
+			blocks, refMap := Parse([]byte(ex.Markdown))
+			clones := make([]*RootBlock, len(blocks))
+			for i, root := range blocks {
+				clones[i] = root.Clone(copySource)
+				if got, want := clones[i].StartLine, root.StartLine; got != want {
+					t.Errorf("Example %d: blocks[%d].Clone(%t).StartLine = %d; want %d", ex.Example, i, copySource, got, want)
+				}
+				if got, want := string(clones[i].Source), string(root.Source); got != want {
+					t.Errorf("Example %d: blocks[%d].Clone(%t).Source = %q; want %q", ex.Example, i, copySource, got, want)
+				}
+				if len(root.Source) > 0 {
+					if shared := &clones[i].Source[0] == &root.Source[0]; shared == copySource {
+						t.Errorf("Example %d: blocks[%d].Clone(%t).Source shared = %t", ex.Example, i, copySource, shared)
+					}
+				}
+			}
+			if diff := cmp.Diff(render(blocks, refMap), render(clones, refMap)); diff != "" {
+				t.Errorf("Example %d: Clone(%t) changed output (-original +clone):\n%s", ex.Example, copySource, diff)
+			}
+			original := nodeSet(blocks)
+			for n := range nodeSet(clones) {
+				if _, shared := original[n]; shared {
+					t.Errorf("Example %d: Clone(%t) shares node %v", ex.Example, copySource, n.Span())
+					break
+				}
+			}
+		}
+	}
+
+	t.Run("Inline", func(t *testing.T) {
+		source := []byte("*a **b** [c](/d)*")
+		inlines := ParseInline(source, nil)
+		clone := inlines[0].Clone()
+		if got, want := inlineTreeString(source, clone.AsNode()), inlineTreeString(source, inlines[0].AsNode()); got != want {
+			t.Errorf("Clone() = %s; want %s", got, want)
+		}
+		clone.RemoveChildren(0, clone.ChildCount())
+		if inlines[0].ChildCount() == 0 {
+			t.Error("RemoveChildren on clone removed children from original")
+		}
+	})
+
+	t.Run("Nil", func(t *testing.T) {
+		if got := (*Block)(nil).Clone(); got != nil {
+			t.Errorf("(*Block)(nil).Clone() = %p; want nil", got)
+		}
+		if got := (*RootBlock)(nil).Clone(true); got != nil {
+			t.Errorf("(*RootBlock)(nil).Clone(true) = %p; want nil", got)
+		}
+		if got := (*Inline)(nil).Clone(); got != nil {
+			t.Errorf("(*Inline)(nil).Clone() = %p; want nil", got)
+		}
+	})
+}
+
+func TestDirectiveBlocks(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		directives bool
+		want       []string
+	}{
+		{
+			name:       "Basic",
+			input:      "::: warning\nHello\n:::\n",
+			directives: true,
+			want:       []string{`DirectiveBlockKind["warning" "" 3](ParagraphKind)`},
+		},
+		{
+			name:       "Attributes",
+			input:      ":::warning {.big #x}  \nHello\n:::\n",
+			directives: true,
+			want:       []string{`DirectiveBlockKind["warning" ".big #x" 3](ParagraphKind)`},
+		},
+		{
+			name:       "AttributesOnly",
+			input:      "::: {.note}\nHello\n:::\n",
+			directives: true,
+			want:       []string{`DirectiveBlockKind["" ".note" 3](ParagraphKind)`},
+		},
+		{
+			name:       "Disabled",
+			input:      "::: warning\nHello\n:::\n",
+			directives: false,
+			want:       []string{"ParagraphKind"},
+		},
+		{
+			name:       "FollowedByParagraph",
+			input:      "::: warning\nHello\n:::\nWorld\n",
+			directives: true,
+			want: []string{
+				`DirectiveBlockKind["warning" "" 3](ParagraphKind)`,
+				"ParagraphKind",
+			},
+		},
+		{
+			name:       "EmptyDirective",
+			input:      "::: warning\n:::\nWorld\n",
+			directives: true,
+			want: []string{
+				`DirectiveBlockKind["warning" "" 3]`,
+				"ParagraphKind",
+			},
+		},
+		{
+			name:       "InterruptsParagraph",
+			input:      "Hello\n::: warning\nWorld\n:::\n",
+			directives: true,
+			want: []string{
+				"ParagraphKind",
+				`DirectiveBlockKind["warning" "" 3](ParagraphKind)`,
+			},
+		},
+		{
+			name:       "Unclosed",
+			input:      "::: warning\nHello\n\n- a\n",
+			directives: true,
+			want:       []string{`DirectiveBlockKind["warning" "" 3](ParagraphKind ListKind(ListItemKind(ListMarkerKind ParagraphKind)))`},
+		},
+		{
+			name:       "Nested",
+			input:      ":::: outer\n::: inner\nHello\n:::\nWorld\n::::\n",
+			directives: true,
+			want:       []string{`DirectiveBlockKind["outer" "" 4](DirectiveBlockKind["inner" "" 3](ParagraphKind) ParagraphKind)`},
+		},
+		{
+			name:       "NestedSameLength",
+			input:      "::: outer\n::: inner\nHello\n:::\nWorld\n:::\n",
+			directives: true,
+			want:       []string{`DirectiveBlockKind["outer" "" 3](DirectiveBlockKind["inner" "" 3](ParagraphKind) ParagraphKind)`},
+		},
+		{
+			name:       "NestedLongerInner",
+			input:      "::: outer\n:::: inner\nHello\n::::\nWorld\n:::\n",
+			directives: true,
+			want:       []string{`DirectiveBlockKind["outer" "" 3](DirectiveBlockKind["inner" "" 4](ParagraphKind) ParagraphKind)`},
+		},
+		{
+			name:       "NestedShortInnerClosingFence",
+			input:      "::: outer\n:::: inner\nHello\n:::\nWorld\n::::\n:::\n",
+			directives: true,
+			want:       []string{`DirectiveBlockKind["outer" "" 3](DirectiveBlockKind["inner" "" 4](ParagraphKind))`},
+		},
+		{
+			name:       "LongerClosingFenceClosesInnermost",
+			input:      ":::: outer\n::: inner\nHello\n::::\nWorld\n",
+			directives: true,
+			want:       []string{`DirectiveBlockKind["outer" "" 4](DirectiveBlockKind["inner" "" 3](ParagraphKind) ParagraphKind)`},
+		},
+		{
+			name:       "ShortClosingFence",
+			input:      "::::: outer\nHello\n:::\nWorld\n:::::\n",
+			directives: true,
+			want:       []string{`DirectiveBlockKind["outer" "" 5](ParagraphKind)`},
+		},
+		{
+			name:       "FenceInCode",
+			input:      "::: outer\n```\n:::\n```\n:::\n",
+			directives: true,
+			want:       []string{`DirectiveBlockKind["outer" "" 3](FencedCodeBlockKind)`},
+		},
+		{
+			name:       "BlockQuote",
+			input:      "::: outer\n> Hello\n:::\n",
+			directives: true,
+			want:       []string{`DirectiveBlockKind["outer" "" 3](BlockQuoteKind(ParagraphKind))`},
+		},
+		{
+			name:       "InListItem",
+			input:      "- ::: outer\n  Hello\n  :::\n- World\n",
+			directives: true,
+			want:       []string{`ListKind(ListItemKind(ListMarkerKind DirectiveBlockKind["outer" "" 3](ParagraphKind)) ListItemKind(ListMarkerKind ParagraphKind))`},
+		},
+		{
+			name:       "Indented",
+			input:      "    ::: warning\n",
+			directives: true,
+			want:       []string{"IndentedCodeBlockKind"},
+		},
+		{
+			name:       "TrailingText",
+			input:      "::: warning text\n",
+			directives: true,
+			want:       []string{"ParagraphKind"},
+		},
+		{
+			name:       "UnclosedAttributes",
+			input:      "::: warning {.big\n",
+			directives: true,
+			want:       []string{"ParagraphKind"},
+		},
+		{
+			name:       "ShortFence",
+			input:      ":: warning\n",
+			directives: true,
+			want:       []string{"ParagraphKind"},
+		},
+		{
+			name:       "StrayClosingFence",
+			input:      ":::\n",
+			directives: true,
+			want:       []string{"ParagraphKind"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := NewBlockParser(strings.NewReader(test.input))
+			p.Directives = test.directives
+			var got []string
+			for {
+				block, err := p.NextBlock()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, blockTreeString(block.Source, &block.Block))
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("blocks (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDirectiveBlockSpans(t *testing.T) {
+	const input = "::: outer\n::: inner\nHello\n:::\nWorld\n:::\n"
+	p := NewBlockParser(strings.NewReader(input))
+	p.Directives = true
+	block, err := p.NextBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := block.Source
+	outer := &block.Block
+	if got, want := string(spanSlice(source, outer.Span())), input; got != want {
+		t.Errorf("outer span = %q; want %q", got, want)
+	}
+	if outer.ChildCount() != 2 {
+		t.Fatalf("outer has %d children; want 2", outer.ChildCount())
+	}
+	inner := outer.Child(0).Block()
+	if got, want := string(spanSlice(source, inner.Span())), "::: inner\nHello\n:::\n"; got != want {
+		t.Errorf("inner span = %q; want %q", got, want)
+	}
+	if got, want := string(spanSlice(source, inner.Child(0).Block().Span())), "Hello\n"; got != want {
+		t.Errorf("inner paragraph span = %q; want %q", got, want)
+	}
+	if got, want := string(spanSlice(source, outer.Child(1).Block().Span())), "World\n"; got != want {
+		t.Errorf("outer paragraph span = %q; want %q", got, want)
+	}
+}
+
+func TestLinkReferenceDefinitions(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{
+			name:  "Alone",
+			input: "[foo]: /url\n",
+			want:  []string{`LinkReferenceDefinitionKind "[foo]: /url\n"`},
+		},
+		{
+			name:  "TitleOnSameLine",
+			input: "[foo]: /url \"title\"\nbar\n",
+			want: []string{
+				`LinkReferenceDefinitionKind "[foo]: /url \"title\"\n"`,
+				`<p>bar</p>`,
+			},
+		},
+		{
+			name:  "TitleOnNextLine",
+			input: "[foo]: /url\n  'title'\nbar\n",
+			want: []string{
+				`LinkReferenceDefinitionKind "[foo]: /url\n  'title'\n"`,
+				`<p>bar</p>`,
+			},
+		},
+		{
+			name:  "MultilineTitle",
+			input: "[foo]: /url (a\nb)\nbar\n",
+			want: []string{
+				`LinkReferenceDefinitionKind "[foo]: /url (a\nb)\n"`,
+				`<p>bar</p>`,
+			},
+		},
+		{
+			name:  "NoSpaceBeforeTitle",
+			input: "[foo]: </url>\"title\"\n",
+			want:  []string{`<p>[foo]: </url>&quot;title&quot;</p>`},
+		},
+		{
+			name:  "JunkAfterDestination",
+			input: "[foo]: /url junk\nbar\n",
+			want:  []string{"<p>[foo]: /url junk\nbar</p>"},
+		},
+		{
+			name:  "JunkAfterTitleOnSameLine",
+			input: "[foo]: /url \"title\" junk\n",
+			want:  []string{`<p>[foo]: /url &quot;title&quot; junk</p>`},
+		},
+		{
+			name:  "JunkAfterTitleOnNextLine",
+			input: "[foo]: /url\n\"title\" junk\n",
+			want: []string{
+				`LinkReferenceDefinitionKind "[foo]: /url\n"`,
+				`<p>&quot;title&quot; junk</p>`,
+			},
+		},
+		{
+			name:  "UnclosedTitleOnSameLine",
+			input: "[foo]: /url \"unclosed\nbar\n",
+			want:  []string{"<p>[foo]: /url &quot;unclosed\nbar</p>"},
+		},
+		{
+			name:  "UnclosedTitleOnNextLine",
+			input: "[foo]: /url\n\"unclosed\nbar\n",
+			want: []string{
+				`LinkReferenceDefinitionKind "[foo]: /url\n"`,
+				"<p>&quot;unclosed\nbar</p>",
+			},
+		},
+		{
+			name:  "UnclosedIndentedTitle",
+			input: "[foo]: /url\n  \"unclosed\nbar\n",
+			want: []string{
+				`LinkReferenceDefinitionKind "[foo]: /url\n"`,
+				"<p>&quot;unclosed\nbar</p>",
+			},
+		},
+		{
+			name:  "UnclosedTitleAfterTabs",
+			input: "> [foo]: /url\n>\t\t\"unclosed\n",
+			want: []string{
+				`LinkReferenceDefinitionKind "[foo]: /url\n"`,
+				"<blockquote><p>&quot;unclosed</p></blockquote>",
+			},
+		},
+		{
+			name:  "UnclosedTitleCRLF",
+			input: "[foo]: /url\r\n\"unclosed\r\nbar\r\n",
+			want: []string{
+				`LinkReferenceDefinitionKind "[foo]: /url\r\n"`,
+				"<p>&quot;unclosed\r\nbar</p>",
+			},
+		},
+		{
+			name:  "Multiple",
+			input: "[foo]: /url \"t\"\n[bar]: /b\n [baz]: /z\nqux\n",
+			want: []string{
+				`LinkReferenceDefinitionKind "[foo]: /url \"t\"\n"`,
+				`LinkReferenceDefinitionKind "[bar]: /b\n"`,
+				`LinkReferenceDefinitionKind "[baz]: /z\n"`,
+				`<p>qux</p>`,
+			},
+		},
+		{
+			name:  "SetextHeading",
+			input: "[foo]: /url\n\"unclosed\n===\n",
+			want: []string{
+				`LinkReferenceDefinitionKind "[foo]: /url\n"`,
+				`<h1>&quot;unclosed</h1>`,
+			},
+		},
+		{
+			name:  "SetextOrphan",
+			input: "[foo]: /url\n===\n",
+			want: []string{
+				`LinkReferenceDefinitionKind "[foo]: /url\n"`,
+				`<p>===</p>`,
+			},
+		},
+		{
+			name:  "SetextOrphanAfterTitle",
+			input: "[foo]: /url\n\"title\"\n===\n",
+			want: []string{
+				`LinkReferenceDefinitionKind "[foo]: /url\n\"title\"\n"`,
+				`<p>===</p>`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			r := &HTMLRenderer{ReferenceMap: refMap}
+			var got []string
+			for _, root := range blocks {
+				for _, b := range CollectBlocks(root.AsNode()) {
+					if b.Kind() == LinkReferenceDefinitionKind {
+						got = append(got, fmt.Sprintf("%v %q", b.Kind(), spanSlice(root.Source, b.Span())))
+					}
+				}
+				if html := string(r.AppendBlock(nil, root)); html != "" {
+					got = append(got, html)
+				}
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("blocks (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestStackedLinkReferenceDefinitions verifies that every definition
+// in a run of three or more definitions at the start of a paragraph is extracted,
+// regardless of whether their titles are on the same line or the next line.
+func TestStackedLinkReferenceDefinitions(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		wantRefs ReferenceMap
+		wantHTML string
+	}{
+		{
+			name:  "Three",
+			input: "[a]: /a\n[b]: /b\n\"title b\"\n[c]: /c 'c'\n",
+			wantRefs: ReferenceMap{
+				"a": {Destination: "/a"},
+				"b": {Destination: "/b", Title: "title b", TitlePresent: true},
+				"c": {Destination: "/c", Title: "c", TitlePresent: true},
+			},
+			wantHTML: "",
+		},
+		{
+			name:  "FourWithText",
+			input: "[a]: /a \"t\"\n[b]:\n/b\n'bt'\n[c]: /c\n[d]: /d\n(d)\ntext\n",
+			wantRefs: ReferenceMap{
+				"a": {Destination: "/a", Title: "t", TitlePresent: true},
+				"b": {Destination: "/b", Title: "bt", TitlePresent: true},
+				"c": {Destination: "/c"},
+				"d": {Destination: "/d", Title: "d", TitlePresent: true},
+			},
+			wantHTML: "<p>text</p>",
+		},
+		{
+			name:  "Five",
+			input: "[a]: /a\n[b]: /b\n  \"bt\"\n[c]: </c>\n[d]: /d (d\ntitle)\n[e]: /e\n\"et\"\n",
+			wantRefs: ReferenceMap{
+				"a": {Destination: "/a"},
+				"b": {Destination: "/b", Title: "bt", TitlePresent: true},
+				"c": {Destination: "/c"},
+				"d": {Destination: "/d", Title: "d\ntitle", TitlePresent: true},
+				"e": {Destination: "/e", Title: "et", TitlePresent: true},
+			},
+			wantHTML: "",
+		},
+		{
+			name:  "JunkAfterMiddleTitle",
+			input: "[a]: /a\n[b]: /b\n\"t\" junk\n[c]: /c\n",
+			wantRefs: ReferenceMap{
+				"a": {Destination: "/a"},
+				"b": {Destination: "/b"},
+			},
+			wantHTML: "<p>&quot;t&quot; junk\n[c]: /c</p>",
+		},
+		{
+			name:  "BlockQuote",
+			input: "> [a]: /a\n> [b]:\n> /b\n> \"bt\"\n> [c]: /c \"ct\"\n> [d]: /d\n> (d)\n> text\n",
+			wantRefs: ReferenceMap{
+				"a": {Destination: "/a"},
+				"b": {Destination: "/b", Title: "bt", TitlePresent: true},
+				"c": {Destination: "/c", Title: "ct", TitlePresent: true},
+				"d": {Destination: "/d", Title: "d", TitlePresent: true},
+			},
+			wantHTML: "<blockquote><p>text</p></blockquote>",
+		},
+		{
+			name:  "ListItem",
+			input: "- [a]: /a\n  [b]: /b\n  \"bt\"\n  [c]: </c>\n  [d]: /d\n",
+			wantRefs: ReferenceMap{
+				"a": {Destination: "/a"},
+				"b": {Destination: "/b", Title: "bt", TitlePresent: true},
+				"c": {Destination: "/c"},
+				"d": {Destination: "/d"},
+			},
+			wantHTML: "<ul><li></li></ul>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			if diff := cmp.Diff(test.wantRefs, refMap); diff != "" {
+				t.Errorf("reference map (-want +got):\n%s", diff)
+			}
+			buf := new(bytes.Buffer)
+			if err := RenderHTML(buf, blocks, refMap); err != nil {
+				t.Fatal(err)
+			}
+			// Trim the separators written for the definitions.
+			got := string(normhtml.NormalizeHTML(bytes.TrimSpace(buf.Bytes())))
+			want := string(normhtml.NormalizeHTML([]byte(test.wantHTML)))
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("HTML (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// blockTreeString formats the block structure of b
+// as an S-expression-like string.
+func blockTreeString(source []byte, b *Block) string {
+	sb := new(strings.Builder)
+	sb.WriteString(b.Kind().String())
+	if b.Kind() == DirectiveBlockKind {
+		fmt.Fprintf(sb, "[%q %q %d]", b.DirectiveName(source), b.DirectiveAttributes(source), b.FenceLength())
+	}
+	if len(b.blockChildren) > 0 {
+		sb.WriteString("(")
+		for i, child := range b.blockChildren {
+			if i > 0 {
+				sb.WriteString(" ")
+			}
+			sb.WriteString(blockTreeString(source, child))
+		}
+		sb.WriteString(")")
+	}
+	return sb.String()
+}
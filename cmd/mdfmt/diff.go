@@ -0,0 +1,203 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// diffContext is the number of unchanged lines
+// shown around each change in a unified diff.
+const diffContext = 3
+
+// An edit is a single line in an edit script.
+type edit struct {
+	op   byte // ' ' for unchanged, '-' for deletion, or '+' for insertion
+	line []byte
+}
+
+// unifiedDiff returns a unified diff that transforms a into b,
+// or nil if a and b are equal.
+func unifiedDiff(aName, bName string, a, b []byte) []byte {
+	edits := diffLines(splitLines(a), splitLines(b))
+	var buf bytes.Buffer
+	for i := 0; i < len(edits); {
+		// Find the next change.
+		if edits[i].op == ' ' {
+			i++
+			continue
+		}
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "--- %s\n+++ %s\n", aName, bName)
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		// Extend the hunk until there are more than 2*diffContext unchanged lines.
+		end := i
+		for unchanged := 0; end < len(edits) && unchanged <= 2*diffContext; end++ {
+			if edits[end].op == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		for end > i && edits[end-1].op == ' ' {
+			end--
+		}
+		end += diffContext
+		if end > len(edits) {
+			end = len(edits)
+		}
+		writeHunk(&buf, edits, start, end)
+		i = end
+	}
+	return buf.Bytes()
+}
+
+// writeHunk writes the edits in edits[start:end] as a unified diff hunk.
+func writeHunk(buf *bytes.Buffer, edits []edit, start, end int) {
+	aStart, bStart := 0, 0
+	for _, e := range edits[:start] {
+		if e.op != '+' {
+			aStart++
+		}
+		if e.op != '-' {
+			bStart++
+		}
+	}
+	aCount, bCount := 0, 0
+	for _, e := range edits[start:end] {
+		if e.op != '+' {
+			aCount++
+		}
+		if e.op != '-' {
+			bCount++
+		}
+	}
+	// Empty ranges are identified by the line before them.
+	if aCount > 0 {
+		aStart++
+	}
+	if bCount > 0 {
+		bStart++
+	}
+	fmt.Fprintf(buf, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+	for _, e := range edits[start:end] {
+		buf.WriteByte(e.op)
+		buf.Write(e.line)
+		if !bytes.HasSuffix(e.line, []byte("\n")) {
+			buf.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// splitLines splits b into lines, each including its trailing newline.
+// The last line may not end in a newline.
+func splitLines(b []byte) [][]byte {
+	var lines [][]byte
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			lines = append(lines, b)
+			break
+		}
+		lines = append(lines, b[:i+1])
+		b = b[i+1:]
+	}
+	return lines
+}
+
+// diffLines returns a shortest edit script that transforms a into b
+// using the algorithm described in Eugene W. Myers's paper
+// "An O(ND) Difference Algorithm and Its Variations".
+func diffLines(a, b [][]byte) []edit {
+	n, m := len(a), len(b)
+	maxD := n + m
+	// v[offset+k] is the furthest x reached on diagonal k.
+	offset := maxD + 1
+	v := make([]int, 2*maxD+3)
+	// trace[d] holds v[offset-d-1 : offset+d+2] before step d.
+	var trace [][]int
+	var d int
+search:
+	for d = 0; d <= maxD; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && bytes.Equal(a[x], b[y]) {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Walk backward through the trace to recover the edits.
+	var edits []edit
+	x, y := n, m
+	for ; d >= 0; d-- {
+		prev := trace[d]
+		get := func(k int) int { return prev[k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || k != d && get(k-1) < get(k+1) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := get(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, edit{op: ' ', line: a[x]})
+		}
+		if d > 0 {
+			if x == prevX {
+				y--
+				edits = append(edits, edit{op: '+', line: b[y]})
+			} else {
+				x--
+				edits = append(edits, edit{op: '-', line: a[x]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
@@ -0,0 +1,163 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want string
+	}{
+		{
+			name: "Equal",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+			want: "",
+		},
+		{
+			name: "Empty",
+			a:    "",
+			b:    "a\n",
+			want: "--- a\n+++ b\n@@ -0,0 +1 @@\n+a\n",
+		},
+		{
+			name: "Delete",
+			a:    "a\nb\nc\n",
+			b:    "a\nc\n",
+			want: "--- a\n+++ b\n@@ -1,3 +1,2 @@\n a\n-b\n c\n",
+		},
+		{
+			name: "NoNewline",
+			a:    "a\nb",
+			b:    "a\nb\n",
+			want: "--- a\n+++ b\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+		{
+			name: "SeparateHunks",
+			a:    "x\n1\n2\n3\n4\n5\n6\n7\n8\nx\n",
+			b:    "y\n1\n2\n3\n4\n5\n6\n7\n8\ny\n",
+			want: "--- a\n+++ b\n" +
+				"@@ -1,4 +1,4 @@\n-x\n+y\n 1\n 2\n 3\n" +
+				"@@ -7,4 +7,4 @@\n 6\n 7\n 8\n-x\n+y\n",
+		},
+		{
+			name: "MergedHunks",
+			a:    "x\n1\n2\n3\n4\n5\n6\nx\n",
+			b:    "y\n1\n2\n3\n4\n5\n6\ny\n",
+			want: "--- a\n+++ b\n" +
+				"@@ -1,8 +1,8 @@\n-x\n+y\n 1\n 2\n 3\n 4\n 5\n 6\n-x\n+y\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := string(unifiedDiff("a", "b", []byte(test.a), []byte(test.b)))
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("unifiedDiff(...) (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomLines := func() [][]byte {
+		lines := make([][]byte, rng.Intn(12))
+		for i := range lines {
+			lines[i] = []byte(strconv.Itoa(rng.Intn(4)) + "\n")
+		}
+		return lines
+	}
+	for i := 0; i < 1000; i++ {
+		a, b := randomLines(), randomLines()
+		edits := diffLines(a, b)
+
+		var gotA, gotB [][]byte
+		changes := 0
+		for _, e := range edits {
+			if e.op != '+' {
+				gotA = append(gotA, e.line)
+			}
+			if e.op != '-' {
+				gotB = append(gotB, e.line)
+			}
+			if e.op != ' ' {
+				changes++
+			}
+		}
+		if !equalLines(gotA, a) || !equalLines(gotB, b) {
+			t.Fatalf("diffLines(%q, %q) = %q; does not reproduce inputs", a, b, edits)
+		}
+		if want := len(a) + len(b) - 2*lcsLength(a, b); changes != want {
+			t.Fatalf("diffLines(%q, %q) has %d changes; want %d", a, b, changes, want)
+		}
+	}
+}
+
+func equalLines(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// lcsLength returns the length of the longest common subsequence of a and b.
+func lcsLength(a, b [][]byte) int {
+	table := make([][]int, len(a)+1)
+	for i := range table {
+		table[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case bytes.Equal(a[i], b[j]):
+				table[i][j] = table[i+1][j+1] + 1
+			case table[i+1][j] > table[i][j+1]:
+				table[i][j] = table[i+1][j]
+			default:
+				table[i][j] = table[i][j+1]
+			}
+		}
+	}
+	return table[0][0]
+}
+
+func TestSplitLines(t *testing.T) {
+	got := splitLines([]byte("a\n\nb"))
+	want := []string{"a\n", "\n", "b"}
+	var gotStrings []string
+	for _, line := range got {
+		gotStrings = append(gotStrings, string(line))
+	}
+	if diff := cmp.Diff(want, gotStrings); diff != "" {
+		t.Errorf("splitLines (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// mdfmt formats Markdown files.
+//
+// Usage:
+//
+//	mdfmt [flags] [path ...]
+//
+// Without an explicit path, mdfmt processes the standard input.
+// Given a file, it operates on that file;
+// given a directory, it operates on all .md and .markdown files in that directory,
+// recursively.
+// (Files and directories starting with a period are ignored.)
+// By default, mdfmt prints the reformatted sources to standard output.
+//
+// The flags are:
+//
+//	-d
+//		Do not print reformatted sources to standard output.
+//		If a file's formatting is different than mdfmt's,
+//		print diffs to standard output.
+//	-l
+//		Do not print reformatted sources to standard output.
+//		If a file's formatting is different from mdfmt's,
+//		print its name to standard output.
+//	-w
+//		Do not print reformatted sources to standard output.
+//		If a file's formatting is different from mdfmt's,
+//		overwrite it with mdfmt's version.
+//		The file's permissions are preserved.
+//
+// Before writing any output for a file,
+// mdfmt checks that the reformatted source renders to the same HTML as the original.
+// If it does not, mdfmt reports an error and leaves the file unchanged.
+// mdfmt exits with a status of 2 if any errors occurred.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"zombiezen.com/go/commonmark"
+	"zombiezen.com/go/commonmark/format"
+	"zombiezen.com/go/commonmark/internal/normhtml"
+)
+
+const stdinName = "<standard input>"
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run executes mdfmt with the given arguments
+// and returns the process exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet("mdfmt", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	flagSet.Usage = func() {
+		fmt.Fprintln(stderr, "usage: mdfmt [flags] [path ...]")
+		flagSet.PrintDefaults()
+	}
+	m := &mdfmt{
+		stdout: stdout,
+		stderr: stderr,
+	}
+	flagSet.BoolVar(&m.diff, "d", false, "display diffs instead of rewriting files")
+	flagSet.BoolVar(&m.list, "l", false, "list files whose formatting differs from mdfmt's")
+	flagSet.BoolVar(&m.write, "w", false, "write result to (source) file instead of stdout")
+	if err := flagSet.Parse(args); errors.Is(err, flag.ErrHelp) {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	if flagSet.NArg() == 0 {
+		if m.write {
+			fmt.Fprintln(stderr, "mdfmt: cannot use -w with standard input")
+			return 2
+		}
+		m.processFile(stdinName, stdin, 0)
+		return m.exitCode
+	}
+	for _, path := range flagSet.Args() {
+		info, err := os.Stat(path)
+		if err != nil {
+			m.report(err)
+			continue
+		}
+		if info.IsDir() {
+			m.walkDir(path)
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			m.report(err)
+			continue
+		}
+		m.processFile(path, f, info.Mode().Perm())
+		f.Close()
+	}
+	return m.exitCode
+}
+
+type mdfmt struct {
+	diff  bool
+	list  bool
+	write bool
+
+	stdout   io.Writer
+	stderr   io.Writer
+	exitCode int
+}
+
+// report prints an error to stderr and marks the run as failed.
+func (m *mdfmt) report(err error) {
+	fmt.Fprintln(m.stderr, err)
+	m.exitCode = 2
+}
+
+// walkDir processes all Markdown files in the directory tree rooted at dir.
+func (m *mdfmt) walkDir(dir string) {
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			m.report(err)
+			return nil
+		}
+		name := entry.Name()
+		if path != dir && strings.HasPrefix(name, ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() || !isMarkdownFile(name) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			m.report(err)
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			m.report(err)
+			return nil
+		}
+		m.processFile(path, f, info.Mode().Perm())
+		f.Close()
+		return nil
+	})
+}
+
+func isMarkdownFile(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == ".md" || ext == ".markdown"
+}
+
+// processFile formats the Markdown read from r.
+// perm is the permission bits of the file named by filename
+// and is used when overwriting the file.
+func (m *mdfmt) processFile(filename string, r io.Reader, perm fs.FileMode) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		m.report(fmt.Errorf("%s: %v", filename, err))
+		return
+	}
+	res, err := formatSource(src)
+	if err != nil {
+		m.report(fmt.Errorf("%s: %v", filename, err))
+		return
+	}
+
+	if !m.list && !m.write && !m.diff {
+		if _, err := m.stdout.Write(res); err != nil {
+			m.report(err)
+		}
+		return
+	}
+	if bytes.Equal(src, res) {
+		return
+	}
+	if m.list {
+		fmt.Fprintln(m.stdout, filename)
+	}
+	if m.write {
+		if err := writeFile(filename, res, perm); err != nil {
+			m.report(err)
+			return
+		}
+	}
+	if m.diff {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "diff %s.orig %s\n", filename, filename)
+		buf.Write(unifiedDiff(filename+".orig", filename, src, res))
+		if _, err := m.stdout.Write(buf.Bytes()); err != nil {
+			m.report(err)
+		}
+	}
+}
+
+// formatSource formats src as CommonMark.
+// It returns an error if the formatted source
+// does not render to the same HTML as src.
+func formatSource(src []byte) ([]byte, error) {
+	blocks, refMap := commonmark.Parse(src)
+	res := new(bytes.Buffer)
+	if err := format.Format(res, blocks); err != nil {
+		return nil, err
+	}
+	want, err := renderNormalizedHTML(blocks, refMap)
+	if err != nil {
+		return nil, err
+	}
+	got, err := renderNormalizedHTML(commonmark.Parse(res.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(want, got) {
+		return nil, errors.New("formatting would change rendered HTML")
+	}
+	return res.Bytes(), nil
+}
+
+func renderNormalizedHTML(blocks []*commonmark.RootBlock, refMap commonmark.ReferenceMap) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := commonmark.RenderHTML(buf, blocks, refMap); err != nil {
+		return nil, err
+	}
+	return normhtml.NormalizeHTML(buf.Bytes()), nil
+}
+
+// writeFile replaces the contents of the named file with data.
+// The data is written to a temporary file in the same directory
+// that is renamed over the original,
+// so the original is left intact if writing fails.
+func writeFile(filename string, data []byte, perm fs.FileMode) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".mdfmt*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
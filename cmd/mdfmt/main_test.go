@@ -0,0 +1,199 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const (
+	unformatted = "Hello   \n\n\n\n* a\n* b\n"
+	formatted   = "Hello\n\n* a\n* b\n"
+	// changesHTML is a document that the formatter cannot currently reformat
+	// without changing its meaning.
+	changesHTML = "[link](/url 'title \"and\" title')\n"
+)
+
+func TestRun(t *testing.T) {
+	t.Run("Stdin", func(t *testing.T) {
+		stdout := new(strings.Builder)
+		stderr := new(strings.Builder)
+		if code := run(nil, strings.NewReader(unformatted), stdout, stderr); code != 0 {
+			t.Errorf("exit code = %d; want 0. stderr:\n%s", code, stderr)
+		}
+		if diff := cmp.Diff(formatted, stdout.String()); diff != "" {
+			t.Errorf("stdout (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("StdinWrite", func(t *testing.T) {
+		stderr := new(strings.Builder)
+		if code := run([]string{"-w"}, strings.NewReader(unformatted), io.Discard, stderr); code != 2 {
+			t.Errorf("exit code = %d; want 2", code)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		dir := makeTree(t, map[string]string{
+			"a.md":               unformatted,
+			"b.md":               formatted,
+			"notes.txt":          unformatted,
+			".hidden/c.md":       unformatted,
+			"sub/d.markdown":     unformatted,
+			"sub/.e.md":          unformatted,
+			"sub/deeper/f.md":    formatted,
+			"sub/deeper/g.md.go": unformatted,
+		})
+		stdout := new(strings.Builder)
+		stderr := new(strings.Builder)
+		if code := run([]string{"-l", dir}, strings.NewReader(""), stdout, stderr); code != 0 {
+			t.Errorf("exit code = %d; want 0. stderr:\n%s", code, stderr)
+		}
+		want := filepath.Join(dir, "a.md") + "\n" + filepath.Join(dir, "sub", "d.markdown") + "\n"
+		if diff := cmp.Diff(want, stdout.String()); diff != "" {
+			t.Errorf("stdout (-want +got):\n%s", diff)
+		}
+		// -l must not modify files.
+		if got := readFile(t, filepath.Join(dir, "a.md")); got != unformatted {
+			t.Errorf("a.md = %q; want %q", got, unformatted)
+		}
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		dir := makeTree(t, map[string]string{
+			"a.md": unformatted,
+			"b.md": formatted,
+		})
+		path := filepath.Join(dir, "a.md")
+		const perm = 0o640
+		if err := os.Chmod(path, perm); err != nil {
+			t.Fatal(err)
+		}
+		stdout := new(strings.Builder)
+		stderr := new(strings.Builder)
+		if code := run([]string{"-w", path, filepath.Join(dir, "b.md")}, strings.NewReader(""), stdout, stderr); code != 0 {
+			t.Errorf("exit code = %d; want 0. stderr:\n%s", code, stderr)
+		}
+		if stdout.Len() > 0 {
+			t.Errorf("stdout = %q; want empty", stdout)
+		}
+		if got := readFile(t, path); got != formatted {
+			t.Errorf("a.md = %q; want %q", got, formatted)
+		}
+		if runtime.GOOS != "windows" {
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := info.Mode().Perm(); got != perm {
+				t.Errorf("a.md mode = %v; want %v", got, os.FileMode(perm))
+			}
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 {
+			t.Errorf("directory has %d entries after -w; want 2", len(entries))
+		}
+	})
+
+	t.Run("Diff", func(t *testing.T) {
+		dir := makeTree(t, map[string]string{"a.md": unformatted})
+		path := filepath.Join(dir, "a.md")
+		stdout := new(strings.Builder)
+		stderr := new(strings.Builder)
+		if code := run([]string{"-d", path}, strings.NewReader(""), stdout, stderr); code != 0 {
+			t.Errorf("exit code = %d; want 0. stderr:\n%s", code, stderr)
+		}
+		want := "diff " + path + ".orig " + path + "\n" +
+			"--- " + path + ".orig\n" +
+			"+++ " + path + "\n" +
+			"@@ -1,6 +1,4 @@\n" +
+			"-Hello   \n" +
+			"+Hello\n" +
+			" \n" +
+			"-\n" +
+			"-\n" +
+			" * a\n" +
+			" * b\n"
+		if diff := cmp.Diff(want, stdout.String()); diff != "" {
+			t.Errorf("stdout (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("ChangesHTML", func(t *testing.T) {
+		dir := makeTree(t, map[string]string{
+			"a.md":   unformatted,
+			"bad.md": changesHTML,
+		})
+		stdout := new(strings.Builder)
+		stderr := new(strings.Builder)
+		if code := run([]string{"-w", dir}, strings.NewReader(""), stdout, stderr); code != 2 {
+			t.Errorf("exit code = %d; want 2", code)
+		}
+		if !strings.Contains(stderr.String(), "bad.md") {
+			t.Errorf("stderr = %q; want to mention bad.md", stderr)
+		}
+		if got := readFile(t, filepath.Join(dir, "bad.md")); got != changesHTML {
+			t.Errorf("bad.md = %q; want %q", got, changesHTML)
+		}
+		// Other files should still be processed.
+		if got := readFile(t, filepath.Join(dir, "a.md")); got != formatted {
+			t.Errorf("a.md = %q; want %q", got, formatted)
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		stderr := new(strings.Builder)
+		path := filepath.Join(t.TempDir(), "nope.md")
+		if code := run([]string{path}, strings.NewReader(""), io.Discard, stderr); code != 2 {
+			t.Errorf("exit code = %d; want 2", code)
+		}
+	})
+}
+
+func makeTree(tb testing.TB, files map[string]string) string {
+	tb.Helper()
+	dir := tb.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o666); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func readFile(tb testing.TB, path string) string {
+	tb.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commonmark
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// dumpExcerptLength is the maximum number of source bytes
+// that [DumpTree] shows for each node.
+const dumpExcerptLength = 40
+
+// DumpTree writes a human-readable description of a node and its descendants to w,
+// intended for debugging.
+// Each node is written on its own line, indented by two spaces per level of depth,
+// as its kind (without the "Kind" suffix), its span,
+// any kind-specific attributes (like a heading's level or a list's looseness),
+// and a quoted excerpt of the source it covers.
+// Excerpts longer than 40 bytes are truncated and followed by "...".
+// source must be the Source of the [RootBlock] that contains the node.
+// Nodes with spans that are not valid within source are written without an excerpt,
+// and a zero Node is written as "nil".
+// The output format is not stable across versions of this package.
+func DumpTree(w io.Writer, source []byte, node Node) error {
+	sb := new(strings.Builder)
+	dumpTree(sb, source, node, 0)
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func dumpTree(sb *strings.Builder, source []byte, node Node, depth int) {
+	for i := 0; i < depth; i++ {
+		sb.WriteString("  ")
+	}
+	span := node.Span()
+	inSource := span.IsValid() && span.End <= len(source)
+	if b := node.Block(); b != nil {
+		sb.WriteString(strings.TrimSuffix(b.Kind().String(), "Kind"))
+		sb.WriteString(" ")
+		sb.WriteString(span.String())
+		dumpBlockAttributes(sb, source, b, inSource)
+	} else if inline := node.Inline(); inline != nil {
+		sb.WriteString(strings.TrimSuffix(inline.Kind().String(), "Kind"))
+		sb.WriteString(" ")
+		sb.WriteString(span.String())
+		dumpInlineAttributes(sb, inline)
+	} else {
+		sb.WriteString("nil\n")
+		return
+	}
+	if inSource {
+		excerpt := spanSlice(source, span)
+		truncated := len(excerpt) > dumpExcerptLength
+		if truncated {
+			n := dumpExcerptLength
+			for n > 0 && !utf8.RuneStart(excerpt[n]) {
+				n--
+			}
+			excerpt = excerpt[:n]
+		}
+		fmt.Fprintf(sb, " %q", excerpt)
+		if truncated {
+			sb.WriteString("...")
+		}
+	}
+	sb.WriteString("\n")
+	for i, n := 0, node.ChildCount(); i < n; i++ {
+		dumpTree(sb, source, node.Child(i), depth+1)
+	}
+}
+
+// dumpBlockAttributes writes the kind-specific attributes of b.
+// Attributes that are read from source are omitted
+// unless inSource is true.
+func dumpBlockAttributes(sb *strings.Builder, source []byte, b *Block, inSource bool) {
+	switch {
+	case b.IsHeading():
+		fmt.Fprintf(sb, " level=%d", b.HeadingLevel())
+	case b.IsList():
+		if b.IsOrderedList() {
+			sb.WriteString(" ordered")
+			if inSource {
+				fmt.Fprintf(sb, " start=%d", b.ListStartNumber(source))
+			}
+		}
+		if b.IsTightList() {
+			sb.WriteString(" tight")
+		} else {
+			sb.WriteString(" loose")
+		}
+	case b.IsListItem():
+		if b.IsEmptyListItem() {
+			sb.WriteString(" empty")
+		}
+		if b.ListItemStartsWithBlankLine() {
+			sb.WriteString(" blankstart")
+		}
+	case b.Kind() == FencedCodeBlockKind:
+		fmt.Fprintf(sb, " fence=%q*%d", b.FenceChar(), b.FenceLength())
+	case b.Kind() == DirectiveBlockKind && inSource:
+		fmt.Fprintf(sb, " name=%q", b.DirectiveName(source))
+	}
+}
+
+// dumpInlineAttributes writes the kind-specific attributes of inline.
+func dumpInlineAttributes(sb *strings.Builder, inline *Inline) {
+	switch inline.Kind() {
+	case IndentKind:
+		fmt.Fprintf(sb, " width=%d", inline.IndentWidth())
+	case HardLineBreakKind:
+		switch inline.HardBreakStyle() {
+		case HardBreakBackslash:
+			sb.WriteString(" backslash")
+		case HardBreakSpaces:
+			sb.WriteString(" spaces")
+		}
+	case EmphasisKind, StrongKind, CodeSpanKind:
+		if c := inline.DelimiterChar(); c != 0 {
+			fmt.Fprintf(sb, " delim=%q*%d", c, inline.DelimiterRun())
+		}
+	case LinkKind, ImageKind:
+		if ref := inline.LinkReference(); ref != "" {
+			fmt.Fprintf(sb, " ref=%q", ref)
+		}
+	}
+}
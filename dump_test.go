@@ -0,0 +1,158 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commonmark_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/commonmark"
+)
+
+// dumpTestInput is a document that contains every kind of node.
+const dumpTestInput = "# ATX *em* **strong**\n" +
+	"\n" +
+	"Setext `code\n" +
+	"span`\n" +
+	"======\n" +
+	"\n" +
+	"Text with a soft\n" +
+	"break, a hard\\\n" +
+	"break, &amp; <span>html</span>, <https://example.com>,\n" +
+	"https://example.org, :smile:, [[Wiki Page|wiki]],\n" +
+	":kbd[Ctrl]{.key}, [link](/url \"title\"), ![image][ref], and [collapsed][].\n" +
+	"\n" +
+	"[ref]: /img.png 'Image'\n" +
+	"[collapsed]: /c\n" +
+	"\n" +
+	"> Quote\n" +
+	"\n" +
+	"- item\n" +
+	"\n" +
+	"1. ordered\n" +
+	"2. list\n" +
+	"\n" +
+	"***\n" +
+	"\n" +
+	"    indented code\n" +
+	"\n" +
+	"```go\n" +
+	"fenced code\n" +
+	"```\n" +
+	"\n" +
+	"<div>\n" +
+	"html block\n" +
+	"</div>\n" +
+	"\n" +
+	"::: warning {.note}\n" +
+	"directive with a long line of text that is truncated in the dump\n" +
+	":::\n"
+
+func TestDumpTree(t *testing.T) {
+	p := commonmark.NewBlockParser(strings.NewReader(dumpTestInput))
+	p.Directives = true
+	var blocks []*commonmark.RootBlock
+	var unparsed *commonmark.RootBlock
+	for {
+		block, err := p.NextBlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unparsed == nil && block.Kind() == commonmark.ParagraphKind {
+			unparsed = block.Clone(false)
+		}
+		blocks = append(blocks, block)
+	}
+	refMap := make(commonmark.ReferenceMap)
+	for _, root := range blocks {
+		refMap.Extract(root.Source, root.AsNode())
+	}
+	inlineParser := &commonmark.InlineParser{
+		ReferenceMatcher:  refMap,
+		Directives:        true,
+		EmojiResolver:     commonmark.EmojiMap{"smile": "\U0001f604"},
+		WikiLinks:         true,
+		ExtendedAutolinks: true,
+	}
+	for _, root := range blocks {
+		inlineParser.Rewrite(root)
+	}
+
+	buf := new(bytes.Buffer)
+	for _, root := range append(blocks, unparsed) {
+		if err := commonmark.DumpTree(buf, root.Source, root.AsNode()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := commonmark.DumpTree(buf, nil, commonmark.Node{}); err != nil {
+		t.Fatal(err)
+	}
+	// Spans outside of the source don't have excerpts.
+	if err := commonmark.DumpTree(buf, blocks[0].Source[:3], blocks[0].AsNode()); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+
+	path := filepath.Join("testdata", "dump.txt")
+	if *updateGolden {
+		if err := os.WriteFile(path, []byte(got), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%v (run with -update to create)", err)
+		}
+		if diff := cmp.Diff(string(want), got); diff != "" {
+			t.Errorf("DumpTree (-want +got):\n%s", diff)
+		}
+	}
+
+	// Verify that the input covers every kind of node.
+	blockKinds := make(map[commonmark.BlockKind]bool)
+	inlineKinds := make(map[commonmark.InlineKind]bool)
+	for _, root := range append(blocks, unparsed) {
+		commonmark.Walk(root.AsNode(), &commonmark.WalkOptions{
+			Pre: func(c *commonmark.Cursor) bool {
+				if b := c.Node().Block(); b != nil {
+					blockKinds[b.Kind()] = true
+				} else {
+					inlineKinds[c.Node().Inline().Kind()] = true
+				}
+				return true
+			},
+		})
+	}
+	for k := commonmark.ParagraphKind; k <= commonmark.DirectiveBlockKind; k++ {
+		if !blockKinds[k] {
+			t.Errorf("input does not contain a %v", k)
+		}
+	}
+	for k := commonmark.TextKind; k <= commonmark.WikiLinkTargetKind; k++ {
+		if !inlineKinds[k] {
+			t.Errorf("input does not contain a %v", k)
+		}
+	}
+}
@@ -33,6 +33,24 @@ func Example() {
 	// <p>Hello, <strong>World</strong>!</p>
 }
 
+func ExampleRenderHTMLSafe() {
+	blocks, refMap := commonmark.Parse([]byte(
+		"Press <kbd>Ctrl</kbd>+<kbd>C</kbd> to copy.\n" +
+			"<img src=\"cat.png\" onerror=\"alert('xss')\">\n" +
+			"<a href=\"javascript:alert('xss')\">Click me</a>\n",
+	))
+
+	// Permit <kbd> in addition to the default elements.
+	policy := commonmark.DefaultSanitizePolicy()
+	policy.Elements = append(policy.Elements, "kbd")
+
+	commonmark.RenderHTMLSafe(os.Stdout, blocks, refMap, policy)
+	// Output:
+	// <p>Press <kbd>Ctrl</kbd>+<kbd>C</kbd> to copy.
+	// <img src="cat.png">
+	// <a>Click me</a></p>
+}
+
 func ExampleBlockParser() {
 	input := strings.NewReader(
 		"Hello, [World][]!\n" +
@@ -20,7 +20,9 @@ package format
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -28,14 +30,152 @@ import (
 	"zombiezen.com/go/commonmark"
 )
 
-// Format writes the given blocks as CommonMark to the given writer.
+// A Formatter writes parsed CommonMark documents as CommonMark.
+// The zero value formats documents with the default options.
+type Formatter struct {
+	// If Width is positive, then paragraph text is wrapped
+	// so that lines are no wider than Width columns where possible.
+	// Lines may only be broken at spaces, tabs, or soft line breaks in text,
+	// so words, code spans, raw HTML, link labels, and link destinations
+	// that are wider than the remaining space will cause lines to exceed Width.
+	// Width is measured in Unicode code points
+	// (including any indentation and block quote markers),
+	// with tabs advancing to the next multiple of 4 columns.
+	// Runs of spaces and tabs in wrapped text are written as a single space.
+	Width int
+	// OrderedListNumbering determines how ordered list item markers are written.
+	// The zero value, [ListNumberingPreserve], writes item numbers as they appear in the source.
+	OrderedListNumbering ListNumbering
+	// LineEnding is the line ending written at the end of each line.
+	// It must be empty, "\n", "\r\n", or "\r".
+	// If LineEnding is empty, then "\n" is used.
+	LineEnding string
+	// If PreserveLinkLabelCase is false, then the labels of full reference links
+	// and link reference definitions are written in their [normalized form]
+	// (case-folded, with runs of whitespace collapsed into a single space),
+	// so that references to the same definition are written the same way.
+	// If PreserveLinkLabelCase is true, then labels keep their original case,
+	// but whitespace is still collapsed.
+	// Collapsed and shortcut reference links are always written
+	// with their original link text, since the link text is also the label.
+	//
+	// [normalized form]: https://spec.commonmark.org/0.30/#matches
+	PreserveLinkLabelCase bool
+	// If PreserveReferenceLabels is true, then the labels of full reference links
+	// and link reference definitions are written as they appear in the source,
+	// including their case and any whitespace inside the brackets.
+	// A line ending inside a label and the indentation around it
+	// are written as a single space,
+	// so that the label cannot start a new block on its own line.
+	// Links still refer to the same definitions,
+	// since labels are matched by their normalized form.
+	// PreserveReferenceLabels takes precedence over PreserveLinkLabelCase.
+	PreserveReferenceLabels bool
+	// If PreserveHardBreakStyle is true, then hard line breaks
+	// that were written as trailing spaces in the source
+	// are written as two trailing spaces.
+	// Otherwise, all hard line breaks are written with a backslash
+	// so that lines never end in whitespace.
+	PreserveHardBreakStyle bool
+	// FenceChar is the character used for code block fences.
+	// It must be zero, '`', or '~'.
+	// If FenceChar is zero, then fenced code blocks keep their original fence character
+	// and the length of their original fence (if longer than MinFenceLength),
+	// and indented code blocks are written with backticks.
+	// Otherwise, all code blocks are written with FenceChar fences
+	// of MinFenceLength characters.
+	// In either case, tildes are used for blocks whose info string contains a backtick,
+	// and fences are made longer than any fence-like line in the block's content.
+	FenceChar byte
+	// MinFenceLength is the minimum number of characters in a code block fence.
+	// If MinFenceLength is less than 3, then 3 is used.
+	MinFenceLength int
+	// If CompactHeadings is true, then a heading that immediately follows
+	// another heading in the same container is written on the next line.
+	// Otherwise, a blank line is written between them,
+	// like between any other pair of blocks.
+	CompactHeadings bool
+}
+
+// ListNumbering is an enumeration of styles for ordered list item numbers.
+type ListNumbering int
+
+const (
+	// ListNumberingPreserve indicates that list item markers
+	// should be written as they appear in the source.
+	ListNumberingPreserve ListNumbering = iota
+	// ListNumberingIncrement indicates that ordered list items
+	// should be numbered consecutively, like 1, 2, 3.
+	// Numbering begins at the list's start number
+	// (the number of its first item)
+	// rather than at 1,
+	// because the start number is part of the rendered list.
+	// Lists whose numbers would exceed the nine digits permitted by CommonMark
+	// are written as they appear in the source.
+	ListNumberingIncrement
+	// ListNumberingLoose indicates that only the first item in an ordered list
+	// should have a meaningful number:
+	// the first item keeps its number
+	// and every following item is numbered 1.
+	// As with ListNumberingIncrement, the first item is not reset to 1
+	// because its number is the rendered list's start number.
+	ListNumberingLoose
+)
+
+// maxListItemNumber is the largest number permitted in an [ordered list marker].
+//
+// [ordered list marker]: https://spec.commonmark.org/0.30/#ordered-list-marker
+const maxListItemNumber = 999_999_999
+
+// Format writes the given blocks as CommonMark to the given writer
+// using the default options for [Formatter].
+// See [*Formatter.Format] for details.
 func Format(w io.Writer, blocks []*commonmark.RootBlock) error {
+	return new(Formatter).Format(w, blocks)
+}
+
+// Format writes the given blocks as CommonMark to the given writer.
+//
+// Top-level blocks are separated by exactly one blank line
+// and the output ends with a single line ending.
+// Lines never end in spaces or tabs,
+// except inside code blocks and HTML blocks,
+// whose contents are reproduced byte-for-byte,
+// and at hard line breaks kept as spaces by [Formatter.PreserveHardBreakStyle].
+// Hard line breaks are otherwise written with a backslash.
+// Setext headings with a level greater than 2
+// (e.g. after [*commonmark.Block.SetHeadingLevel])
+// are written as single-line ATX headings.
+// All line endings are written as [Formatter.LineEnding].
+func (f *Formatter) Format(w io.Writer, blocks []*commonmark.RootBlock) error {
 	fw := newFormatWriter(w)
+	switch f.LineEnding {
+	case "":
+	case "\n", "\r\n", "\r":
+		fw.lineEnding = f.LineEnding
+	default:
+		return fmt.Errorf("format markdown: invalid line ending %q", f.LineEnding)
+	}
+	switch f.FenceChar {
+	case 0, '`', '~':
+		fw.fenceChar = f.FenceChar
+	default:
+		return fmt.Errorf("format markdown: invalid fence character %q", f.FenceChar)
+	}
+	if f.MinFenceLength > fw.minFenceLength {
+		fw.minFenceLength = f.MinFenceLength
+	}
+	fw.wrapWidth = f.Width
+	fw.listNumbering = f.OrderedListNumbering
+	fw.preserveLinkLabelCase = f.PreserveLinkLabelCase
+	fw.preserveReferenceLabels = f.PreserveReferenceLabels
+	fw.preserveHardBreakStyle = f.PreserveHardBreakStyle
+	fw.compactHeadings = f.CompactHeadings
 	var source []byte
 	commonmark.Walk(commonmark.Node{}, &commonmark.WalkOptions{
 		Pre: func(c *commonmark.Cursor) bool {
 			if b := c.Node().Block(); b != nil {
-				if c.ParentBlock() == nil {
+				if c.BlockParent() == nil {
 					for _, root := range blocks {
 						if b == &root.Block {
 							source = root.Source
@@ -78,16 +218,20 @@ func Format(w io.Writer, blocks []*commonmark.RootBlock) error {
 			return n.Child(i)
 		},
 	})
+	fw.finish()
 	return fw.err
 }
 
 func preBlock(fw *formatWriter, source []byte, cursor *commonmark.Cursor) (childrenIndent string, descend bool) {
 	curr := cursor.Node().Block()
+	compactHeading := fw.compactHeadings && fw.afterHeading
+	fw.afterHeading = false
 	switch k := curr.Kind(); k {
 	case commonmark.ParagraphKind:
 		if !isFirstParagraph(cursor) {
-			fw.s("\n")
+			fw.blockSeparator(cursor)
 		}
+		fw.wrapping = fw.wrapWidth > 0
 		return "", true
 	case commonmark.ThematicBreakKind:
 		if fw.hasWritten {
@@ -98,33 +242,34 @@ func preBlock(fw *formatWriter, source []byte, cursor *commonmark.Cursor) (child
 		}
 		return "", true
 	case commonmark.ListKind:
-		if fw.hasWritten && curr.IsTightList() {
-			// Individual list items won't contain a blank line,
-			// so add them beforehand.
-			fw.s("\n")
+		if fw.hasWritten && !startsMarkerLine(cursor) {
+			fw.blockSeparator(cursor)
 		}
 		return "", true
 	case commonmark.ListItemKind:
-		if cursor.Index() > 0 && !curr.IsTightList() {
-			fw.s("\n")
+		if cursor.Index() > 0 {
+			fw.blockSeparator(cursor)
 		}
 		start := 0
 		if marker := curr.Child(start).Block(); marker.Kind() == commonmark.ListMarkerKind {
 			start++
-			markerBytes := spanSlice(source, marker.Span())
+			markerBytes := fw.listMarker(source, cursor)
 			fw.b(markerBytes)
 			fw.s(" ")
 			childrenIndent = strings.Repeat(" ", len(markerBytes)+1)
 		}
 		return childrenIndent, true
 	case commonmark.LinkReferenceDefinitionKind:
-		if fw.hasWritten {
-			fw.s("\n")
+		if fw.hasWritten && !startsMarkerLine(cursor) {
+			fw.blockSeparator(cursor)
 		}
 		fw.s("[")
-		fw.s(curr.Child(0).Inline().LinkReference())
+		label := curr.Child(0).Inline()
+		fw.s(fw.linkLabel(source, label, definitionLabelInner(source, curr)))
 		fw.s("]: ")
-		fw.s(curr.Child(1).Inline().Text(source))
+		// Unlike in an inline link, a definition's destination can't be omitted,
+		// so an empty destination is always written in angle brackets.
+		fw.s(formatLinkDestination(commonmark.NormalizeURI(curr.Child(1).Inline().Text(source)), true))
 		if curr.ChildCount() > 2 {
 			fw.s(` "`)
 			fw.s(curr.Child(2).Inline().Text(source))
@@ -133,56 +278,134 @@ func preBlock(fw *formatWriter, source []byte, cursor *commonmark.Cursor) (child
 		fw.s("\n")
 		return "", false
 	case commonmark.BlockQuoteKind:
-		if fw.hasWritten {
-			fw.s("\n")
+		if fw.hasWritten && !startsMarkerLine(cursor) {
+			fw.blockSeparator(cursor)
 		}
 		fw.s("> ")
 		return "> ", true
 	case commonmark.IndentedCodeBlockKind:
-		if fw.hasWritten {
-			fw.s("\n")
+		if fw.hasWritten && !startsMarkerLine(cursor) {
+			fw.blockSeparator(cursor)
 		}
-		for i, n := 0, codeFenceLength(source, curr); i < n; i++ {
-			fw.s("`")
+		c := [1]byte{fw.codeFenceChar(source, curr)}
+		for i, n := 0, fw.codeFenceLength(source, curr); i < n; i++ {
+			fw.b(c[:])
 		}
 		fw.s("\n")
+		fw.verbatim = true
 		return "", true
 	case commonmark.FencedCodeBlockKind:
-		if fw.hasWritten {
-			fw.s("\n")
+		if fw.hasWritten && !startsMarkerLine(cursor) {
+			fw.blockSeparator(cursor)
 		}
-		c := [1]byte{codeFenceChar(source, curr)}
-		for i, n := 0, codeFenceLength(source, curr); i < n; i++ {
+		c := [1]byte{fw.codeFenceChar(source, curr)}
+		for i, n := 0, fw.codeFenceLength(source, curr); i < n; i++ {
 			fw.b(c[:])
 		}
 		if info := curr.InfoString(); info != nil {
 			fw.b(spanSlice(source, info.Span()))
 		}
 		fw.s("\n")
+		fw.verbatim = true
 		return "", true
-	case commonmark.ATXHeadingKind:
-		if fw.hasWritten {
-			fw.s("\n")
+	case commonmark.ATXHeadingKind, commonmark.SetextHeadingKind:
+		if fw.hasWritten && !compactHeading && !startsMarkerLine(cursor) {
+			fw.blockSeparator(cursor)
 		}
-		for i, n := 0, curr.HeadingLevel(); i < n; i++ {
-			fw.s("#")
+		if isATXHeading(curr) {
+			for i, n := 0, curr.HeadingLevel(); i < n; i++ {
+				fw.s("#")
+			}
+			fw.s(" ")
 		}
-		fw.s(" ")
 		return "", true
-	case commonmark.SetextHeadingKind, commonmark.HTMLBlockKind:
-		if fw.hasWritten {
-			fw.s("\n")
+	case commonmark.HTMLBlockKind:
+		if fw.hasWritten && !startsMarkerLine(cursor) {
+			fw.blockSeparator(cursor)
 		}
+		fw.verbatim = true
+		return "", true
+	case commonmark.DirectiveBlockKind:
+		if fw.hasWritten && !startsMarkerLine(cursor) {
+			fw.blockSeparator(cursor)
+		}
+		fw.s(strings.Repeat(":", curr.FenceLength()))
+		name := curr.DirectiveName(source)
+		if name != "" {
+			fw.s(" ")
+			fw.s(name)
+		}
+		// A fence without a name or attributes would close the directive.
+		if attrs := curr.DirectiveAttributes(source); attrs != "" || name == "" {
+			fw.s(" {")
+			fw.s(attrs)
+			fw.s("}")
+		}
+		fw.s("\n")
 		return "", true
 	default:
 		return "", false
 	}
 }
 
+// listMarker returns the marker to write
+// for the [commonmark.ListItemKind] block at the cursor.
+func (fw *formatWriter) listMarker(source []byte, cursor *commonmark.Cursor) []byte {
+	item := cursor.Node().Block()
+	markerBytes := spanSlice(source, item.Child(0).Block().Span())
+	if fw.listNumbering == ListNumberingPreserve || !item.IsOrderedList() {
+		return markerBytes
+	}
+	list := cursor.Parent().Block()
+	start := list.ListStartNumber(source)
+	var n int
+	switch fw.listNumbering {
+	case ListNumberingIncrement:
+		if start > maxListItemNumber-(list.ChildCount()-1) {
+			return markerBytes
+		}
+		n = start + cursor.Index()
+	case ListNumberingLoose:
+		n = 1
+		if cursor.Index() == 0 {
+			n = start
+		}
+	default:
+		return markerBytes
+	}
+	delim := markerBytes[len(markerBytes)-1]
+	return append(strconv.AppendInt(nil, int64(n), 10), delim)
+}
+
+// blockSeparator ends the line before the cursor's block
+// and separates the block from the previous one with a blank line,
+// unless the block is directly inside a tight list or list item,
+// where a blank line would make the list loose.
+func (fw *formatWriter) blockSeparator(cursor *commonmark.Cursor) {
+	fw.s("\n")
+	if cursor.BlockParent().IsTightList() {
+		fw.pendingBlank = false
+	}
+}
+
 func isFirstParagraph(cursor *commonmark.Cursor) bool {
-	if cursor.Node().Block().Kind() != commonmark.ParagraphKind {
+	return cursor.Node().Block().Kind() == commonmark.ParagraphKind && isFirstChild(cursor)
+}
+
+// startsMarkerLine reports whether the cursor's block is written
+// on the same line as its parent's block quote or list item marker.
+func startsMarkerLine(cursor *commonmark.Cursor) bool {
+	switch cursor.Parent().Block().Kind() {
+	case commonmark.BlockQuoteKind, commonmark.ListItemKind:
+		return isFirstChild(cursor)
+	default:
 		return false
 	}
+}
+
+// isFirstChild reports whether the cursor's block
+// is the first block in its parent, ignoring any list marker.
+func isFirstChild(cursor *commonmark.Cursor) bool {
 	if cursor.Index() <= 0 {
 		return true
 	}
@@ -195,26 +418,38 @@ func isFirstParagraph(cursor *commonmark.Cursor) bool {
 
 func postBlock(fw *formatWriter, source []byte, cursor *commonmark.Cursor) {
 	b := cursor.Node().Block()
+	fw.afterHeading = b.Kind() == commonmark.ATXHeadingKind || b.Kind() == commonmark.SetextHeadingKind
 	switch b.Kind() {
 	case commonmark.ParagraphKind:
-		if !cursor.ParentBlock().IsTightList() {
+		if fw.wrapping {
+			fw.flushWrap()
+		}
+		if !cursor.BlockParent().IsTightList() {
 			fw.s("\n")
 		}
 	case commonmark.ListItemKind:
 		fw.s("\n")
 	case commonmark.IndentedCodeBlockKind, commonmark.FencedCodeBlockKind:
-		c := [1]byte{codeFenceChar(source, b)}
-		for i, n := 0, codeFenceLength(source, b); i < n; i++ {
+		fw.verbatim = false
+		c := [1]byte{fw.codeFenceChar(source, b)}
+		for i, n := 0, fw.codeFenceLength(source, b); i < n; i++ {
 			fw.b(c[:])
 		}
 		fw.s("\n")
-	case commonmark.ATXHeadingKind:
+	case commonmark.HTMLBlockKind:
+		fw.verbatim = false
 		fw.s("\n")
-	case commonmark.SetextHeadingKind:
+	case commonmark.DirectiveBlockKind:
+		fw.s(strings.Repeat(":", b.FenceLength()))
+		fw.s("\n")
+	case commonmark.ATXHeadingKind, commonmark.SetextHeadingKind:
 		// TODO(someday): Extend to the length of the source.
-		if b.HeadingLevel() == 1 {
+		switch {
+		case isATXHeading(b):
+			fw.s("\n")
+		case b.HeadingLevel() == 1:
 			fw.s("\n=====\n")
-		} else {
+		default:
 			fw.s("\n-----\n")
 		}
 	}
@@ -224,28 +459,131 @@ func visitInline(fw *formatWriter, source []byte, cursor *commonmark.Cursor) boo
 	child := cursor.Node().Inline()
 	switch child.Kind() {
 	case commonmark.LinkKind:
+		fw.s("[")
+		if isShortcutLinkOrImage(child) {
+			// The link text is also the link label,
+			// so don't change its whitespace.
+			fw.noBreak++
+		}
+		return true
+	case commonmark.ImageKind:
+		fw.s("![")
+		if isShortcutLinkOrImage(child) {
+			fw.noBreak++
+		}
+		return true
+	case commonmark.DirectiveKind:
+		fw.s(":")
+		fw.s(child.DirectiveName(source))
 		fw.s("[")
 		return true
 	case commonmark.TextKind:
-		if cursor.ParentBlock().Kind().IsCode() {
+		if cursor.BlockParent().IsCode() {
 			fw.b(spanSlice(source, child.Span()))
 			return false
 		}
 
-		for s := spanSlice(source, child.Span()); len(s) > 0; {
+		s := spanSlice(source, child.Span())
+		if parent := cursor.Parent().Block(); parent != nil && cursor.Index() == parent.ChildCount()-1 {
+			// Trailing whitespace at the end of a paragraph or heading is not significant.
+			s = bytes.TrimRight(s, " \t\r\n")
+		}
+		// List markers at the start of a line must be escaped.
+		lineStart, lineDigits := fw.textLinePosition(source, cursor)
+		for len(s) > 0 {
 			r, n := utf8.DecodeRune(s)
-			if r == '\n' && cursor.ParentBlock().Kind() == commonmark.SetextHeadingKind {
+			if (r == '\n' || r == '\r') && cursor.BlockParent().Kind() == commonmark.SetextHeadingKind {
 				s = s[n:]
 				continue
 			}
-			if strings.ContainsRune(`\[]*_-=<>&#~`+"`", r) {
+			escape := strings.ContainsRune(`\[]*_-=<>&#~`+"`", r) ||
+				(r == '+' && lineStart) ||
+				((r == '.' || r == ')') && 0 < lineDigits && lineDigits <= maxListItemNumberDigits)
+			switch {
+			case r == '\n' || r == '\r':
+				lineStart, lineDigits = true, 0
+			case '0' <= r && r <= '9' && lineDigits >= 0:
+				lineStart = false
+				lineDigits++
+			default:
+				lineStart, lineDigits = false, -1
+			}
+			if (r == ' ' || r == '\t') && fw.canBreak() {
+				fw.breakOpportunity()
+				s = s[n:]
+				continue
+			}
+			if escape {
 				fw.s(`\`)
 			}
 			fw.b(s[:n])
 			s = s[n:]
 		}
 		return false
-	case commonmark.InfoStringKind, commonmark.LinkDestinationKind, commonmark.LinkLabelKind, commonmark.LinkTitleKind:
+	case commonmark.EmphasisKind, commonmark.StrongKind:
+		fw.s(emphasisDelimiter(child))
+		return true
+	case commonmark.SoftLineBreakKind:
+		if isATXHeading(cursor.BlockParent()) {
+			// ATX headings cannot span multiple lines.
+			fw.s(" ")
+			return false
+		}
+		if fw.canBreak() && !isNextToRawHTML(cursor) {
+			// Soft line breaks are semantically equivalent to spaces.
+			// (Except around raw HTML, which may be something like a <pre> tag.)
+			fw.breakOpportunity()
+			return false
+		}
+		if child.Span().Len() == 0 {
+			fw.s("\n")
+		} else {
+			fw.b(spanSlice(source, child.Span()))
+		}
+		return false
+	case commonmark.IndentKind:
+		if fw.canBreak() && !fw.atWrapLineStart() {
+			fw.breakOpportunity()
+		} else {
+			// Indentation at the start of a line may prevent
+			// the rest of the line from being interpreted as a block.
+			fw.b(spanSlice(source, child.Span()))
+		}
+		return false
+	case commonmark.HardLineBreakKind:
+		if isATXHeading(cursor.BlockParent()) {
+			fw.s(" ")
+			return false
+		}
+		if fw.preserveHardBreakStyle && child.HardBreakStyle() == commonmark.HardBreakSpaces {
+			fw.verbatimBytes([]byte("  "))
+		} else {
+			// Use a backslash rather than trailing spaces
+			// so that lines never end in whitespace.
+			fw.s(`\`)
+		}
+		if s := spanSlice(source, child.Span()); bytes.HasSuffix(s, []byte("\n")) || bytes.HasSuffix(s, []byte("\r")) {
+			fw.s("\n")
+		}
+		return false
+	case commonmark.HTMLTagKind:
+		if startsContinuationLine(cursor) && interruptsParagraph(firstTagLine(source, child)) {
+			// The original line must have been indented
+			// or the tag would have started an HTML block.
+			fw.verbatimBytes([]byte(strings.Repeat(" ", codeBlockIndentLimit)))
+		}
+		if child.ChildCount() == 0 {
+			fw.verbatimBytes(spanSlice(source, child.Span()))
+			return false
+		}
+		// Write the tag's lines from its children,
+		// since the tag's span includes the container markers
+		// of any continuation lines.
+		return true
+	case commonmark.CodeSpanKind, commonmark.RawHTMLKind, commonmark.WikiLinkKind:
+		fw.verbatimBytes(spanSlice(source, child.Span()))
+		return false
+	case commonmark.InfoStringKind, commonmark.LinkDestinationKind, commonmark.LinkLabelKind, commonmark.LinkTitleKind, commonmark.DirectiveAttributesKind:
 		return false
 	default:
 		if !child.Span().IsValid() {
@@ -259,22 +597,34 @@ func visitInline(fw *formatWriter, source []byte, cursor *commonmark.Cursor) boo
 func postInline(fw *formatWriter, source []byte, cursor *commonmark.Cursor) {
 	child := cursor.Node().Inline()
 	switch child.Kind() {
-	case commonmark.LinkKind:
+	case commonmark.EmphasisKind, commonmark.StrongKind:
+		fw.s(emphasisDelimiter(child))
+	case commonmark.DirectiveKind:
+		fw.s("]")
+		if attrs := child.DirectiveAttributes(); attrs != nil {
+			fw.verbatimBytes(spanSlice(source, attrs.Span()))
+		}
+	case commonmark.LinkKind, commonmark.ImageKind:
+		if isShortcutLinkOrImage(child) {
+			fw.noBreak--
+		}
 		fw.s("]")
 		if ref := child.LinkReference(); ref != "" {
-			if isShortcutLinkOrImage(child) {
-				// Turn shortcut links into collapsed links.
-				fw.s("[]")
-			} else {
+			if label := child.Child(child.ChildCount() - 1); label.Kind() == commonmark.LinkLabelKind {
+				// A link's label span includes its brackets.
+				span := label.Span()
 				fw.s("[")
-				fw.s(ref)
+				fw.s(fw.linkLabel(source, label, commonmark.Span{Start: span.Start + 1, End: span.End - 1}))
 				fw.s("]")
+			} else {
+				// Turn shortcut links and images into collapsed ones.
+				fw.s("[]")
 			}
 		} else {
 			fw.s("(")
 			title := child.LinkTitle()
 			if dst := child.LinkDestination(); dst != nil {
-				fw.s(commonmark.NormalizeURI(dst.Text(source)))
+				fw.s(formatLinkDestination(commonmark.NormalizeURI(dst.Text(source)), title != nil))
 				if title != nil {
 					fw.s(" ")
 				}
@@ -289,8 +639,255 @@ func postInline(fw *formatWriter, source []byte, cursor *commonmark.Cursor) {
 	}
 }
 
+// linkLabel returns the text to write between the brackets
+// of a [commonmark.LinkLabelKind] node.
+// inner is the span of the text between the brackets in source.
+func (fw *formatWriter) linkLabel(source []byte, label *commonmark.Inline, inner commonmark.Span) string {
+	if fw.preserveReferenceLabels {
+		return sourceLinkLabel(source, label, inner)
+	}
+	if !fw.preserveLinkLabelCase {
+		return label.LinkReference()
+	}
+	sb := new(strings.Builder)
+	pendingSpace := false
+	for i, n := 0, label.ChildCount(); i < n; i++ {
+		for _, c := range spanSlice(source, label.Child(i).Span()) {
+			if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+				pendingSpace = sb.Len() > 0
+				continue
+			}
+			if pendingSpace {
+				sb.WriteByte(' ')
+				pendingSpace = false
+			}
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// sourceLinkLabel returns the text between the brackets
+// of a [commonmark.LinkLabelKind] node as it appears in the source,
+// replacing each line ending and the whitespace around it with a single space.
+// inner is the span of the text between the brackets.
+// Any container markers at the start of a continuation line
+// are between the label's children, so they are omitted, too.
+func sourceLinkLabel(source []byte, label *commonmark.Inline, inner commonmark.Span) string {
+	var buf []byte
+	lineBreak := false
+	appendText := func(b []byte) {
+		for {
+			i := bytes.IndexAny(b, "\r\n")
+			line := b
+			if i >= 0 {
+				line = b[:i]
+			}
+			if lineBreak {
+				line = bytes.TrimLeft(line, " \t")
+				if len(line) > 0 {
+					buf = append(buf, ' ')
+					lineBreak = false
+				}
+			}
+			buf = append(buf, line...)
+			if i < 0 {
+				return
+			}
+			buf = bytes.TrimRight(buf, " \t")
+			lineBreak = true
+			b = b[i+1:]
+		}
+	}
+	pos := inner.Start
+	for i, n := 0, label.ChildCount(); i <= n; i++ {
+		gapEnd := inner.End
+		if i < n {
+			gapEnd = label.Child(i).Span().Start
+		}
+		if gap := source[pos:gapEnd]; lineBreak || bytes.ContainsAny(gap, "\r\n") {
+			// Skip over any container markers on the next line.
+			buf = bytes.TrimRight(buf, " \t")
+			lineBreak = true
+		} else {
+			appendText(gap)
+		}
+		if i == n {
+			break
+		}
+		appendText(spanSlice(source, label.Child(i).Span()))
+		pos = label.Child(i).Span().End
+	}
+	if lineBreak {
+		buf = append(buf, ' ')
+	}
+	return string(buf)
+}
+
+// definitionLabelInner returns the span of the text
+// between the brackets of a [commonmark.LinkReferenceDefinitionKind] block's label.
+// The label node's span omits the whitespace next to the brackets,
+// but the definition starts with the opening bracket,
+// and only whitespace and container markers
+// can appear between the label text and the closing bracket.
+func definitionLabelInner(source []byte, def *commonmark.Block) commonmark.Span {
+	labelSpan := def.Child(0).Inline().Span()
+	inner := commonmark.Span{Start: def.Span().Start + 1, End: labelSpan.End}
+	if i := bytes.IndexByte(source[labelSpan.End:def.Span().End], ']'); i >= 0 {
+		inner.End += i
+	}
+	return inner
+}
+
+// formatLinkDestination returns the [link destination] syntax for dst.
+// Destinations are written without angle brackets
+// unless they contain spaces, control characters, or unbalanced parentheses,
+// begin with a '<', or are empty and followed by a title.
+//
+// [link destination]: https://spec.commonmark.org/0.30/#link-destination
+func formatLinkDestination(dst string, hasTitle bool) string {
+	needsBrackets := (dst == "" && hasTitle) || strings.HasPrefix(dst, "<")
+	parenDepth := 0
+	for i := 0; i < len(dst) && !needsBrackets; i++ {
+		switch c := dst[i]; {
+		case c < 0x20 || c == 0x7f || c == ' ':
+			needsBrackets = true
+		case c == '(':
+			parenDepth++
+		case c == ')':
+			parenDepth--
+			needsBrackets = parenDepth < 0
+		}
+	}
+	needsBrackets = needsBrackets || parenDepth != 0
+
+	sb := new(strings.Builder)
+	sb.Grow(len(dst) + len("<>"))
+	if needsBrackets {
+		sb.WriteString("<")
+	}
+	for i := 0; i < len(dst); i++ {
+		switch c := dst[i]; {
+		case c == '\\' || (needsBrackets && (c == '<' || c == '>')):
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case needsBrackets && (c == '\n' || c == '\r'):
+			// Line endings are not permitted inside angle brackets.
+			sb.WriteString(commonmark.NormalizeURI(string(c)))
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	if needsBrackets {
+		sb.WriteString(">")
+	}
+	return sb.String()
+}
+
+// textLinePosition reports whether the cursor's text node
+// starts a line in its paragraph or heading.
+// lineDigits is the number of digits between the start of the line
+// and the text node
+// or -1 if anything other than digits precedes the text node on its line.
+func (fw *formatWriter) textLinePosition(source []byte, cursor *commonmark.Cursor) (lineStart bool, lineDigits int) {
+	parent := cursor.Parent()
+	for i := cursor.Index() - 1; i >= 0; i-- {
+		prev := parent.Child(i).Inline()
+		switch prev.Kind() {
+		case commonmark.SoftLineBreakKind:
+			if fw.canBreak() && !isHTMLTagAt(parent, i-1) && !isHTMLTagAt(parent, i+1) {
+				// Written as a space or a line break chosen by flushWrap,
+				// which does not break lines before list markers.
+				return false, -1
+			}
+			return lineDigits == 0, lineDigits
+		case commonmark.HardLineBreakKind:
+			return lineDigits == 0, lineDigits
+		case commonmark.TextKind:
+			for _, c := range spanSlice(source, prev.Span()) {
+				if c < '0' || c > '9' {
+					return false, -1
+				}
+			}
+			lineDigits += prev.Span().Len()
+		default:
+			return false, -1
+		}
+	}
+	if parent.Block() == nil {
+		// Inside an inline container like emphasis,
+		// which has its own delimiters at the start.
+		return false, -1
+	}
+	return lineDigits == 0, lineDigits
+}
+
+// isNextToRawHTML reports whether the cursor's node
+// has an HTML tag immediately before or after it.
+func isNextToRawHTML(cursor *commonmark.Cursor) bool {
+	parent := cursor.Parent()
+	return isHTMLTagAt(parent, cursor.Index()-1) || isHTMLTagAt(parent, cursor.Index()+1)
+}
+
+// startsContinuationLine reports whether the inline at the cursor
+// immediately follows a line break.
+func startsContinuationLine(cursor *commonmark.Cursor) bool {
+	i := cursor.Index() - 1
+	if i < 0 {
+		return false
+	}
+	k := cursor.Parent().Child(i).Inline().Kind()
+	return k == commonmark.SoftLineBreakKind || k == commonmark.HardLineBreakKind
+}
+
+// firstTagLine returns the first line of an [commonmark.HTMLTagKind] node.
+func firstTagLine(source []byte, tag *commonmark.Inline) []byte {
+	if tag.ChildCount() > 0 {
+		return spanSlice(source, tag.Child(0).Span())
+	}
+	return spanSlice(source, tag.Span())
+}
+
+// interruptsParagraph reports whether line would start a new block
+// if it followed a paragraph line.
+func interruptsParagraph(line []byte) bool {
+	src := make([]byte, 0, len(line)+3)
+	src = append(src, "x\n"...)
+	src = append(src, line...)
+	src = append(src, '\n')
+	blocks, _ := commonmark.Parse(src)
+	return len(blocks) != 1 || blocks[0].Kind() != commonmark.ParagraphKind
+}
+
+// isHTMLTagAt reports whether the i'th child of parent
+// is an [commonmark.HTMLTagKind] node.
+func isHTMLTagAt(parent commonmark.Node, i int) bool {
+	return 0 <= i && i < parent.ChildCount() && parent.Child(i).Inline().Kind() == commonmark.HTMLTagKind
+}
+
+// emphasisDelimiter returns the delimiter run on each side
+// of an [commonmark.EmphasisKind] or [commonmark.StrongKind] node.
+func emphasisDelimiter(inline *commonmark.Inline) string {
+	return strings.Repeat(string(inline.DelimiterChar()), inline.DelimiterRun())
+}
+
+// isATXHeading reports whether b is written as an ATX heading.
+// Setext headings can only express levels 1 and 2,
+// so deeper setext headings (e.g. from [*commonmark.Block.SetHeadingLevel])
+// are written as ATX headings.
+func isATXHeading(b *commonmark.Block) bool {
+	switch b.Kind() {
+	case commonmark.ATXHeadingKind:
+		return true
+	case commonmark.SetextHeadingKind:
+		return b.HeadingLevel() > 2
+	default:
+		return false
+	}
+}
+
 func isShortcutLinkOrImage(inline *commonmark.Inline) bool {
-	if k := inline.Kind(); k != commonmark.LinkKind && k != commonmark.ImageKind || inline.ChildCount() == 0 {
+	if !inline.IsLinkOrImage() || inline.ChildCount() == 0 {
 		return false
 	}
 	last := inline.Child(inline.ChildCount() - 1)
@@ -307,22 +904,44 @@ func isShortcutLinkOrImage(inline *commonmark.Inline) bool {
 
 const codeBlockIndentLimit = 4
 
-func codeFenceChar(source []byte, block *commonmark.Block) byte {
-	info := block.InfoString()
-	if info == nil {
-		return '`'
-	}
-	s := spanSlice(source, info.Span())
-	if bytes.ContainsRune(s, '`') {
+// maxListItemNumberDigits is the maximum number of digits
+// in an [ordered list marker].
+//
+// [ordered list marker]: https://spec.commonmark.org/0.30/#ordered-list-marker
+const maxListItemNumberDigits = 9
+
+// tabStopSize is the multiple of columns that a [tab] advances to.
+//
+// [tab]: https://spec.commonmark.org/0.30/#tabs
+const tabStopSize = 4
+
+// codeFenceChar returns the character to use for the code fence of a code block.
+// Code blocks use the formatter's fence character if one was set.
+// Otherwise, fenced code blocks keep their original fence character
+// and indented code blocks use backticks.
+// Tildes are always used if the info string contains a backtick.
+func (fw *formatWriter) codeFenceChar(source []byte, block *commonmark.Block) byte {
+	if info := block.InfoString(); info != nil && bytes.ContainsRune(spanSlice(source, info.Span()), '`') {
 		return '~'
-	} else {
-		return '`'
 	}
+	if fw.fenceChar != 0 {
+		return fw.fenceChar
+	}
+	if c := block.FenceChar(); c != 0 {
+		return c
+	}
+	return '`'
 }
 
-func codeFenceLength(source []byte, block *commonmark.Block) int {
-	fence := codeFenceChar(source, block)
-	minFence := 3 - 1
+// codeFenceLength returns the number of fence characters
+// to use for the code fence of a code block.
+// The result is at least the formatter's minimum fence length
+// and is longer than any line of fence characters in the block's content.
+// If the formatter does not have a fence character set,
+// then the result is also at least the length of the block's original fence.
+func (fw *formatWriter) codeFenceLength(source []byte, block *commonmark.Block) int {
+	fence := fw.codeFenceChar(source, block)
+	minFence := fw.minFenceLength - 1
 	state := -1 // -1 = start of line, 0 = not a fence-like line
 	indent := 0
 	for i, n := 0, block.ChildCount(); i < n; i++ {
@@ -339,11 +958,12 @@ func codeFenceLength(source []byte, block *commonmark.Block) int {
 							state = 0
 						}
 					}
-				case '\n':
+				case '\n', '\r':
 					if state > minFence {
 						minFence = state
 					}
 					state = -1
+					indent = 0
 				case fence:
 					if state < 0 {
 						state = 1
@@ -359,6 +979,7 @@ func codeFenceLength(source []byte, block *commonmark.Block) int {
 				minFence = state
 			}
 			state = -1
+			indent = 0
 		case commonmark.IndentKind:
 			if state == -1 {
 				indent += inl.IndentWidth()
@@ -368,14 +989,64 @@ func codeFenceLength(source []byte, block *commonmark.Block) int {
 			}
 		}
 	}
+	if n := block.FenceLength(); fw.fenceChar == 0 && n > minFence+1 && block.FenceChar() == fence {
+		return n
+	}
 	return minFence + 1
 }
 
+// formatWriter writes lines of Markdown prefixed by the current indentation.
+//
+// Outside of verbatim mode, formatWriter enforces the formatter's whitespace policy:
+// trailing spaces and tabs are removed from every line,
+// runs of blank lines are collapsed into a single blank line,
+// and blank lines are not written at the beginning or end of the document.
+// Blank lines are deferred until the next line of content is written,
+// so they use the indentation of the content that follows them.
 type formatWriter struct {
 	w           stringWriter
 	indents     []string
 	startedLine bool
 
+	// verbatim is true while writing content
+	// whose whitespace must be preserved byte-for-byte,
+	// like the contents of a code block.
+	verbatim bool
+	// pendingSpace is horizontal whitespace at the end of the current line
+	// that has not been written yet.
+	pendingSpace string
+	// pendingBlank is true if a blank line should be written
+	// before the next line of content.
+	pendingBlank bool
+	// afterCR is true if the last string written ended in a carriage return.
+	afterCR bool
+	// lineEnding is written at the end of each line.
+	lineEnding string
+
+	listNumbering           ListNumbering
+	preserveLinkLabelCase   bool
+	preserveReferenceLabels bool
+	preserveHardBreakStyle  bool
+	compactHeadings         bool
+	// afterHeading is true if the last block written was a heading.
+	afterHeading bool
+	// fenceChar is the character to use for code fences
+	// or zero to keep each block's original character.
+	fenceChar byte
+	// minFenceLength is the minimum number of characters in a code fence.
+	minFenceLength int
+
+	// wrapWidth is the maximum width of paragraph lines
+	// or zero if paragraphs should not be wrapped.
+	wrapWidth int
+	// wrapping is true while a paragraph's content is being buffered
+	// in wrapTokens to be laid out by flushWrap.
+	wrapping bool
+	// noBreak is greater than zero
+	// while writing content whose spaces should not be used as line breaks.
+	noBreak    int
+	wrapTokens []wrapToken
+
 	hasWritten bool
 	err        error
 }
@@ -383,9 +1054,9 @@ type formatWriter struct {
 func newFormatWriter(w io.Writer) *formatWriter {
 	sw, ok := w.(stringWriter)
 	if !ok {
-		return &formatWriter{w: fallbackStringWriter{w}}
+		sw = fallbackStringWriter{w}
 	}
-	return &formatWriter{w: sw}
+	return &formatWriter{w: sw, lineEnding: "\n", minFenceLength: 3}
 }
 
 func (fw *formatWriter) push(indent string) {
@@ -401,53 +1072,242 @@ func (fw *formatWriter) b(p []byte) {
 	fw.s(string(p))
 }
 
+// verbatimBytes writes p, preserving all of its whitespace.
+func (fw *formatWriter) verbatimBytes(p []byte) {
+	prev := fw.verbatim
+	fw.verbatim = true
+	fw.b(p)
+	fw.verbatim = prev
+}
+
 func (fw *formatWriter) s(s string) {
-	if fw.err != nil {
-		return
+	// Normalize line endings to LF.
+	if fw.afterCR && strings.HasPrefix(s, "\n") {
+		s = s[1:]
+		fw.afterCR = false
+	}
+	if len(s) > 0 {
+		fw.afterCR = strings.HasSuffix(s, "\r")
+	}
+	if strings.IndexByte(s, '\r') >= 0 {
+		s = strings.ReplaceAll(s, "\r\n", "\n")
+		s = strings.ReplaceAll(s, "\r", "\n")
 	}
 
-	for {
+	for fw.err == nil {
 		i := strings.IndexByte(s, '\n')
 		if i == -1 {
-			break
-		}
-		fw.hasWritten = true
-		if !fw.startedLine {
-			if i == 0 {
-				// For blank lines: don't leave trailing whitespace.
-				if fw.err = writeTrimmedIndent(fw.w, fw.indents); fw.err != nil {
-					return
-				}
-				if _, fw.err = fw.w.WriteString("\n"); fw.err != nil {
-					return
-				}
-				s = s[1:]
-				continue
-			}
-
-			if fw.err = writeStrings(fw.w, fw.indents); fw.err != nil {
-				return
-			}
-		}
-
-		if _, fw.err = fw.w.WriteString(s[:i+1]); fw.err != nil {
+			fw.text(s)
 			return
 		}
-		fw.startedLine = false
+		fw.text(s[:i])
+		fw.newline()
 		s = s[i+1:]
 	}
+}
 
-	if len(s) == 0 {
+// text writes a string that does not contain a line ending.
+func (fw *formatWriter) text(s string) {
+	if fw.err != nil || len(s) == 0 {
 		return
 	}
-	fw.hasWritten = true
+	if fw.wrapping {
+		fw.wrapTokens = append(fw.wrapTokens, wrapToken{
+			kind:     wrapText,
+			s:        s,
+			verbatim: fw.verbatim,
+		})
+		return
+	}
+	if fw.verbatim {
+		s, fw.pendingSpace = fw.pendingSpace+s, ""
+	} else {
+		content := strings.TrimRight(s, " \t")
+		if len(content) == 0 {
+			fw.pendingSpace += s
+			return
+		}
+		s, fw.pendingSpace = fw.pendingSpace+content, s[len(content):]
+	}
 	if !fw.startedLine {
-		if fw.err = writeStrings(fw.w, fw.indents); fw.err != nil {
+		if fw.pendingBlank {
+			fw.pendingBlank = false
+			fw.blankLine()
+		}
+		if fw.err == nil {
+			fw.err = writeStrings(fw.w, fw.indents)
+		}
+		if fw.err != nil {
 			return
 		}
+		fw.startedLine = true
 	}
+	fw.hasWritten = true
 	_, fw.err = fw.w.WriteString(s)
-	fw.startedLine = true
+}
+
+// newline ends the current line.
+func (fw *formatWriter) newline() {
+	if fw.err != nil {
+		return
+	}
+	if fw.wrapping {
+		fw.wrapTokens = append(fw.wrapTokens, wrapToken{kind: wrapNewline})
+		return
+	}
+	fw.pendingSpace = ""
+	switch {
+	case fw.startedLine:
+		_, fw.err = fw.w.WriteString(fw.lineEnding)
+		fw.startedLine = false
+	case !fw.verbatim:
+		if fw.hasWritten {
+			fw.pendingBlank = true
+		}
+	default:
+		if fw.pendingBlank {
+			fw.pendingBlank = false
+			fw.blankLine()
+		}
+		fw.blankLine()
+		fw.hasWritten = true
+	}
+}
+
+// blankLine writes a blank line using the current indentation.
+func (fw *formatWriter) blankLine() {
+	if fw.err != nil {
+		return
+	}
+	// For blank lines: don't leave trailing whitespace.
+	if fw.err = writeTrimmedIndent(fw.w, fw.indents); fw.err != nil {
+		return
+	}
+	_, fw.err = fw.w.WriteString(fw.lineEnding)
+}
+
+// finish ends the document with a single line ending.
+// Any pending blank lines are discarded.
+func (fw *formatWriter) finish() {
+	fw.pendingSpace = ""
+	fw.pendingBlank = false
+	if fw.err == nil && fw.startedLine {
+		_, fw.err = fw.w.WriteString(fw.lineEnding)
+		fw.startedLine = false
+	}
+}
+
+// canBreak reports whether a space written now may be replaced by a line break.
+func (fw *formatWriter) canBreak() bool {
+	return fw.wrapping && fw.noBreak == 0
+}
+
+// breakOpportunity writes a space that may be replaced by a line break.
+// Consecutive break opportunities are written as a single space
+// so that the layout does not depend on how the input was wrapped.
+// It must only be called if canBreak returns true.
+func (fw *formatWriter) breakOpportunity() {
+	if n := len(fw.wrapTokens); n > 0 && fw.wrapTokens[n-1].kind == wrapSpace {
+		return
+	}
+	fw.wrapTokens = append(fw.wrapTokens, wrapToken{kind: wrapSpace})
+}
+
+// atWrapLineStart reports whether the next token buffered for wrapping
+// will start a line.
+func (fw *formatWriter) atWrapLineStart() bool {
+	n := len(fw.wrapTokens)
+	return n == 0 || fw.wrapTokens[n-1].kind == wrapNewline
+}
+
+// flushWrap ends buffering of a paragraph
+// and writes its content with lines broken at wrapWidth where possible.
+func (fw *formatWriter) flushWrap() {
+	tokens := fw.wrapTokens
+	fw.wrapping = false
+	fw.wrapTokens = fw.wrapTokens[:0]
+
+	indentWidth := 0
+	for _, indent := range fw.indents {
+		indentWidth += columnWidth(indentWidth, indent)
+	}
+	col := indentWidth
+	lineEmpty := true
+	space := false
+	// If the first line starts with raw HTML,
+	// breaking it could turn the paragraph into an HTML block.
+	firstLineHTML := len(tokens) > 0 && tokens[0].kind == wrapText && strings.HasPrefix(tokens[0].s, "<")
+	for i := 0; i < len(tokens); {
+		switch tokens[i].kind {
+		case wrapSpace:
+			space = !lineEmpty
+			i++
+		case wrapNewline:
+			fw.newline()
+			col = indentWidth
+			lineEmpty = true
+			space = false
+			firstLineHTML = false
+			i++
+		case wrapText:
+			// Words are runs of text between break opportunities.
+			start := i
+			word := tokens[i].s
+			for i++; i < len(tokens) && tokens[i].kind == wrapText; i++ {
+				word += tokens[i].s
+			}
+			if space && !firstLineHTML && col+1+columnWidth(col+1, word) > fw.wrapWidth && canStartLine(word) {
+				fw.newline()
+				col = indentWidth
+				space = false
+			}
+			if space {
+				fw.text(" ")
+				col++
+			}
+			col += columnWidth(col, word)
+			for _, tok := range tokens[start:i] {
+				fw.verbatim = tok.verbatim
+				fw.text(tok.s)
+			}
+			fw.verbatim = false
+			lineEmpty = false
+			space = false
+		}
+	}
+}
+
+// canStartLine reports whether a paragraph continuation line
+// can start with the given word without changing the document's structure.
+func canStartLine(word string) bool {
+	if word == "" {
+		return false
+	}
+	switch c := word[0]; {
+	case strings.IndexByte("<>-+*#=_`~", c) >= 0:
+		// Could start a block or be a setext heading underline.
+		return false
+	case '0' <= c && c <= '9':
+		// Could start an ordered list.
+		end := strings.IndexFunc(word, func(r rune) bool { return r < '0' || r > '9' })
+		return end < 0 || (word[end] != '.' && word[end] != ')')
+	default:
+		return true
+	}
+}
+
+// columnWidth returns the number of columns that s occupies
+// when it starts at the given column.
+func columnWidth(start int, s string) int {
+	end := start
+	for _, r := range s {
+		if r == '\t' {
+			end += tabStopSize - end%tabStopSize
+		} else {
+			end++
+		}
+	}
+	return end - start
 }
 
 func writeStrings(w io.StringWriter, slice []string) error {
@@ -483,6 +1343,24 @@ func writeTrimmedIndent(w io.StringWriter, indents []string) error {
 	return err
 }
 
+type wrapTokenKind int8
+
+const (
+	// wrapText is text that must not be broken across lines.
+	wrapText wrapTokenKind = 1 + iota
+	// wrapSpace is a single space that may be replaced by a line break.
+	wrapSpace
+	// wrapNewline is a line break that must be preserved.
+	wrapNewline
+)
+
+type wrapToken struct {
+	kind wrapTokenKind
+	s    string // only used for wrapText
+	// verbatim is true if a wrapText token's whitespace must be preserved.
+	verbatim bool
+}
+
 type stringWriter interface {
 	io.Writer
 	io.StringWriter
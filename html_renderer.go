@@ -41,6 +41,9 @@ import (
 //
 //   - The resulting HTML can be sent through an HTML sanitizer.
 //     This is highly recommended.
+//     [RenderHTMLSafe] applies a minimal allow-list sanitizer,
+//     but a dedicated sanitizer library may be more appropriate
+//     for complex policies.
 //   - Set IgnoreRaw to prevent inclusion of raw HTML.
 //     This eliminates any raw HTML usage,
 //     so the output is guaranteed to use a fixed set of elements
@@ -60,16 +63,142 @@ type HTMLRenderer struct {
 	ReferenceMap ReferenceMap
 	// SoftBreakBehavior determines how soft line breaks are rendered.
 	SoftBreakBehavior SoftBreakBehavior
+	// BlockSeparator is the string that Render writes between top-level blocks.
+	// If BlockSeparator is empty, then "\n\n" is used.
+	// To write blocks without any separator, call [*HTMLRenderer.AppendBlock] for each block.
+	BlockSeparator string
+	// If TrailingNewline is true, then Render ends its output with a newline
+	// if it rendered any blocks and the last block did not end with one.
+	TrailingNewline bool
 	// If IgnoreRaw is true, the renderer skips any HTML blocks or raw HTML.
 	IgnoreRaw bool
+	// RenderBlockHook, if not nil, is called to render each block,
+	// including blocks nested inside other blocks.
+	// The hook should write the HTML for b to w.
+	// source is the Source of the [RootBlock] that contains b.
+	// Calling defaultRender writes the HTML that the renderer would produce
+	// without the hook to w.
+	// Any blocks nested inside b are passed to the hook during defaultRender.
+	// If the hook returns an error, then rendering stops
+	// and [*HTMLRenderer.Render] returns the error.
+	// w is only valid until the hook returns.
+	RenderBlockHook func(w io.Writer, source []byte, b *Block, defaultRender func()) error
+	// RenderInlineHook, if not nil, is called to render each inline node,
+	// including nodes nested inside other inline nodes.
+	// It behaves like RenderBlockHook, but for [Inline] nodes.
+	RenderInlineHook func(w io.Writer, source []byte, i *Inline, defaultRender func()) error
+	// If XHTML is true, then the renderer writes void elements
+	// (<br>, <hr>, and <img>) in XHTML style, like "<br />".
+	// Raw HTML is not modified.
+	XHTML bool
 	// FilterTag is a predicate function
 	// that reports whether an element with the given lowercased tag name
 	// should have its leading angle bracket escaped.
 	// If FilterTag is nil, then no filtering will occur.
+	// [FilterTagGFM] is available for GitHub Flavored Markdown-compatible filtering.
+	// FilterTag applies to both HTML blocks and inline raw HTML.
 	//
 	// FilterTag functions must not modify the byte slice
 	// nor retain the slice after the function returns.
 	FilterTag func(tag []byte) bool
+	// AttributeFilter is a function that is called
+	// for each attribute of each start tag in raw HTML
+	// with the lowercased tag name, the lowercased attribute name,
+	// and the attribute's value with any character references decoded.
+	// If keep is false, then the attribute is omitted.
+	// Otherwise, if newValue differs from value,
+	// then the attribute's value is replaced with newValue.
+	// Attributes are split the same way that a web browser would,
+	// but a tag that is not closed within a single HTML block or inline tag
+	// is only filtered up to the end of the block or inline tag.
+	// If AttributeFilter is nil, then attributes are not changed.
+	AttributeFilter func(tag, attr, value string) (newValue string, keep bool)
+	// ResolveWikiLink is called with the target of each [WikiLinkKind] node
+	// to obtain the URL that the link should point to.
+	// If ResolveWikiLink is nil or returns false,
+	// then the wiki link is considered broken.
+	ResolveWikiLink func(target string) (href string, ok bool)
+	// If BrokenWikiLinksAsText is true,
+	// then broken wiki links are rendered as their display text.
+	// Otherwise, broken wiki links are rendered
+	// as <a class="broken"> elements without an href attribute.
+	BrokenWikiLinksAsText bool
+	// If SourcePos is true, then the renderer adds a data-sourcepos attribute
+	// to the elements it produces for blocks
+	// (paragraphs, headings, code blocks, block quotes, lists, list items,
+	// and thematic breaks)
+	// in the form "startLine:startColumn-endLine:endColumn".
+	// Lines are numbered from the beginning of the original source,
+	// starting with [RootBlock.StartLine].
+	// Columns are 1-based byte offsets from the beginning of the line,
+	// so tabs and multi-byte characters are not expanded.
+	// The end position is inclusive and excludes trailing whitespace.
+	// Positions are only written by [*HTMLRenderer.Render],
+	// [*HTMLRenderer.RenderSafe], and [*HTMLRenderer.AppendBlock].
+	// [*HTMLRenderer.RenderSafe] removes the attribute
+	// unless the policy permits "data-sourcepos".
+	SourcePos bool
+	// If Nonce is not empty, then the renderer adds a nonce attribute
+	// with the given value to every <script> and <style> start tag
+	// in HTML blocks and inline raw HTML,
+	// replacing any nonce attribute already present.
+	// This permits the elements under a [Content Security Policy]
+	// that uses the same nonce.
+	// Since this allows any scripts in the document to run,
+	// Nonce should only be used with trusted inputs.
+	//
+	// [Content Security Policy]: https://developer.mozilla.org/en-US/docs/Web/HTTP/CSP
+	Nonce string
+	// CodeWrapper, if not nil, is called for each code block
+	// with the first word of the block's info string
+	// (with backslash escapes and character references resolved)
+	// or the empty string if the block has no info string.
+	// The returned openHTML and closeHTML are written verbatim
+	// in place of the <pre><code> start tags and the </code></pre> end tags, respectively,
+	// so they must escape lang if they include it.
+	// The code block's contents are still escaped as usual.
+	// CodeWrapper output does not include the data-sourcepos attribute
+	// added by SourcePos nor is it subject to FilterTag.
+	CodeWrapper func(lang string) (openHTML, closeHTML string)
+	// CodeBlockClassPrefix is prepended to the first word of a code block's info string
+	// to form the class of the block's <code> element.
+	// If CodeBlockClassPrefix is empty, then "language-" is used.
+	CodeBlockClassPrefix string
+	// CodeBlockAttributes, if not nil, is called for each code block
+	// to obtain additional attributes for the block's <code> element.
+	// source is the Source of the [RootBlock] that contains block.
+	// The values of "class" attributes are added to the element's class list.
+	// Attributes whose keys are not valid HTML attribute names are skipped.
+	// CodeBlockClassPrefix and CodeBlockAttributes are not used
+	// if CodeWrapper is not nil.
+	CodeBlockAttributes func(source []byte, block *Block) []HTMLAttr
+	// If RenderLinkDefs is true, then [*HTMLRenderer.Render]
+	// appends a <dl> element after all other content,
+	// separated from it by BlockSeparator,
+	// that lists the document's link reference definitions in source order.
+	// Each definition is rendered as a <dt> element containing the label in brackets
+	// and a <dd> element containing a link to the destination
+	// followed by the title, if present.
+	// Definitions whose labels were already defined earlier in the document are omitted,
+	// since they are never used.
+	// Link reference definitions are otherwise not rendered.
+	RenderLinkDefs bool
+	// If FigureImages is true, then a paragraph whose only content is an image
+	// is rendered as a <figure> element instead of a <p> element.
+	// If the image has a non-empty title,
+	// then the title (with backslash escapes and character references resolved)
+	// is written in a <figcaption> element after the image.
+	// Paragraphs in tight lists are not affected.
+	FigureImages bool
+}
+
+// HTMLAttr is an attribute that [HTMLRenderer] adds to an element.
+type HTMLAttr struct {
+	// Key is the attribute's name.
+	Key string
+	// Val is the attribute's value without any escaping.
+	// The renderer escapes the value when writing it.
+	Val string
 }
 
 // RenderHTML writes the given sequence of parsed blocks
@@ -84,13 +213,46 @@ func RenderHTML(w io.Writer, blocks []*RootBlock, refMap ReferenceMap) error {
 // to the given writer as HTML.
 // It will return the first error encountered, if any.
 func (r *HTMLRenderer) Render(w io.Writer, blocks []*RootBlock) error {
+	sep := r.BlockSeparator
+	if sep == "" {
+		sep = "\n\n"
+	}
+	var defs []byte
+	if r.RenderLinkDefs {
+		defs = r.appendLinkDefinitions(nil, blocks)
+	}
 	var buf []byte
+	// lastEmpty is true if the last block rendered to nothing,
+	// so the output already ends with a separator (if anything).
+	lastEmpty := true
 	for i, b := range blocks {
 		buf = buf[:0]
 		if i > 0 {
-			buf = append(buf, "\n\n"...)
+			buf = append(buf, sep...)
+		}
+		start := len(buf)
+		var err error
+		buf, err = r.appendBlock(buf, b)
+		if err != nil {
+			return fmt.Errorf("render markdown to html: %w", err)
+		}
+		lastEmpty = len(buf) == start
+		if r.TrailingNewline && i == len(blocks)-1 && len(defs) == 0 && !bytes.HasSuffix(buf, []byte("\n")) {
+			buf = append(buf, '\n')
+		}
+		if _, err := w.Write(buf); err != nil {
+			return fmt.Errorf("render markdown to html: %w", err)
+		}
+	}
+	if len(defs) > 0 {
+		buf = buf[:0]
+		if !lastEmpty {
+			buf = append(buf, sep...)
+		}
+		buf = append(buf, defs...)
+		if r.TrailingNewline {
+			buf = append(buf, '\n')
 		}
-		buf = r.AppendBlock(buf, b)
 		if _, err := w.Write(buf); err != nil {
 			return fmt.Errorf("render markdown to html: %w", err)
 		}
@@ -98,33 +260,109 @@ func (r *HTMLRenderer) Render(w io.Writer, blocks []*RootBlock) error {
 	return nil
 }
 
-// AppendBlock appends the rendered HTML of a fully parsed block to dst
+// appendLinkDefinitions appends a <dl> element
+// listing the link reference definitions in blocks to dst
 // and returns the resulting byte slice.
-func (r *HTMLRenderer) AppendBlock(dst []byte, block *RootBlock) []byte {
+// If blocks do not contain any link reference definitions,
+// then appendLinkDefinitions returns dst unchanged.
+func (r *HTMLRenderer) appendLinkDefinitions(dst []byte, blocks []*RootBlock) []byte {
 	state := &renderState{
 		HTMLRenderer: r,
 		dst:          dst,
 	}
-	Walk(block.AsNode(), &WalkOptions{
-		Pre: func(c *Cursor) bool {
-			if b := c.Node().Block(); b != nil {
-				return state.preBlock(block.Source, c)
+	seen := make(map[string]struct{})
+	for _, root := range blocks {
+		stack := []*Block{&root.Block}
+		for len(stack) > 0 {
+			block := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if block.Kind() != LinkReferenceDefinitionKind {
+				for i := len(block.blockChildren) - 1; i >= 0; i-- {
+					stack = append(stack, block.blockChildren[i])
+				}
+				continue
 			}
-			if i := c.Node().Inline(); i != nil {
-				return state.preInline(block.Source, i)
+			label := block.inlineChildren[0]
+			if _, dup := seen[label.LinkReference()]; label.LinkReference() == "" || dup {
+				// Only the first definition of a label is used.
+				continue
 			}
-			return true
-		},
-		Post: func(c *Cursor) bool {
-			if b := c.Node().Block(); b != nil {
-				return state.postBlock(block.Source, c)
-			}
-			if i := c.Node().Inline(); i != nil {
-				return state.postInline(block.Source, i)
+			seen[label.LinkReference()] = struct{}{}
+			if len(seen) == 1 {
+				state.openTag(atom.Dl)
 			}
-			return true
-		},
-	})
+			state.linkDefinition(root.Source, block)
+		}
+	}
+	if len(seen) > 0 {
+		state.closeTag(atom.Dl)
+	}
+	return state.dst
+}
+
+// linkDefinition writes the <dt> and <dd> elements
+// for a [LinkReferenceDefinitionKind] block.
+func (r *renderState) linkDefinition(source []byte, block *Block) {
+	r.openTag(atom.Dt)
+	r.dst = append(r.dst, '[')
+	r.dst = escapeHTML(r.dst, spanSlice(source, block.inlineChildren[0].Span()))
+	r.dst = append(r.dst, ']')
+	r.closeTag(atom.Dt)
+
+	r.openTag(atom.Dd)
+	destination := block.inlineChildren[1].Text(source)
+	r.openTagAttr(atom.A)
+	r.dst = append(r.dst, ` href="`...)
+	r.dst = append(r.dst, html.EscapeString(NormalizeURI(destination))...)
+	r.dst = append(r.dst, `">`...)
+	r.dst = append(r.dst, html.EscapeString(destination)...)
+	r.closeTag(atom.A)
+	if len(block.inlineChildren) > 2 {
+		r.dst = append(r.dst, " \u2014 "...)
+		r.dst = append(r.dst, html.EscapeString(block.inlineChildren[2].Text(source))...)
+	}
+	r.closeTag(atom.Dd)
+}
+
+// AppendBlock appends the rendered HTML of a fully parsed block to dst
+// and returns the resulting byte slice.
+// If RenderBlockHook or RenderInlineHook returns an error,
+// then AppendBlock returns the HTML rendered before the error.
+// Use [*HTMLRenderer.Render] to observe such errors.
+func (r *HTMLRenderer) AppendBlock(dst []byte, block *RootBlock) []byte {
+	dst, _ = r.appendBlock(dst, block)
+	return dst
+}
+
+// appendBlock appends the rendered HTML of a fully parsed block to dst
+// and returns the resulting byte slice
+// along with the first error returned by a hook, if any.
+func (r *HTMLRenderer) appendBlock(dst []byte, block *RootBlock) ([]byte, error) {
+	state := &renderState{
+		HTMLRenderer: r,
+		dst:          dst,
+	}
+	if r.SourcePos {
+		state.lines = newLineIndex(block)
+	}
+	state.walkBlock(block.Source, &block.Block, nil, true)
+	return state.dst, state.err
+}
+
+// AppendInlines appends the rendered HTML of inline nodes to dst
+// and returns the resulting byte slice.
+// Spans in the inline nodes are relative to source.
+// AppendInlines is typically used with the result of [ParseInline].
+// If RenderInlineHook returns an error,
+// then AppendInlines returns the HTML rendered before the error.
+func (r *HTMLRenderer) AppendInlines(dst []byte, source []byte, inlines []*Inline) []byte {
+	state := &renderState{
+		HTMLRenderer: r,
+		dst:          dst,
+	}
+	for _, inline := range inlines {
+		state.walkInline(source, inline, true)
+	}
 	return state.dst
 }
 
@@ -132,6 +370,28 @@ type renderState struct {
 	*HTMLRenderer
 	dst      []byte
 	lowerBuf []byte
+	rawBuf   []byte
+	// lines is non-nil if the renderer should write source positions.
+	lines *lineIndex
+	// codeClose is the closing HTML returned by CodeWrapper
+	// for the code block being rendered.
+	codeClose string
+	// err is the first error returned by a hook.
+	err error
+}
+
+// Write appends p to the rendered HTML.
+// It is used as the [io.Writer] passed to hooks.
+func (r *renderState) Write(p []byte) (int, error) {
+	r.dst = append(r.dst, p...)
+	return len(p), nil
+}
+
+// setErr records err if it is the first error returned by a hook.
+func (r *renderState) setErr(err error) {
+	if r.err == nil {
+		r.err = err
+	}
 }
 
 func (r *renderState) openTagAttr(name atom.Atom) {
@@ -150,6 +410,56 @@ func (r *renderState) openTag(name atom.Atom) {
 	r.dst = append(r.dst, '>')
 }
 
+// openBlockTag writes a start tag for the element that represents block.
+func (r *renderState) openBlockTag(name atom.Atom, source []byte, block *Block) {
+	r.openTagAttr(name)
+	r.sourcePosAttr(source, block)
+	r.dst = append(r.dst, '>')
+}
+
+// sourcePosAttr writes a data-sourcepos attribute for block
+// if source positions are enabled.
+func (r *renderState) sourcePosAttr(source []byte, block *Block) {
+	if r.lines == nil {
+		return
+	}
+	span := block.Span()
+	if !span.IsValid() {
+		return
+	}
+	last := span.End - 1
+	for last > span.Start && isSpaceTabOrLineEnding(source[last]) {
+		last--
+	}
+	startLine, startCol := r.lines.position(span.Start)
+	endLine, endCol := r.lines.position(last)
+	r.dst = append(r.dst, ` data-sourcepos="`...)
+	r.dst = strconv.AppendInt(r.dst, int64(startLine), 10)
+	r.dst = append(r.dst, ':')
+	r.dst = strconv.AppendInt(r.dst, int64(startCol), 10)
+	r.dst = append(r.dst, '-')
+	r.dst = strconv.AppendInt(r.dst, int64(endLine), 10)
+	r.dst = append(r.dst, ':')
+	r.dst = strconv.AppendInt(r.dst, int64(endCol), 10)
+	r.dst = append(r.dst, '"')
+}
+
+// closeVoidTag ends a start tag begun with openTagAttr
+// for an element that has no end tag.
+func (r *renderState) closeVoidTag() {
+	if r.XHTML {
+		r.dst = append(r.dst, " />"...)
+	} else {
+		r.dst = append(r.dst, '>')
+	}
+}
+
+func (r *renderState) hardLineBreak() {
+	r.dst = append(r.dst, "<br"...)
+	r.closeVoidTag()
+	r.dst = append(r.dst, '\n')
+}
+
 func (r *renderState) closeTag(name atom.Atom) {
 	const prefix = "</"
 	start := len(r.dst)
@@ -163,15 +473,119 @@ func (r *renderState) closeTag(name atom.Atom) {
 	r.dst = append(r.dst, '>')
 }
 
-func (r *renderState) preBlock(source []byte, cursor *Cursor) bool {
-	block := cursor.Node().Block()
+// walkBlock renders a block and its descendants.
+// parent is the block's parent, if any.
+// If hookRoot is false, then block is rendered without calling RenderBlockHook,
+// but its descendants are still passed to the hook.
+func (r *renderState) walkBlock(source []byte, block *Block, parent *Block, hookRoot bool) {
+	Walk(block.AsNode(), &WalkOptions{
+		Pre: func(c *Cursor) bool {
+			if r.err != nil {
+				return false
+			}
+			if b := c.Node().Block(); b != nil {
+				p := c.Parent().Block()
+				if c.Index() < 0 {
+					p = parent
+				}
+				if p.Kind() == DirectiveBlockKind && c.Index() > 0 {
+					// Directives render only their contents,
+					// so separate them like sibling blocks.
+					r.dst = append(r.dst, '\n')
+				}
+				if r.RenderBlockHook != nil && (c.Index() >= 0 || hookRoot) {
+					r.hookBlock(source, b, p)
+					return false
+				}
+				return r.preBlock(source, b, p)
+			}
+			if i := c.Node().Inline(); i != nil {
+				if r.RenderInlineHook != nil {
+					r.hookInline(source, i)
+					return false
+				}
+				return r.preInline(source, i)
+			}
+			return true
+		},
+		Post: func(c *Cursor) bool {
+			if r.err != nil {
+				return false
+			}
+			if b := c.Node().Block(); b != nil {
+				p := c.Parent().Block()
+				if c.Index() < 0 {
+					p = parent
+				}
+				return r.postBlock(source, b, p)
+			}
+			if i := c.Node().Inline(); i != nil {
+				return r.postInline(source, i)
+			}
+			return true
+		},
+	})
+}
+
+// hookBlock renders a block with RenderBlockHook.
+func (r *renderState) hookBlock(source []byte, block *Block, parent *Block) {
+	err := r.RenderBlockHook(r, source, block, func() {
+		r.walkBlock(source, block, parent, false)
+	})
+	if err != nil {
+		r.setErr(err)
+	}
+}
+
+// walkInline renders an inline node and its descendants.
+// If hookRoot is false, then inline is rendered without calling RenderInlineHook,
+// but its descendants are still passed to the hook.
+func (r *renderState) walkInline(source []byte, inline *Inline, hookRoot bool) {
+	Walk(inline.AsNode(), &WalkOptions{
+		Pre: func(c *Cursor) bool {
+			if r.err != nil {
+				return false
+			}
+			i := c.Node().Inline()
+			if r.RenderInlineHook != nil && (c.Index() >= 0 || hookRoot) {
+				r.hookInline(source, i)
+				return false
+			}
+			return r.preInline(source, i)
+		},
+		Post: func(c *Cursor) bool {
+			if r.err != nil {
+				return false
+			}
+			return r.postInline(source, c.Node().Inline())
+		},
+	})
+}
+
+// hookInline renders an inline node with RenderInlineHook.
+func (r *renderState) hookInline(source []byte, inline *Inline) {
+	err := r.RenderInlineHook(r, source, inline, func() {
+		r.walkInline(source, inline, false)
+	})
+	if err != nil {
+		r.setErr(err)
+	}
+}
+
+func (r *renderState) preBlock(source []byte, block *Block, parent *Block) bool {
 	switch block.Kind() {
 	case ParagraphKind:
-		if !cursor.Parent().Block().IsTightList() {
-			r.openTag(atom.P)
+		switch {
+		case parent.IsTightList():
+		case r.FigureImages && figureImage(block) != nil:
+			r.openBlockTag(atom.Figure, source, block)
+		default:
+			r.openBlockTag(atom.P, source, block)
 		}
 	case ThematicBreakKind:
-		r.openTag(atom.Hr)
+		r.openTagAttr(atom.Hr)
+		r.sourcePosAttr(source, block)
+		r.closeVoidTag()
 		return false
 	case ATXHeadingKind, SetextHeadingKind:
 		var tagName atom.Atom
@@ -189,27 +603,28 @@ func (r *renderState) preBlock(source []byte, cursor *Cursor) bool {
 		default:
 			tagName = atom.H6
 		}
-		r.openTag(tagName)
+		r.openBlockTag(tagName, source, block)
 	case IndentedCodeBlockKind, FencedCodeBlockKind:
-		r.openTag(atom.Pre)
-		r.openTagAttr(atom.Code)
-		if info := block.InfoString(); info != nil {
-			words := strings.Fields(info.Text(source))
-			if len(words) > 0 {
-				r.dst = append(r.dst, ` class="language-`...)
-				r.dst = append(r.dst, html.EscapeString(words[0])...)
-				r.dst = append(r.dst, `"`...)
-			}
+		lang := codeLanguage(source, block)
+		if r.CodeWrapper != nil {
+			var openHTML string
+			openHTML, r.codeClose = r.CodeWrapper(lang)
+			r.dst = append(r.dst, openHTML...)
+			return true
 		}
+		r.openBlockTag(atom.Pre, source, block)
+		r.openTagAttr(atom.Code)
+		r.codeBlockAttributes(source, block, lang)
 		r.dst = append(r.dst, ">"...)
 	case BlockQuoteKind:
-		r.openTag(atom.Blockquote)
+		r.openBlockTag(atom.Blockquote, source, block)
 	case ListKind:
 		var tagName atom.Atom
 		if block.IsOrderedList() {
 			tagName = atom.Ol
 			r.openTagAttr(tagName)
-			if n := block.firstChild().Block().ListItemNumber(source); n >= 0 && n != 1 {
+			r.sourcePosAttr(source, block)
+			if n := block.ListStartNumber(source); n >= 0 && n != 1 {
 				r.dst = append(r.dst, ` start="`...)
 				r.dst = strconv.AppendInt(r.dst, int64(n), 10)
 				r.dst = append(r.dst, `"`...)
@@ -217,25 +632,132 @@ func (r *renderState) preBlock(source []byte, cursor *Cursor) bool {
 			r.dst = append(r.dst, ">"...)
 		} else {
 			tagName = atom.Ul
-			r.openTag(tagName)
+			r.openBlockTag(tagName, source, block)
 		}
 	case ListItemKind:
-		r.openTag(atom.Li)
+		r.openBlockTag(atom.Li, source, block)
 	case HTMLBlockKind:
 		if r.IgnoreRaw {
 			return false
 		}
+		if r.rewritesAttributes() {
+			// Tags may span multiple lines.
+			r.filterRaw(r.collectRaw(source, block.AsNode()))
+			return false
+		}
+	case DirectiveBlockKind:
+		// Render the directive's contents only.
+		// RenderBlockHook can be used to render the directive itself.
 	default:
 		return false
 	}
 	return true
 }
 
-func (r *renderState) postBlock(source []byte, cursor *Cursor) bool {
-	block := cursor.Node().Block()
+// codeBlockAttributes writes the attributes of the <code> element for a code block.
+func (r *renderState) codeBlockAttributes(source []byte, block *Block, lang string) {
+	class := ""
+	if lang != "" {
+		prefix := r.CodeBlockClassPrefix
+		if prefix == "" {
+			prefix = "language-"
+		}
+		class = prefix + lang
+	}
+	var attrs []HTMLAttr
+	if r.CodeBlockAttributes != nil {
+		attrs = r.CodeBlockAttributes(source, block)
+	}
+	for _, attr := range attrs {
+		if attr.Key == "class" && attr.Val != "" {
+			if class != "" {
+				class += " "
+			}
+			class += attr.Val
+		}
+	}
+	if class != "" {
+		r.dst = append(r.dst, ` class="`...)
+		r.dst = append(r.dst, html.EscapeString(class)...)
+		r.dst = append(r.dst, `"`...)
+	}
+	for _, attr := range attrs {
+		if attr.Key == "class" || !isHTMLAttributeName(attr.Key) {
+			continue
+		}
+		r.dst = append(r.dst, ' ')
+		r.dst = append(r.dst, attr.Key...)
+		r.dst = append(r.dst, `="`...)
+		r.dst = append(r.dst, html.EscapeString(attr.Val)...)
+		r.dst = append(r.dst, `"`...)
+	}
+}
+
+// isHTMLAttributeName reports whether s matches the CommonMark grammar
+// for an [attribute name].
+//
+// [attribute name]: https://spec.commonmark.org/0.30/#attribute-name
+func isHTMLAttributeName(s string) bool {
+	if s == "" || !isASCIILetter(s[0]) && s[0] != '_' && s[0] != ':' {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if c := s[i]; !isASCIILetter(c) && !isASCIIDigit(c) && strings.IndexByte("_.:-", c) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// figureImage returns the image in a paragraph
+// whose only content is a single image
+// or nil if the paragraph contains anything else.
+func figureImage(paragraph *Block) *Inline {
+	var image *Inline
+	for _, child := range paragraph.inlineChildren {
+		switch child.Kind() {
+		case ImageKind:
+			if image != nil {
+				return nil
+			}
+			image = child
+		case SoftLineBreakKind, IndentKind:
+		default:
+			return nil
+		}
+	}
+	return image
+}
+
+// codeLanguage returns the first word of a code block's info string
+// or the empty string if the block does not have one.
+func codeLanguage(source []byte, block *Block) string {
+	info := block.InfoString()
+	if info == nil {
+		return ""
+	}
+	words := strings.Fields(info.Text(source))
+	if len(words) == 0 {
+		return ""
+	}
+	return words[0]
+}
+
+func (r *renderState) postBlock(source []byte, block *Block, parent *Block) bool {
 	switch block.Kind() {
 	case ParagraphKind:
-		if !cursor.Parent().Block().IsTightList() {
+		switch {
+		case parent.IsTightList():
+		case r.FigureImages && figureImage(block) != nil:
+			def := ResolveLink(figureImage(block), source, r.ReferenceMap)
+			if def.Title != "" {
+				r.openTagAttr(atom.Figcaption)
+				r.dst = append(r.dst, '>')
+				r.dst = append(r.dst, html.EscapeString(def.Title)...)
+				r.closeTag(atom.Figcaption)
+			}
+			r.closeTag(atom.Figure)
+		default:
 			r.closeTag(atom.P)
 		}
 	case ATXHeadingKind, SetextHeadingKind:
@@ -256,6 +778,11 @@ func (r *renderState) postBlock(source []byte, cursor *Cursor) bool {
 		}
 		r.closeTag(tagName)
 	case IndentedCodeBlockKind, FencedCodeBlockKind:
+		if r.CodeWrapper != nil {
+			r.dst = append(r.dst, r.codeClose...)
+			r.codeClose = ""
+			break
+		}
 		r.closeTag(atom.Code)
 		r.closeTag(atom.Pre)
 	case BlockQuoteKind:
@@ -275,17 +802,21 @@ func (r *renderState) postBlock(source []byte, cursor *Cursor) bool {
 }
 
 func (r *renderState) preInline(source []byte, inline *Inline) bool {
-	const hardLineBreak = "<br>\n"
 	switch inline.Kind() {
 	case TextKind, UnparsedKind:
 		r.dst = escapeHTML(r.dst, spanSlice(source, inline.Span()))
 		return false
 	case CharacterReferenceKind:
-		r.dst = append(r.dst, spanSlice(source, inline.Span())...)
+		// Decode the reference so that body text matches attribute values,
+		// then escape the result in case it is a special character.
+		r.dst = escapeHTML(r.dst, []byte(inline.Text(source)))
+		return false
+	case EmojiKind:
+		r.dst = escapeHTML(r.dst, []byte(inline.Text(source)))
 		return false
 	case RawHTMLKind:
 		if !r.IgnoreRaw {
-			if r.FilterTag == nil {
+			if r.FilterTag == nil && !r.rewritesAttributes() {
 				r.dst = append(r.dst, spanSlice(source, inline.Span())...)
 			} else {
 				r.filterRaw(spanSlice(source, inline.Span()))
@@ -295,7 +826,7 @@ func (r *renderState) preInline(source []byte, inline *Inline) bool {
 	case SoftLineBreakKind:
 		switch r.SoftBreakBehavior {
 		case SoftBreakHarden:
-			r.dst = append(r.dst, hardLineBreak...)
+			r.hardLineBreak()
 		case SoftBreakSpace:
 			r.dst = append(r.dst, ' ')
 		default:
@@ -307,7 +838,7 @@ func (r *renderState) preInline(source []byte, inline *Inline) bool {
 		}
 		return false
 	case HardLineBreakKind:
-		r.dst = append(r.dst, hardLineBreak...)
+		r.hardLineBreak()
 		return false
 	case EmphasisKind:
 		r.openTag(atom.Em)
@@ -316,17 +847,7 @@ func (r *renderState) preInline(source []byte, inline *Inline) bool {
 	case CodeSpanKind:
 		r.openTag(atom.Code)
 	case LinkKind:
-		var def LinkDefinition
-		if ref := inline.LinkReference(); ref != "" {
-			def = r.ReferenceMap[ref]
-		} else {
-			title := inline.LinkTitle()
-			def = LinkDefinition{
-				Destination:  inline.LinkDestination().Text(source),
-				Title:        title.Text(source),
-				TitlePresent: title != nil,
-			}
-		}
+		def := ResolveLink(inline, source, r.ReferenceMap)
 		r.openTagAttr(atom.A)
 		r.dst = append(r.dst, ` href="`...)
 		r.dst = append(r.dst, html.EscapeString(NormalizeURI(def.Destination))...)
@@ -338,17 +859,7 @@ func (r *renderState) preInline(source []byte, inline *Inline) bool {
 		}
 		r.dst = append(r.dst, ">"...)
 	case ImageKind:
-		var def LinkDefinition
-		if ref := inline.LinkReference(); ref != "" {
-			def = r.ReferenceMap[ref]
-		} else {
-			title := inline.LinkTitle()
-			def = LinkDefinition{
-				Destination:  inline.LinkDestination().Text(source),
-				Title:        title.Text(source),
-				TitlePresent: title != nil,
-			}
-		}
+		def := ResolveLink(inline, source, r.ReferenceMap)
 		r.openTagAttr(atom.Img)
 		r.dst = append(r.dst, ` src="`...)
 		r.dst = append(r.dst, html.EscapeString(NormalizeURI(def.Destination))...)
@@ -359,7 +870,7 @@ func (r *renderState) preInline(source []byte, inline *Inline) bool {
 			r.dst = append(r.dst, `"`...)
 		}
 		r.dst = appendAltText(r.dst, source, inline)
-		r.dst = append(r.dst, ">"...)
+		r.closeVoidTag()
 		return false
 	case AutolinkKind:
 		destination := inline.children[0].Text(source)
@@ -379,13 +890,50 @@ func (r *renderState) preInline(source []byte, inline *Inline) bool {
 		}
 		return false
 	case HTMLTagKind:
-		// Just descend into children.
+		if r.rewritesAttributes() && !r.IgnoreRaw {
+			// Tags may span multiple lines.
+			r.filterRaw(r.collectRaw(source, inline.AsNode()))
+			return false
+		}
+		// Otherwise, just descend into children.
+	case DirectiveKind:
+		// Render the label only.
+		// RenderInlineHook can be used to render the directive itself.
+	case WikiLinkKind:
+		href, ok := "", false
+		if r.ResolveWikiLink != nil {
+			href, ok = r.ResolveWikiLink(inline.WikiLinkTarget().Text(source))
+		}
+		if !ok && r.BrokenWikiLinksAsText {
+			r.walkWikiLinkDisplay(source, inline)
+			return false
+		}
+		r.openTagAttr(atom.A)
+		if ok {
+			r.dst = append(r.dst, ` href="`...)
+			r.dst = append(r.dst, html.EscapeString(NormalizeURI(href))...)
+			r.dst = append(r.dst, `">`...)
+		} else {
+			r.dst = append(r.dst, ` class="broken">`...)
+		}
+		r.walkWikiLinkDisplay(source, inline)
+		r.closeTag(atom.A)
+		return false
 	default:
 		return false
 	}
 	return true
 }
 
+// walkWikiLinkDisplay renders the display text of a [WikiLinkKind] node.
+func (r *renderState) walkWikiLinkDisplay(source []byte, inline *Inline) {
+	for _, child := range inline.children {
+		if child.Kind() != WikiLinkTargetKind {
+			r.walkInline(source, child, true)
+		}
+	}
+}
+
 func (r *renderState) postInline(source []byte, inline *Inline) bool {
 	switch inline.Kind() {
 	case EmphasisKind:
@@ -405,6 +953,14 @@ func (r *renderState) postInline(source []byte, inline *Inline) bool {
 //
 // It cannot use a conventional HTML parser,
 // since raw HTML in Markdown may be incomplete or start in the middle of a tag.
+//
+// Each call starts in the copy state,
+// even if a previous call ended inside a comment or similar construct.
+// Browsers end processing instructions and CDATA sections
+// at the first '>' rather than at "?>" or "]]>",
+// so continuing from a previous block's state could skip a disallowed tag
+// that a browser would interpret.
+// Starting in the copy state only ever filters more tags.
 func (r *renderState) filterRaw(rawHTML []byte) {
 	const (
 		copyState = iota
@@ -437,11 +993,16 @@ func (r *renderState) filterRaw(rawHTML []byte) {
 					}
 					tagNameEnd := tagNameStart + htmlTagNameEnd(rawHTML[tagNameStart:tagEnd])
 					tagName := maybeLower(rawHTML[tagNameStart:tagNameEnd], &r.lowerBuf)
-					if r.FilterTag(tagName) {
+					switch {
+					case r.FilterTag != nil && r.FilterTag(tagName):
 						r.dst = append(r.dst, rawHTML[copyStart:i]...)
 						r.dst = append(r.dst, "&lt;"...)
 						r.dst = append(r.dst, rawHTML[tagNameStart:tagEnd]...)
 						copyStart = tagEnd
+					case r.rewritesAttributes() && tagNameEnd > tagNameStart:
+						r.dst = append(r.dst, rawHTML[copyStart:i]...)
+						tagEnd = i + r.filterAttributes(rawHTML[i:])
+						copyStart = tagEnd
 					}
 					i = tagEnd
 				}
@@ -482,6 +1043,136 @@ func (r *renderState) filterRaw(rawHTML []byte) {
 	r.dst = append(r.dst, rawHTML[copyStart:]...)
 }
 
+// rewritesAttributes reports whether the renderer
+// changes the attributes of start tags in raw HTML.
+func (r *renderState) rewritesAttributes() bool {
+	return r.AttributeFilter != nil || r.Nonce != ""
+}
+
+// collectRaw returns the concatenated text of the raw HTML children of n.
+// The returned slice is only valid until the next call to collectRaw.
+func (r *renderState) collectRaw(source []byte, n Node) []byte {
+	r.rawBuf = r.rawBuf[:0]
+	for i, count := 0, n.ChildCount(); i < count; i++ {
+		switch child := n.Child(i).Inline(); child.Kind() {
+		case RawHTMLKind:
+			r.rawBuf = append(r.rawBuf, spanSlice(source, child.Span())...)
+		case IndentKind:
+			for j, width := 0, child.IndentWidth(); j < width; j++ {
+				r.rawBuf = append(r.rawBuf, ' ')
+			}
+		}
+	}
+	return r.rawBuf
+}
+
+// filterAttributes appends the start tag at the beginning of tag to r.dst,
+// passing each of its attributes through AttributeFilter
+// and adding Nonce to <script> and <style> tags.
+// It returns the number of bytes of tag consumed.
+//
+// filterAttributes follows the [HTML tokenization] rules for tags
+// so that attributes are split the same way as in a web browser,
+// even for tags that are not valid CommonMark raw HTML.
+//
+// [HTML tokenization]: https://html.spec.whatwg.org/multipage/parsing.html#tag-open-state
+func (r *renderState) filterAttributes(tag []byte) int {
+	i := len("<")
+	for i < len(tag) && !isHTMLWhitespace(tag[i]) && tag[i] != '/' && tag[i] != '>' {
+		i++
+	}
+	tagName := strings.ToLower(string(tag[len("<"):i]))
+	r.dst = append(r.dst, tag[:i]...)
+	addNonce := r.Nonce != "" && (tagName == "script" || tagName == "style")
+	if addNonce {
+		r.dst = append(r.dst, ` nonce="`...)
+		r.dst = escapeHTML(r.dst, []byte(r.Nonce))
+		r.dst = append(r.dst, '"')
+	}
+	for i < len(tag) {
+		if c := tag[i]; isHTMLWhitespace(c) || c == '/' {
+			r.dst = append(r.dst, c)
+			i++
+			continue
+		}
+		if tag[i] == '>' {
+			r.dst = append(r.dst, '>')
+			return i + 1
+		}
+
+		// An equals sign at the start of an attribute name is part of the name.
+		nameStart := i
+		for i++; i < len(tag) && !isHTMLWhitespace(tag[i]) && tag[i] != '/' && tag[i] != '>' && tag[i] != '='; i++ {
+		}
+		nameEnd := i
+		var rawValue []byte
+		if j := skipHTMLWhitespace(tag, i); j < len(tag) && tag[j] == '=' {
+			j = skipHTMLWhitespace(tag, j+1)
+			switch {
+			case j >= len(tag):
+				i = j
+			case tag[j] == '"' || tag[j] == '\'':
+				valueStart := j + 1
+				if k := bytes.IndexByte(tag[valueStart:], tag[j]); k >= 0 {
+					rawValue = tag[valueStart : valueStart+k]
+					i = valueStart + k + 1
+				} else {
+					rawValue = tag[valueStart:]
+					i = len(tag)
+				}
+			default:
+				valueStart := j
+				for j < len(tag) && !isHTMLWhitespace(tag[j]) && tag[j] != '>' {
+					j++
+				}
+				rawValue = tag[valueStart:j]
+				i = j
+			}
+		}
+
+		name := tag[nameStart:nameEnd]
+		lowerName := strings.ToLower(string(name))
+		if addNonce && lowerName == "nonce" {
+			// Replaced by Nonce above.
+			continue
+		}
+		if r.AttributeFilter == nil {
+			r.dst = append(r.dst, tag[nameStart:i]...)
+			continue
+		}
+		value := html.UnescapeString(string(rawValue))
+		newValue, keep := r.AttributeFilter(tagName, lowerName, value)
+		switch {
+		case !keep:
+		case newValue == value:
+			r.dst = append(r.dst, tag[nameStart:i]...)
+		default:
+			r.dst = append(r.dst, name...)
+			r.dst = append(r.dst, `="`...)
+			r.dst = escapeHTML(r.dst, []byte(newValue))
+			r.dst = append(r.dst, '"')
+		}
+	}
+	return len(tag)
+}
+
+func skipHTMLWhitespace(b []byte, i int) int {
+	for i < len(b) && isHTMLWhitespace(b[i]) {
+		i++
+	}
+	return i
+}
+
+// isHTMLWhitespace reports whether c is [ASCII whitespace].
+//
+// [ASCII whitespace]: https://infra.spec.whatwg.org/#ascii-whitespace
+func isHTMLWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r'
+}
+
+// appendAltText appends the plain text content of an image description
+// as an HTML-escaped alt attribute.
+// Raw HTML in the description is omitted.
 func appendAltText(dst []byte, source []byte, parent *Inline) []byte {
 	stack := []*Inline{parent}
 	hasAttr := false
@@ -494,14 +1185,20 @@ func appendAltText(dst []byte, source []byte, parent *Inline) []byte {
 				dst = append(dst, ` alt="`...)
 				hasAttr = true
 			}
-			dst = append(dst, curr.Text(source)...)
+			dst = escapeHTML(dst, spanSlice(source, curr.Span()))
+		case CharacterReferenceKind, EmojiKind:
+			if !hasAttr {
+				dst = append(dst, ` alt="`...)
+				hasAttr = true
+			}
+			dst = escapeHTML(dst, []byte(curr.Text(source)))
 		case IndentKind, SoftLineBreakKind, HardLineBreakKind:
 			if !hasAttr {
 				dst = append(dst, ` alt="`...)
 				hasAttr = true
 			}
 			dst = append(dst, ' ')
-		case LinkDestinationKind, LinkTitleKind, LinkLabelKind:
+		case LinkDestinationKind, LinkTitleKind, LinkLabelKind, HTMLTagKind, RawHTMLKind, DirectiveAttributesKind, WikiLinkTargetKind:
 			// Ignore.
 		default:
 			for i := len(curr.children) - 1; i >= 0; i-- {
@@ -510,7 +1207,7 @@ func appendAltText(dst []byte, source []byte, parent *Inline) []byte {
 		}
 	}
 	if !hasAttr {
-		dst = append(dst, `alt="`...)
+		dst = append(dst, ` alt="`...)
 	}
 	dst = append(dst, `"`...)
 	return dst
@@ -609,6 +1306,17 @@ const (
 // that are not reserved or unreserved URI characters.
 // This is commonly used for transforming CommonMark link destinations
 // into strings suitable for href or src attributes.
+//
+// The output matches the reference CommonMark implementation (cmark)
+// with two exceptions:
+// a '%' that does not start a percent-encoded byte is encoded as "%25",
+// and the brackets around an IPv6 literal host
+// (as in "http://[::1]/") are left as-is.
+// Brackets anywhere else are percent-encoded.
+// Non-ASCII characters are percent-encoded as UTF-8 bytes everywhere,
+// including the host (e.g. "http://ex%C3%A4mple.com/").
+// NormalizeURI does not convert internationalized domain names to punycode:
+// browsers decode percent-encoded hosts before applying IDNA processing.
 func NormalizeURI(s string) string {
 	// RFC 3986 reserved and unreserved characters.
 	const safeSet = `;/?:@&=+$,-_.!~*'()#`
@@ -617,6 +1325,7 @@ func NormalizeURI(s string) string {
 	sb.Grow(len(s))
 	skip := 0
 	var buf [utf8.UTFMax]byte
+	hostStart, hostEnd := ipLiteralHost(s)
 	for i, c := range s {
 		if skip > 0 {
 			skip--
@@ -633,6 +1342,8 @@ func NormalizeURI(s string) string {
 			}
 		case (c < 0x80 && (isASCIILetter(byte(c)) || isASCIIDigit(byte(c)))) || strings.ContainsRune(safeSet, c):
 			sb.WriteRune(c)
+		case i == hostStart || i == hostEnd:
+			sb.WriteRune(c)
 		default:
 			n := utf8.EncodeRune(buf[:], c)
 			for _, b := range buf[:n] {
@@ -645,8 +1356,42 @@ func NormalizeURI(s string) string {
 	return sb.String()
 }
 
+// ipLiteralHost returns the indices of the '[' and ']' characters
+// surrounding an [IP literal] host in the URI s,
+// or (-1, -1) if s does not have an IP literal host.
+//
+// [IP literal]: https://datatracker.ietf.org/doc/html/rfc3986#section-3.2.2
+func ipLiteralHost(s string) (start, end int) {
+	schemeEnd := strings.Index(s, "://")
+	if schemeEnd < 1 || !isASCIILetter(s[0]) {
+		return -1, -1
+	}
+	for i := 1; i < schemeEnd; i++ {
+		if c := s[i]; !isASCIILetter(c) && !isASCIIDigit(c) && c != '+' && c != '.' && c != '-' {
+			return -1, -1
+		}
+	}
+	authorityStart := schemeEnd + len("://")
+	authorityEnd := len(s)
+	if i := strings.IndexAny(s[authorityStart:], "/?#"); i >= 0 {
+		authorityEnd = authorityStart + i
+	}
+	start = authorityStart
+	if i := strings.LastIndexByte(s[authorityStart:authorityEnd], '@'); i >= 0 {
+		start = authorityStart + i + 1
+	}
+	if start >= authorityEnd || s[start] != '[' {
+		return -1, -1
+	}
+	i := strings.IndexByte(s[start:authorityEnd], ']')
+	if i < 0 {
+		return -1, -1
+	}
+	return start, start + i
+}
+
 func isHex(c byte) bool {
-	return 'a' <= c && c <= 'f' || 'A' <= c && c <= 'f' || isASCIIDigit(c)
+	return 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F' || isASCIIDigit(c)
 }
 
 func urlHexDigit(x byte) byte {
@@ -18,13 +18,20 @@ package commonmark
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime/debug"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	nethtml "golang.org/x/net/html"
 	"zombiezen.com/go/commonmark/internal/normhtml"
 )
 
@@ -59,6 +66,42 @@ func TestSoftBreakBehavior(t *testing.T) {
 			input:    "Hello\r\nWorld!",
 			want:     "<p>Hello<br>\nWorld!</p>",
 		},
+		{
+			name:     "PreserveCR",
+			behavior: SoftBreakPreserve,
+			input:    "Hello\rWorld!",
+			want:     "<p>Hello\rWorld!</p>",
+		},
+		{
+			name:     "SpaceCR",
+			behavior: SoftBreakSpace,
+			input:    "Hello\rWorld!",
+			want:     "<p>Hello World!</p>",
+		},
+		{
+			name:     "HardenCR",
+			behavior: SoftBreakHarden,
+			input:    "Hello\rWorld!",
+			want:     "<p>Hello<br>\nWorld!</p>",
+		},
+		{
+			name:     "PreserveBackslashHardBreak",
+			behavior: SoftBreakPreserve,
+			input:    "Hello\\\rWorld!",
+			want:     "<p>Hello<br>\nWorld!</p>",
+		},
+		{
+			name:     "HardenBackslashHardBreak",
+			behavior: SoftBreakHarden,
+			input:    "Hello\\\nWorld!",
+			want:     "<p>Hello<br>\nWorld!</p>",
+		},
+		{
+			name:     "HardenBackslashHardBreakCRLF",
+			behavior: SoftBreakHarden,
+			input:    "Hello\\\r\nWorld!",
+			want:     "<p>Hello<br>\nWorld!</p>",
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -123,59 +166,88 @@ func TestHTMLRendererIgnoreRaw(t *testing.T) {
 	}
 }
 
-func TestHTMLRendererFilter(t *testing.T) {
+func TestHTMLRendererBlockSeparator(t *testing.T) {
 	tests := []struct {
-		name      string
-		input     string
-		filterTag func(tag []byte) bool
-		want      string
+		name            string
+		input           string
+		blockSeparator  string
+		trailingNewline bool
+		want            string
 	}{
 		{
-			name: "GFMExample/Default",
-			input: "<strong> <title> <style> <em>\n\n" +
-				"<blockquote>\n" +
-				"  <xmp> is disallowed.  <XMP> is also disallowed.\n" +
-				"</blockquote>\n",
-			want: "<p><strong> <title> <style> <em></p>\n" +
-				"<blockquote>\n" +
-				"  <xmp> is disallowed.  <XMP> is also disallowed.\n" +
-				"</blockquote>\n",
+			name:  "Default",
+			input: "# Hi\n\nHello\n",
+			want:  "<h1>Hi</h1>\n\n<p>Hello</p>",
 		},
 		{
-			name: "GFMExample/GFM",
-			input: "<strong> <title> <style> <em>\n\n" +
-				"<blockquote>\n" +
-				"  <xmp> is disallowed.  <XMP> is also disallowed.\n" +
-				"</blockquote>\n",
-			filterTag: FilterTagGFM,
-			want: "<p><strong> &lt;title> &lt;style> <em></p>\n" +
-				"<blockquote>\n" +
-				"  &lt;xmp> is disallowed.  &lt;XMP> is also disallowed.\n" +
-				"</blockquote>",
+			name:           "Newline",
+			input:          "# Hi\n\nHello\n",
+			blockSeparator: "\n",
+			want:           "<h1>Hi</h1>\n<p>Hello</p>",
 		},
 		{
-			name: "GFMExample/AllowAll",
-			input: "<strong> <title> <style> <em>\n\n" +
-				"<blockquote>\n" +
-				"  <xmp> is disallowed.  <XMP> is also disallowed.\n" +
-				"</blockquote>\n",
-			filterTag: func(tag []byte) bool { return false },
-			want: "<p><strong> <title> <style> <em></p>\n" +
-				"<blockquote>\n" +
-				"  <xmp> is disallowed.  <XMP> is also disallowed.\n" +
-				"</blockquote>\n",
+			name:            "TrailingNewline",
+			input:           "# Hi\n\nHello\n",
+			trailingNewline: true,
+			want:            "<h1>Hi</h1>\n\n<p>Hello</p>\n",
 		},
 		{
-			name: "GFMExample/BlockAll",
-			input: "<strong> <title> <style> <em>\n\n" +
-				"<blockquote>\n" +
-				"  <xmp> is disallowed.  <XMP> is also disallowed.\n" +
-				"</blockquote>\n",
-			filterTag: func(tag []byte) bool { return true },
-			want: "&lt;p>&lt;strong> &lt;title> &lt;style> &lt;em>&lt;/p>\n" +
-				"&lt;blockquote>\n" +
-				"  &lt;xmp> is disallowed.  &lt;XMP> is also disallowed.\n" +
-				"&lt;/blockquote>\n",
+			name:            "TrailingNewlineAfterHTMLBlock",
+			input:           "Hello\n\n<div>\n",
+			trailingNewline: true,
+			want:            "<p>Hello</p>\n\n<div>\n",
+		},
+		{
+			name:            "TrailingNewlineEmpty",
+			input:           "",
+			trailingNewline: true,
+			want:            "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			r := &HTMLRenderer{
+				ReferenceMap:    refMap,
+				BlockSeparator:  test.blockSeparator,
+				TrailingNewline: test.trailingNewline,
+			}
+			buf := new(bytes.Buffer)
+			if err := r.Render(buf, blocks); err != nil {
+				t.Error("Render:", err)
+			}
+			if got := buf.String(); got != test.want {
+				t.Errorf("output = %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHTMLRendererXHTML(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "ThematicBreak",
+			input: "***\n",
+			want:  "<hr />",
+		},
+		{
+			name:  "HardLineBreak",
+			input: "a\\\nb\n",
+			want:  "<p>a<br />\nb</p>",
+		},
+		{
+			name:  "Image",
+			input: "![alt](/img.png \"title\")\n",
+			want:  `<p><img src="/img.png" title="title" alt="alt" /></p>`,
+		},
+		{
+			name:  "RawHTML",
+			input: "a <br> b\n\n<hr>\n",
+			want:  "<p>a <br> b</p>\n\n<hr>\n",
 		},
 	}
 	for _, test := range tests {
@@ -183,7 +255,89 @@ func TestHTMLRendererFilter(t *testing.T) {
 			blocks, refMap := Parse([]byte(test.input))
 			r := &HTMLRenderer{
 				ReferenceMap: refMap,
-				FilterTag:    test.filterTag,
+				XHTML:        true,
+			}
+			buf := new(bytes.Buffer)
+			if err := r.Render(buf, blocks); err != nil {
+				t.Error("Render:", err)
+			}
+			if got := buf.String(); got != test.want {
+				t.Errorf("output = %q; want %q", got, test.want)
+			}
+		})
+	}
+
+	t.Run("SoftBreakHarden", func(t *testing.T) {
+		blocks, refMap := Parse([]byte("a\nb\n"))
+		r := &HTMLRenderer{
+			ReferenceMap:      refMap,
+			SoftBreakBehavior: SoftBreakHarden,
+			XHTML:             true,
+		}
+		got := string(r.AppendBlock(nil, blocks[0]))
+		if want := "<p>a<br />\nb</p>"; got != want {
+			t.Errorf("output = %q; want %q", got, want)
+		}
+	})
+}
+
+func TestHTMLRendererRenderBlockHook(t *testing.T) {
+	hook := func(w io.Writer, source []byte, b *Block, defaultRender func()) error {
+		switch {
+		case b.Kind() == FencedCodeBlockKind && b.InfoString().Text(source) == "mermaid":
+			io.WriteString(w, `<div class="mermaid">`)
+			for i := 1; i < b.ChildCount(); i++ {
+				io.WriteString(w, html.EscapeString(b.Child(i).Inline().Text(source)))
+			}
+			io.WriteString(w, "</div>")
+		case b.Kind() == BlockQuoteKind:
+			io.WriteString(w, `<div class="quote">`)
+			defaultRender()
+			io.WriteString(w, "</div>")
+		default:
+			defaultRender()
+		}
+		return nil
+	}
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "Default",
+			input: "Hello *World*\n",
+			want:  "<p>Hello <em>World</em></p>",
+		},
+		{
+			name:  "Replace",
+			input: "```mermaid\ngraph TD;\n  A-->B;\n```\n",
+			want:  "<div class=\"mermaid\">graph TD;\n  A--&gt;B;\n</div>",
+		},
+		{
+			name:  "Wrap",
+			input: "> quote\n",
+			want:  "<div class=\"quote\"><blockquote>\n<p>quote</p>\n</blockquote></div>",
+		},
+		{
+			name:  "Nested",
+			input: "- a\n- > b\n- ```mermaid\n  c\n  ```\n",
+			want: "<ul>\n<li>a</li>\n" +
+				"<li><div class=\"quote\"><blockquote>\n<p>b</p>\n</blockquote></div></li>\n" +
+				"<li><div class=\"mermaid\">c\n</div></li>\n</ul>",
+		},
+		{
+			name:  "Code",
+			input: "```go\nx\n```\n",
+			want:  "<pre><code class=\"language-go\">x\n</code></pre>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			r := &HTMLRenderer{
+				ReferenceMap:    refMap,
+				RenderBlockHook: hook,
 			}
 			buf := new(bytes.Buffer)
 			if err := r.Render(buf, blocks); err != nil {
@@ -196,33 +350,1599 @@ func TestHTMLRendererFilter(t *testing.T) {
 			}
 		})
 	}
+
+	t.Run("VisitsAllBlocks", func(t *testing.T) {
+		blocks, refMap := Parse([]byte("# a\n\n> - b\n>\n>   c\n"))
+		var kinds []BlockKind
+		r := &HTMLRenderer{
+			ReferenceMap: refMap,
+			RenderBlockHook: func(w io.Writer, source []byte, b *Block, defaultRender func()) error {
+				kinds = append(kinds, b.Kind())
+				defaultRender()
+				return nil
+			},
+		}
+		got := new(bytes.Buffer)
+		if err := r.Render(got, blocks); err != nil {
+			t.Fatal("Render:", err)
+		}
+		wantKinds := []BlockKind{
+			ATXHeadingKind,
+			BlockQuoteKind,
+			ListKind,
+			ListItemKind,
+			ListMarkerKind,
+			ParagraphKind,
+			ParagraphKind,
+		}
+		if diff := cmp.Diff(wantKinds, kinds); diff != "" {
+			t.Errorf("blocks passed to hook (-want +got):\n%s", diff)
+		}
+		want := new(bytes.Buffer)
+		if err := RenderHTML(want, blocks, refMap); err != nil {
+			t.Fatal("RenderHTML:", err)
+		}
+		if diff := cmp.Diff(want.String(), got.String()); diff != "" {
+			t.Errorf("pass-through hook changed output (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		blocks, refMap := Parse([]byte("a\n\n> b\n\nc\n"))
+		hookErr := errors.New("bork")
+		r := &HTMLRenderer{
+			ReferenceMap: refMap,
+			RenderBlockHook: func(w io.Writer, source []byte, b *Block, defaultRender func()) error {
+				if b.Kind() == ParagraphKind && b.Child(0).Inline().Text(source) == "b" {
+					return hookErr
+				}
+				defaultRender()
+				return nil
+			},
+		}
+		got := new(bytes.Buffer)
+		if err := r.Render(got, blocks); !errors.Is(err, hookErr) {
+			t.Errorf("Render(...) = %v; want %v", err, hookErr)
+		}
+		if strings.Contains(got.String(), "<p>c</p>") {
+			t.Errorf("Render(...) wrote %q after hook error", got)
+		}
+	})
 }
 
-func BenchmarkRenderHTML(b *testing.B) {
-	b.Run("Spec", func(b *testing.B) {
-		input := new(bytes.Buffer)
-		testsuite := loadTestSuite(b)
-		for i, test := range testsuite {
-			if i > 0 {
-				input.WriteString("\n\n")
+func TestHTMLRendererRenderInlineHook(t *testing.T) {
+	hook := func(w io.Writer, source []byte, inline *Inline, defaultRender func()) error {
+		switch inline.Kind() {
+		case AutolinkKind:
+			dest := inline.Child(0).Text(source)
+			fmt.Fprintf(w, `<a href="%s?ref=docs">%s</a>`, NormalizeURI(dest), html.EscapeString(dest))
+		case CodeSpanKind:
+			if inline.Child(0).Text(source) == "Walk" {
+				io.WriteString(w, `<a href="#Walk">`)
+				defaultRender()
+				io.WriteString(w, "</a>")
+			} else {
+				defaultRender()
 			}
-			input.WriteString(test.Markdown)
+		case TextKind:
+			if string(spanSlice(source, inline.Span())) == "secret" {
+				io.WriteString(w, "[redacted]")
+			} else {
+				defaultRender()
+			}
+		default:
+			defaultRender()
 		}
-		doc, refMap := Parse(input.Bytes())
-		b.ResetTimer()
-		b.SetBytes(int64(input.Len()))
-		b.ReportMetric(float64(len(testsuite)), "examples/op")
+		return nil
+	}
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "Autolink",
+			input: "<https://example.com/>\n",
+			want:  `<p><a href="https://example.com/?ref=docs">https://example.com/</a></p>`,
+		},
+		{
+			name:  "CodeSpan",
+			input: "Call `Walk` or `Parse`.\n",
+			want:  `<p>Call <a href="#Walk"><code>Walk</code></a> or <code>Parse</code>.</p>`,
+		},
+		{
+			name:  "Nested",
+			input: "*a **secret** b*\n",
+			want:  `<p><em>a <strong>[redacted]</strong> b</em></p>`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			r := &HTMLRenderer{
+				ReferenceMap:     refMap,
+				RenderInlineHook: hook,
+			}
+			buf := new(bytes.Buffer)
+			if err := r.Render(buf, blocks); err != nil {
+				t.Error("Render:", err)
+			}
+			if got := buf.String(); got != test.want {
+				t.Errorf("output = %q; want %q", got, test.want)
+			}
+		})
+	}
 
-		for i := 0; i < b.N; i++ {
-			RenderHTML(io.Discard, doc, refMap)
+	t.Run("AppendInlines", func(t *testing.T) {
+		const input = "a `Walk` *secret*"
+		r := &HTMLRenderer{RenderInlineHook: hook}
+		got := string(r.AppendInlines(nil, []byte(input), ParseInline([]byte(input), nil)))
+		const want = `a <a href="#Walk"><code>Walk</code></a> <em>[redacted]</em>`
+		if got != want {
+			t.Errorf("AppendInlines(...) = %q; want %q", got, want)
 		}
 	})
 
-	b.Run("Goldmark", func(b *testing.B) {
-		input, err := os.ReadFile(filepath.Join("testdata", "goldmark_bench.md"))
-		if err != nil {
-			b.Fatal(err)
+	t.Run("Error", func(t *testing.T) {
+		const input = "a `b` c\n"
+		blocks, refMap := Parse([]byte(input))
+		hookErr := errors.New("bork")
+		r := &HTMLRenderer{
+			ReferenceMap: refMap,
+			RenderInlineHook: func(w io.Writer, source []byte, inline *Inline, defaultRender func()) error {
+				if inline.Kind() == CodeSpanKind {
+					return hookErr
+				}
+				defaultRender()
+				return nil
+			},
+		}
+		got := new(bytes.Buffer)
+		if err := r.Render(got, blocks); !errors.Is(err, hookErr) {
+			t.Errorf("Render(...) = %v; want %v", err, hookErr)
+		}
+		if strings.Contains(got.String(), "c") {
+			t.Errorf("Render(...) wrote %q after hook error", got)
+		}
+		const wantAppend = "a "
+		if got := string(r.AppendInlines(nil, []byte(input), ParseInline([]byte(input), nil))); got != wantAppend {
+			t.Errorf("AppendInlines(...) = %q; want %q", got, wantAppend)
+		}
+	})
+
+	t.Run("PassThrough", func(t *testing.T) {
+		r := &HTMLRenderer{
+			RenderBlockHook: func(w io.Writer, source []byte, b *Block, defaultRender func()) error {
+				defaultRender()
+				return nil
+			},
+			RenderInlineHook: func(w io.Writer, source []byte, inline *Inline, defaultRender func()) error {
+				defaultRender()
+				return nil
+			},
+		}
+		for _, test := range loadTestSuite(t) {
+			blocks, refMap := Parse([]byte(test.Markdown))
+			want := new(bytes.Buffer)
+			if err := RenderHTML(want, blocks, refMap); err != nil {
+				t.Fatal("RenderHTML:", err)
+			}
+			r.ReferenceMap = refMap
+			got := new(bytes.Buffer)
+			if err := r.Render(got, blocks); err != nil {
+				t.Fatal("Render:", err)
+			}
+			if diff := cmp.Diff(want.String(), got.String()); diff != "" {
+				t.Errorf("Example %d: pass-through hooks changed output (-want +got):\n%s", test.Example, diff)
+			}
+		}
+	})
+}
+
+func TestHTMLRendererDirectives(t *testing.T) {
+	blockHook := func(w io.Writer, source []byte, b *Block, defaultRender func()) error {
+		if b.Kind() != DirectiveBlockKind {
+			defaultRender()
+			return nil
+		}
+		fmt.Fprintf(w, `<div class="%s">`, html.EscapeString(b.DirectiveName(source)))
+		defaultRender()
+		io.WriteString(w, "</div>")
+		return nil
+	}
+	inlineHook := func(w io.Writer, source []byte, inline *Inline, defaultRender func()) error {
+		if inline.Kind() != DirectiveKind {
+			defaultRender()
+			return nil
+		}
+		fmt.Fprintf(w, "<%s>", inline.DirectiveName(source))
+		defaultRender()
+		fmt.Fprintf(w, "</%s>", inline.DirectiveName(source))
+		return nil
+	}
+	tests := []struct {
+		name  string
+		input string
+		hooks bool
+		want  string
+	}{
+		{
+			name:  "Default",
+			input: "::: warning {.big}\nPress :kbd[*Ctrl*]{.key}\n:::\n",
+			want:  "<p>Press <em>Ctrl</em></p>",
+		},
+		{
+			name:  "Hooks",
+			input: "::: warning {.big}\nPress :kbd[*Ctrl*]{.key}\n:::\n",
+			hooks: true,
+			want:  `<div class="warning"><p>Press <kbd><em>Ctrl</em></kbd></p></div>`,
+		},
+		{
+			name:  "Nested",
+			input: ":::: outer\n::: inner\nHello\n:::\n::::\n",
+			hooks: true,
+			want:  `<div class="outer"><div class="inner"><p>Hello</p></div></div>`,
+		},
+		{
+			name:  "Siblings",
+			input: "::: outer\n::: inner\nHello\n:::\nWorld\n:::\n",
+			want:  "<p>Hello</p>\n<p>World</p>",
+		},
+		{
+			name:  "ImageDescription",
+			input: "![:x[a]{b} c](/img.png)\n",
+			want:  `<p><img src="/img.png" alt="a c"></p>`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blockParser := NewBlockParser(strings.NewReader(test.input))
+			blockParser.Directives = true
+			inlineParser := &InlineParser{Directives: true}
+			r := new(HTMLRenderer)
+			if test.hooks {
+				r.RenderBlockHook = blockHook
+				r.RenderInlineHook = inlineHook
+			}
+			var got []byte
+			for {
+				block, err := blockParser.NextBlock()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				inlineParser.Rewrite(block)
+				got = r.AppendBlock(got, block)
+			}
+			if diff := cmp.Diff(test.want, string(got)); diff != "" {
+				t.Errorf("-want +got:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHTMLRendererEmoji(t *testing.T) {
+	resolver := EmojiMap{
+		"heart": "<3",
+		"smile": "\U0001f604",
+	}
+	imgHook := func(w io.Writer, source []byte, inline *Inline, defaultRender func()) error {
+		if inline.Kind() != EmojiKind {
+			defaultRender()
+			return nil
 		}
+		_, err := fmt.Fprintf(w, `<img class="emoji" src="/emoji/%s.png" alt="%s">`,
+			inline.EmojiName(source), html.EscapeString(inline.Text(source)))
+		return err
+	}
+	tests := []struct {
+		name  string
+		input string
+		hook  func(w io.Writer, source []byte, inline *Inline, defaultRender func()) error
+		want  string
+	}{
+		{
+			name:  "Escaped",
+			input: "I :heart: Go :smile:\n",
+			want:  "<p>I &lt;3 Go \U0001f604</p>",
+		},
+		{
+			name:  "Hook",
+			input: "I :heart: Go\n",
+			hook:  imgHook,
+			want:  `<p>I <img class="emoji" src="/emoji/heart.png" alt="&lt;3"> Go</p>`,
+		},
+		{
+			name:  "ImageDescription",
+			input: "![:smile: face](/face.png)\n",
+			want:  "<p><img src=\"/face.png\" alt=\"\U0001f604 face\"></p>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			block, err := NewBlockParser(strings.NewReader(test.input)).NextBlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			(&InlineParser{EmojiResolver: resolver}).Rewrite(block)
+			r := &HTMLRenderer{RenderInlineHook: test.hook}
+			got := r.AppendBlock(nil, block)
+			if diff := cmp.Diff(string(normhtml.NormalizeHTML([]byte(test.want))), string(normhtml.NormalizeHTML(got))); diff != "" {
+				t.Errorf("-want +got:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHTMLRendererWikiLinks(t *testing.T) {
+	resolve := func(target string) (string, bool) {
+		if target == "Missing" {
+			return "", false
+		}
+		return "/wiki/" + strings.ReplaceAll(target, " ", "_"), true
+	}
+	tests := []struct {
+		name         string
+		input        string
+		resolve      func(target string) (string, bool)
+		brokenAsText bool
+		want         string
+	}{
+		{
+			name:    "Resolved",
+			input:   "See [[Page Name]].\n",
+			resolve: resolve,
+			want:    `<p>See <a href="/wiki/Page_Name">Page Name</a>.</p>`,
+		},
+		{
+			name:    "Display",
+			input:   "See [[Page Name|R&D notes]].\n",
+			resolve: resolve,
+			want:    `<p>See <a href="/wiki/Page_Name">R&amp;D notes</a>.</p>`,
+		},
+		{
+			name:    "Broken",
+			input:   "See [[Missing|this]].\n",
+			resolve: resolve,
+			want:    `<p>See <a class="broken">this</a>.</p>`,
+		},
+		{
+			name:  "NoResolver",
+			input: "See [[Page]].\n",
+			want:  `<p>See <a class="broken">Page</a>.</p>`,
+		},
+		{
+			name:         "BrokenAsText",
+			input:        "See [[Missing|this]] and [[Page]].\n",
+			resolve:      resolve,
+			brokenAsText: true,
+			want:         `<p>See this and <a href="/wiki/Page">Page</a>.</p>`,
+		},
+		{
+			name:    "ImageDescription",
+			input:   "![a [[Page|b]] c](/img.png)\n",
+			resolve: resolve,
+			want:    `<p><img src="/img.png" alt="a b c"></p>`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			block, err := NewBlockParser(strings.NewReader(test.input)).NextBlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			(&InlineParser{WikiLinks: true}).Rewrite(block)
+			r := &HTMLRenderer{
+				ResolveWikiLink:       test.resolve,
+				BrokenWikiLinksAsText: test.brokenAsText,
+			}
+			got := r.AppendBlock(nil, block)
+			if diff := cmp.Diff(string(normhtml.NormalizeHTML([]byte(test.want))), string(normhtml.NormalizeHTML(got))); diff != "" {
+				t.Errorf("-want +got:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHTMLRendererSourcePos(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		// want is the list of elements with a data-sourcepos attribute
+		// in the form "tag source text".
+		want []string
+	}{
+		{
+			name:  "Heading",
+			input: "# Hi\n",
+			want:  []string{"h1 # Hi"},
+		},
+		{
+			name:  "SecondBlock",
+			input: "foo\nbar\n\n***\n\nbaz\n===\n",
+			want: []string{
+				"p foo\nbar",
+				"hr ***",
+				"h1 baz\n===",
+			},
+		},
+		{
+			name:  "BlockQuote",
+			input: "> a\n> b\n",
+			want: []string{
+				"blockquote > a\n> b",
+				"p a\n> b",
+			},
+		},
+		{
+			name:  "TightList",
+			input: "1. x\n2. y\n",
+			want: []string{
+				"ol 1. x\n2. y",
+				"li 1. x",
+				"li 2. y",
+			},
+		},
+		{
+			name:  "LooseList",
+			input: "- x\n\n  y\n- z\n\nafter\n",
+			want: []string{
+				"ul - x\n\n  y\n- z",
+				"li - x\n\n  y",
+				"p x",
+				"p y",
+				"li - z",
+				"p z",
+				"p after",
+			},
+		},
+		{
+			name:  "CodeBlocks",
+			input: "```go\nf()\n```\n\n    code\n",
+			want: []string{
+				"pre ```go\nf()\n```",
+				// Indented code blocks start after the indentation.
+				"pre code",
+			},
+		},
+		{
+			name:  "TabsAndMultiByte",
+			input: "> \u00e9\t*x*\n>\t\u00e9\n\n\t\u00e9\n",
+			want: []string{
+				"blockquote > \u00e9\t*x*\n>\t\u00e9",
+				"p \u00e9\t*x*\n>\t\u00e9",
+				"pre \u00e9",
+			},
+		},
+		{
+			name:  "CRLF",
+			input: "a\r\nb\r\n\r\n# c\r\n",
+			want: []string{
+				"p a\r\nb",
+				"h1 # c",
+			},
+		},
+	}
+
+	policy := DefaultSanitizePolicy()
+	policy.Attributes["*"] = append(policy.Attributes["*"], "data-sourcepos")
+	renderers := []struct {
+		name   string
+		render func(w io.Writer, r *HTMLRenderer, blocks []*RootBlock) error
+	}{
+		{
+			name: "Render",
+			render: func(w io.Writer, r *HTMLRenderer, blocks []*RootBlock) error {
+				return r.Render(w, blocks)
+			},
+		},
+		{
+			name: "RenderSafe",
+			render: func(w io.Writer, r *HTMLRenderer, blocks []*RootBlock) error {
+				return r.RenderSafe(w, blocks, policy)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		for _, renderer := range renderers {
+			t.Run(test.name+"/"+renderer.name, func(t *testing.T) {
+				blocks, refMap := Parse([]byte(test.input))
+				r := &HTMLRenderer{
+					ReferenceMap: refMap,
+					SourcePos:    true,
+				}
+				buf := new(bytes.Buffer)
+				if err := renderer.render(buf, r, blocks); err != nil {
+					t.Fatal(err)
+				}
+				got, err := extractSourcePos(test.input, buf.String())
+				if err != nil {
+					t.Fatalf("%v; output:\n%s", err, buf)
+				}
+				if diff := cmp.Diff(test.want, got); diff != "" {
+					t.Errorf("positions (-want +got):\n%s\noutput:\n%s", diff, buf)
+				}
+			})
+		}
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		blocks, refMap := Parse([]byte("# Hi\n\n- x\n"))
+		buf := new(bytes.Buffer)
+		if err := RenderHTML(buf, blocks, refMap); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(buf.String(), "data-sourcepos") {
+			t.Errorf("output = %q; want no data-sourcepos attributes", buf)
+		}
+	})
+}
+
+// extractSourcePos finds the elements in the rendered HTML
+// that have a data-sourcepos attribute
+// and returns each element's tag name followed by the source text it refers to.
+func extractSourcePos(source string, rendered string) ([]string, error) {
+	lineStarts := []int{0}
+	for i := 0; i < len(source); i++ {
+		if source[i] == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+	offset := func(line, col int) (int, error) {
+		if line < 1 || line > len(lineStarts) || col < 1 {
+			return 0, fmt.Errorf("position %d:%d out of range", line, col)
+		}
+		off := lineStarts[line-1] + col - 1
+		if off >= len(source) {
+			return 0, fmt.Errorf("position %d:%d out of range", line, col)
+		}
+		return off, nil
+	}
+
+	var result []string
+	z := nethtml.NewTokenizer(strings.NewReader(rendered))
+	for {
+		tt := z.Next()
+		if tt == nethtml.ErrorToken {
+			return result, nil
+		}
+		if tt != nethtml.StartTagToken && tt != nethtml.SelfClosingTagToken {
+			continue
+		}
+		tok := z.Token()
+		for _, attr := range tok.Attr {
+			if attr.Key != "data-sourcepos" {
+				continue
+			}
+			var startLine, startCol, endLine, endCol int
+			if _, err := fmt.Sscanf(attr.Val, "%d:%d-%d:%d", &startLine, &startCol, &endLine, &endCol); err != nil {
+				return nil, fmt.Errorf("<%s data-sourcepos=%q>: %v", tok.Data, attr.Val, err)
+			}
+			start, err := offset(startLine, startCol)
+			if err != nil {
+				return nil, fmt.Errorf("<%s data-sourcepos=%q>: %v", tok.Data, attr.Val, err)
+			}
+			end, err := offset(endLine, endCol)
+			if err != nil {
+				return nil, fmt.Errorf("<%s data-sourcepos=%q>: %v", tok.Data, attr.Val, err)
+			}
+			result = append(result, tok.Data+" "+source[start:end+1])
+		}
+	}
+}
+
+func TestHTMLRendererFilter(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		filterTag func(tag []byte) bool
+		want      string
+	}{
+		{
+			name: "GFMExample/Default",
+			input: "<strong> <title> <style> <em>\n\n" +
+				"<blockquote>\n" +
+				"  <xmp> is disallowed.  <XMP> is also disallowed.\n" +
+				"</blockquote>\n",
+			want: "<p><strong> <title> <style> <em></p>\n" +
+				"<blockquote>\n" +
+				"  <xmp> is disallowed.  <XMP> is also disallowed.\n" +
+				"</blockquote>\n",
+		},
+		{
+			name: "GFMExample/GFM",
+			input: "<strong> <title> <style> <em>\n\n" +
+				"<blockquote>\n" +
+				"  <xmp> is disallowed.  <XMP> is also disallowed.\n" +
+				"</blockquote>\n",
+			filterTag: FilterTagGFM,
+			want: "<p><strong> &lt;title> &lt;style> <em></p>\n" +
+				"<blockquote>\n" +
+				"  &lt;xmp> is disallowed.  &lt;XMP> is also disallowed.\n" +
+				"</blockquote>",
+		},
+		{
+			name: "GFMExample/AllowAll",
+			input: "<strong> <title> <style> <em>\n\n" +
+				"<blockquote>\n" +
+				"  <xmp> is disallowed.  <XMP> is also disallowed.\n" +
+				"</blockquote>\n",
+			filterTag: func(tag []byte) bool { return false },
+			want: "<p><strong> <title> <style> <em></p>\n" +
+				"<blockquote>\n" +
+				"  <xmp> is disallowed.  <XMP> is also disallowed.\n" +
+				"</blockquote>\n",
+		},
+		{
+			name: "GFMExample/BlockAll",
+			input: "<strong> <title> <style> <em>\n\n" +
+				"<blockquote>\n" +
+				"  <xmp> is disallowed.  <XMP> is also disallowed.\n" +
+				"</blockquote>\n",
+			filterTag: func(tag []byte) bool { return true },
+			want: "&lt;p>&lt;strong> &lt;title> &lt;style> &lt;em>&lt;/p>\n" +
+				"&lt;blockquote>\n" +
+				"  &lt;xmp> is disallowed.  &lt;XMP> is also disallowed.\n" +
+				"&lt;/blockquote>\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			r := &HTMLRenderer{
+				ReferenceMap: refMap,
+				FilterTag:    test.filterTag,
+			}
+			buf := new(bytes.Buffer)
+			if err := r.Render(buf, blocks); err != nil {
+				t.Error("Render:", err)
+			}
+			got := normhtml.NormalizeHTML(buf.Bytes())
+			want := normhtml.NormalizeHTML([]byte(test.want))
+			if diff := cmp.Diff(want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("-want +got:\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestHTMLRendererFilterTagDefault verifies that raw HTML is not filtered
+// unless the caller opts in with a FilterTag function.
+func TestHTMLRendererFilterTagDefault(t *testing.T) {
+	const input = "<script>alert(1)</script>\n\n" +
+		"a <title>b</title> <textarea>c</textarea> <xmp>d</xmp>\n"
+	blocks, refMap := Parse([]byte(input))
+	want := new(bytes.Buffer)
+	noFilter := &HTMLRenderer{
+		ReferenceMap: refMap,
+		FilterTag:    func(tag []byte) bool { return false },
+	}
+	if err := noFilter.Render(want, blocks); err != nil {
+		t.Fatal("Render:", err)
+	}
+	if strings.Contains(want.String(), "&lt;") {
+		t.Fatalf("unfiltered output contains escaped tags:\n%s", want)
+	}
+
+	t.Run("RenderHTML", func(t *testing.T) {
+		got := new(bytes.Buffer)
+		if err := RenderHTML(got, blocks, refMap); err != nil {
+			t.Fatal("RenderHTML:", err)
+		}
+		if diff := cmp.Diff(want.String(), got.String()); diff != "" {
+			t.Errorf("-want +got:\n%s", diff)
+		}
+	})
+	t.Run("ZeroFilterTag", func(t *testing.T) {
+		got := new(bytes.Buffer)
+		r := &HTMLRenderer{ReferenceMap: refMap}
+		if err := r.Render(got, blocks); err != nil {
+			t.Fatal("Render:", err)
+		}
+		if diff := cmp.Diff(want.String(), got.String()); diff != "" {
+			t.Errorf("-want +got:\n%s", diff)
+		}
+	})
+	t.Run("FilterTagGFM", func(t *testing.T) {
+		got := new(bytes.Buffer)
+		r := &HTMLRenderer{
+			ReferenceMap: refMap,
+			FilterTag:    FilterTagGFM,
+		}
+		if err := r.Render(got, blocks); err != nil {
+			t.Fatal("Render:", err)
+		}
+		for _, tag := range []string{"script", "title", "textarea", "xmp"} {
+			if !strings.Contains(got.String(), "&lt;"+tag+">") {
+				t.Errorf("output does not escape <%s>:\n%s", tag, got)
+			}
+		}
+	})
+}
+
+func TestHTMLRendererAttributeFilter(t *testing.T) {
+	filter := func(tag, attr, value string) (newValue string, keep bool) {
+		switch {
+		case strings.HasPrefix(attr, "on"):
+			return "", false
+		case tag == "img" && attr == "src" && !strings.Contains(value, "://"):
+			return "https://example.com/" + value, true
+		default:
+			return value, true
+		}
+	}
+	tests := []struct {
+		name      string
+		input     string
+		filterTag func(tag []byte) bool
+		want      string
+	}{
+		{
+			name:  "InlineTag",
+			input: "Click <a href=\"/x\" onclick='alert(1)'>here</a>\n",
+			want:  "<p>Click <a href=\"/x\" >here</a></p>",
+		},
+		{
+			name:  "MultilineInlineTag",
+			input: "<span\nONMOUSEOVER=\"x\"\nclass=y>z</span>\n",
+			want:  "<p><span\n\nclass=y>z</span></p>",
+		},
+		{
+			name:  "RewriteValue",
+			input: "<img src=\"cat.png\" alt=\"A &amp; B\">\n",
+			want:  "<img src=\"https://example.com/cat.png\" alt=\"A &amp; B\">\n",
+		},
+		{
+			name:  "EscapeNewValue",
+			input: "<img src=\"a&quot;b\">\n",
+			want:  "<img src=\"https://example.com/a&quot;b\">\n",
+		},
+		{
+			name:  "HTMLBlock",
+			input: "<div\n  class=\"x\" onclick=\"y\">\n<img src=\"https://example.com/a.png\"\n onload=z alt='a > b'>\n</div>\n",
+			want:  "<div\n  class=\"x\" >\n<img src=\"https://example.com/a.png\"\n  alt='a > b'>\n</div>\n",
+		},
+		{
+			name:  "BlockQuote",
+			input: "> <div a=b onmouseover=x>\n> c\n",
+			want:  "<blockquote><div a=b >\nc\n</blockquote>",
+		},
+		{
+			name:  "BrowserAttributeSplitting",
+			input: "<div>\n<img/src=x/onerror=alert(1)>\n<img src=x/onerror=alert(1)>\n<img =x onerror=y>\n",
+			want:  "<div>\n<img/src=\"https://example.com/x/onerror=alert(1)\">\n<img src=\"https://example.com/x/onerror=alert(1)\">\n<img =x >\n",
+		},
+		{
+			name:  "Comment",
+			input: "a <!-- <b onclick=x> --> c\n",
+			want:  "<p>a <!-- <b onclick=x> --> c</p>",
+		},
+		{
+			name:      "FilterTag",
+			input:     "<title onclick=x>\n<b onclick=x>\n",
+			filterTag: FilterTagGFM,
+			want:      "&lt;title onclick=x>\n<b >\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			r := &HTMLRenderer{
+				ReferenceMap:    refMap,
+				FilterTag:       test.filterTag,
+				AttributeFilter: filter,
+			}
+			buf := new(bytes.Buffer)
+			if err := r.Render(buf, blocks); err != nil {
+				t.Error("Render:", err)
+			}
+			if diff := cmp.Diff(test.want, buf.String()); diff != "" {
+				t.Errorf("-want +got:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHTMLRendererNonce(t *testing.T) {
+	tests := []struct {
+		name            string
+		input           string
+		nonce           string
+		filterTag       func(tag []byte) bool
+		attributeFilter func(tag, attr, value string) (newValue string, keep bool)
+		want            string
+	}{
+		{
+			name:  "ScriptBlock",
+			input: "<script src=\"/app.js\"></script>\n",
+			nonce: "abc123",
+			want:  "<script nonce=\"abc123\" src=\"/app.js\"></script>\n",
+		},
+		{
+			name:  "StyleBlock",
+			input: "<style>\np { color: red }\n</style>\n",
+			nonce: "abc123",
+			want:  "<style nonce=\"abc123\">\np { color: red }\n</style>\n",
+		},
+		{
+			name:  "InlineTag",
+			input: "Hi <script>alert(1)</script> <b>there</b>\n",
+			nonce: "abc123",
+			want:  "<p>Hi <script nonce=\"abc123\">alert(1)</script> <b>there</b></p>",
+		},
+		{
+			name:  "MultilineTag",
+			input: "a <SCRIPT\ntype=module>x</SCRIPT>\n",
+			nonce: "abc123",
+			want:  "<p>a <SCRIPT nonce=\"abc123\"\ntype=module>x</SCRIPT></p>",
+		},
+		{
+			name:  "ReplaceNonce",
+			input: "<script NONCE=\"evil\" defer nonce=x></script>\n",
+			nonce: "abc123",
+			want:  "<script nonce=\"abc123\"  defer ></script>\n",
+		},
+		{
+			name:  "OtherTagsUnchanged",
+			input: "<div nonce=\"x\" class='y'>\n<scripts>\n</div>\n",
+			nonce: "abc123",
+			want:  "<div nonce=\"x\" class='y'>\n<scripts>\n</div>\n",
+		},
+		{
+			name:  "EscapeNonce",
+			input: "<style></style>\n",
+			nonce: `a"b&c`,
+			want:  "<style nonce=\"a&quot;b&amp;c\"></style>\n",
+		},
+		{
+			name:  "Comment",
+			input: "<!-- <script></script> -->\n",
+			nonce: "abc123",
+			want:  "<!-- <script></script> -->\n",
+		},
+		{
+			name:  "CodeSpan",
+			input: "`<script>`\n",
+			nonce: "abc123",
+			want:  "<p><code>&lt;script&gt;</code></p>",
+		},
+		{
+			name:      "FilterTag",
+			input:     "<script></script>\n<style></style>\n",
+			nonce:     "abc123",
+			filterTag: FilterTagGFM,
+			want:      "&lt;script></script>\n\n\n&lt;style></style>\n",
+		},
+		{
+			name:  "AttributeFilter",
+			input: "<script onload=x nonce=y src=/a.js></script>\n",
+			nonce: "abc123",
+			attributeFilter: func(tag, attr, value string) (string, bool) {
+				if attr == "nonce" {
+					t.Errorf("AttributeFilter called with nonce attribute")
+				}
+				return value, attr != "onload"
+			},
+			want: "<script nonce=\"abc123\"   src=/a.js></script>\n",
+		},
+		{
+			name:  "Empty",
+			input: "<script nonce=x></script>\n",
+			want:  "<script nonce=x></script>\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			r := &HTMLRenderer{
+				ReferenceMap:    refMap,
+				FilterTag:       test.filterTag,
+				AttributeFilter: test.attributeFilter,
+				Nonce:           test.nonce,
+			}
+			buf := new(bytes.Buffer)
+			if err := r.Render(buf, blocks); err != nil {
+				t.Error("Render:", err)
+			}
+			if diff := cmp.Diff(test.want, buf.String()); diff != "" {
+				t.Errorf("-want +got:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHTMLRendererCodeWrapper(t *testing.T) {
+	wrapper := func(lang string) (openHTML, closeHTML string) {
+		if lang == "" {
+			return `<div class="highlight"><pre>`, "</pre></div>"
+		}
+		return `<div class="highlight"><pre><code lang="` + html.EscapeString(lang) + `">`, "</code></pre></div>"
+	}
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "Fenced",
+			input: "```rust extra\nfn main() {}\n```\n",
+			want:  "<div class=\"highlight\"><pre><code lang=\"rust\">fn main() {}\n</code></pre></div>",
+		},
+		{
+			name:  "NoInfoString",
+			input: "```\na < b\n```\n",
+			want:  "<div class=\"highlight\"><pre>a &lt; b\n</pre></div>",
+		},
+		{
+			name:  "Indented",
+			input: "    code\n",
+			want:  "<div class=\"highlight\"><pre>code\n</pre></div>",
+		},
+		{
+			name:  "EscapedLanguage",
+			input: "```a&amp;\\\"b\nx\n```\n",
+			want:  "<div class=\"highlight\"><pre><code lang=\"a&amp;&#34;b\">x\n</code></pre></div>",
+		},
+		{
+			name:  "InList",
+			input: "- ```go\n  x\n  ```\n- y\n",
+			want:  "<ul><li><div class=\"highlight\"><pre><code lang=\"go\">x\n</code></pre></div></li><li>y</li></ul>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			r := &HTMLRenderer{
+				ReferenceMap: refMap,
+				CodeWrapper:  wrapper,
+			}
+			buf := new(bytes.Buffer)
+			if err := r.Render(buf, blocks); err != nil {
+				t.Error("Render:", err)
+			}
+			if diff := cmp.Diff(test.want, buf.String()); diff != "" {
+				t.Errorf("-want +got:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHTMLRendererCodeBlockAttributes(t *testing.T) {
+	meta := func(source []byte, block *Block) []HTMLAttr {
+		info := block.InfoString()
+		if info == nil {
+			return nil
+		}
+		words := strings.Fields(info.Text(source))
+		if len(words) < 2 {
+			return nil
+		}
+		return []HTMLAttr{{Key: "data-meta", Val: strings.Join(words[1:], " ")}}
+	}
+	tests := []struct {
+		name       string
+		input      string
+		prefix     string
+		attributes func(source []byte, block *Block) []HTMLAttr
+		want       string
+	}{
+		{
+			name:  "Default",
+			input: "```go {1,3} title=\"a.go\"\nx\n```\n",
+			want:  "<pre><code class=\"language-go\">x\n</code></pre>",
+		},
+		{
+			name:   "Prefix",
+			input:  "```go\nx\n```\n",
+			prefix: "highlight-source-",
+			want:   "<pre><code class=\"highlight-source-go\">x\n</code></pre>",
+		},
+		{
+			name:       "Metadata",
+			input:      "```go {1,3} title=\"a&b.go\"\nx\n```\n",
+			attributes: meta,
+			want:       "<pre><code class=\"language-go\" data-meta=\"{1,3} title=&#34;a&amp;b.go&#34;\">x\n</code></pre>",
+		},
+		{
+			name:       "NoMetadata",
+			input:      "```go\nx\n```\n",
+			attributes: meta,
+			want:       "<pre><code class=\"language-go\">x\n</code></pre>",
+		},
+		{
+			name:  "MergeClass",
+			input: "```go linenos\nx\n```\n",
+			attributes: func(source []byte, block *Block) []HTMLAttr {
+				return []HTMLAttr{
+					{Key: "class", Val: "line-numbers"},
+					{Key: "data-start", Val: "5"},
+				}
+			},
+			want: "<pre><code class=\"language-go line-numbers\" data-start=\"5\">x\n</code></pre>",
+		},
+		{
+			name:  "ClassWithoutLanguage",
+			input: "    x\n",
+			attributes: func(source []byte, block *Block) []HTMLAttr {
+				return []HTMLAttr{{Key: "class", Val: "plain"}}
+			},
+			want: "<pre><code class=\"plain\">x\n</code></pre>",
+		},
+		{
+			name:  "InvalidKey",
+			input: "```\nx\n```\n",
+			attributes: func(source []byte, block *Block) []HTMLAttr {
+				return []HTMLAttr{
+					{Key: "onclick=alert(1) x", Val: "y"},
+					{Key: "", Val: "y"},
+					{Key: "data-ok", Val: "<\">"},
+				}
+			},
+			want: "<pre><code data-ok=\"&lt;&#34;&gt;\">x\n</code></pre>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			r := &HTMLRenderer{
+				ReferenceMap:         refMap,
+				CodeBlockClassPrefix: test.prefix,
+				CodeBlockAttributes:  test.attributes,
+			}
+			buf := new(bytes.Buffer)
+			if err := r.Render(buf, blocks); err != nil {
+				t.Error("Render:", err)
+			}
+			if diff := cmp.Diff(test.want, buf.String()); diff != "" {
+				t.Errorf("-want +got:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHTMLRendererLinkDefs(t *testing.T) {
+	tests := []struct {
+		name            string
+		input           string
+		trailingNewline bool
+		want            string
+	}{
+		{
+			name:  "Single",
+			input: "See [Foo].\n\n[Foo]: /url \"The title\"\n",
+			want: "<p>See <a href=\"/url\" title=\"The title\">Foo</a>.</p>\n\n" +
+				"<dl><dt>[Foo]</dt><dd><a href=\"/url\">/url</a> \u2014 The title</dd></dl>",
+		},
+		{
+			name:  "NoTitle",
+			input: "[a b]: <my url>\n",
+			want:  "<dl><dt>[a b]</dt><dd><a href=\"my%20url\">my url</a></dd></dl>",
+		},
+		{
+			name:  "Nested",
+			input: "> [q]: /q\n\n- [l]: /l 'x < y'\n\n[z]: /z\n",
+			want: "<blockquote></blockquote>\n\n<ul><li></li></ul>\n\n" +
+				"<dl><dt>[q]</dt><dd><a href=\"/q\">/q</a></dd>" +
+				"<dt>[l]</dt><dd><a href=\"/l\">/l</a> \u2014 x &lt; y</dd>" +
+				"<dt>[z]</dt><dd><a href=\"/z\">/z</a></dd></dl>",
+		},
+		{
+			name:  "Duplicate",
+			input: "[foo]: /first\n[FOO]: /second\n",
+			want:  "\n\n<dl><dt>[foo]</dt><dd><a href=\"/first\">/first</a></dd></dl>",
+		},
+		{
+			name:  "Escaping",
+			input: "[<b>&amp;]: /a&b\n",
+			want:  "<dl><dt>[&lt;b&gt;&amp;amp;]</dt><dd><a href=\"/a&amp;b\">/a&amp;b</a></dd></dl>",
+		},
+		{
+			name:  "None",
+			input: "Hello\n",
+			want:  "<p>Hello</p>",
+		},
+		{
+			name:            "TrailingNewline",
+			input:           "Hello\n\n[x]: /x\n",
+			trailingNewline: true,
+			want:            "<p>Hello</p>\n\n<dl><dt>[x]</dt><dd><a href=\"/x\">/x</a></dd></dl>\n",
+		},
+		{
+			name:  "Separator",
+			input: "[x]: /x\n\nHello\n",
+			want:  "\n\n<p>Hello</p>\n\n<dl><dt>[x]</dt><dd><a href=\"/x\">/x</a></dd></dl>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			r := &HTMLRenderer{
+				ReferenceMap:    refMap,
+				TrailingNewline: test.trailingNewline,
+				RenderLinkDefs:  true,
+			}
+			buf := new(bytes.Buffer)
+			if err := r.Render(buf, blocks); err != nil {
+				t.Error("Render:", err)
+			}
+			if diff := cmp.Diff(test.want, buf.String()); diff != "" {
+				t.Errorf("-want +got:\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestHTMLRendererCharacterReferences verifies that character references in text
+// are decoded and escaped the same way as in attributes.
+func TestHTMLRendererCharacterReferences(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "&ouml; &copy; &#1234;", want: "<p>ö © Ӓ</p>"},
+		{input: "&#38; &amp; &lt; &#62; &quot; &#39;", want: "<p>&amp; &amp; &lt; &gt; &quot; &#39;</p>"},
+		{input: "&#0; &#x110000;", want: "<p>\ufffd \ufffd</p>"},
+		{input: `[&ouml;](/url "&ouml;")`, want: `<p><a href="/url" title="ö">ö</a></p>`},
+		{input: "# &AElig;&#x41;", want: "<h1>ÆA</h1>"},
+		{input: "- &#60;b&#62;", want: "<ul><li>&lt;b&gt;</li></ul>"},
+		{input: "`&ouml;`", want: "<p><code>&amp;ouml;</code></p>"},
+		{input: "&#xG; &#X4G;", want: "<p>&amp;#xG; &amp;#X4G;</p>"},
+	}
+	for _, test := range tests {
+		blocks, refMap := Parse([]byte(test.input))
+		buf := new(bytes.Buffer)
+		if err := RenderHTML(buf, blocks, refMap); err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, buf.String()); diff != "" {
+			t.Errorf("%q (-want +got):\n%s", test.input, diff)
+		}
+	}
+}
+
+func TestHTMLRendererFigureImages(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		disabled bool
+		want     string
+	}{
+		{
+			name:  "Title",
+			input: `![alt](/img.png "a &amp; b \*")` + "\n",
+			want:  `<figure><img src="/img.png" title="a &amp; b *" alt="alt"><figcaption>a &amp; b *</figcaption></figure>`,
+		},
+		{
+			name:  "ReferenceTitle",
+			input: "![alt][ref]\n\n[ref]: /img.png '&lt;b&gt; \\* &ouml;'\n",
+			want:  `<figure><img src="/img.png" title="&lt;b&gt; * ö" alt="alt"><figcaption>&lt;b&gt; * ö</figcaption></figure>`,
+		},
+		{
+			name:  "NoTitle",
+			input: "![alt](/img.png)\n",
+			want:  `<figure><img src="/img.png" alt="alt"></figure>`,
+		},
+		{
+			name:  "EmptyTitle",
+			input: `![alt](/img.png "")` + "\n",
+			want:  `<figure><img src="/img.png" title="" alt="alt"></figure>`,
+		},
+		{
+			name:     "Disabled",
+			input:    `![alt](/img.png "title")` + "\n",
+			disabled: true,
+			want:     `<p><img src="/img.png" title="title" alt="alt"></p>`,
+		},
+		{
+			name:  "WithText",
+			input: `![alt](/img.png "title") caption` + "\n",
+			want:  `<p><img src="/img.png" title="title" alt="alt"> caption</p>`,
+		},
+		{
+			name:  "TwoImages",
+			input: "![a](/a.png)\n![b](/b.png)\n",
+			want:  "<p><img src=\"/a.png\" alt=\"a\">\n<img src=\"/b.png\" alt=\"b\"></p>",
+		},
+		{
+			name:  "LinkedImage",
+			input: "[![alt](/img.png)](/url)\n",
+			want:  `<p><a href="/url"><img src="/img.png" alt="alt"></a></p>`,
+		},
+		{
+			name:  "TightList",
+			input: `- ![alt](/img.png "title")` + "\n",
+			want:  `<ul><li><img src="/img.png" title="title" alt="alt"></li></ul>`,
+		},
+		{
+			name:  "BlockQuote",
+			input: `> ![alt](/img.png "title")` + "\n",
+			want:  `<blockquote><figure><img src="/img.png" title="title" alt="alt"><figcaption>title</figcaption></figure></blockquote>`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			r := &HTMLRenderer{
+				ReferenceMap: refMap,
+				FigureImages: !test.disabled,
+			}
+			buf := new(bytes.Buffer)
+			if err := r.Render(buf, blocks); err != nil {
+				t.Fatal("Render:", err)
+			}
+			if diff := cmp.Diff(test.want, strings.TrimSpace(buf.String())); diff != "" {
+				t.Errorf("output (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNormalizeURI(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{s: "", want: ""},
+		{s: "/url", want: "/url"},
+		{s: "/my uri", want: "/my%20uri"},
+		{s: "/f\u00f6\u00f6", want: "/f%C3%B6%C3%B6"},
+		{s: "foo%20bar", want: "foo%20bar"},
+		{s: "%7b%7B", want: "%7b%7B"},
+		{s: "100%", want: "100%25"},
+		{s: "%ZZ", want: "%25ZZ"},
+		{s: "%aG", want: "%25aG"},
+		{s: "%A", want: "%25A"},
+		{s: "a[b]", want: "a%5Bb%5D"},
+		{s: "http://example.com/[x]", want: "http://example.com/%5Bx%5D"},
+		{s: "http://[::1]/", want: "http://[::1]/"},
+		{s: "http://[::1]", want: "http://[::1]"},
+		{s: "http://[::1]:8080/[x]?[y]#[z]", want: "http://[::1]:8080/%5Bx%5D?%5By%5D#%5Bz%5D"},
+		{s: "http://user@[fe80::1%25eth0]/", want: "http://user@[fe80::1%25eth0]/"},
+		{s: "http://[::1/", want: "http://%5B::1/"},
+		{s: "http://example.com[::1]/", want: "http://example.com%5B::1%5D/"},
+		{s: "//[::1]/", want: "//%5B::1%5D/"},
+		{s: "/x://[::1]/", want: "/x://%5B::1%5D/"},
+		{s: "http://ex\u00e4mple.com/", want: "http://ex%C3%A4mple.com/"},
+		{s: "http://\u4f8b\u3048.jp/", want: "http://%E4%BE%8B%E3%81%88.jp/"},
+	}
+	for _, test := range tests {
+		if got := NormalizeURI(test.s); got != test.want {
+			t.Errorf("NormalizeURI(%q) = %q; want %q", test.s, got, test.want)
+		}
+	}
+}
+
+// TestNormalizeURISpec compares NormalizeURI
+// with the href and src attributes produced by cmark
+// for the links, images, and autolinks in the CommonMark specification's examples.
+// testdata/normalize_uri.json was generated by pairing
+// the destinations of each example's links
+// with the attributes in the example's expected HTML,
+// skipping examples that contain raw HTML.
+func TestNormalizeURISpec(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "normalize_uri.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []struct {
+		Example     int
+		Destination string
+		Href        string
+	}
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) == 0 {
+		t.Fatal("No test vectors")
+	}
+	for _, v := range vectors {
+		if got := NormalizeURI(v.Destination); got != v.Href {
+			t.Errorf("Example %d: NormalizeURI(%q) = %q; want %q", v.Example, v.Destination, got, v.Href)
+		}
+	}
+}
+
+// TestHTMLRendererEmptyImageAlt verifies that images without a description
+// render an empty alt attribute,
+// even when their only children are the destination and title.
+func TestHTMLRendererEmptyImageAlt(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "![](src.png)", want: `<p><img src="src.png" alt=""></p>`},
+		{input: "![](<>)", want: `<p><img src="" alt=""></p>`},
+		{input: `![](/u "title")`, want: `<p><img src="/u" title="title" alt=""></p>`},
+		{input: "![](\n/u\n'title'\n)", want: `<p><img src="/u" title="title" alt=""></p>`},
+		{input: "![<b>](/u)", want: `<p><img src="/u" alt=""></p>`},
+		{input: "![][ref]\n\n[ref]: /u \"title\"\n", want: `<p><img src="/u" title="title" alt=""></p>`},
+		{input: "![x](/u)", want: `<p><img src="/u" alt="x"></p>`},
+	}
+	for _, test := range tests {
+		blocks, refMap := Parse([]byte(test.input))
+		buf := new(bytes.Buffer)
+		if err := RenderHTML(buf, blocks, refMap); err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, strings.TrimSpace(buf.String())); diff != "" {
+			t.Errorf("%q (-want +got):\n%s", test.input, diff)
+		}
+	}
+
+	t.Run("DestinationAndTitleOnly", func(t *testing.T) {
+		source := []byte(`/u"t"`)
+		image := &Inline{
+			kind: ImageKind,
+			span: Span{Start: 0, End: len(source)},
+			children: []*Inline{
+				{
+					kind: LinkDestinationKind,
+					span: Span{Start: 0, End: 2},
+					children: []*Inline{
+						{kind: TextKind, span: Span{Start: 0, End: 2}},
+					},
+				},
+				{
+					kind: LinkTitleKind,
+					span: Span{Start: 2, End: 5},
+					children: []*Inline{
+						{kind: TextKind, span: Span{Start: 3, End: 4}},
+					},
+				},
+			},
+		}
+		got := string(new(HTMLRenderer).AppendInlines(nil, source, []*Inline{image}))
+		const want = `<img src="/u" title="t" alt="">`
+		if got != want {
+			t.Errorf("AppendInlines(...) = %q; want %q", got, want)
+		}
+	})
+
+	t.Run("NoChildren", func(t *testing.T) {
+		image := &Inline{kind: ImageKind}
+		got := string(new(HTMLRenderer).AppendInlines(nil, nil, []*Inline{image}))
+		const want = `<img src="" alt="">`
+		if got != want {
+			t.Errorf("AppendInlines(...) = %q; want %q", got, want)
+		}
+	})
+}
+
+// TestHTMLRendererFilterAcrossBlocks verifies that tag filtering
+// does not depend on raw HTML in previous blocks.
+// Browsers do not end comments, processing instructions, and CDATA sections
+// in the same places as CommonMark,
+// so treating a later block as being inside one of them
+// could leave a disallowed tag unescaped.
+func TestHTMLRendererFilterAcrossBlocks(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{
+			name:  "Comment",
+			input: "<div>\n<!--\n\n<div>\n<script>alert(1)</script>\n</div>\n",
+		},
+		{
+			name:  "ProcessingInstruction",
+			input: "<div>\n<?x\n\n<b>\n<script>alert(1)</script>\n",
+		},
+		{
+			name:  "CDATA",
+			input: "<div>\n<![CDATA[\n\n<b>\n<script>alert(1)</script>\n",
+		},
+		{
+			name:  "Script",
+			input: "<div>\n<script>\n\n<div>\nalert(1)\n\n</script>\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			if len(blocks) < 2 {
+				t.Fatalf("input parsed into %d blocks; want >=2", len(blocks))
+			}
+			r := &HTMLRenderer{
+				ReferenceMap: refMap,
+				FilterTag:    FilterTagGFM,
+			}
+			buf := new(bytes.Buffer)
+			if err := r.Render(buf, blocks); err != nil {
+				t.Error("Render:", err)
+			}
+			if got := buf.String(); strings.Contains(got, "<script") {
+				t.Errorf("Output contains unescaped <script> tag:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestHTMLRendererNoLanguageClass(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "NoInfoString",
+			input: "```\ncode\n```\n",
+			want:  "<pre><code>code\n</code></pre>",
+		},
+		{
+			name:  "BlankInfoString",
+			input: "```   \ncode\n```\n",
+			want:  "<pre><code>code\n</code></pre>",
+		},
+		{
+			name:  "TildeFence",
+			input: "~~~\ncode\n~~~\n",
+			want:  "<pre><code>code\n</code></pre>",
+		},
+		{
+			name:  "Indented",
+			input: "    code\n",
+			want:  "<pre><code>code\n</code></pre>",
+		},
+		{
+			name:  "WithLanguage",
+			input: "```go\ncode\n```\n",
+			want:  `<pre><code class="language-go">code` + "\n</code></pre>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			buf := new(bytes.Buffer)
+			if err := RenderHTML(buf, blocks, refMap); err != nil {
+				t.Error("RenderHTML:", err)
+			}
+			if diff := cmp.Diff(test.want, buf.String()); diff != "" {
+				t.Errorf("-want +got:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestImageAltText(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "Plain",
+			input: "![foo bar](x.png)",
+			want:  `<p><img src="x.png" alt="foo bar"></p>`,
+		},
+		{
+			name:  "Quotes",
+			input: `![a "b"](x.png)`,
+			want:  `<p><img src="x.png" alt="a &quot;b&quot;"></p>`,
+		},
+		{
+			name:  "Ampersand",
+			input: "![a & b](x.png)",
+			want:  `<p><img src="x.png" alt="a &amp; b"></p>`,
+		},
+		{
+			name:  "EntityReference",
+			input: "![a &amp; b &quot;c&quot; &#60;](x.png)",
+			want:  `<p><img src="x.png" alt="a &amp; b &quot;c&quot; &lt;"></p>`,
+		},
+		{
+			name:  "CodeSpan",
+			input: "![a `<b>` c](x.png)",
+			want:  `<p><img src="x.png" alt="a &lt;b&gt; c"></p>`,
+		},
+		{
+			name:  "Emphasis",
+			input: "![*foo* **bar**](x.png)",
+			want:  `<p><img src="x.png" alt="foo bar"></p>`,
+		},
+		{
+			name:  "NestedImage",
+			input: `![foo ![bar "baz"](y.png)](x.png)`,
+			want:  `<p><img src="x.png" alt="foo bar &quot;baz&quot;"></p>`,
+		},
+		{
+			name:  "RawHTML",
+			input: `![a <b title="x">c</b>](x.png)`,
+			want:  `<p><img src="x.png" alt="a c"></p>`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			buf := new(bytes.Buffer)
+			if err := RenderHTML(buf, blocks, refMap); err != nil {
+				t.Error("RenderHTML:", err)
+			}
+			if got := buf.String(); got != test.want {
+				t.Errorf("output = %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRenderHTMLDeepNesting(t *testing.T) {
+	const depth = 100_000
+	blocks, refMap := Parse(deeplyNestedStrong(depth))
+	if len(blocks) != 1 {
+		t.Fatalf("Parse returned %d blocks; want 1", len(blocks))
+	}
+
+	// Recursing once per level would exceed this limit.
+	defer debug.SetMaxStack(debug.SetMaxStack(1 << 20))
+
+	buf := new(bytes.Buffer)
+	if err := RenderHTML(buf, blocks, refMap); err != nil {
+		t.Fatal("RenderHTML:", err)
+	}
+	want := "<p>" + strings.Repeat("<strong>", depth) + "a" + strings.Repeat("</strong>", depth) + "</p>"
+	if got := buf.String(); got != want {
+		t.Errorf("RenderHTML output does not contain %d nested strong elements", depth)
+	}
+
+	root := blocks[0].Block.Child(0).Inline()
+	if !root.ContainsKind(TextKind) {
+		t.Error("ContainsKind(TextKind) = false; want true")
+	}
+	if root.ContainsKind(EmphasisKind) {
+		t.Error("ContainsKind(EmphasisKind) = true; want false")
+	}
+	clone := root.Clone()
+	if len(clone.DescendantsOfKind(StrongKind)) != depth-1 {
+		t.Errorf("Clone() has %d strong descendants; want %d", len(clone.DescendantsOfKind(StrongKind)), depth-1)
+	}
+}
+
+// deeplyNestedStrong returns a paragraph of depth nested strong emphasis spans.
+func deeplyNestedStrong(depth int) []byte {
+	delim := strings.Repeat("**", depth)
+	return []byte(delim + "a" + delim + "\n")
+}
+
+func BenchmarkRenderHTML(b *testing.B) {
+	b.Run("Spec", func(b *testing.B) {
+		input := new(bytes.Buffer)
+		testsuite := loadTestSuite(b)
+		for i, test := range testsuite {
+			if i > 0 {
+				input.WriteString("\n\n")
+			}
+			input.WriteString(test.Markdown)
+		}
+		doc, refMap := Parse(input.Bytes())
+		b.ResetTimer()
+		b.SetBytes(int64(input.Len()))
+		b.ReportMetric(float64(len(testsuite)), "examples/op")
+
+		for i := 0; i < b.N; i++ {
+			RenderHTML(io.Discard, doc, refMap)
+		}
+	})
+
+	b.Run("Goldmark", func(b *testing.B) {
+		input, err := os.ReadFile(filepath.Join("testdata", "goldmark_bench.md"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		doc, refMap := Parse(input)
+		b.ResetTimer()
+		b.SetBytes(int64(len(input)))
+
+		for i := 0; i < b.N; i++ {
+			RenderHTML(io.Discard, doc, refMap)
+		}
+	})
+
+	b.Run("DeepNesting", func(b *testing.B) {
+		input := deeplyNestedStrong(10_000)
 		doc, refMap := Parse(input)
 		b.ResetTimer()
 		b.SetBytes(int64(len(input)))
@@ -0,0 +1,63 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package htmltemplate_test
+
+import (
+	"html/template"
+	"os"
+
+	"zombiezen.com/go/commonmark"
+	"zombiezen.com/go/commonmark/htmltemplate"
+)
+
+func ExampleRender() {
+	// Parse the Markdown document.
+	blocks, refMap := commonmark.Parse([]byte(
+		"Hello, *World*!<sup>1</sup> <style>p { color: red }</style>\n" +
+			"\n" +
+			"[Click me](javascript:alert('hi'))\n",
+	))
+
+	// Render the document to HTML,
+	// escaping tags disallowed by GitHub Flavored Markdown
+	// and then removing anything not permitted by the sanitizer policy.
+	r := &commonmark.HTMLRenderer{
+		ReferenceMap: refMap,
+		FilterTag:    commonmark.FilterTagGFM,
+	}
+	body, err := htmltemplate.Render(r, blocks, commonmark.DefaultSanitizePolicy())
+	if err != nil {
+		panic(err)
+	}
+
+	// Use the result in a template.
+	tmpl := template.Must(template.New("page").Parse(
+		"<title>{{.Title}}</title>\n<main>{{.Body}}</main>\n",
+	))
+	err = tmpl.Execute(os.Stdout, map[string]any{
+		"Title": "Greetings & Salutations",
+		"Body":  body,
+	})
+	if err != nil {
+		panic(err)
+	}
+	// Output:
+	// <title>Greetings &amp; Salutations</title>
+	// <main><p>Hello, <em>World</em>!<sup>1</sup> &lt;style&gt;p { color: red }</p>
+	//
+	// <p><a>Click me</a></p></main>
+}
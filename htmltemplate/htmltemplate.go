@@ -0,0 +1,48 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package htmltemplate renders CommonMark documents
+// for use in [html/template] templates.
+// It is a separate package so that programs that do not use html/template
+// do not need to depend on it.
+package htmltemplate
+
+import (
+	"html/template"
+	"strings"
+
+	"zombiezen.com/go/commonmark"
+)
+
+// Render renders the given blocks with r,
+// removes any elements, attributes, or URLs not permitted by the policy
+// as described in [commonmark.RenderHTMLSafe],
+// and returns the result as a [template.HTML] value.
+// Templates insert the returned value without escaping it,
+// so it should only be used in an HTML text context
+// (e.g. as the content of a <div>).
+//
+// Like [commonmark.RenderHTMLSafe], Render does not balance tags in raw HTML,
+// so an unclosed element in the document may affect
+// the rest of the template's output.
+// Set r.IgnoreRaw to prevent this.
+func Render(r *commonmark.HTMLRenderer, blocks []*commonmark.RootBlock, policy commonmark.SanitizePolicy) (template.HTML, error) {
+	sb := new(strings.Builder)
+	if err := r.RenderSafe(sb, blocks, policy); err != nil {
+		return "", err
+	}
+	return template.HTML(sb.String()), nil
+}
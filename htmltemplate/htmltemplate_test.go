@@ -0,0 +1,87 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package htmltemplate
+
+import (
+	"html/template"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/commonmark"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		renderer commonmark.HTMLRenderer
+		want     string
+	}{
+		{
+			name:  "Markdown",
+			input: "Hello, *World*!\n",
+			want:  "<div><p>Hello, <em>World</em>!</p></div>",
+		},
+		{
+			name:  "JavaScriptLink",
+			input: "[a](javascript:alert(1))\n",
+			want:  "<div><p><a>a</a></p></div>",
+		},
+		{
+			name:  "Script",
+			input: "<script>alert(1)</script>\n\nHi\n",
+			want:  "<div>\n\n\n<p>Hi</p></div>",
+		},
+		{
+			name:  "EventHandler",
+			input: "<b onclick=\"alert(1)\">bold</b>\n",
+			want:  "<div><p><b>bold</b></p></div>",
+		},
+		{
+			name:     "IgnoreRaw",
+			input:    "<b>bold\n",
+			renderer: commonmark.HTMLRenderer{IgnoreRaw: true},
+			want:     "<div><p>bold</p></div>",
+		},
+		{
+			name:     "FilterTag",
+			input:    "<title>x</title>\n",
+			renderer: commonmark.HTMLRenderer{FilterTag: commonmark.FilterTagGFM},
+			want:     "<div>&lt;title&gt;x\n</div>",
+		},
+	}
+	tmpl := template.Must(template.New("").Parse("<div>{{.}}</div>"))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := commonmark.Parse([]byte(test.input))
+			r := test.renderer
+			r.ReferenceMap = refMap
+			h, err := Render(&r, blocks, commonmark.DefaultSanitizePolicy())
+			if err != nil {
+				t.Fatal("Render:", err)
+			}
+			got := new(strings.Builder)
+			if err := tmpl.Execute(got, h); err != nil {
+				t.Fatal("Execute:", err)
+			}
+			if diff := cmp.Diff(test.want, got.String()); diff != "" {
+				t.Errorf("-want +got:\n%s", diff)
+			}
+		})
+	}
+}
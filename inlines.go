@@ -17,21 +17,31 @@
 package commonmark
 
 import (
+	"bytes"
 	"fmt"
 	"html"
 	"strings"
 	"unicode/utf8"
-
-	"golang.org/x/text/cases"
 )
 
 // Inline represents CommonMark content elements like text, links, or emphasis.
 type Inline struct {
-	kind     InlineKind
-	span     Span
-	indent   int
+	kind   InlineKind
+	span   Span
+	indent int
+	// ref is the normalized label of a link or image,
+	// or the resolved value of an [EmojiKind] node.
 	ref      string
 	children []*Inline
+
+	// delimChar is the character used to delimit
+	// an [EmphasisKind], [StrongKind], or [CodeSpanKind] node.
+	delimChar byte
+	// delimRun is the number of delimiter characters on each side
+	// of an [EmphasisKind], [StrongKind], or [CodeSpanKind] node.
+	delimRun int
+	// breakStyle is the style of a [HardLineBreakKind] node.
+	breakStyle HardBreakStyle
 }
 
 // Kind returns the type of inline node
@@ -51,6 +61,30 @@ func (inline *Inline) Span() Span {
 	return inline.span
 }
 
+// SourceText returns the bytes of source that the node was parsed from,
+// including any delimiters like emphasis markers, backticks, or link brackets,
+// with backslash escapes and character references left unresolved.
+// source must be the Source of the [RootBlock] that contains the node.
+// SourceText returns nil if the node is nil or its span is not valid within source.
+// The returned slice aliases source.
+func (inline *Inline) SourceText(source []byte) []byte {
+	span := inline.Span()
+	if !span.IsValid() || span.End > len(source) {
+		return nil
+	}
+	return spanSlice(source, span)
+}
+
+// Raw returns the verbatim bytes of source that the node spans.
+// Unlike [*Inline.Text], Raw does not decode character references
+// or remove delimiters, which makes it useful for syntax highlighters
+// and formatters that need to preserve the original source.
+// Raw is equivalent to [*Inline.SourceText].
+// [*Block.Raw] is the block-level analogue.
+func (inline *Inline) Raw(source []byte) []byte {
+	return inline.SourceText(source)
+}
+
 // IndentWidth returns the number of spaces the [IndentKind] span represents,
 // or zero if the node is nil or of a different type.
 func (inline *Inline) IndentWidth() int {
@@ -60,13 +94,49 @@ func (inline *Inline) IndentWidth() int {
 	return inline.indent
 }
 
+// DelimiterChar returns the character used to delimit
+// an [EmphasisKind] or [StrongKind] node ('*' or '_')
+// or a [CodeSpanKind] node ('`').
+// DelimiterChar returns zero if the node is nil or of a different type.
+func (inline *Inline) DelimiterChar() byte {
+	if inline == nil {
+		return 0
+	}
+	return inline.delimChar
+}
+
+// DelimiterRun returns the number of delimiter characters
+// on each side of an [EmphasisKind] node (1), a [StrongKind] node (2),
+// or a [CodeSpanKind] node (the length of the backtick strings).
+// DelimiterRun returns zero if the node is nil or of a different type.
+func (inline *Inline) DelimiterRun() int {
+	if inline == nil {
+		return 0
+	}
+	return inline.delimRun
+}
+
+// HardBreakStyle returns the way a [HardLineBreakKind] node was written in the source.
+// HardBreakStyle returns zero if the node is nil, of a different type,
+// or was not created by the parser.
+func (inline *Inline) HardBreakStyle() HardBreakStyle {
+	if inline.Kind() != HardLineBreakKind {
+		return 0
+	}
+	return inline.breakStyle
+}
+
 // Text converts a non-container inline node into a string.
+// Character references are decoded and delimiters are omitted:
+// use [*Inline.Raw] to obtain the node's verbatim source bytes.
 func (inline *Inline) Text(source []byte) string {
 	switch inline.Kind() {
 	case TextKind, RawHTMLKind:
 		return string(spanSlice(source, inline.Span()))
 	case CharacterReferenceKind:
 		return html.UnescapeString(string(spanSlice(source, inline.Span())))
+	case EmojiKind:
+		return inline.ref
 	case SoftLineBreakKind:
 		if inline.Span().Len() == 0 {
 			return "\n"
@@ -80,7 +150,7 @@ func (inline *Inline) Text(source []byte) string {
 			sb.WriteByte(' ')
 		}
 		return sb.String()
-	case InfoStringKind, LinkDestinationKind, LinkTitleKind:
+	case InfoStringKind, LinkDestinationKind, LinkTitleKind, DirectiveAttributesKind, WikiLinkTargetKind:
 		sb := new(strings.Builder)
 		sb.Grow(inline.Span().Len())
 		for i, n := 0, inline.ChildCount(); i < n; i++ {
@@ -97,10 +167,25 @@ func (inline *Inline) Text(source []byte) string {
 	}
 }
 
+// IsLink reports whether the node is a [LinkKind] node.
+func (inline *Inline) IsLink() bool {
+	return inline.Kind() == LinkKind
+}
+
+// IsImage reports whether the node is an [ImageKind] node.
+func (inline *Inline) IsImage() bool {
+	return inline.Kind() == ImageKind
+}
+
+// IsLinkOrImage reports whether the node is a [LinkKind] or [ImageKind] node.
+func (inline *Inline) IsLinkOrImage() bool {
+	return inline.IsLink() || inline.IsImage()
+}
+
 // LinkDestination returns the destination child of a [LinkKind] node
 // or nil if none is present or the node is not a link.
 func (inline *Inline) LinkDestination() *Inline {
-	if k := inline.Kind(); k != LinkKind && k != ImageKind {
+	if !inline.IsLinkOrImage() {
 		return nil
 	}
 	for i := len(inline.children) - 1; i >= len(inline.children)-2 && i >= 0; i-- {
@@ -114,7 +199,7 @@ func (inline *Inline) LinkDestination() *Inline {
 // LinkTitle returns the title child of a [LinkKind] node
 // or nil if none is present or the node is not a link.
 func (inline *Inline) LinkTitle() *Inline {
-	if k := inline.Kind(); k != LinkKind && k != ImageKind {
+	if !inline.IsLinkOrImage() {
 		return nil
 	}
 	for i := len(inline.children) - 1; i >= len(inline.children)-2 && i >= 0; i-- {
@@ -125,11 +210,57 @@ func (inline *Inline) LinkTitle() *Inline {
 	return nil
 }
 
+// DirectiveName returns the name of a [DirectiveKind] node
+// or the empty string if the node is not a directive.
+func (inline *Inline) DirectiveName(source []byte) string {
+	if inline.Kind() != DirectiveKind {
+		return ""
+	}
+	// Skip the leading colon.
+	start := inline.Span().Start + 1
+	return string(source[start : start+parseDirectiveName(source[start:])])
+}
+
+// EmojiName returns the shortcode name of an [EmojiKind] node
+// (e.g. "smile" for ":smile:")
+// or the empty string if the node is not an emoji.
+func (inline *Inline) EmojiName(source []byte) string {
+	if inline.Kind() != EmojiKind {
+		return ""
+	}
+	span := inline.Span()
+	return string(source[span.Start+1 : span.End-1])
+}
+
+// DirectiveAttributes returns the attributes child of a [DirectiveKind] node
+// or nil if none is present or the node is not a directive.
+func (inline *Inline) DirectiveAttributes() *Inline {
+	if inline.Kind() != DirectiveKind || len(inline.children) == 0 {
+		return nil
+	}
+	if last := inline.children[len(inline.children)-1]; last.Kind() == DirectiveAttributesKind {
+		return last
+	}
+	return nil
+}
+
+// WikiLinkTarget returns the target child of a [WikiLinkKind] node
+// or nil if the node is not a wiki link.
+func (inline *Inline) WikiLinkTarget() *Inline {
+	if inline.Kind() != WikiLinkKind || len(inline.children) == 0 {
+		return nil
+	}
+	if first := inline.children[0]; first.Kind() == WikiLinkTargetKind {
+		return first
+	}
+	return nil
+}
+
 // LinkReference returns the [normalized form] of a link label.
 //
 // [normalized form]: https://spec.commonmark.org/0.30/#matches
 func (inline *Inline) LinkReference() string {
-	if k := inline.Kind(); (k == LinkKind || k == ImageKind) && len(inline.children) > 0 {
+	if inline.IsLinkOrImage() && len(inline.children) > 0 {
 		if last := inline.children[len(inline.children)-1]; last.Kind() == LinkLabelKind {
 			// Full reference link.
 			return last.LinkReference()
@@ -138,40 +269,25 @@ func (inline *Inline) LinkReference() string {
 	return inline.ref
 }
 
-func transformLinkReference(source []byte, nodes []*Inline) string {
-	if len(nodes) == 0 {
-		return ""
-	}
-	return transformLinkReferenceSpan(source, nodes, Span{
-		Start: nodes[0].Span().Start,
-		End:   nodes[len(nodes)-1].Span().End,
-	})
-}
-
+// transformLinkReferenceSpan returns the [normalized form]
+// of the link label text in the given span of nodes.
+// Link reference definitions and all forms of reference links
+// use transformLinkReferenceSpan to compute their labels
+// so that they match consistently.
+// As required by the specification,
+// backslash escapes and character references are not expanded.
+//
+// [normalized form]: https://spec.commonmark.org/0.30/#matches
 func transformLinkReferenceSpan(source []byte, nodes []*Inline, span Span) string {
 	sb := new(strings.Builder)
 	r := newInlineByteReader(source, nodes, span.Start)
 	for r.pos < span.End {
-		c := r.current()
-		if isSpaceTabOrLineEnding(c) {
-			// Collapse consecutive whitespace to a single space.
-			sb.WriteByte(' ')
-			if !r.next() {
-				break
-			}
-			for r.pos < span.End && isSpaceTabOrLineEnding(r.current()) {
-				if !r.next() {
-					break
-				}
-			}
-		} else {
-			sb.WriteByte(c)
-			if !r.next() {
-				break
-			}
+		sb.WriteByte(r.current())
+		if !r.next() {
+			break
 		}
 	}
-	return cases.Fold().String(strings.TrimSpace(sb.String()))
+	return normalizeLinkLabel(sb.String())
 }
 
 // ChildCount returns the number of children the node has.
@@ -188,6 +304,104 @@ func (inline *Inline) Child(i int) *Inline {
 	return inline.children[i]
 }
 
+// DescendantsOfKind returns the descendants of the node
+// (not including the node itself) that are of the given kind, in pre-order.
+// DescendantsOfKind returns nil if there are no such descendants.
+func (inline *Inline) DescendantsOfKind(kind InlineKind) []*Inline {
+	var result []*Inline
+	for _, child := range inline.children {
+		result = append(result, CollectInlines(child.AsNode(), kind)...)
+	}
+	return result
+}
+
+// ContainsKind reports whether any descendant of the node
+// (not including the node itself) is of the given kind.
+// It is equivalent to len(inline.DescendantsOfKind(kind)) > 0,
+// but stops as soon as it finds a match.
+func (inline *Inline) ContainsKind(kind InlineKind) bool {
+	// Use an explicit stack so that deeply nested inlines
+	// cannot overflow the goroutine stack.
+	stack := append([]*Inline(nil), inline.children...)
+	for len(stack) > 0 {
+		curr := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if curr.Kind() == kind {
+			return true
+		}
+		stack = append(stack, curr.children...)
+	}
+	return false
+}
+
+// RemoveChildren removes the children in the range [i, j) from the node.
+// RemoveChildren panics if i or j are out of range.
+func (inline *Inline) RemoveChildren(i, j int) {
+	if i < 0 || j < i || j > inline.ChildCount() {
+		panic("RemoveChildren range out of bounds")
+	}
+	inline.children = deleteInlineNodes(inline.children, i, j)
+}
+
+// Clone returns a deep copy of the node and its descendants.
+// The copy does not share any nodes or child slices with inline,
+// so either tree can be modified without affecting the other.
+// Every property of each node (its kind, span, indentation width,
+// link reference, and delimiters) is copied.
+// This makes Clone suitable for duplicating subtrees in transformations,
+// like copying a link's text into an image description.
+// Spans are copied as-is,
+// so the copy must be used with the same source as inline.
+// Calling Clone on nil returns nil.
+func (inline *Inline) Clone() *Inline {
+	if inline == nil {
+		return nil
+	}
+	root := new(Inline)
+	*root = *inline
+	// Use an explicit stack so that deeply nested inlines
+	// cannot overflow the goroutine stack.
+	stack := []*Inline{root}
+	for len(stack) > 0 {
+		clone := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if clone.children == nil {
+			continue
+		}
+		children := make([]*Inline, len(clone.children))
+		for i, child := range clone.children {
+			children[i] = new(Inline)
+			*children[i] = *child
+		}
+		clone.children = children
+		stack = append(stack, children...)
+	}
+	return root
+}
+
+// DeepCopy returns a copy of the node and all of its descendants
+// that shares no pointers with inline,
+// for building synthetic trees out of existing subtrees.
+// DeepCopy is equivalent to [*Inline.Clone].
+// Calling DeepCopy on nil returns nil.
+func (inline *Inline) DeepCopy() *Inline {
+	return inline.Clone()
+}
+
+// TruncateText shortens a [TextKind] or [RawHTMLKind] node
+// so that its span covers only its first n bytes.
+// TruncateText panics if the node is of a different kind
+// or if n is not in the range [0, inline.Span().Len()].
+func (inline *Inline) TruncateText(n int) {
+	if k := inline.Kind(); k != TextKind && k != RawHTMLKind {
+		panic("TruncateText called on non-text node")
+	}
+	if n < 0 || n > inline.span.Len() {
+		panic("TruncateText length out of range")
+	}
+	inline.span.End = inline.span.Start + n
+}
+
 // InlineKind is an enumeration of values returned by [*Inline.Kind].
 type InlineKind uint16
 
@@ -213,8 +427,11 @@ const (
 	// [info string]: https://spec.commonmark.org/0.30/#info-string
 	InfoStringKind
 	// EmphasisKind is used for text that has stress emphasis.
+	// The node's span includes its delimiters,
+	// which are not included in its children.
 	EmphasisKind
 	// StrongKind is used for text that has strong emphasis.
+	// Like [EmphasisKind], the node's span includes its delimiters.
 	StrongKind
 	// LinkKind is used for hyperlinks.
 	// The [*Inline.LinkDestination], [*Inline.LinkTitle], and [*Inline.LinkReference] methods
@@ -235,7 +452,8 @@ const (
 	LinkLabelKind
 	// CodeSpanKind is used for inline code in a non-code-block context.
 	CodeSpanKind
-	// AutolinkKind is used for [autolinks].
+	// AutolinkKind is used for [autolinks]
+	// and for extended autolinks (see [InlineParser.ExtendedAutolinks]).
 	// The node's content is also the link's destination.
 	//
 	// [autolinks]: https://spec.commonmark.org/0.30/#autolinks
@@ -250,32 +468,262 @@ const (
 
 	// UnparsedKind is used for inline text that has not been tokenized.
 	UnparsedKind
+
+	// DirectiveKind is used for text directives
+	// (e.g. ":abbr[HTML]{title=\"HyperText Markup Language\"}"),
+	// which are only recognized if [InlineParser.Directives] is true.
+	// The node's children are the label's contents,
+	// optionally followed by a [DirectiveAttributesKind] node.
+	// The [*Inline.DirectiveName] and [*Inline.DirectiveAttributes] methods
+	// can be used to retrieve specific parts of the directive.
+	DirectiveKind
+	// DirectiveAttributesKind is used as part of a [DirectiveKind] node
+	// to hold the attributes between braces.
+	// Its contents are implementation-defined.
+	DirectiveAttributesKind
+	// EmojiKind is used for emoji shortcodes (e.g. ":smile:"),
+	// which are only recognized if [InlineParser.EmojiResolver] is not nil.
+	// [*Inline.Text] returns the value that the shortcode resolved to.
+	EmojiKind
+	// WikiLinkKind is used for wiki links (e.g. "[[Page Name|display text]]"),
+	// which are only recognized if [InlineParser.WikiLinks] is true.
+	// The node's first child is a [WikiLinkTargetKind] node,
+	// followed by a [TextKind] node for the display text.
+	// If the link does not have display text,
+	// the display text node has the same span as the target.
+	WikiLinkKind
+	// WikiLinkTargetKind is used as part of a [WikiLinkKind] node
+	// to hold the name of the linked page.
+	// [*Inline.Text] returns the target.
+	WikiLinkTargetKind
+)
+
+// HardBreakStyle is an enumeration of the ways
+// that a [hard line break] can be written.
+//
+// [hard line break]: https://spec.commonmark.org/0.30/#hard-line-breaks
+type HardBreakStyle int
+
+const (
+	// HardBreakBackslash indicates a hard line break
+	// written as a backslash at the end of a line.
+	HardBreakBackslash HardBreakStyle = 1 + iota
+	// HardBreakSpaces indicates a hard line break
+	// written as two or more spaces at the end of a line.
+	HardBreakSpaces
 )
 
 // An InlineParser converts [UnparsedKind] [Inline] nodes
 // into inline trees.
 type InlineParser struct {
 	ReferenceMatcher ReferenceMatcher
+
+	// AutolinkSchemes is the list of URI schemes
+	// that are permitted in [autolinks].
+	// Schemes are compared case-insensitively.
+	// Email autolinks are permitted if AutolinkSchemes contains "mailto".
+	// Autolinks with other schemes are parsed
+	// as if they were not autolinks:
+	// usually as literal text.
+	// If AutolinkSchemes is nil, then all autolinks are permitted.
+	//
+	// [autolinks]: https://spec.commonmark.org/0.30/#autolinks
+	AutolinkSchemes []string
+
+	// If Directives is true, then the parser recognizes text directives
+	// as [DirectiveKind] nodes.
+	// A text directive is a colon, a name, a label in brackets,
+	// and optional attributes in braces (e.g. ":kbd[Ctrl]{.key}").
+	// The colon must not follow an ASCII letter or digit.
+	// Text directives are not part of the CommonMark specification.
+	Directives bool
+
+	// If EmojiResolver is not nil, then the parser recognizes emoji shortcodes
+	// as [EmojiKind] nodes.
+	// A shortcode is a name made of ASCII letters, digits, '_', '+', or '-'
+	// between two colons (e.g. ":smile:")
+	// that is not adjacent to an ASCII letter or digit.
+	// Shortcodes that EmojiResolver does not resolve are left as literal text.
+	// Emoji shortcodes are not part of the CommonMark specification.
+	EmojiResolver EmojiResolver
+
+	// If WikiLinks is true, then the parser recognizes wiki links
+	// as [WikiLinkKind] nodes.
+	// A wiki link is a target followed by optional display text
+	// separated by a '|', all between double brackets
+	// (e.g. "[[Page Name]]" or "[[Page Name|display text]]").
+	// Brackets inside the target must be balanced,
+	// and a wiki link may not contain backticks, '<', or line endings.
+	// Like other links, wiki links may not contain links,
+	// so a wiki link inside a link's text prevents the outer link from forming.
+	// Wiki links are not part of the CommonMark specification.
+	WikiLinks bool
+
+	// If ExtendedAutolinks is true, then the parser recognizes
+	// URLs that start with "http://", "https://", or "ftp://"
+	// as [AutolinkKind] nodes without the surrounding angle brackets,
+	// as in the [GitHub Flavored Markdown autolinks extension].
+	// The URL must be at the beginning of a line
+	// or follow whitespace, '*', '_', '~', or '('.
+	// It ends at whitespace, '<', or ']'.
+	// Like cmark-gfm, URLs are not recognized after a '[' or "![" opener
+	// that has not been closed yet,
+	// so that link text and image descriptions can contain bare URLs.
+	// Trailing punctuation, unbalanced closing parentheses,
+	// and trailing entity-like sequences (e.g. "&hl;")
+	// are not included in the link.
+	// AutolinkSchemes applies to extended autolinks,
+	// but [ConstructAutolink] in DisabledConstructs does not.
+	//
+	// [GitHub Flavored Markdown autolinks extension]: https://github.github.com/gfm/#autolinks-extension-
+	ExtendedAutolinks bool
+
+	// DisabledConstructs is the set of constructs that the parser does not recognize.
+	// Only [ConstructRawHTML], [ConstructImage], and [ConstructAutolink]
+	// affect inline parsing.
+	DisabledConstructs Constructs
+}
+
+// An EmojiResolver maps emoji shortcode names to their values.
+// The name does not include the surrounding colons.
+type EmojiResolver interface {
+	Resolve(name string) (value string, ok bool)
+}
+
+// EmojiMap is an [EmojiResolver] that maps shortcode names to values.
+type EmojiMap map[string]string
+
+// Resolve returns the value for the given name.
+func (m EmojiMap) Resolve(name string) (value string, ok bool) {
+	value, ok = m[name]
+	return value, ok
 }
 
 // Rewrite replaces any [UnparsedKind] nodes in the given root block
 // with parsed versions of the node.
 func (p *InlineParser) Rewrite(root *RootBlock) {
-	stack := []*Block{&root.Block}
-	for len(stack) > 0 {
-		curr := stack[len(stack)-1]
-		stack = stack[:len(stack)-1]
+	p.rewrite(root, nil, -1)
+}
+
+// RewriteN is like [*InlineParser.Rewrite],
+// but parses the inline children of at most maxBlocks blocks
+// so that callers can interleave other work while parsing a large block.
+// Blocks are rewritten in document order,
+// starting from the position recorded in progress.
+// The zero value of [RewriteProgress] starts from the beginning of root.
+// RewriteN returns the progress to pass to the next call for the same root
+// and reports whether every block in root has been rewritten.
+// Blocks that no longer contain [UnparsedKind] nodes are skipped.
+// Between calls, root may be rendered as normal,
+// and blocks that have not been rewritten yet
+// will render their unparsed text literally.
+// If root's blocks are added, removed, or reordered between calls,
+// then the next call should be passed the zero [RewriteProgress].
+//
+// If maxBlocks is negative, then RewriteN rewrites all remaining blocks,
+// like [*InlineParser.Rewrite].
+// If maxBlocks is zero, then RewriteN does not rewrite any blocks
+// and only reports whether any blocks remain to be rewritten.
+func (p *InlineParser) RewriteN(root *RootBlock, progress RewriteProgress, maxBlocks int) (next RewriteProgress, done bool) {
+	path, done := p.rewrite(root, progress.path, maxBlocks)
+	return RewriteProgress{path: path}, done
+}
+
+// RewriteProgress records the position in a [RootBlock]
+// at which [*InlineParser.RewriteN] resumes parsing.
+// The zero value starts from the beginning of a root block.
+type RewriteProgress struct {
+	path []rewriteFrame
+}
+
+// rewriteFrame is an element of the path to the next block to rewrite.
+type rewriteFrame struct {
+	block *Block
+	// next is the index of the next child of block to visit.
+	next int
+}
+
+// rewrite parses the inline children of up to n blocks in root,
+// or all blocks if n is negative,
+// resuming from the given path.
+// It returns the path to the next block to rewrite
+// and reports whether there are no unparsed blocks remaining.
+func (p *InlineParser) rewrite(root *RootBlock, path []rewriteFrame, n int) ([]rewriteFrame, bool) {
+	if len(path) == 0 || path[0].block != &root.Block {
+		path = []rewriteFrame{{block: &root.Block}}
+	} else {
+		// Don't modify the caller's progress
+		// so that it can be reused.
+		path = append([]rewriteFrame(nil), path...)
+	}
+	for len(path) > 0 {
+		top := &path[len(path)-1]
+		curr := top.block
 		switch {
-		case len(curr.inlineChildren) > 0 && hasUnparsed(curr):
-			curr.inlineChildren = p.parse(root.Source, curr)
-		case len(curr.blockChildren) > 0:
-			for i := len(curr.blockChildren) - 1; i >= 0; i-- {
-				if b := curr.blockChildren[i]; b != nil {
-					stack = append(stack, b)
+		case len(curr.inlineChildren) > 0:
+			if hasUnparsed(curr) {
+				if n == 0 {
+					return path, false
+				}
+				curr.inlineChildren = p.parse(root.Source, curr)
+				if n > 0 {
+					n--
 				}
 			}
+			path = path[:len(path)-1]
+		case top.next < len(curr.blockChildren):
+			child := curr.blockChildren[top.next]
+			top.next++
+			if child != nil {
+				path = append(path, rewriteFrame{block: child})
+			}
+		default:
+			path = path[:len(path)-1]
 		}
 	}
+	return nil, true
+}
+
+// ParseInline parses source as the text of a single paragraph
+// without performing any block parsing,
+// which is useful for short strings like titles or labels.
+// Link reference definitions in source are not recognized,
+// but links may refer to definitions in refs, which may be nil.
+// Leading spaces and tabs in source are ignored,
+// as are trailing spaces, tabs, and line endings,
+// so a final line ending (LF, CR, or CRLF) never produces a line break.
+// Unlike [Parse], ParseInline does not replace NUL bytes in source.
+// The returned nodes' spans are relative to the beginning of source.
+func ParseInline(source []byte, refs ReferenceMatcher) []*Inline {
+	start := 0
+	for start < len(source) && (source[start] == ' ' || source[start] == '\t') {
+		start++
+	}
+	end := len(source)
+	for end > start && isSpaceTabOrLineEnding(source[end-1]) {
+		end--
+	}
+	container := &Block{
+		kind: ParagraphKind,
+		span: Span{Start: start, End: end},
+	}
+	for lineStart := start; lineStart < end; {
+		lineEnd := end
+		if i := bytes.IndexAny(source[lineStart:end], "\r\n"); i >= 0 {
+			lineEnd = lineStart + i
+			lineEnd += lineEndingLength(source[lineEnd:end])
+		}
+		container.inlineChildren = append(container.inlineChildren, &Inline{
+			kind: UnparsedKind,
+			span: Span{Start: lineStart, End: lineEnd},
+		})
+		lineStart = lineEnd
+	}
+	if len(container.inlineChildren) == 0 {
+		return nil
+	}
+	p := &InlineParser{ReferenceMatcher: refs}
+	return p.parse(source, container)
 }
 
 type inlineState struct {
@@ -341,6 +789,25 @@ func (p *InlineParser) parse(source []byte, container *Block) []*Inline {
 					pos = p.parseDelimiterRun(state, pos)
 					plainStart = pos
 				case '[':
+					if node := p.parseWikiLink(state, pos); node != nil {
+						state.addToRoot(&Inline{
+							kind: TextKind,
+							span: Span{
+								Start: plainStart,
+								End:   pos,
+							},
+						})
+						state.addToRoot(node)
+						// Links may not contain other links.
+						for i := range state.stack {
+							if state.stack[i].typ == inlineDelimiterLink {
+								state.stack[i].flags &^= activeFlag
+							}
+						}
+						pos = node.span.End
+						plainStart = pos
+						continue
+					}
 					state.addToRoot(&Inline{
 						kind: TextKind,
 						span: Span{
@@ -374,7 +841,7 @@ func (p *InlineParser) parse(source []byte, container *Block) []*Inline {
 					pos = p.parseEndBracket(state, pos)
 					plainStart = pos
 				case '!':
-					if pos+1 >= state.spanEnd() || source[pos+1] != '[' {
+					if pos+1 >= state.spanEnd() || source[pos+1] != '[' || p.DisabledConstructs&ConstructImage != 0 {
 						pos++
 						continue
 					}
@@ -400,6 +867,87 @@ func (p *InlineParser) parse(source []byte, container *Block) []*Inline {
 					})
 					pos += 2
 					plainStart = pos
+				case ':':
+					if value, end := p.parseEmoji(state, pos); end >= 0 {
+						state.addToRoot(&Inline{
+							kind: TextKind,
+							span: Span{
+								Start: plainStart,
+								End:   pos,
+							},
+						})
+						state.addToRoot(&Inline{
+							kind: EmojiKind,
+							span: Span{
+								Start: pos,
+								End:   end,
+							},
+							ref: value,
+						})
+						pos = end
+						plainStart = pos
+						continue
+					}
+					end := p.parseDirectiveStart(state, pos)
+					if end < 0 {
+						pos++
+						continue
+					}
+					state.addToRoot(&Inline{
+						kind: TextKind,
+						span: Span{
+							Start: plainStart,
+							End:   pos,
+						},
+					})
+					node := &Inline{
+						kind: TextKind,
+						span: Span{
+							Start: pos,
+							End:   end,
+						},
+					}
+					state.addToRoot(node)
+					state.stack = append(state.stack, delimiterStackElement{
+						typ:   inlineDelimiterDirective,
+						flags: activeFlag,
+						node:  node,
+					})
+					pos = end
+					plainStart = pos
+				case 'h', 'f':
+					if !p.ExtendedAutolinks || !state.canStartExtendedAutolink(pos) {
+						pos++
+						continue
+					}
+					end := parseExtendedAutolink(source[pos:state.spanEnd()])
+					if end < 0 || !p.allowsAutolinkScheme(source[pos:pos+end]) || state.inBracket() {
+						pos++
+						continue
+					}
+					state.addToRoot(&Inline{
+						kind: TextKind,
+						span: Span{
+							Start: plainStart,
+							End:   pos,
+						},
+					})
+					state.addToRoot(&Inline{
+						kind: AutolinkKind,
+						span: Span{
+							Start: pos,
+							End:   pos + end,
+						},
+						children: []*Inline{{
+							kind: TextKind,
+							span: Span{
+								Start: pos,
+								End:   pos + end,
+							},
+						}},
+					})
+					pos += end
+					plainStart = pos
 				case ' ':
 					end, ok := parseHardLineBreakSpace(source[pos:state.spanEnd()])
 					if ok && !state.isLastSpan() {
@@ -416,6 +964,7 @@ func (p *InlineParser) parse(source []byte, container *Block) []*Inline {
 								Start: pos,
 								End:   pos + end,
 							},
+							breakStyle: HardBreakSpaces,
 						})
 						// Leading spaces at the beginning of the next line are ignored.
 						state.ignoreNextIndent = true
@@ -440,7 +989,7 @@ func (p *InlineParser) parse(source []byte, container *Block) []*Inline {
 						pos = cs.content.Start
 					}
 				case '<':
-					if end := parseAutolink(state.source[pos:state.spanEnd()]); end >= 0 {
+					if end := parseAutolink(state.source[pos:state.spanEnd()]); end >= 0 && p.allowsAutolink(state.source[pos+1:pos+end-1]) {
 						end += pos
 						state.addToRoot(&Inline{
 							kind: TextKind,
@@ -467,6 +1016,10 @@ func (p *InlineParser) parse(source []byte, container *Block) []*Inline {
 						plainStart = pos
 						continue
 					}
+					if p.DisabledConstructs&ConstructRawHTML != 0 {
+						pos++
+						continue
+					}
 					r := newInlineByteReader(state.source, state.unparsed[state.unparsedPos:], pos)
 					span := parseHTMLTag(r)
 					if !span.IsValid() {
@@ -610,11 +1163,16 @@ func (p *InlineParser) parseBackslash(state *inlineState, start int) (end int) {
 				Start: start,
 				End:   start + 1,
 			},
+			breakStyle: HardBreakBackslash,
 		}
 		if state.isLastSpan() {
 			// Hard line breaks not permitted at end of block.
 			newNode.kind = TextKind
+			newNode.breakStyle = 0
 		} else {
+			// Include the line ending in the break
+			// so that it is not also treated as a soft line break.
+			newNode.span.End += lineEndingLength(state.source[newNode.span.End:state.spanEnd()])
 			// Leading spaces at the beginning of the next line are ignored.
 			state.ignoreNextIndent = true
 		}
@@ -644,6 +1202,20 @@ func (p *InlineParser) parseBackslash(state *inlineState, start int) (end int) {
 	return end
 }
 
+// lineEndingLength returns the length of the line ending
+// at the beginning of text
+// or zero if text does not begin with a line ending.
+func lineEndingLength(text []byte) int {
+	switch {
+	case hasBytePrefix(text, "\r\n"):
+		return 2
+	case hasBytePrefix(text, "\n") || hasBytePrefix(text, "\r"):
+		return 1
+	default:
+		return 0
+	}
+}
+
 func parseCharacterEscape(text []byte) (end int) {
 	if len(text) < 3 || text[0] != '&' {
 		return -1
@@ -752,6 +1324,9 @@ func (p *InlineParser) parseEndBracket(state *inlineState, start int) (end int)
 		})
 		return start + 1
 	}
+	if state.stack[openDelimIndex].typ == inlineDelimiterDirective {
+		return p.finishDirective(state, start, openDelimIndex)
+	}
 	kind := LinkKind
 	if state.stack[openDelimIndex].typ == inlineDelimiterImage {
 		kind = ImageKind
@@ -846,7 +1421,7 @@ func (p *InlineParser) parseEndBracket(state *inlineState, start int) (end int)
 			newInlineByteReader(state.source, state.unparsed[state.unparsedPos:], label.inner.Start),
 			label.inner.End,
 		)
-		inlineLabel.ref = transformLinkReference(state.source, inlineLabel.children)
+		inlineLabel.ref = transformLinkReferenceSpan(state.source, state.unparsed[state.unparsedPos:], label.inner)
 		if p.ReferenceMatcher == nil || !p.ReferenceMatcher.MatchReference(inlineLabel.ref) {
 			state.addToRoot(&Inline{
 				kind: TextKind,
@@ -865,6 +1440,12 @@ func (p *InlineParser) parseEndBracket(state *inlineState, start int) (end int)
 			Start: state.stack[openDelimIndex].node.span.Start,
 			End:   label.span.End,
 		}
+		// The label may span multiple lines.
+		if i := nodeIndexForPosition(state.unparsed[state.unparsedPos:], label.span.End-1); i >= 0 {
+			state.unparsedPos += i
+		} else {
+			state.unparsedPos = len(state.unparsed)
+		}
 		p.finishLink(state, kind, openDelimIndex)
 		return linkNode.span.End
 	default:
@@ -911,6 +1492,171 @@ func (p *InlineParser) finishLink(state *inlineState, kind InlineKind, openDelim
 	}
 }
 
+// parseEmoji parses an emoji shortcode starting at the given position,
+// returning the value it resolves to and the end of the shortcode,
+// or -1 if the position does not start a shortcode that resolves.
+func (p *InlineParser) parseEmoji(state *inlineState, start int) (value string, end int) {
+	if p.EmojiResolver == nil {
+		return "", -1
+	}
+	if start > 0 {
+		if c := state.source[start-1]; isASCIILetter(c) || isASCIIDigit(c) {
+			return "", -1
+		}
+	}
+	nameStart := start + 1
+	nameEnd := nameStart
+	for nameEnd < state.spanEnd() && isEmojiNameChar(state.source[nameEnd]) {
+		nameEnd++
+	}
+	if nameEnd == nameStart || nameEnd >= state.spanEnd() || state.source[nameEnd] != ':' {
+		return "", -1
+	}
+	end = nameEnd + 1
+	if end < state.spanEnd() {
+		if c := state.source[end]; isASCIILetter(c) || isASCIIDigit(c) {
+			return "", -1
+		}
+	}
+	value, ok := p.EmojiResolver.Resolve(string(state.source[nameStart:nameEnd]))
+	if !ok {
+		return "", -1
+	}
+	return value, end
+}
+
+func isEmojiNameChar(c byte) bool {
+	return isASCIILetter(c) || isASCIIDigit(c) || c == '_' || c == '+' || c == '-'
+}
+
+// parseWikiLink parses a wiki link starting at the given position,
+// returning nil if the position does not start a wiki link.
+func (p *InlineParser) parseWikiLink(state *inlineState, start int) *Inline {
+	if !p.WikiLinks || !hasBytePrefix(state.source[start:state.spanEnd()], "[[") {
+		return nil
+	}
+	contentStart := start + 2
+	pipe := -1
+	depth := 0
+	for i := contentStart; i < state.spanEnd(); i++ {
+		switch state.source[i] {
+		case '[':
+			depth++
+		case ']':
+			if depth > 0 {
+				depth--
+				continue
+			}
+			if i+1 >= state.spanEnd() || state.source[i+1] != ']' {
+				return nil
+			}
+			targetEnd := i
+			if pipe >= 0 {
+				targetEnd = pipe
+			}
+			target := trimWikiLinkSpace(state.source, Span{Start: contentStart, End: targetEnd})
+			if target.Len() == 0 {
+				return nil
+			}
+			display := target
+			if pipe >= 0 {
+				if d := trimWikiLinkSpace(state.source, Span{Start: pipe + 1, End: i}); d.Len() > 0 {
+					display = d
+				}
+			}
+			return &Inline{
+				kind: WikiLinkKind,
+				span: Span{
+					Start: start,
+					End:   i + 2,
+				},
+				children: []*Inline{
+					{
+						kind:     WikiLinkTargetKind,
+						span:     target,
+						children: []*Inline{{kind: TextKind, span: target}},
+					},
+					{kind: TextKind, span: display},
+				},
+			}
+		case '|':
+			if depth == 0 && pipe < 0 {
+				pipe = i
+			}
+		case '`', '<', '\r', '\n':
+			return nil
+		}
+	}
+	return nil
+}
+
+// trimWikiLinkSpace returns the span without leading or trailing spaces or tabs.
+func trimWikiLinkSpace(source []byte, span Span) Span {
+	for span.Start < span.End && (source[span.Start] == ' ' || source[span.Start] == '\t') {
+		span.Start++
+	}
+	for span.End > span.Start && (source[span.End-1] == ' ' || source[span.End-1] == '\t') {
+		span.End--
+	}
+	return span
+}
+
+// parseDirectiveStart returns the end of the opening of a text directive
+// (the colon, name, and left bracket) starting at the given position,
+// or -1 if the position does not start a text directive.
+func (p *InlineParser) parseDirectiveStart(state *inlineState, start int) (end int) {
+	if !p.Directives {
+		return -1
+	}
+	if start > 0 {
+		if c := state.source[start-1]; isASCIILetter(c) || isASCIIDigit(c) {
+			return -1
+		}
+	}
+	nameEnd := start + 1 + parseDirectiveName(state.source[start+1:state.spanEnd()])
+	if nameEnd == start+1 || nameEnd >= state.spanEnd() || state.source[nameEnd] != '[' {
+		return -1
+	}
+	return nameEnd + 1
+}
+
+// finishDirective wraps the nodes after the directive opener
+// at openDelimIndex in a [DirectiveKind] node.
+// start is the position of the closing bracket.
+func (p *InlineParser) finishDirective(state *inlineState, start int, openDelimIndex int) (end int) {
+	opener := state.stack[openDelimIndex].node
+	directiveNode := state.wrap(DirectiveKind, opener, nil)
+	end = start + 1
+	if end < state.spanEnd() && state.source[end] == '{' {
+		if i := bytes.IndexAny(state.source[end+1:state.spanEnd()], "{}\r\n"); i >= 0 && state.source[end+1+i] == '}' {
+			attrs := &Inline{
+				kind: DirectiveAttributesKind,
+				span: Span{
+					Start: end,
+					End:   end + i + 2,
+				},
+			}
+			if i > 0 {
+				attrs.children = []*Inline{{
+					kind: TextKind,
+					span: Span{
+						Start: end + 1,
+						End:   end + 1 + i,
+					},
+				}}
+			}
+			directiveNode.children = append(directiveNode.children, attrs)
+			end = attrs.span.End
+		}
+	}
+	directiveNode.span = Span{
+		Start: opener.span.Start,
+		End:   end,
+	}
+	p.finishLink(state, DirectiveKind, openDelimIndex)
+	return end
+}
+
 type inlineLinkInfo struct {
 	span        Span
 	destination linkDestination
@@ -1010,7 +1756,9 @@ func parseLinkDestination(r *inlineByteReader) linkDestination {
 		start := r.pos
 		for r.next() {
 			switch r.current() {
-			case '\r', '\n':
+			case '\r', '\n', '<':
+				// Line endings and unescaped '<' are not permitted
+				// in a destination enclosed in pointy brackets.
 				return linkDestination{span: NullSpan(), text: NullSpan()}
 			case '\\':
 				if !r.next() {
@@ -1302,7 +2050,7 @@ func collectTextNodes(parent *Inline, r *inlineByteReader, end int, textKind Inl
 func (p *InlineParser) lookForLinkOrImage(state *inlineState) int {
 	for i := len(state.stack) - 1; i >= 0; i-- {
 		curr := &state.stack[i]
-		if curr.typ == inlineDelimiterLink || curr.typ == inlineDelimiterImage {
+		if curr.typ == inlineDelimiterLink || curr.typ == inlineDelimiterImage || curr.typ == inlineDelimiterDirective {
 			if curr.flags&activeFlag == 0 {
 				state.stack = deleteDelimiterStack(state.stack, i, i+1)
 				return -1
@@ -1380,16 +2128,23 @@ closerLoop:
 		if openerIndex >= openersBottom[openersBottomIndex] {
 			opener := state.stack[openerIndex].node
 			closer := state.stack[currentPosition].node
-			strong := opener.Span().Len() >= 2 && closer.Span().Len() >= 2
-			if strong {
+			delimChar := byte('*')
+			if state.stack[openerIndex].typ == inlineDelimiterUnderscore {
+				delimChar = '_'
+			}
+			var newNode *Inline
+			if strong := opener.Span().Len() >= 2 && closer.Span().Len() >= 2; strong {
 				opener.span.End -= 2
 				closer.span.Start += 2
-				state.wrap(StrongKind, opener, closer)
+				newNode = state.wrap(StrongKind, opener, closer)
+				newNode.delimRun = 2
 			} else {
 				opener.span.End--
 				closer.span.Start++
-				state.wrap(EmphasisKind, opener, closer)
+				newNode = state.wrap(EmphasisKind, opener, closer)
+				newNode.delimRun = 1
 			}
+			newNode.delimChar = delimChar
 
 			// Remove any delimiters between the opener and closer from the delimiter stack.
 			state.stack = deleteDelimiterStack(state.stack, openerIndex+1, currentPosition)
@@ -1428,8 +2183,9 @@ closerLoop:
 }
 
 type codeSpan struct {
-	span    Span
-	content Span
+	span           Span
+	content        Span
+	backtickLength int
 }
 
 func (p *InlineParser) parseCodeSpan(state *inlineState, start int) codeSpan {
@@ -1437,10 +2193,9 @@ func (p *InlineParser) parseCodeSpan(state *inlineState, start int) codeSpan {
 		span:    Span{Start: start, End: -1},
 		content: Span{Start: start, End: -1},
 	}
-	backtickLength := 0
 	r := newInlineByteReader(state.source, state.unparsed[state.unparsedPos:], start)
 	for r.current() == '`' {
-		backtickLength++
+		result.backtickLength++
 		ok := r.next()
 		result.content.Start = r.pos
 		if !ok {
@@ -1460,7 +2215,7 @@ func (p *InlineParser) parseCodeSpan(state *inlineState, start int) codeSpan {
 		for r.next() && r.current() == '`' {
 			currentRunLength++
 		}
-		if currentRunLength == backtickLength {
+		if currentRunLength == result.backtickLength {
 			result.content.End = potentialEnd
 			result.span.End = r.prevPos + 1
 			return result
@@ -1474,8 +2229,10 @@ func (p *InlineParser) parseCodeSpan(state *inlineState, start int) codeSpan {
 
 func (p *InlineParser) collectCodeSpan(state *inlineState, cs codeSpan) {
 	codeSpanNode := &Inline{
-		kind: CodeSpanKind,
-		span: cs.span,
+		kind:      CodeSpanKind,
+		span:      cs.span,
+		delimChar: '`',
+		delimRun:  cs.backtickLength,
 	}
 	addSpan := func(child *Inline) {
 		spanText := spanSlice(state.source, child.Span())
@@ -1598,25 +2355,192 @@ func isOnlySpaces(line []byte) bool {
 }
 
 func parseAutolink(text []byte) (end int) {
-	const minSchemeChars = 2
-	const maxSchemeChars = 32
-
-	if len(text) < len("<:>")+minSchemeChars || text[0] != '<' {
+	if len(text) < len("<") || text[0] != '<' {
 		return -1
 	}
 	if emailEnd := parseEmail(text[1:]); emailEnd >= 0 && 1+emailEnd < len(text) && text[1+emailEnd] == '>' {
 		return 2 + emailEnd
 	}
+	if uriEnd := parseAbsoluteURI(text[1:]); uriEnd >= 0 && 1+uriEnd < len(text) && text[1+uriEnd] == '>' {
+		return 2 + uriEnd
+	}
+	return -1
+}
+
+// canStartExtendedAutolink reports whether an extended autolink
+// may begin at the given position.
+func (state *inlineState) canStartExtendedAutolink(pos int) bool {
+	if pos == state.unparsed[state.unparsedPos].Span().Start {
+		return true
+	}
+	c := state.source[pos-1]
+	return isExtendedAutolinkSpace(c) || c == '*' || c == '_' || c == '~' || c == '('
+}
+
+// inBracket reports whether the delimiter stack has a link or image opener,
+// meaning that the current position may be inside link text or an image description.
+// Like cmark-gfm, extended autolinks are not recognized there,
+// since a link cannot contain another link.
+func (state *inlineState) inBracket() bool {
+	for i := len(state.stack) - 1; i >= 0; i-- {
+		if typ := state.stack[i].typ; typ == inlineDelimiterLink || typ == inlineDelimiterImage {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExtendedAutolink returns the length of the [extended URL autolink]
+// at the beginning of text or -1 if text does not begin with one.
+//
+// [extended URL autolink]: https://github.github.com/gfm/#extended-url-autolink
+func parseExtendedAutolink(text []byte) int {
+	var n int
+	switch {
+	case bytes.HasPrefix(text, []byte("http://")):
+		n = len("http://")
+	case bytes.HasPrefix(text, []byte("https://")):
+		n = len("https://")
+	case bytes.HasPrefix(text, []byte("ftp://")):
+		n = len("ftp://")
+	default:
+		return -1
+	}
+	domainEnd := parseExtendedAutolinkDomain(text[n:])
+	if domainEnd < 0 {
+		return -1
+	}
+	end := n + domainEnd
+	for end < len(text) && !isExtendedAutolinkSpace(text[end]) && text[end] != '<' && text[end] != ']' {
+		end++
+	}
+	end = trimExtendedAutolink(text[:end])
+	if end <= n {
+		return -1
+	}
+	return end
+}
+
+// parseExtendedAutolinkDomain returns the length of the [valid domain]
+// at the beginning of text or -1 if text does not begin with one.
+// A valid domain is made of segments of ASCII letters, digits, '_', and '-'
+// separated by periods.
+// There must be at least one period,
+// and the last two segments may not contain underscores.
+// Trailing periods are included in the returned length,
+// but are not considered part of the domain.
+//
+// [valid domain]: https://github.github.com/gfm/#valid-domain
+func parseExtendedAutolinkDomain(text []byte) int {
+	end := 0
+	for end < len(text) && (isASCIILetter(text[end]) || isASCIIDigit(text[end]) || text[end] == '_' || text[end] == '-' || text[end] == '.') {
+		end++
+	}
+	segments := bytes.Split(bytes.TrimRight(text[:end], "."), []byte("."))
+	if len(segments) < 2 {
+		return -1
+	}
+	for i, seg := range segments {
+		if len(seg) == 0 {
+			return -1
+		}
+		if i >= len(segments)-2 && bytes.IndexByte(seg, '_') >= 0 {
+			return -1
+		}
+	}
+	return end
+}
+
+// trimExtendedAutolink returns the length of link
+// after following the [extended autolink path validation] rules.
+// Like cmark-gfm, quotes are treated as trailing punctuation.
+//
+// [extended autolink path validation]: https://github.github.com/gfm/#extended-autolink-path-validation
+func trimExtendedAutolink(link []byte) int {
+	end := len(link)
+	for end > 0 {
+		switch c := link[end-1]; {
+		case strings.IndexByte("?!.,:*_~'\"", c) >= 0:
+			end--
+		case c == ';':
+			// Exclude something that looks like an entity reference.
+			i := end - 2
+			for i > 0 && (isASCIILetter(link[i]) || isASCIIDigit(link[i])) {
+				i--
+			}
+			if i < end-2 && link[i] == '&' {
+				end = i
+			} else {
+				end--
+			}
+		case c == ')':
+			opening := bytes.Count(link[:end], []byte("("))
+			closing := bytes.Count(link[:end], []byte(")"))
+			if closing <= opening {
+				return end
+			}
+			end--
+		default:
+			return end
+		}
+	}
+	return end
+}
+
+func isExtendedAutolinkSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+// allowsAutolink reports whether autolinks are enabled
+// and the destination of an autolink
+// uses a scheme permitted by p.AutolinkSchemes.
+func (p *InlineParser) allowsAutolink(dst []byte) bool {
+	return p.DisabledConstructs&ConstructAutolink == 0 && p.allowsAutolinkScheme(dst)
+}
+
+// allowsAutolinkScheme reports whether the destination of an autolink
+// uses a scheme permitted by p.AutolinkSchemes.
+func (p *InlineParser) allowsAutolinkScheme(dst []byte) bool {
+	if p.AutolinkSchemes == nil {
+		return true
+	}
+	var scheme []byte
+	if parseEmail(dst) == len(dst) {
+		scheme = []byte("mailto")
+	} else if i := bytes.IndexByte(dst, ':'); i >= 0 {
+		scheme = dst[:i]
+	}
+	for _, allowed := range p.AutolinkSchemes {
+		if bytes.EqualFold(scheme, []byte(allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAbsoluteURI reports whether the string is a CommonMark [absolute URI].
+//
+// [absolute URI]: https://spec.commonmark.org/0.30/#absolute-uri
+func IsAbsoluteURI(s string) bool {
+	return parseAbsoluteURI([]byte(s)) == len(s)
+}
+
+// parseAbsoluteURI parses an [absolute URI].
+//
+// [absolute URI]: https://spec.commonmark.org/0.30/#absolute-uri
+func parseAbsoluteURI(text []byte) (end int) {
+	const minSchemeChars = 2
+	const maxSchemeChars = 32
 
 	// Scheme.
-	if !isASCIILetter(text[1]) {
+	if len(text) == 0 || !isASCIILetter(text[0]) {
 		return -1
 	}
-	end = 2
+	end = 1
 	for end < len(text) && (isASCIILetter(text[end]) || isASCIIDigit(text[end]) || strings.IndexByte("+.-", text[end]) >= 0) {
 		end++
 	}
-	if end < 1+minSchemeChars || end > 1+maxSchemeChars {
+	if end < minSchemeChars || end > maxSchemeChars {
 		return -1
 	}
 	if end >= len(text) || text[end] != ':' {
@@ -1625,15 +2549,10 @@ func parseAutolink(text []byte) (end int) {
 	end++
 
 	// URI.
-	for ; end < len(text); end++ {
-		switch {
-		case text[end] == '>':
-			return end + 1
-		case isASCIIControl(text[end]) || text[end] == ' ' || text[end] == '<':
-			return -1
-		}
+	for end < len(text) && !isASCIIControl(text[end]) && text[end] != ' ' && text[end] != '<' && text[end] != '>' {
+		end++
 	}
-	return -1
+	return end
 }
 
 // IsEmailAddress reports whether the string is a CommonMark [email address].
@@ -1855,7 +2774,7 @@ type delimiterStackElement struct {
 	node  *Inline
 }
 
-const openersBottomCount = 9
+const openersBottomCount = 10
 
 func (elem delimiterStackElement) openersBottomIndex() int {
 	switch elem.typ {
@@ -1871,6 +2790,8 @@ func (elem delimiterStackElement) openersBottomIndex() int {
 		return 7
 	case inlineDelimiterImage:
 		return 8
+	case inlineDelimiterDirective:
+		return 9
 	default:
 		panic("unreachable")
 	}
@@ -1910,6 +2831,7 @@ const (
 	inlineDelimiterUnderscore
 	inlineDelimiterLink
 	inlineDelimiterImage
+	inlineDelimiterDirective
 )
 
 func (d inlineDelimiter) String() string {
@@ -1922,6 +2844,8 @@ func (d inlineDelimiter) String() string {
 		return "["
 	case inlineDelimiterImage:
 		return "!["
+	case inlineDelimiterDirective:
+		return ":["
 	default:
 		return fmt.Sprintf("inlineDelimiter(%d)", int8(d))
 	}
@@ -2061,13 +2985,12 @@ func (r *inlineByteReader) jumped() bool {
 // It assumes that the starts of the inline nodes
 // are monotonically increasing.
 func nodeIndexForPosition(spans []*Inline, pos int) int {
-	search := Span{Start: pos, End: pos + 1}
 	for i, inline := range spans {
 		inlineSpan := inline.Span()
 		if inlineSpan.Start > pos {
 			return -1
 		}
-		if inline.Span().Intersect(search).Len() > 0 {
+		if inlineSpan.ContainsOffset(pos) {
 			return i
 		}
 	}
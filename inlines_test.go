@@ -18,6 +18,7 @@ package commonmark
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"strings"
 	"testing"
@@ -74,6 +75,48 @@ func TestEmphasisSpan(t *testing.T) {
 	}
 }
 
+func TestDelimiters(t *testing.T) {
+	tests := []struct {
+		input    string
+		index    int
+		kind     InlineKind
+		wantChar byte
+		wantRun  int
+	}{
+		{input: "*a*", kind: EmphasisKind, wantChar: '*', wantRun: 1},
+		{input: "_a_", kind: EmphasisKind, wantChar: '_', wantRun: 1},
+		{input: "**a**", kind: StrongKind, wantChar: '*', wantRun: 2},
+		{input: "__a__", kind: StrongKind, wantChar: '_', wantRun: 2},
+		{input: "***a***", kind: EmphasisKind, wantChar: '*', wantRun: 1},
+		{input: "**a*", index: 1, kind: EmphasisKind, wantChar: '*', wantRun: 1},
+		{input: "`a`", kind: CodeSpanKind, wantChar: '`', wantRun: 1},
+		{input: "``a`b``", kind: CodeSpanKind, wantChar: '`', wantRun: 2},
+		{input: "a", kind: TextKind, wantChar: 0, wantRun: 0},
+	}
+	for _, test := range tests {
+		blocks, _ := Parse([]byte(test.input))
+		if len(blocks) != 1 || blocks[0].Kind() != ParagraphKind {
+			t.Errorf("%q did not parse as a single paragraph", test.input)
+			continue
+		}
+		if blocks[0].ChildCount() <= test.index {
+			t.Errorf("%q has %d inline children; want >%d", test.input, blocks[0].ChildCount(), test.index)
+			continue
+		}
+		inline := blocks[0].Child(test.index).Inline()
+		if got := inline.Kind(); got != test.kind {
+			t.Errorf("%q inline %d Kind() = %v; want %v", test.input, test.index, got, test.kind)
+			continue
+		}
+		if got := inline.DelimiterChar(); got != test.wantChar {
+			t.Errorf("%q inline %d DelimiterChar() = %q; want %q", test.input, test.index, got, test.wantChar)
+		}
+		if got := inline.DelimiterRun(); got != test.wantRun {
+			t.Errorf("%q inline %d DelimiterRun() = %d; want %d", test.input, test.index, got, test.wantRun)
+		}
+	}
+}
+
 func TestLinkSpan(t *testing.T) {
 	const (
 		prefix          = "oh "
@@ -93,6 +136,14 @@ func TestLinkSpan(t *testing.T) {
 			name: "FullReference",
 			link: "[hello][hello]",
 		},
+		{
+			name: "MultilineFullReference",
+			link: "[hello][\nhello]",
+		},
+		{
+			name: "MultilineFullReferenceEnd",
+			link: "[hello][hello\n]",
+		},
 		{
 			name: "CollapsedReference",
 			link: "[hello][]",
@@ -140,6 +191,390 @@ func TestLinkSpan(t *testing.T) {
 	}
 }
 
+func TestLinkDestinations(t *testing.T) {
+	tests := []struct {
+		input string
+		// If isLink is false, then the input should not contain a link.
+		isLink     bool
+		want       string
+		normalized string
+	}{
+		{input: `[link](/uri "title")`, isLink: true, want: "/uri", normalized: "/uri"},
+		{input: `[link]()`, isLink: true, want: "", normalized: ""},
+		{input: `[link](<>)`, isLink: true, want: "", normalized: ""},
+		{input: `[link](/my uri)`, isLink: false},
+		{input: `[link](</my uri>)`, isLink: true, want: "/my uri", normalized: "/my%20uri"},
+		{input: "[link](foo\nbar)", isLink: false},
+		{input: "[link](<foo\nbar>)", isLink: false},
+		{input: `[a](<b)c>)`, isLink: true, want: "b)c", normalized: "b)c"},
+		{input: `[link](<foo\>)`, isLink: false},
+		{input: "[a](<b)c\n[a](<b)c>\n[a](<b>c)", isLink: false},
+		{input: `[link](\(foo\))`, isLink: true, want: "(foo)", normalized: "(foo)"},
+		{input: `[link](foo(and(bar)))`, isLink: true, want: "foo(and(bar))", normalized: "foo(and(bar))"},
+		{input: `[link](foo\)\:)`, isLink: true, want: "foo):", normalized: "foo):"},
+		{input: `[link](foo%20b&auml;)`, isLink: true, want: "foo%20b\u00e4", normalized: "foo%20b%C3%A4"},
+		{input: `[x](<a\>b>)`, isLink: true, want: "a>b", normalized: "a%3Eb"},
+		{input: `[x](<a\<b>)`, isLink: true, want: "a<b", normalized: "a%3Cb"},
+		{input: `[x](<a<b>)`, isLink: false},
+		{input: `[x](<a\\>)`, isLink: true, want: `a\`, normalized: "a%5C"},
+		{input: "[x]\n\n[x]: <a\\>b>", isLink: true, want: "a>b", normalized: "a%3Eb"},
+		{input: "[x]\n\n[x]: <a<b>", isLink: false},
+	}
+	for _, test := range tests {
+		blocks, refMap := Parse([]byte(test.input))
+		var links []*Inline
+		var source []byte
+		for _, root := range blocks {
+			if found := CollectInlines(root.AsNode(), LinkKind); len(found) > 0 {
+				links = found
+				source = root.Source
+				break
+			}
+		}
+		if !test.isLink {
+			if len(links) > 0 {
+				t.Errorf("Parse(%q) contains a link; want none", test.input)
+			}
+			continue
+		}
+		if len(links) != 1 {
+			t.Errorf("Parse(%q) contains %d links; want 1", test.input, len(links))
+			continue
+		}
+		got := ResolveLink(links[0], source, refMap).Destination
+		if got != test.want {
+			t.Errorf("Parse(%q) destination = %q; want %q", test.input, got, test.want)
+		}
+		if normalized := NormalizeURI(got); normalized != test.normalized {
+			t.Errorf("NormalizeURI(%q) = %q; want %q", got, normalized, test.normalized)
+		}
+	}
+}
+
+func TestImageDescriptionLinks(t *testing.T) {
+	const definitions = "\n\n[ref]: /r\n"
+	tests := []struct {
+		name  string
+		input string
+		// tree is the paragraph's inline tree as formatted by inlineTreeString.
+		tree string
+		alt  string
+	}{
+		{
+			name:  "InlineLinkInImage",
+			input: "![foo [bar](/url)](/url2)",
+			tree:  `ImageKind("foo " LinkKind("bar" LinkDestinationKind) LinkDestinationKind)`,
+			alt:   "foo bar",
+		},
+		{
+			name:  "ReferenceLinkInImage",
+			input: "![foo [bar][ref]](/url2)" + definitions,
+			tree:  `ImageKind("foo " LinkKind("bar" LinkLabelKind) LinkDestinationKind)`,
+			alt:   "foo bar",
+		},
+		{
+			name:  "ReferenceLinkInReferenceImage",
+			input: "![[foo][ref]][ref]" + definitions,
+			tree:  `ImageKind(LinkKind("foo" LinkLabelKind) LinkLabelKind)`,
+			alt:   "foo",
+		},
+		{
+			name:  "ShortcutLinkInImage",
+			input: "![[ref]](/url2)" + definitions,
+			tree:  `ImageKind(LinkKind("ref") LinkDestinationKind)`,
+			alt:   "ref",
+		},
+		{
+			name:  "ImageInImage",
+			input: "![foo ![bar](/url)](/url2)",
+			tree:  `ImageKind("foo " ImageKind("bar" LinkDestinationKind) LinkDestinationKind)`,
+			alt:   "foo bar",
+		},
+		{
+			name:  "LinkInLinkInImage",
+			input: "![[[foo](uri1)](uri2)](uri3)",
+			tree:  `ImageKind("[" LinkKind("foo" LinkDestinationKind) "]" "(uri2)" LinkDestinationKind)`,
+			alt:   "[foo](uri2)",
+		},
+		{
+			name:  "LinkInLink",
+			input: "[foo [bar](/url)](/url2)",
+			tree:  `"[" "foo " LinkKind("bar" LinkDestinationKind) "]" "(/url2)"`,
+		},
+		{
+			name:  "ImageInLink",
+			input: "[![moon](moon.jpg)](/uri)",
+			tree:  `LinkKind(ImageKind("moon" LinkDestinationKind) LinkDestinationKind)`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			para := blocks[0]
+			if got := inlineTreeString(para.Source, para.AsNode()); got != test.tree {
+				t.Errorf("tree:\n got %s\nwant %s", got, test.tree)
+			}
+			if test.alt == "" {
+				return
+			}
+			r := &HTMLRenderer{ReferenceMap: refMap}
+			html := string(r.AppendBlock(nil, para))
+			if want := `alt="` + test.alt + `"`; !strings.Contains(html, want) {
+				t.Errorf("rendered %s; want %s", html, want)
+			}
+		})
+	}
+}
+
+// TestLinkCodeSpanPrecedence verifies that code spans bind more tightly
+// than link brackets, even when the code span spans multiple lines.
+func TestLinkCodeSpanPrecedence(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		// tree is the paragraph's inline tree as formatted by inlineTreeString.
+		tree string
+	}{
+		{
+			name:  "CodeSpanBracket",
+			input: "[a `]` b](url)",
+			tree:  `LinkKind("a " CodeSpanKind("]") " b" LinkDestinationKind)`,
+		},
+		{
+			name:  "MultilineCodeSpan",
+			input: "[a `b\nc]` d](url)",
+			tree:  `LinkKind("a " CodeSpanKind("b" IndentKind "c]") " d" LinkDestinationKind)`,
+		},
+		{
+			name:  "MultilineCodeSpanReference",
+			input: "[a `x\ny\nz]` b][ref]\n\n[ref]: /u\n",
+			tree:  `LinkKind("a " CodeSpanKind("x" IndentKind "y" IndentKind "z]") " b" LinkLabelKind)`,
+		},
+		{
+			name:  "BracketAfterCodeSpan",
+			input: "[a `x\n]`\n]` b](url)",
+			tree:  `"[" "a " CodeSpanKind("x" IndentKind "]") SoftLineBreakKind "]" "` + "`" + ` b" "]" "(url)"`,
+		},
+		{
+			name:  "Image",
+			input: "![a `x\n]` b](url)",
+			tree:  `ImageKind("a " CodeSpanKind("x" IndentKind "]") " b" LinkDestinationKind)`,
+		},
+		{
+			name:  "NestedLink",
+			input: "[a [b `]\n]`](x)](y)",
+			tree:  `"[" "a " LinkKind("b " CodeSpanKind("]" IndentKind "]") LinkDestinationKind) "]" "(y)"`,
+		},
+		{
+			name:  "NotDefinition",
+			input: "[foo`]\n`]: /x",
+			tree:  `"[" "foo" CodeSpanKind("]" IndentKind) "]" ": /x"`,
+		},
+		{
+			name:  "CodeSpanOpener",
+			input: "`[a\n]`](b)",
+			tree:  `CodeSpanKind("[a" IndentKind "]") "]" "(b)"`,
+		},
+		{
+			name:  "Spec342",
+			input: "[not a `link](/foo`)",
+			tree:  `"[" "not a " CodeSpanKind("link](/foo") ")"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, _ := Parse([]byte(test.input))
+			para := blocks[0]
+			if got := inlineTreeString(para.Source, para.AsNode()); got != test.tree {
+				t.Errorf("tree:\n got %s\nwant %s", got, test.tree)
+			}
+		})
+	}
+
+	t.Run("Containers", func(t *testing.T) {
+		const input = "> [a `x\n> ]` b](url)\n\n- [a `x\n  ]` b](url)\n"
+		const want = `<blockquote><p><a href="url">a <code>x ]</code> b</a></p></blockquote>` +
+			`<ul><li><a href="url">a <code>x ]</code> b</a></li></ul>`
+		blocks, refMap := Parse([]byte(input))
+		buf := new(bytes.Buffer)
+		if err := RenderHTML(buf, blocks, refMap); err != nil {
+			t.Fatal(err)
+		}
+		got := string(normhtml.NormalizeHTML(buf.Bytes()))
+		if diff := cmp.Diff(string(normhtml.NormalizeHTML([]byte(want))), got); diff != "" {
+			t.Errorf("-want +got:\n%s", diff)
+		}
+	})
+}
+
+func TestEmptyLinksAndImages(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		// tree is the first block's inline tree as formatted by inlineTreeString.
+		tree string
+		html string
+	}{
+		{
+			name:  "Spec495",
+			input: "[link]()\n",
+			tree:  `LinkKind("link")`,
+			html:  `<p><a href="">link</a></p>`,
+		},
+		{
+			name:  "Spec496",
+			input: "[link](<>)\n",
+			tree:  `LinkKind("link" LinkDestinationKind)`,
+			html:  `<p><a href="">link</a></p>`,
+		},
+		{
+			name:  "Spec559",
+			input: "[]\n\n[]: /uri\n",
+			tree:  `"[" "]"`,
+			html:  `<p>[]</p>`,
+		},
+		{
+			name:  "Spec575",
+			input: "[foo]()\n\n[foo]: /url1\n",
+			tree:  `LinkKind("foo")`,
+			html:  `<p><a href="">foo</a></p>`,
+		},
+		{
+			name:  "Spec589",
+			input: "![](/url)\n",
+			tree:  `ImageKind(LinkDestinationKind)`,
+			html:  `<p><img src="/url" alt=""></p>`,
+		},
+		{
+			name:  "EmptyLink",
+			input: "[]()\n",
+			tree:  `LinkKind`,
+			html:  `<p><a href=""></a></p>`,
+		},
+		{
+			name:  "EmptyImage",
+			input: "![]()\n",
+			tree:  `ImageKind`,
+			html:  `<p><img src="" alt=""></p>`,
+		},
+		{
+			name:  "EmptyTextWithDestination",
+			input: "[](/uri)\n",
+			tree:  `LinkKind(LinkDestinationKind)`,
+			html:  `<p><a href="/uri"></a></p>`,
+		},
+		{
+			name:  "EmptyImageBracketedDestination",
+			input: "![](<>)\n",
+			tree:  `ImageKind(LinkDestinationKind)`,
+			html:  `<p><img src="" alt=""></p>`,
+		},
+		{
+			name:  "EmptyTitle",
+			input: "[link](<> \"\")\n",
+			tree:  `LinkKind("link" LinkDestinationKind LinkTitleKind)`,
+			html:  `<p><a href="" title="">link</a></p>`,
+		},
+		{
+			name:  "EmptyDefinitionDestination",
+			input: "[x][]\n\n[x]: <>\n",
+			tree:  `LinkKind("x")`,
+			html:  `<p><a href="">x</a></p>`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			para := blocks[0]
+			if got := inlineTreeString(para.Source, para.AsNode()); got != test.tree {
+				t.Errorf("tree:\n got %s\nwant %s", got, test.tree)
+			}
+			r := &HTMLRenderer{ReferenceMap: refMap}
+			if got := string(r.AppendBlock(nil, para)); got != test.html {
+				t.Errorf("HTML = %q; want %q", got, test.html)
+			}
+		})
+	}
+
+	t.Run("NoChildren", func(t *testing.T) {
+		// Nodes built outside the parser may not have any children at all.
+		inlines := []*Inline{{kind: LinkKind}, {kind: ImageKind}}
+		const want = `<a href=""></a><img src="" alt="">`
+		if got := string(new(HTMLRenderer).AppendInlines(nil, nil, inlines)); got != want {
+			t.Errorf("HTML = %q; want %q", got, want)
+		}
+		if got, want := ResolveLink(inlines[0], nil, nil), (LinkDefinition{}); got != want {
+			t.Errorf("ResolveLink(...) = %+v; want %+v", got, want)
+		}
+	})
+}
+
+func TestHardLineBreaks(t *testing.T) {
+	tests := []struct {
+		input string
+		tree  string
+	}{
+		// Examples 633-647 of the CommonMark specification.
+		{"foo  \nbaz\n", `"foo" HardLineBreakKind "baz"`},
+		{"foo\\\nbaz\n", `"foo" HardLineBreakKind "baz"`},
+		{"foo       \nbaz\n", `"foo" HardLineBreakKind "baz"`},
+		{"foo  \n     bar\n", `"foo" HardLineBreakKind "bar"`},
+		{"foo\\\n     bar\n", `"foo" HardLineBreakKind "bar"`},
+		{"*foo  \nbar*\n", `EmphasisKind("foo" HardLineBreakKind "bar")`},
+		{"*foo\\\nbar*\n", `EmphasisKind("foo" HardLineBreakKind "bar")`},
+		{"`code  \nspan`\n", `CodeSpanKind("code  " IndentKind "span")`},
+		{"`code\\\nspan`\n", `CodeSpanKind("code\\" IndentKind "span")`},
+		{"<a href=\"foo  \nbar\">\n", `HTMLTagKind(RawHTMLKind)`},
+		{"<a href=\"foo\\\nbar\">\n", `HTMLTagKind(RawHTMLKind)`},
+		{"foo\\\n", `"foo" "\\"`},
+		{"foo  \n", `"foo  \n"`},
+		{"### foo\\\n", `"foo" "\\"`},
+		{"### foo  \n", `"foo"`},
+
+		// Breaks next to emphasis delimiters.
+		{"*foo*  \nbar\n", `EmphasisKind("foo") HardLineBreakKind "bar"`},
+		{"*foo  \n*bar*\n", `"*" "foo" HardLineBreakKind EmphasisKind("bar")`},
+		{"**foo  \n**bar\n", `"**" "foo" HardLineBreakKind "**" "bar"`},
+		{"**foo\\\n  bar**\n", `StrongKind("foo" HardLineBreakKind "bar")`},
+		{"_foo  \n  bar_\n", `EmphasisKind("foo" HardLineBreakKind "bar")`},
+	}
+	for _, test := range tests {
+		blocks, _ := Parse([]byte(test.input))
+		if got := inlineTreeString(blocks[0].Source, blocks[0].AsNode()); got != test.tree {
+			t.Errorf("Parse(%q) tree:\n got %s\nwant %s", test.input, got, test.tree)
+		}
+	}
+}
+
+// inlineTreeString formats the inline children of a node.
+// Text nodes are written as quoted strings,
+// and other nodes are written as their kind
+// followed by their children in parentheses.
+// The contents of link labels and destinations are omitted.
+func inlineTreeString(source []byte, n Node) string {
+	sb := new(strings.Builder)
+	for i := 0; i < n.ChildCount(); i++ {
+		if i > 0 {
+			sb.WriteString(" ")
+		}
+		child := n.Child(i).Inline()
+		switch child.Kind() {
+		case TextKind:
+			fmt.Fprintf(sb, "%q", spanSlice(source, child.Span()))
+		case LinkDestinationKind, LinkLabelKind, LinkTitleKind:
+			sb.WriteString(child.Kind().String())
+		default:
+			sb.WriteString(child.Kind().String())
+			if child.ChildCount() > 0 {
+				sb.WriteString("(")
+				sb.WriteString(inlineTreeString(source, child.AsNode()))
+				sb.WriteString(")")
+			}
+		}
+	}
+	return sb.String()
+}
+
 func TestDelimiterFlags(t *testing.T) {
 	tests := []struct {
 		prefix string
@@ -184,6 +619,834 @@ func TestDelimiterFlags(t *testing.T) {
 	}
 }
 
+func TestParseInline(t *testing.T) {
+	refMap := ReferenceMap{
+		"foo": {Destination: "/url", Title: "Foo", TitlePresent: true},
+	}
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "", want: ""},
+		{input: "Hello, World!", want: "Hello, World!"},
+		{input: "  *Fix* the `parser` & <b>more</b>", want: "<em>Fix</em> the <code>parser</code> &amp; <b>more</b>"},
+		{input: "See [foo] and [bar]", want: `See <a href="/url" title="Foo">foo</a> and [bar]`},
+		{input: "# Not a heading", want: "# Not a heading"},
+		{input: "[foo]: /other", want: `<a href="/url" title="Foo">foo</a>: /other`},
+		{input: "trailing backslash\\", want: "trailing backslash\\"},
+		{input: "two lines\\\nhere\n", want: "two lines<br>\nhere"},
+		{input: "soft\r\nbreak", want: "soft\r\nbreak"},
+		{input: "x\n", want: "x"},
+		{input: "x\r", want: "x"},
+		{input: "x\r\n", want: "x"},
+		{input: "a  ", want: "a"},
+		{input: "a \t", want: "a"},
+		{input: "a  \n", want: "a"},
+		{input: "a  \r", want: "a"},
+		{input: "a  \r\n", want: "a"},
+		{input: "a  \nb  \r\n", want: "a<br>\nb"},
+		{input: "a\n\n", want: "a"},
+		{input: " \r\n", want: ""},
+	}
+	for _, test := range tests {
+		inlines := ParseInline([]byte(test.input), refMap)
+		r := &HTMLRenderer{ReferenceMap: refMap}
+		got := string(r.AppendInlines(nil, []byte(test.input), inlines))
+		if got != test.want {
+			t.Errorf("ParseInline(%q) rendered as %q; want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestDescendantsOfKind(t *testing.T) {
+	tests := []struct {
+		input string
+		kind  InlineKind
+		want  []string
+	}{
+		{input: "*Hello, World!*", kind: CodeSpanKind, want: nil},
+		{input: "*`a` and `b`*", kind: CodeSpanKind, want: []string{"`a`", "`b`"}},
+		{input: "*x `a` [`b`](/url)*", kind: CodeSpanKind, want: []string{"`a`", "`b`"}},
+		{input: "*a **b** c*", kind: StrongKind, want: []string{"**b**"}},
+		{input: "*a *b* c*", kind: EmphasisKind, want: []string{"*b*"}},
+	}
+	for _, test := range tests {
+		source := []byte(test.input)
+		inlines := ParseInline(source, nil)
+		if len(inlines) != 1 {
+			t.Errorf("ParseInline(%q) returned %d nodes; want 1", test.input, len(inlines))
+			continue
+		}
+		descendants := inlines[0].DescendantsOfKind(test.kind)
+		if descendants != nil && len(descendants) == 0 {
+			t.Errorf("%q: DescendantsOfKind(%v) = []*Inline{}; want nil", test.input, test.kind)
+		}
+		var got []string
+		for _, d := range descendants {
+			got = append(got, string(source[d.Span().Start:d.Span().End]))
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%q: DescendantsOfKind(%v) (-want +got):\n%s", test.input, test.kind, diff)
+		}
+	}
+}
+
+func TestContainsKind(t *testing.T) {
+	tests := []struct {
+		input string
+		kind  InlineKind
+		want  bool
+	}{
+		{input: "*Hello, World!*", kind: CodeSpanKind, want: false},
+		{input: "*Hello, World!*", kind: EmphasisKind, want: false},
+		{input: "*`a` and `b`*", kind: CodeSpanKind, want: true},
+		{input: "*x [`b`](/url)*", kind: CodeSpanKind, want: true},
+		{input: "*x [`b`](/url)*", kind: LinkDestinationKind, want: true},
+		{input: "*a **b** c*", kind: StrongKind, want: true},
+		{input: "*a **b** c*", kind: TextKind, want: true},
+	}
+	for _, test := range tests {
+		source := []byte(test.input)
+		inlines := ParseInline(source, nil)
+		if len(inlines) != 1 {
+			t.Errorf("ParseInline(%q) returned %d nodes; want 1", test.input, len(inlines))
+			continue
+		}
+		if got := inlines[0].ContainsKind(test.kind); got != test.want {
+			t.Errorf("%q: ContainsKind(%v) = %t; want %t", test.input, test.kind, got, test.want)
+		}
+		if got, want := inlines[0].ContainsKind(test.kind), len(inlines[0].DescendantsOfKind(test.kind)) > 0; got != want {
+			t.Errorf("%q: ContainsKind(%v) = %t; len(DescendantsOfKind(%v)) > 0 = %t", test.input, test.kind, got, test.kind, want)
+		}
+	}
+}
+
+func TestHardBreakStyle(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []HardBreakStyle
+	}{
+		{input: "foo\\\nbar\n", want: []HardBreakStyle{HardBreakBackslash}},
+		{input: "foo  \nbar\n", want: []HardBreakStyle{HardBreakSpaces}},
+		{input: "foo     \r\nbar\r\n", want: []HardBreakStyle{HardBreakSpaces}},
+		{input: "foo\\\r\nbar  \nbaz\n", want: []HardBreakStyle{HardBreakBackslash, HardBreakSpaces}},
+		{input: "*foo  \nbar*\n", want: []HardBreakStyle{HardBreakSpaces}},
+		{input: "foo\\\n", want: nil},
+		{input: "foo  \n", want: nil},
+	}
+	for _, test := range tests {
+		blocks, _ := Parse([]byte(test.input))
+		var got []HardBreakStyle
+		for _, root := range blocks {
+			for i := 0; i < root.ChildCount(); i++ {
+				inline := root.Child(i).Inline()
+				if inline.Kind() == HardLineBreakKind {
+					got = append(got, inline.HardBreakStyle())
+				} else if inline.HardBreakStyle() != 0 {
+					t.Errorf("%q: %v node has HardBreakStyle() = %d", test.input, inline.Kind(), inline.HardBreakStyle())
+				}
+				for _, br := range inline.DescendantsOfKind(HardLineBreakKind) {
+					got = append(got, br.HardBreakStyle())
+				}
+			}
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%q: hard break styles (-want +got):\n%s", test.input, diff)
+		}
+	}
+}
+
+func TestInlineClone(t *testing.T) {
+	source := []byte("*a  \nb* [**c** `d`][ref] \\\n    e")
+	refMap := ReferenceMap{"ref": {Destination: "/url"}}
+	inlines := ParseInline(source, refMap)
+	for _, inline := range inlines {
+		if diff := cmp.Diff(inline, inline.DeepCopy(), cmp.AllowUnexported(Inline{})); diff != "" {
+			t.Errorf("%v.DeepCopy() (-want +got):\n%s", inline.Kind(), diff)
+		}
+		clone := inline.Clone()
+		if diff := cmp.Diff(inline, clone, cmp.AllowUnexported(Inline{})); diff != "" {
+			t.Errorf("%v.Clone() (-want +got):\n%s", inline.Kind(), diff)
+		}
+		if clone.ChildCount() == 0 {
+			continue
+		}
+		// Modifying the clone must not affect the original.
+		want := inline.ChildCount()
+		firstChild := inline.Child(0)
+		clone.RemoveChildren(0, 1)
+		if got := inline.ChildCount(); got != want {
+			t.Errorf("%v: removing child from clone changed original ChildCount() to %d; want %d", inline.Kind(), got, want)
+		}
+		if inline.Child(0) != firstChild {
+			t.Errorf("%v: removing child from clone changed original's first child", inline.Kind())
+		}
+		for _, child := range clone.children {
+			for _, orig := range inline.children {
+				if child == orig {
+					t.Errorf("%v: clone shares child %v", inline.Kind(), child.Kind())
+				}
+			}
+		}
+	}
+	if got := (*Inline)(nil).Clone(); got != nil {
+		t.Errorf("(*Inline)(nil).Clone() = %v; want nil", got)
+	}
+	if got := (*Inline)(nil).DeepCopy(); got != nil {
+		t.Errorf("(*Inline)(nil).DeepCopy() = %v; want nil", got)
+	}
+}
+
+func TestAutolinkSchemes(t *testing.T) {
+	tests := []struct {
+		name    string
+		schemes []string
+		input   string
+		want    string
+	}{
+		{
+			name:  "Default",
+			input: "<weird:thing> <foo@example.com>",
+			want:  `<p><a href="weird:thing">weird:thing</a> <a href="mailto:foo@example.com">foo@example.com</a></p>`,
+		},
+		{
+			name:    "Allowed",
+			schemes: []string{"http", "https", "mailto"},
+			input:   "<https://example.com/> <foo@example.com>",
+			want:    `<p><a href="https://example.com/">https://example.com/</a> <a href="mailto:foo@example.com">foo@example.com</a></p>`,
+		},
+		{
+			name:    "CaseInsensitive",
+			schemes: []string{"HTTP"},
+			input:   "<http://example.com/> <HtTp://example.com/>",
+			want:    `<p><a href="http://example.com/">http://example.com/</a> <a href="HtTp://example.com/">HtTp://example.com/</a></p>`,
+		},
+		{
+			name:    "Disallowed",
+			schemes: []string{"http", "https"},
+			input:   "<weird:thing> <foo@example.com>",
+			want:    "<p>&lt;weird:thing&gt; &lt;foo@example.com&gt;</p>",
+		},
+		{
+			name:    "MailtoURI",
+			schemes: []string{"mailto"},
+			input:   "<MAILTO:foo@example.com> <foo@example.com> <https://example.com/>",
+			want:    `<p><a href="MAILTO:foo@example.com">MAILTO:foo@example.com</a> <a href="mailto:foo@example.com">foo@example.com</a> &lt;https://example.com/&gt;</p>`,
+		},
+		{
+			name:    "Empty",
+			schemes: []string{},
+			input:   "<https://example.com/>",
+			want:    "<p>&lt;https://example.com/&gt;</p>",
+		},
+		{
+			name:    "DisallowedThenHTMLTag",
+			schemes: []string{"https"},
+			input:   "<weird:thing> <b>bold</b>",
+			want:    "<p>&lt;weird:thing&gt; <b>bold</b></p>",
+		},
+		{
+			name:    "DisallowedInsideHTMLTag",
+			schemes: []string{"https"},
+			input:   `<a href="x" title="<weird:thing>">link</a>`,
+			want:    `<p><a href="x" title="<weird:thing>">link</a></p>`,
+		},
+		{
+			name:    "DisallowedInsideLink",
+			schemes: []string{"https"},
+			input:   "[<weird:thing>](https://example.com/)",
+			want:    `<p><a href="https://example.com/">&lt;weird:thing&gt;</a></p>`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blockParser := NewBlockParser(strings.NewReader(test.input))
+			block, err := blockParser.NextBlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			inlineParser := &InlineParser{AutolinkSchemes: test.schemes}
+			inlineParser.Rewrite(block)
+			r := new(HTMLRenderer)
+			got := string(r.AppendBlock(nil, block))
+			if got != test.want {
+				t.Errorf("got %s; want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExtendedAutolinks(t *testing.T) {
+	tests := []struct {
+		name     string
+		disabled bool
+		schemes  []string
+		input    string
+		want     string
+	}{
+		{
+			name:  "GFMExample628",
+			input: "http://commonmark.org\n\n(Visit https://encrypted.google.com/search?q=Markup+(business))\n\nAnonymous FTP is available at ftp://foo.bar.baz.\n",
+			want: `<p><a href="http://commonmark.org">http://commonmark.org</a></p>` + "\n" +
+				`<p>(Visit <a href="https://encrypted.google.com/search?q=Markup+(business)">https://encrypted.google.com/search?q=Markup+(business)</a>)</p>` + "\n" +
+				`<p>Anonymous FTP is available at <a href="ftp://foo.bar.baz">ftp://foo.bar.baz</a>.</p>`,
+		},
+		{
+			name:     "Disabled",
+			disabled: true,
+			input:    "Visit https://example.com today\n",
+			want:     "<p>Visit https://example.com today</p>",
+		},
+		{
+			name:  "TrailingPunctuation",
+			input: "See https://example.com/a.b. Or https://example.com/x?! Or https://example.com/y_*~:,\n",
+			want:  `<p>See <a href="https://example.com/a.b">https://example.com/a.b</a>. Or <a href="https://example.com/x">https://example.com/x</a>?! Or <a href="https://example.com/y">https://example.com/y</a>_*~:,</p>`,
+		},
+		{
+			name:  "Parentheses",
+			input: "https://example.com/q=(a)))\n\n(https://example.com/q=(a)\n\nhttps://example.com/q=(a))+ok\n",
+			want: `<p><a href="https://example.com/q=(a)">https://example.com/q=(a)</a>))</p>` + "\n" +
+				`<p>(<a href="https://example.com/q=(a)">https://example.com/q=(a)</a></p>` + "\n" +
+				`<p><a href="https://example.com/q=(a))+ok">https://example.com/q=(a))+ok</a></p>`,
+		},
+		{
+			name:  "Entity",
+			input: "https://example.com/?q=a&hl=en\n\nhttps://example.com/?q=a&hl;\n",
+			want: `<p><a href="https://example.com/?q=a&amp;hl=en">https://example.com/?q=a&amp;hl=en</a></p>` + "\n" +
+				`<p><a href="https://example.com/?q=a">https://example.com/?q=a</a>&amp;hl;</p>`,
+		},
+		{
+			name:  "LessThan",
+			input: "https://example.com/he<lp\n",
+			want:  `<p><a href="https://example.com/he">https://example.com/he</a>&lt;lp</p>`,
+		},
+		{
+			name:  "Delimiters",
+			input: "*https://example.com/a_b_c* ~https://example.com\n",
+			want:  `<p><em><a href="https://example.com/a_b_c">https://example.com/a_b_c</a></em> ~<a href="https://example.com">https://example.com</a></p>`,
+		},
+		{
+			name:  "AfterWord",
+			input: "xhttps://example.com :https://example.com\n",
+			want:  "<p>xhttps://example.com :https://example.com</p>",
+		},
+		{
+			name:  "StartOfContinuationLine",
+			input: "> a\n> https://example.com\n",
+			want:  "<blockquote>\n<p>a\n<a href=\"https://example.com\">https://example.com</a></p>\n</blockquote>",
+		},
+		{
+			name:  "InvalidDomain",
+			input: "http://localhost http://a_b.example.com http://a.b_c.com http://a..b\n",
+			want:  `<p>http://localhost <a href="http://a_b.example.com">http://a_b.example.com</a> http://a.b_c.com http://a..b</p>`,
+		},
+		{
+			name:  "UppercaseScheme",
+			input: "HTTPS://example.com\n",
+			want:  "<p>HTTPS://example.com</p>",
+		},
+		{
+			name:  "CodeSpan",
+			input: "`https://example.com`\n",
+			want:  "<p><code>https://example.com</code></p>",
+		},
+		{
+			name:  "LinkDestination",
+			input: "[text](https://example.com)\n",
+			want:  `<p><a href="https://example.com">text</a></p>`,
+		},
+		{
+			name:  "LinkText",
+			input: "[see https://example.com](/url)\n",
+			want:  `<p><a href="/url">see https://example.com</a></p>`,
+		},
+		{
+			name:  "ImageDescription",
+			input: "![see https://example.com](/img.png)\n",
+			want:  `<p><img src="/img.png" alt="see https://example.com"></p>`,
+		},
+		{
+			name:  "AfterLink",
+			input: "[a](/url) https://example.com\n",
+			want:  `<p><a href="/url">a</a> <a href="https://example.com">https://example.com</a></p>`,
+		},
+		{
+			name:  "CloseBracket",
+			input: "https://example.com/a]b\n",
+			want:  `<p><a href="https://example.com/a">https://example.com/a</a>]b</p>`,
+		},
+		{
+			name:  "AngleBrackets",
+			input: "<https://example.com>\n",
+			want:  `<p><a href="https://example.com">https://example.com</a></p>`,
+		},
+		{
+			name:    "AutolinkSchemes",
+			schemes: []string{"https"},
+			input:   "https://example.com ftp://example.com\n",
+			want:    `<p><a href="https://example.com">https://example.com</a> ftp://example.com</p>`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blockParser := NewBlockParser(strings.NewReader(test.input))
+			inlineParser := &InlineParser{
+				AutolinkSchemes:   test.schemes,
+				ExtendedAutolinks: !test.disabled,
+			}
+			var blocks []*RootBlock
+			for {
+				block, err := blockParser.NextBlock()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				inlineParser.Rewrite(block)
+				blocks = append(blocks, block)
+			}
+			got := new(bytes.Buffer)
+			if err := RenderHTML(got, blocks, nil); err != nil {
+				t.Error("RenderHTML:", err)
+			}
+			if diff := cmp.Diff(string(normhtml.NormalizeHTML([]byte(test.want))), string(normhtml.NormalizeHTML(got.Bytes()))); diff != "" {
+				t.Errorf("Input:\n%s\nOutput (-want +got):\n%s", test.input, diff)
+			}
+		})
+	}
+}
+
+func TestTextDirectives(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		directives bool
+		want       string
+	}{
+		{
+			name:       "Basic",
+			input:      "Press :kbd[Ctrl]{.key} now",
+			directives: true,
+			want:       `"Press " DirectiveKind("Ctrl" DirectiveAttributesKind(".key")) " now"`,
+		},
+		{
+			name:       "NoAttributes",
+			input:      ":abbr[HTML] is fun",
+			directives: true,
+			want:       `DirectiveKind("HTML") " is fun"`,
+		},
+		{
+			name:       "EmptyAttributes",
+			input:      ":abbr[HTML]{}",
+			directives: true,
+			want:       `DirectiveKind("HTML" DirectiveAttributesKind)`,
+		},
+		{
+			name:       "UnclosedAttributes",
+			input:      ":abbr[HTML]{x",
+			directives: true,
+			want:       `DirectiveKind("HTML") "{x"`,
+		},
+		{
+			name:       "Disabled",
+			input:      ":abbr[HTML]{x}",
+			directives: false,
+			want:       `":abbr" "[" "HTML" "]" "{x}"`,
+		},
+		{
+			name:       "AfterLetter",
+			input:      "a:abbr[HTML]",
+			directives: true,
+			want:       `"a:abbr" "[" "HTML" "]"`,
+		},
+		{
+			name:       "NoLabel",
+			input:      ":abbr HTML",
+			directives: true,
+			want:       `":abbr HTML"`,
+		},
+		{
+			name:       "Emphasis",
+			input:      ":x[*a*]",
+			directives: true,
+			want:       `DirectiveKind(EmphasisKind("a"))`,
+		},
+		{
+			name:       "EmphasisDoesNotCross",
+			input:      "*:x[a*]",
+			directives: true,
+			want:       `"*" DirectiveKind("a" "*")`,
+		},
+		{
+			name:       "LinkInLabel",
+			input:      ":x[[a](/u)]",
+			directives: true,
+			want:       `DirectiveKind(LinkKind("a" LinkDestinationKind))`,
+		},
+		{
+			name:       "InLink",
+			input:      "[:x[a]](/u)",
+			directives: true,
+			want:       `LinkKind(DirectiveKind("a") LinkDestinationKind)`,
+		},
+		{
+			name:       "MultipleLines",
+			input:      ":x[a\nb]{c}",
+			directives: true,
+			want:       `DirectiveKind("a" SoftLineBreakKind "b" DirectiveAttributesKind("c"))`,
+		},
+		{
+			name:       "Unclosed",
+			input:      ":x[a",
+			directives: true,
+			want:       `":x[" "a"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blockParser := NewBlockParser(strings.NewReader(test.input))
+			block, err := blockParser.NextBlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			inlineParser := &InlineParser{Directives: test.directives}
+			inlineParser.Rewrite(block)
+			got := inlineTreeString(block.Source, block.AsNode())
+			if got != test.want {
+				t.Errorf("got %s; want %s", got, test.want)
+			}
+		})
+	}
+
+	t.Run("Accessors", func(t *testing.T) {
+		const input = ":kbd-key[Ctrl]{.key}"
+		block, err := NewBlockParser(strings.NewReader(input)).NextBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		(&InlineParser{Directives: true}).Rewrite(block)
+		directive := block.Child(0).Inline()
+		if got, want := directive.Kind(), DirectiveKind; got != want {
+			t.Fatalf("Kind() = %v; want %v", got, want)
+		}
+		if got, want := directive.DirectiveName(block.Source), "kbd-key"; got != want {
+			t.Errorf("DirectiveName(...) = %q; want %q", got, want)
+		}
+		if got, want := directive.DirectiveAttributes().Text(block.Source), ".key"; got != want {
+			t.Errorf("DirectiveAttributes().Text(...) = %q; want %q", got, want)
+		}
+		if got, want := spanSlice(block.Source, directive.Span()), input; string(got) != want {
+			t.Errorf("span = %q; want %q", got, want)
+		}
+	})
+}
+
+func TestEmoji(t *testing.T) {
+	resolver := EmojiMap{
+		"a":     "A",
+		"b":     "B",
+		"smile": "\U0001f604",
+		"+1":    "\U0001f44d",
+	}
+	tests := []struct {
+		name     string
+		input    string
+		resolver EmojiResolver
+		want     string
+	}{
+		{
+			name:     "Alone",
+			input:    ":smile:",
+			resolver: resolver,
+			want:     `EmojiKind`,
+		},
+		{
+			name:     "Start",
+			input:    ":smile: Hello",
+			resolver: resolver,
+			want:     `EmojiKind " Hello"`,
+		},
+		{
+			name:     "End",
+			input:    "Hello :smile:",
+			resolver: resolver,
+			want:     `"Hello " EmojiKind`,
+		},
+		{
+			name:     "Adjacent",
+			input:    ":a::b:",
+			resolver: resolver,
+			want:     `EmojiKind EmojiKind`,
+		},
+		{
+			name:     "Punctuation",
+			input:    "(:+1:).",
+			resolver: resolver,
+			want:     `"(" EmojiKind ")."`,
+		},
+		{
+			name:     "ExtraColons",
+			input:    "::smile::",
+			resolver: resolver,
+			want:     `":" EmojiKind ":"`,
+		},
+		{
+			name:     "Unresolved",
+			input:    ":frown: :smile:",
+			resolver: resolver,
+			want:     `":frown: " EmojiKind`,
+		},
+		{
+			name:  "NoResolver",
+			input: ":smile:",
+			want:  `":smile:"`,
+		},
+		{
+			name:     "AfterWord",
+			input:    "a:smile: :smile:b",
+			resolver: resolver,
+			want:     `"a:smile: :smile:b"`,
+		},
+		{
+			name:     "URLEarlierInLine",
+			input:    "See https://example.com:8080/a:b :smile:",
+			resolver: resolver,
+			want:     `"See https://example.com:8080/a:b " EmojiKind`,
+		},
+		{
+			name:     "Emphasis",
+			input:    "*:smile:*",
+			resolver: resolver,
+			want:     `EmphasisKind(EmojiKind)`,
+		},
+		{
+			name:     "CodeSpan",
+			input:    "`:smile:`",
+			resolver: resolver,
+			want:     `CodeSpanKind(":smile:")`,
+		},
+		{
+			name:     "Autolink",
+			input:    "<https://example.com/:smile:>",
+			resolver: resolver,
+			want:     `AutolinkKind("https://example.com/:smile:")`,
+		},
+		{
+			name:     "RawHTML",
+			input:    `a <span title=":smile:">`,
+			resolver: resolver,
+			want:     `"a " HTMLTagKind(RawHTMLKind)`,
+		},
+		{
+			name:     "LinkDestination",
+			input:    "[:smile:](/:smile:)",
+			resolver: resolver,
+			want:     `LinkKind(EmojiKind LinkDestinationKind)`,
+		},
+		{
+			name:     "Escaped",
+			input:    `\:smile:`,
+			resolver: resolver,
+			want:     `":" "smile:"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blockParser := NewBlockParser(strings.NewReader(test.input))
+			block, err := blockParser.NextBlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			inlineParser := &InlineParser{EmojiResolver: test.resolver}
+			inlineParser.Rewrite(block)
+			got := inlineTreeString(block.Source, block.AsNode())
+			if got != test.want {
+				t.Errorf("got %s; want %s", got, test.want)
+			}
+		})
+	}
+
+	t.Run("Accessors", func(t *testing.T) {
+		block, err := NewBlockParser(strings.NewReader("Hi :+1:")).NextBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		(&InlineParser{EmojiResolver: resolver}).Rewrite(block)
+		emoji := block.Child(1).Inline()
+		if got, want := emoji.Kind(), EmojiKind; got != want {
+			t.Fatalf("Kind() = %v; want %v", got, want)
+		}
+		if got, want := emoji.EmojiName(block.Source), "+1"; got != want {
+			t.Errorf("EmojiName(...) = %q; want %q", got, want)
+		}
+		if got, want := emoji.Text(block.Source), "\U0001f44d"; got != want {
+			t.Errorf("Text(...) = %q; want %q", got, want)
+		}
+	})
+}
+
+func TestWikiLinks(t *testing.T) {
+	refMap := ReferenceMap{
+		"x":   {Destination: "/x"},
+		"foo": {Destination: "/foo"},
+	}
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "Target",
+			input: "See [[Page Name]].",
+			want:  `"See " WikiLinkKind(WikiLinkTargetKind("Page Name") "Page Name") "."`,
+		},
+		{
+			name:  "Display",
+			input: "[[Page Name|display text]]",
+			want:  `WikiLinkKind(WikiLinkTargetKind("Page Name") "display text")`,
+		},
+		{
+			name:  "Whitespace",
+			input: "[[ Page | text ]]",
+			want:  `WikiLinkKind(WikiLinkTargetKind("Page") "text")`,
+		},
+		{
+			name:  "EmptyDisplay",
+			input: "[[Page|]]",
+			want:  `WikiLinkKind(WikiLinkTargetKind("Page") "Page")`,
+		},
+		{
+			name:  "EmptyTarget",
+			input: "[[|text]]",
+			want:  `"[" "[" "|text" "]" "]"`,
+		},
+		{
+			name:  "NestedBrackets",
+			input: "[[a [b] c|d]]",
+			want:  `WikiLinkKind(WikiLinkTargetKind("a [b] c") "d")`,
+		},
+		{
+			name:  "NestedBracketsAtEnd",
+			input: "[[a [b]]]",
+			want:  `WikiLinkKind(WikiLinkTargetKind("a [b]") "a [b]")`,
+		},
+		{
+			name:  "PipeInNestedBrackets",
+			input: "[[a [b|c]]]",
+			want:  `WikiLinkKind(WikiLinkTargetKind("a [b|c]") "a [b|c]")`,
+		},
+		{
+			name:  "Unbalanced",
+			input: "[[a]b]]",
+			want:  `"[" "[" "a" "]" "b" "]" "]"`,
+		},
+		{
+			name:  "Escaped",
+			input: `\[[x]]`,
+			want:  `"[" LinkKind("x") "]"`,
+		},
+		{
+			name:  "InLinkText",
+			input: "[see [[x]]](/url)",
+			want:  `"[" "see " WikiLinkKind(WikiLinkTargetKind("x") "x") "]" "(/url)"`,
+		},
+		{
+			name:  "InImageDescription",
+			input: "![see [[x]]](/img.png)",
+			want:  `ImageKind("see " WikiLinkKind(WikiLinkTargetKind("x") "x") LinkDestinationKind)`,
+		},
+		{
+			name:  "ReferenceLink",
+			input: "[foo] [x][foo] [[x]]",
+			want:  `LinkKind("foo") " " LinkKind("x" LinkLabelKind) " " WikiLinkKind(WikiLinkTargetKind("x") "x")`,
+		},
+		{
+			name:  "CodeSpan",
+			input: "[[a `]]` b]]",
+			want:  `"[" "[" "a " CodeSpanKind("]]") " b" "]" "]"`,
+		},
+		{
+			name:  "LineEnding",
+			input: "[[a\nb]]",
+			want:  `"[" "[" "a" SoftLineBreakKind "b" "]" "]"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			block, err := NewBlockParser(strings.NewReader(test.input)).NextBlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			inlineParser := &InlineParser{
+				ReferenceMatcher: refMap,
+				WikiLinks:        true,
+			}
+			inlineParser.Rewrite(block)
+			got := inlineTreeString(block.Source, block.AsNode())
+			if got != test.want {
+				t.Errorf("got %s; want %s", got, test.want)
+			}
+		})
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		block, err := NewBlockParser(strings.NewReader("[[x]]")).NextBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		(&InlineParser{ReferenceMatcher: refMap}).Rewrite(block)
+		const want = `"[" LinkKind("x") "]"`
+		if got := inlineTreeString(block.Source, block.AsNode()); got != want {
+			t.Errorf("got %s; want %s", got, want)
+		}
+	})
+
+	t.Run("Accessors", func(t *testing.T) {
+		block, err := NewBlockParser(strings.NewReader("Hi [[Page|text]]")).NextBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		(&InlineParser{WikiLinks: true}).Rewrite(block)
+		link := block.Child(1).Inline()
+		if got, want := link.Kind(), WikiLinkKind; got != want {
+			t.Fatalf("Kind() = %v; want %v", got, want)
+		}
+		if got, want := link.WikiLinkTarget().Text(block.Source), "Page"; got != want {
+			t.Errorf("WikiLinkTarget().Text(...) = %q; want %q", got, want)
+		}
+		if got := block.Child(0).Inline().WikiLinkTarget(); got != nil {
+			t.Errorf("WikiLinkTarget() on text = %v; want <nil>", got)
+		}
+	})
+}
+
+func BenchmarkParseInline(b *testing.B) {
+	const input = "Fix *emphasis* parsing in `ParseInline` for [links](https://example.com/)"
+	refMap := make(ReferenceMap)
+	b.Run("ParseInline", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		r := &HTMLRenderer{ReferenceMap: refMap}
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			inlines := ParseInline([]byte(input), refMap)
+			buf = r.AppendInlines(buf[:0], []byte(input), inlines)
+		}
+	})
+	b.Run("Parse", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			blocks, refMap := Parse([]byte(input))
+			r := &HTMLRenderer{ReferenceMap: refMap}
+			buf = buf[:0]
+			for _, block := range blocks {
+				buf = r.AppendBlock(buf, block)
+			}
+		}
+	})
+}
+
 func FuzzInlineParsing(f *testing.F) {
 	for _, test := range loadTestSuite(f) {
 		f.Add(test.Markdown)
@@ -224,3 +1487,174 @@ func FuzzInlineParsing(f *testing.F) {
 		}
 	})
 }
+
+func TestRewriteN(t *testing.T) {
+	var items strings.Builder
+	for i := 0; i < 25; i++ {
+		fmt.Fprintf(&items, "- item *%d* with [a link](/%d)\n", i, i)
+	}
+	tests := []struct {
+		name   string
+		input  string
+		blocks int
+	}{
+		{
+			name:   "Paragraph",
+			input:  "Hello, **World**!\n",
+			blocks: 1,
+		},
+		{
+			name:   "List",
+			input:  items.String(),
+			blocks: 25,
+		},
+		{
+			name:   "Nested",
+			input:  "> # Title\n>\n> - a `b`\n>   c\n>\n>   ```\n>   code\n>   ```\n> - <span>d</span>\n>\n> e\\\n> f\n",
+			blocks: 4,
+		},
+		{
+			name:   "NoInlines",
+			input:  "```\ncode\n```\n",
+			blocks: 0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := parseUnparsed(t, test.input)
+			new(InlineParser).Rewrite(want)
+			wantHTML := string(new(HTMLRenderer).AppendBlock(nil, want))
+
+			for _, n := range []int{1, 2, 3, 1000} {
+				root := parseUnparsed(t, test.input)
+				p := new(InlineParser)
+				progress, done := p.RewriteN(root, RewriteProgress{}, 0)
+				if done != (test.blocks == 0) {
+					t.Errorf("RewriteN(root, {}, 0) = _, %t; want %t", done, test.blocks == 0)
+				}
+				calls := 0
+				for {
+					calls++
+					if calls > test.blocks+1 {
+						t.Fatalf("RewriteN(root, progress, %d) did not finish after %d calls", n, calls-1)
+					}
+					progress, done = p.RewriteN(root, progress, n)
+					// Partially rewritten trees must still be renderable.
+					new(HTMLRenderer).AppendBlock(nil, root)
+					if done {
+						break
+					}
+				}
+				wantCalls := (test.blocks + n - 1) / n
+				if wantCalls == 0 {
+					wantCalls = 1
+				}
+				if calls != wantCalls {
+					t.Errorf("RewriteN(root, progress, %d) finished after %d calls; want %d", n, calls, wantCalls)
+				}
+				if got := string(new(HTMLRenderer).AppendBlock(nil, root)); got != wantHTML {
+					t.Errorf("RewriteN(root, progress, %d) rendered:\n%s\nwant:\n%s", n, got, wantHTML)
+				}
+				if _, done := p.RewriteN(root, progress, 1); !done {
+					t.Errorf("RewriteN(root, progress, 1) after finishing = _, false; want true")
+				}
+				if _, done := p.RewriteN(root, RewriteProgress{}, 1); !done {
+					t.Errorf("RewriteN(root, {}, 1) after finishing = _, false; want true")
+				}
+			}
+
+			t.Run("Negative", func(t *testing.T) {
+				root := parseUnparsed(t, test.input)
+				p := new(InlineParser)
+				progress, done := p.RewriteN(root, RewriteProgress{}, 1)
+				if test.blocks > 1 && done {
+					t.Fatalf("RewriteN(root, {}, 1) = _, true; want false")
+				}
+				if _, done := p.RewriteN(root, progress, -1); !done {
+					t.Errorf("RewriteN(root, progress, -1) = _, false; want true")
+				}
+				if got := string(new(HTMLRenderer).AppendBlock(nil, root)); got != wantHTML {
+					t.Errorf("RewriteN(root, progress, -1) rendered:\n%s\nwant:\n%s", got, wantHTML)
+				}
+			})
+		})
+	}
+}
+
+func TestRewriteNOtherRoot(t *testing.T) {
+	const input = "- a *b*\n- c *d*\n"
+	p := new(InlineParser)
+	progress, _ := p.RewriteN(parseUnparsed(t, input), RewriteProgress{}, 1)
+	root := parseUnparsed(t, input)
+	if _, done := p.RewriteN(root, progress, 2); !done {
+		t.Error("RewriteN with progress from another root did not start from the beginning")
+	}
+	want := "<ul><li>a <em>b</em></li><li>c <em>d</em></li></ul>"
+	if got := string(new(HTMLRenderer).AppendBlock(nil, root)); got != want {
+		t.Errorf("rendered:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func BenchmarkRewriteN(b *testing.B) {
+	var sb strings.Builder
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&sb, "- item *%d*\n", i)
+	}
+	input := sb.String()
+	b.SetBytes(int64(len(input)))
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		root := parseUnparsed(b, input)
+		b.StartTimer()
+		p := new(InlineParser)
+		var progress RewriteProgress
+		for done := false; !done; {
+			progress, done = p.RewriteN(root, progress, 1)
+		}
+	}
+}
+
+// parseUnparsed returns the first root block of input
+// without parsing its inlines.
+func parseUnparsed(tb testing.TB, input string) *RootBlock {
+	tb.Helper()
+	root, err := NewBlockParser(strings.NewReader(input)).NextBlock()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return root
+}
+
+func TestIsAbsoluteURI(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"", false},
+		{"http://example.com", true},
+		{"https://example.com/foo?bar=baz#qux", true},
+		{"irc://foo.bar:2233/baz", true},
+		{"MAILTO:FOO@BAR.BAZ", true},
+		{"a+b+c:d", true},
+		{"made-up-scheme://foo,bar", true},
+		{"localhost:5001/foo", true},
+		{"xy:", true},
+		{"m:abc", false},
+		{"3http://example.com", false},
+		{"abcdefghijklmnopqrstuvwxyzabcdef:x", true},
+		{"abcdefghijklmnopqrstuvwxyzabcdefg:x", false},
+		{"http", false},
+		{"foo.bar.baz", false},
+		{"http://foo.bar/baz bim", false},
+		{"http://example.com/\\[\\", true},
+		{"http://a<b", false},
+		{"http://a>b", false},
+		{"http://a\x7fb", false},
+		{"foo@bar.example.com", false},
+	}
+	for _, test := range tests {
+		if got := IsAbsoluteURI(test.s); got != test.want {
+			t.Errorf("IsAbsoluteURI(%q) = %t; want %t", test.s, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package treedump provides a canonical text serialization of parsed CommonMark trees
+// for use in golden tests.
+//
+// Nodes are serialized by [commonmark.DumpTree],
+// which writes each node's kind, span, kind-specific attributes,
+// and an excerpt of its source on its own line.
+// Dump adds a header for each root block. For example:
+//
+//	Root line=1 offset=[0,6)
+//	  Paragraph [0,6) "Hello\n"
+//	    Text [0,5) "Hello"
+package treedump
+
+import (
+	"fmt"
+	"strings"
+
+	"zombiezen.com/go/commonmark"
+)
+
+// Dump returns the serialization of the given blocks.
+func Dump(blocks []*commonmark.RootBlock) string {
+	sb := new(strings.Builder)
+	for _, root := range blocks {
+		fmt.Fprintf(sb, "Root line=%d offset=[%d,%d)\n", root.StartLine, root.StartOffset, root.EndOffset)
+		tree := DumpNode(root.Source, root.AsNode())
+		for _, line := range strings.SplitAfter(tree, "\n") {
+			if line != "" {
+				sb.WriteString("  ")
+				sb.WriteString(line)
+			}
+		}
+	}
+	return sb.String()
+}
+
+// DumpNode returns the serialization of the given node and its descendants.
+// source must be the source of the [commonmark.RootBlock] the node belongs to.
+func DumpNode(source []byte, n commonmark.Node) string {
+	sb := new(strings.Builder)
+	// Writing to a strings.Builder never fails.
+	commonmark.DumpTree(sb, source, n)
+	return sb.String()
+}
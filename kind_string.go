@@ -20,12 +20,13 @@ func _() {
 	_ = x[ListItemKind-10]
 	_ = x[ListKind-11]
 	_ = x[ListMarkerKind-12]
-	_ = x[documentKind-13]
+	_ = x[DirectiveBlockKind-13]
+	_ = x[documentKind-14]
 }
 
-const _BlockKind_name = "ParagraphKindThematicBreakKindATXHeadingKindSetextHeadingKindIndentedCodeBlockKindFencedCodeBlockKindHTMLBlockKindLinkReferenceDefinitionKindBlockQuoteKindListItemKindListKindListMarkerKinddocumentKind"
+const _BlockKind_name = "ParagraphKindThematicBreakKindATXHeadingKindSetextHeadingKindIndentedCodeBlockKindFencedCodeBlockKindHTMLBlockKindLinkReferenceDefinitionKindBlockQuoteKindListItemKindListKindListMarkerKindDirectiveBlockKinddocumentKind"
 
-var _BlockKind_index = [...]uint8{0, 13, 30, 44, 61, 82, 101, 114, 141, 155, 167, 175, 189, 201}
+var _BlockKind_index = [...]uint8{0, 13, 30, 44, 61, 82, 101, 114, 141, 155, 167, 175, 189, 207, 219}
 
 func (i BlockKind) String() string {
 	i -= 1
@@ -56,11 +57,16 @@ func _() {
 	_ = x[HTMLTagKind-16]
 	_ = x[RawHTMLKind-17]
 	_ = x[UnparsedKind-18]
+	_ = x[DirectiveKind-19]
+	_ = x[DirectiveAttributesKind-20]
+	_ = x[EmojiKind-21]
+	_ = x[WikiLinkKind-22]
+	_ = x[WikiLinkTargetKind-23]
 }
 
-const _InlineKind_name = "TextKindSoftLineBreakKindHardLineBreakKindIndentKindCharacterReferenceKindInfoStringKindEmphasisKindStrongKindLinkKindImageKindLinkDestinationKindLinkTitleKindLinkLabelKindCodeSpanKindAutolinkKindHTMLTagKindRawHTMLKindUnparsedKind"
+const _InlineKind_name = "TextKindSoftLineBreakKindHardLineBreakKindIndentKindCharacterReferenceKindInfoStringKindEmphasisKindStrongKindLinkKindImageKindLinkDestinationKindLinkTitleKindLinkLabelKindCodeSpanKindAutolinkKindHTMLTagKindRawHTMLKindUnparsedKindDirectiveKindDirectiveAttributesKindEmojiKindWikiLinkKindWikiLinkTargetKind"
 
-var _InlineKind_index = [...]uint8{0, 8, 25, 42, 52, 74, 88, 100, 110, 118, 127, 146, 159, 172, 184, 196, 207, 218, 230}
+var _InlineKind_index = [...]uint16{0, 8, 25, 42, 52, 74, 88, 100, 110, 118, 127, 146, 159, 172, 184, 196, 207, 218, 230, 243, 266, 275, 287, 305}
 
 func (i InlineKind) String() string {
 	i -= 1
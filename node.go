@@ -16,7 +16,10 @@
 
 package commonmark
 
-import "unsafe"
+import (
+	"sort"
+	"unsafe"
+)
 
 const (
 	nodeTypeBlock = 1 + iota
@@ -104,3 +107,82 @@ func (b *Block) AsNode() Node {
 		ptr: unsafe.Pointer(b),
 	}
 }
+
+// NodeAtLine returns the deepest node in root
+// that starts on or contains the given 1-based line number.
+// Line numbers are relative to the original source
+// (i.e. root.StartLine is the number of the root block's first line).
+// If more than one sibling contains the line,
+// NodeAtLine descends into the first one.
+// NodeAtLine also returns the node's ancestors,
+// starting with root and ending with the node's parent.
+// If the line is outside of root, NodeAtLine returns the zero Node and nil.
+func NodeAtLine(root *RootBlock, line int) (Node, []Node) {
+	lines := newLineIndex(root)
+	containsLine := func(n Node) bool {
+		span := n.Span()
+		if !span.IsValid() {
+			return false
+		}
+		last := span.End - 1
+		if last < span.Start {
+			last = span.Start
+		}
+		startLine, _ := lines.position(span.Start)
+		lastLine, _ := lines.position(last)
+		return startLine <= line && line <= lastLine
+	}
+
+	curr := root.AsNode()
+	if !containsLine(curr) {
+		return Node{}, nil
+	}
+	var path []Node
+descend:
+	for {
+		for i, n := 0, curr.ChildCount(); i < n; i++ {
+			if child := curr.Child(i); containsLine(child) {
+				path = append(path, curr)
+				curr = child
+				continue descend
+			}
+		}
+		return curr, path
+	}
+}
+
+// lineIndex maps byte offsets in a [RootBlock]'s Source
+// to line and column numbers in the original source.
+type lineIndex struct {
+	startLine int
+	// lineStarts[i] is the offset of the (startLine + i)'th line.
+	lineStarts []int
+}
+
+func newLineIndex(root *RootBlock) *lineIndex {
+	idx := &lineIndex{
+		startLine:  root.StartLine,
+		lineStarts: []int{0},
+	}
+	for i := 0; i < len(root.Source); i++ {
+		switch root.Source[i] {
+		case '\r':
+			if i+1 < len(root.Source) && root.Source[i+1] == '\n' {
+				i++
+			}
+			fallthrough
+		case '\n':
+			idx.lineStarts = append(idx.lineStarts, i+1)
+		}
+	}
+	return idx
+}
+
+// position returns the 1-based line number and 1-based byte column
+// of the given offset.
+func (idx *lineIndex) position(offset int) (line, col int) {
+	i := sort.Search(len(idx.lineStarts), func(i int) bool {
+		return idx.lineStarts[i] > offset
+	}) - 1
+	return idx.startLine + i, offset - idx.lineStarts[i] + 1
+}
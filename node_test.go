@@ -0,0 +1,200 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commonmark
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNodeAtLine(t *testing.T) {
+	const input = "# Title\n" +
+		"\n" +
+		"> - item one\n" +
+		">   more *text*\n" +
+		">\n" +
+		"> - two\n" +
+		"\n" +
+		"foo\r\n" +
+		"bar\r" +
+		"baz\n"
+	tests := []struct {
+		line int
+		// want is the kinds of the ancestors and the node, separated by spaces.
+		want string
+		// text is the source of the node.
+		text string
+	}{
+		{line: 0, want: ""},
+		{line: 1, want: "ATXHeadingKind TextKind", text: "Title"},
+		{line: 2, want: ""},
+		{line: 3, want: "BlockQuoteKind ListKind ListItemKind ListMarkerKind", text: "-"},
+		{line: 4, want: "BlockQuoteKind ListKind ListItemKind ParagraphKind TextKind", text: "more "},
+		{line: 5, want: "BlockQuoteKind ListKind ListItemKind", text: "- item one\n>   more *text*\n>\n"},
+		{line: 6, want: "BlockQuoteKind ListKind ListItemKind ListMarkerKind", text: "-"},
+		{line: 7, want: ""},
+		{line: 8, want: "ParagraphKind TextKind", text: "foo"},
+		{line: 9, want: "ParagraphKind TextKind", text: "bar"},
+		{line: 10, want: "ParagraphKind TextKind", text: "baz"},
+		{line: 11, want: ""},
+	}
+
+	blocks, _ := Parse([]byte(input))
+	for _, test := range tests {
+		var root *RootBlock
+		var got Node
+		var path []Node
+		for _, root = range blocks {
+			got, path = NodeAtLine(root, test.line)
+			if got != (Node{}) {
+				break
+			}
+		}
+		if got == (Node{}) {
+			if path != nil {
+				t.Errorf("NodeAtLine(..., %d) returned zero Node with path %v", test.line, path)
+			}
+			if test.want != "" {
+				t.Errorf("NodeAtLine(..., %d) found no node; want %s", test.line, test.want)
+			}
+			continue
+		}
+
+		var kinds []string
+		for _, n := range append(path, got) {
+			kinds = append(kinds, nodeKindString(n))
+		}
+		if diff := cmp.Diff(test.want, strings.Join(kinds, " ")); diff != "" {
+			t.Errorf("NodeAtLine(..., %d) kinds (-want +got):\n%s", test.line, diff)
+		}
+		if len(path) == 0 || path[0] != root.AsNode() {
+			t.Errorf("NodeAtLine(..., %d) path does not start with root", test.line)
+		}
+		if gotText := string(spanSlice(root.Source, got.Span())); gotText != test.text {
+			t.Errorf("NodeAtLine(..., %d) node source = %q; want %q", test.line, gotText, test.text)
+		}
+	}
+}
+
+// TestSourceTextRoundTrip verifies that the SourceText of blocks and delimited inline nodes
+// parses to a node of the same kind.
+func TestSourceTextRoundTrip(t *testing.T) {
+	delimited := map[InlineKind]bool{
+		EmphasisKind: true,
+		StrongKind:   true,
+		CodeSpanKind: true,
+		LinkKind:     true,
+		ImageKind:    true,
+		AutolinkKind: true,
+		HTMLTagKind:  true,
+	}
+	for _, ex := range loadTestSuite(t) {
+		blocks, refMap := Parse([]byte(ex.Markdown))
+		for _, root := range blocks {
+			text := root.SourceText(root.Source)
+			if root.Kind() != IndentedCodeBlockKind {
+				reparsed, _ := Parse(text)
+				if len(reparsed) != 1 || reparsed[0].Kind() != root.Kind() {
+					t.Errorf("Example %d: %v block SourceText %q parsed as %d blocks", ex.Example, root.Kind(), text, len(reparsed))
+				}
+			}
+
+			var walk func(n Node)
+			walk = func(n Node) {
+				if inline := n.Inline(); inline != nil {
+					text := inline.SourceText(root.Source)
+					if want := spanSlice(root.Source, inline.Span()); !bytes.Equal(text, want) {
+						t.Errorf("Example %d: %v SourceText = %q; want %q", ex.Example, inline.Kind(), text, want)
+					}
+					if delimited[inline.Kind()] {
+						reparsed := ParseInline(text, refMap)
+						if len(reparsed) != 1 || reparsed[0].Kind() != inline.Kind() || !bytes.Equal(reparsed[0].SourceText(text), text) {
+							t.Errorf("Example %d: %v SourceText %q did not parse to a single %v node", ex.Example, inline.Kind(), text, inline.Kind())
+						}
+					}
+				}
+				for i := 0; i < n.ChildCount(); i++ {
+					walk(n.Child(i))
+				}
+			}
+			walk(root.AsNode())
+		}
+	}
+}
+
+func TestSourceText(t *testing.T) {
+	source := []byte("**bold** `code`")
+	inlines := ParseInline(source, nil)
+	var got []string
+	for _, inline := range inlines {
+		got = append(got, string(inline.SourceText(source)))
+	}
+	want := []string{"**bold**", " ", "`code`"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("SourceText (-want +got):\n%s", diff)
+	}
+
+	refSource := []byte("&copy;")
+	ref := ParseInline(refSource, nil)[0]
+	if got, want := string(ref.SourceText(refSource)), "&copy;"; got != want {
+		t.Errorf("character reference SourceText = %q; want %q", got, want)
+	}
+	if got, want := ref.Text(refSource), "\u00a9"; got != want {
+		t.Errorf("character reference Text = %q; want %q", got, want)
+	}
+	if got, want := string(ref.Raw(refSource)), "&copy;"; got != want {
+		t.Errorf("character reference Raw = %q; want %q", got, want)
+	}
+	if got, want := string(inlines[0].Raw(source)), "**bold**"; got != want {
+		t.Errorf("strong Raw = %q; want %q", got, want)
+	}
+
+	quote, _ := Parse([]byte("> - a\n>   b\n"))
+	item := quote[0].Child(0).Block().Child(0).Block()
+	if got, want := string(item.SourceText(quote[0].Source)), "- a\n>   b\n"; got != want {
+		t.Errorf("list item in block quote SourceText = %q; want %q", got, want)
+	}
+	if got, want := string(item.Raw(quote[0].Source)), "- a\n>   b\n"; got != want {
+		t.Errorf("list item in block quote Raw = %q; want %q", got, want)
+	}
+
+	if got := (*Inline)(nil).SourceText(source); got != nil {
+		t.Errorf("(*Inline)(nil).SourceText(...) = %q; want nil", got)
+	}
+	if got := (*Inline)(nil).Raw(source); got != nil {
+		t.Errorf("(*Inline)(nil).Raw(...) = %q; want nil", got)
+	}
+	if got := (*Block)(nil).SourceText(source); got != nil {
+		t.Errorf("(*Block)(nil).SourceText(...) = %q; want nil", got)
+	}
+	if got := (*Block)(nil).Raw(source); got != nil {
+		t.Errorf("(*Block)(nil).Raw(...) = %q; want nil", got)
+	}
+	if got := inlines[0].SourceText(source[:3]); got != nil {
+		t.Errorf("SourceText(short source) = %q; want nil", got)
+	}
+}
+
+func nodeKindString(n Node) string {
+	if b := n.Block(); b != nil {
+		return b.Kind().String()
+	}
+	return n.Inline().Kind().String()
+}
@@ -21,22 +21,98 @@ package commonmark
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"unicode"
 )
 
+// maxBlockSize is the maximum number of bytes
+// that a [BlockParser] will buffer for a single top-level block.
+const maxBlockSize = 1024 * 1024
+
+// ErrBlockTooLarge is returned by [*BlockParser.NextBlock]
+// (possibly wrapped with position information)
+// when a top-level block exceeds 1 MiB.
+var ErrBlockTooLarge = errors.New("block too large")
+
+// ErrLineTooLong is returned by [*BlockParser.NextBlock]
+// (possibly wrapped with position information)
+// when a line exceeds [BlockParser.MaxLineLength].
+var ErrLineTooLong = errors.New("line too long")
+
 // tabStopSize is the multiple of columns that a [tab] advances to.
 //
 // [tab]: https://spec.commonmark.org/0.30/#tabs
 const tabStopSize = 4
 
+// Constructs is a set of CommonMark syntax constructs
+// that can be disabled with [BlockParser.DisabledConstructs]
+// and [InlineParser.DisabledConstructs].
+// When a construct is disabled, the characters that would start it
+// are parsed as if they did not start the construct,
+// usually resulting in literal text.
+type Constructs uint32
+
+const (
+	// ConstructRawHTML represents [HTML blocks] and [raw HTML] inlines.
+	//
+	// [HTML blocks]: https://spec.commonmark.org/0.30/#html-blocks
+	// [raw HTML]: https://spec.commonmark.org/0.30/#raw-html
+	ConstructRawHTML Constructs = 1 << iota
+	// ConstructImage represents [images].
+	// When images are disabled, a '!' before a link is literal text.
+	//
+	// [images]: https://spec.commonmark.org/0.30/#images
+	ConstructImage
+	// ConstructAutolink represents [autolinks].
+	//
+	// [autolinks]: https://spec.commonmark.org/0.30/#autolinks
+	ConstructAutolink
+	// ConstructIndentedCode represents [indented code blocks].
+	// When indented code blocks are disabled,
+	// lines indented by four or more spaces start paragraphs.
+	//
+	// [indented code blocks]: https://spec.commonmark.org/0.30/#indented-code-blocks
+	ConstructIndentedCode
+)
+
 // A BlockParser splits a CommonMark document into blocks.
 type BlockParser struct {
-	buf    []byte // current block being parsed (run through padNulls)
-	offset int64  // offset from beginning of stream to beginning of buf
-	lineno int    // line number of beginning of buf
-	i      int    // parse position within buf
+	// MaxLineLength is the maximum number of bytes permitted in a single line,
+	// not including the line ending.
+	// If MaxLineLength is zero or negative, lines may be of any length.
+	MaxLineLength int
+	// If Directives is true, then the parser recognizes container directives
+	// as [DirectiveBlockKind] blocks.
+	// A container directive starts with a fence of three or more colons
+	// followed by a name and/or attributes in braces
+	// (e.g. "::: warning" or "::: {.note}"),
+	// and ends with a fence of colons that is at least as long as the opening fence.
+	// When directives are nested, a closing fence only closes
+	// the innermost open directive.
+	// Container directives are not part of the CommonMark specification.
+	Directives bool
+	// DisabledConstructs is the set of constructs that the parser does not recognize.
+	// Only [ConstructRawHTML] and [ConstructIndentedCode]
+	// affect block parsing.
+	DisabledConstructs Constructs
+	// If LineHook is not nil, then it is called for each line
+	// as it is read from the source, before the line is parsed.
+	// lineNumber is the 1-based line number within the document
+	// and line contains the line's bytes exactly as read,
+	// including its line ending.
+	// line is only valid for the duration of the call
+	// and must not be modified.
+	// LineHook is useful for reporting progress on large documents.
+	LineHook func(lineNumber int, line []byte)
+
+	buf       []byte // current block being parsed (run through padNulls)
+	offset    int64  // offset from beginning of stream to beginning of buf
+	lineno    int    // line number of beginning of buf
+	i         int    // parse position within buf
+	linesRead int    // number of lines returned by readline
 
 	r   io.Reader
 	err error // non-nil indicates there is no more data after end of buf
@@ -52,14 +128,32 @@ func NewBlockParser(r io.Reader) *BlockParser {
 	return &BlockParser{r: r, lineno: 1}
 }
 
+// Reset discards any buffered data and unreturned blocks
+// and resets the parser to read a new document from r.
+// Reset reuses the parser's buffer allocation where possible.
+// Blocks previously returned by [*BlockParser.NextBlock] are not affected.
+func (p *BlockParser) Reset(r io.Reader) {
+	*p = BlockParser{
+		MaxLineLength:      p.MaxLineLength,
+		Directives:         p.Directives,
+		DisabledConstructs: p.DisabledConstructs,
+		LineHook:           p.LineHook,
+		// p.buf never overlaps with the Source of a returned block.
+		buf:    p.buf[:0],
+		lineno: 1,
+		r:      r,
+	}
+}
+
 // Parse parses an in-memory UTF-8 CommonMark document and returns its blocks.
 // As long as source does not contain NUL bytes,
 // the blocks will use the original byte slice as their source.
 func Parse(source []byte) ([]*RootBlock, ReferenceMap) {
 	source = padNulls(source[:len(source):len(source)], 0)
 	p := &BlockParser{
-		buf: source,
-		err: io.EOF,
+		buf:    source,
+		lineno: 1,
+		err:    io.EOF,
 	}
 	var blocks []*RootBlock
 	refMap := make(ReferenceMap)
@@ -82,11 +176,53 @@ func Parse(source []byte) ([]*RootBlock, ReferenceMap) {
 	}
 }
 
+// ParseString is like [Parse], but parses a string.
+// Blocks refer to their source as a byte slice that callers may modify,
+// so ParseString copies s once before parsing instead of aliasing its memory.
+// The copy is a single allocation,
+// which is less than a [BlockParser] reading from a [strings.Reader] allocates,
+// since the parser copies each block into its own buffer.
+func ParseString(s string) ([]*RootBlock, ReferenceMap) {
+	return Parse([]byte(s))
+}
+
 // NextBlock reads the next top-level block in the document,
 // returning the first error encountered.
 // Blocks returned by NextBlock will typically contain [UnparsedKind] nodes for any text:
 // use [*InlineParser.Rewrite] to complete parsing.
+//
+// The parser reads in small chunks and does not hold onto returned blocks,
+// so memory usage is proportional to the largest block
+// rather than the size of the document,
+// as long as the caller does not retain the blocks.
+//
+// If a top-level block is larger than 1 MiB,
+// then NextBlock parses the data read up to that limit as if the document ended there,
+// returning the truncated block as usual.
+// The block's EndOffset reports the number of bytes consumed from the reader.
+// All subsequent calls to NextBlock return an error
+// that wraps [ErrBlockTooLarge].
+// Use [*BlockParser.Reset] to parse a new document after such an error.
+//
+// Similarly, if a line is longer than [BlockParser.MaxLineLength],
+// then NextBlock parses the data before that line as if the document ended there
+// and all subsequent calls to NextBlock return an error
+// that wraps [ErrLineTooLong].
+// The parser stops reading the line as soon as it exceeds the limit.
 func (p *BlockParser) NextBlock() (*RootBlock, error) {
+	return p.NextBlockContext(context.Background())
+}
+
+// NextBlockContext is like [*BlockParser.NextBlock],
+// but it stops and returns ctx.Err() if ctx is done before the next block is complete.
+// The context is only checked before each line is read,
+// so NextBlockContext does not interrupt a Read call that is blocked.
+// Lines parsed before the context was done are not lost:
+// a later call to NextBlock or NextBlockContext
+// continues parsing where the canceled call left off.
+func (p *BlockParser) NextBlockContext(ctx context.Context) (*RootBlock, error) {
+	done := ctx.Done()
+
 	// If we have any leftover closed blocks from previous calls,
 	// return those first.
 	if next := p.makeRoot(p.blocks); next != nil {
@@ -95,6 +231,9 @@ func (p *BlockParser) NextBlock() (*RootBlock, error) {
 
 	lineStart := 0
 	if len(p.blocks) > 0 {
+		if err := contextDone(ctx, done); err != nil {
+			return nil, err
+		}
 		lineStart = p.i
 		p.readline()
 	} else {
@@ -107,6 +246,9 @@ func (p *BlockParser) NextBlock() (*RootBlock, error) {
 
 		// Keep going until we encounter a non-blank line.
 		for {
+			if err := contextDone(ctx, done); err != nil {
+				return nil, err
+			}
 			if !p.readline() {
 				return nil, p.err
 			}
@@ -122,6 +264,8 @@ func (p *BlockParser) NextBlock() (*RootBlock, error) {
 
 	// Parse lines.
 	lp := newLineParser(p.blocks, lineStart, p.buf[:p.i:p.i])
+	lp.directives = p.Directives
+	lp.disabled = p.DisabledConstructs
 	for {
 		allMatched := descendOpenBlocks(lp)
 		hasText := false
@@ -134,6 +278,11 @@ func (p *BlockParser) NextBlock() (*RootBlock, error) {
 		if next := p.makeRoot(lp.root.blockChildren); next != nil {
 			return next, nil
 		}
+		if err := contextDone(ctx, done); err != nil {
+			// Save the open blocks so that the next call can resume.
+			p.blocks = lp.root.blockChildren
+			return nil, err
+		}
 
 		lineStart := p.i
 		p.readline()
@@ -141,6 +290,36 @@ func (p *BlockParser) NextBlock() (*RootBlock, error) {
 	}
 }
 
+// contextDone returns ctx.Err() if done is closed.
+// done should be the result of ctx.Done(),
+// which is nil for contexts that are never canceled.
+func contextDone(ctx context.Context, done <-chan struct{}) error {
+	if done == nil {
+		return nil
+	}
+	select {
+	case <-done:
+		return ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// Offset returns the number of bytes from the beginning of the document
+// to the first byte that has not been returned as part of a block.
+// Blank lines between blocks count as part of the following block.
+func (p *BlockParser) Offset() int64 {
+	return p.offset
+}
+
+// Line returns the 1-based line number of the last line read from the document
+// or zero if no lines have been read.
+// The parser may read lines before it returns the blocks they belong to,
+// so Line may be larger than the StartLine of the next block returned.
+func (p *BlockParser) Line() int {
+	return p.linesRead
+}
+
 func (p *BlockParser) makeRoot(docChildren []*Block) *RootBlock {
 	if len(docChildren) == 0 || docChildren[0].isOpen() {
 		return nil
@@ -193,6 +372,16 @@ func descendOpenBlocks(p *lineParser) (allMatched bool) {
 		p.state = stateDescending
 		ok := rule.match(p)
 		if p.state == stateDescendTerminated {
+			// The line that terminated the container
+			// is not part of the container's children.
+			if p.ContainerKind() == DirectiveBlockKind {
+				// Close the directive's open content at the start of the closing fence line.
+				// Closing the directive itself would also close its content,
+				// but at the end of the line, so the content would include the fence.
+				if child := p.container.lastChild().Block(); child != nil && child.isOpen() {
+					child.close(p.source, p.container, p.lineStart)
+				}
+			}
 			p.container.close(p.source, parent, p.lineStart+p.i)
 			p.container = parent
 			return true
@@ -383,16 +572,23 @@ func offsetTree(node Node, n int) {
 // returning false if it has reached the end of input.
 // readline saves the line into p.buf, growing it as necessary.
 func (p *BlockParser) readline() bool {
-	const (
-		chunkSize    = 8 * 1024
-		maxBlockSize = 1024 * 1024
-	)
+	const chunkSize = 8 * 1024
 
 	eolEnd := -1
+	contentEnd := -1
+	// scanStart is the position in p.buf to search for a line ending from.
+	// Bytes before scanStart are known to not contain a line ending,
+	// so each byte is only examined once, even if the line spans many reads.
+	scanStart := p.i
 	for {
 		// Check if we have a line ending available.
-		if i := bytes.IndexAny(p.buf[p.i:], "\r\n"); i >= 0 {
-			eolStart := p.i + i
+		contentEnd = len(p.buf)
+		if i := indexLineEnding(p.buf[scanStart:]); i < 0 {
+			scanStart = len(p.buf)
+		} else {
+			eolStart := scanStart + i
+			scanStart = eolStart
+			contentEnd = eolStart
 			if p.buf[eolStart] == '\n' {
 				eolEnd = eolStart + 1
 				break
@@ -419,6 +615,11 @@ func (p *BlockParser) readline() bool {
 			break
 		}
 
+		// Stop reading if the line is already too long.
+		if p.lineTooLong(contentEnd) {
+			break
+		}
+
 		// Grab more data from the reader if possible.
 		newSize := len(p.buf) + chunkSize
 		if len(p.buf)+chunkSize*len(nullReplacementString) > maxBlockSize {
@@ -426,10 +627,12 @@ func (p *BlockParser) readline() bool {
 		}
 		if newSize <= len(p.buf) {
 			// If we're already at the maximum block size,
-			// then drop the line and pretend it's an EOF.
-			p.buf = p.buf[:p.i]
-			p.err = fmt.Errorf("line %d: block too large", p.lineno+lineCount(p.buf[:p.i]))
-			return false
+			// then pretend the document ends here.
+			p.err = fmt.Errorf("line %d: offset %d: %w",
+				p.lineno+lineCount(p.buf[:p.i]),
+				p.offset+int64(unpaddedNullLength(p.buf)),
+				ErrBlockTooLarge)
+			continue
 		}
 		if cap(p.buf) < newSize {
 			newbuf := make([]byte, len(p.buf), newSize)
@@ -441,9 +644,44 @@ func (p *BlockParser) readline() bool {
 		p.buf = padNulls(p.buf[:len(p.buf)+n], len(p.buf))
 	}
 
-	ok := p.i < eolEnd
+	if p.lineTooLong(contentEnd) {
+		// Discard the line and pretend the document ends before it.
+		p.err = fmt.Errorf("line %d: offset %d: %w",
+			p.lineno+lineCount(p.buf[:p.i]),
+			p.offset+int64(unpaddedNullLength(p.buf[:p.i])),
+			ErrLineTooLong)
+		p.buf = p.buf[:p.i]
+		return false
+	}
+
+	lineStart := p.i
 	p.i = eolEnd
-	return ok
+	if lineStart >= eolEnd {
+		return false
+	}
+	p.linesRead++
+	if p.LineHook != nil {
+		p.LineHook(p.linesRead, unpadNulls(p.buf[lineStart:eolEnd:eolEnd]))
+	}
+	return true
+}
+
+// lineTooLong reports whether the line in p.buf
+// starting at p.i and ending at end
+// is longer than p.MaxLineLength.
+func (p *BlockParser) lineTooLong(end int) bool {
+	return p.MaxLineLength > 0 &&
+		end-p.i > p.MaxLineLength &&
+		unpaddedNullLength(p.buf[p.i:end]) > p.MaxLineLength
+}
+
+// indexLineEnding returns the index of the first '\r' or '\n' in text
+// or -1 if text does not contain a line ending.
+func indexLineEnding(text []byte) int {
+	// Search for both at once rather than searching for '\n' first:
+	// with CR-only line endings, there may not be a '\n' in the rest of the buffer,
+	// so searching for it would examine the rest of the buffer on every line.
+	return bytes.IndexAny(text, "\r\n")
 }
 
 func lineCount(text []byte) int {
@@ -461,21 +699,27 @@ func lineCount(text []byte) int {
 	return count
 }
 
-// columnWidth returns the width of the given text in columns
-// given the 0-based column starting position.
-func columnWidth(start int, b []byte) int {
-	end := start
-	for _, bi := range b {
+// ColumnWidth returns the width of the given text in columns
+// when it starts at the given 0-based column.
+// Each Unicode code point occupies one column,
+// except that a tab advances to the next multiple of 4 columns
+// (the [tab stop] size used by CommonMark).
+// For example, ColumnWidth(1, []byte("\t")) is 3.
+//
+// [tab stop]: https://spec.commonmark.org/0.30/#tabs
+func ColumnWidth(startCol int, text []byte) int {
+	end := startCol
+	for _, c := range text {
 		switch {
-		case bi == '\t':
+		case c == '\t':
 			// Assumes tabStopSize is a power-of-two.
 			end = (end + tabStopSize) &^ (tabStopSize - 1)
-		case bi&0x80 == 0:
-			// End of code point or ASCII character.
+		case c&0xc0 != 0x80:
+			// Start of code point (not a UTF-8 continuation byte).
 			end++
 		}
 	}
-	return end - start
+	return end - startCol
 }
 
 const nullReplacementString = "\ufffd"
@@ -525,6 +769,23 @@ func unpaddedNullLength(b []byte) int {
 	return len(b) - nullCount(b)/len(nullReplacementString)*(len(nullReplacementString)-1)
 }
 
+// unpadNulls returns a copy of a byte slice padded by [padNulls]
+// with each padded sequence replaced by a single zero byte.
+// If b does not contain any padding, then unpadNulls returns b.
+func unpadNulls(b []byte) []byte {
+	if bytes.IndexByte(b, 0) < 0 {
+		return b
+	}
+	unpadded := make([]byte, 0, unpaddedNullLength(b))
+	for i := 0; i < len(b); i++ {
+		unpadded = append(unpadded, b[i])
+		if b[i] == 0 {
+			i += len(nullReplacementString) - 1
+		}
+	}
+	return unpadded
+}
+
 // fillNulls replaces a byte slice padded by [padNulls]
 // with the UTF-8 sequence for the Unicode Replacement Character.
 func fillNulls(b []byte) {
@@ -536,9 +797,11 @@ func fillNulls(b []byte) {
 	}
 }
 
-// indentLength returns the number of space or tab bytes
-// at the beginning of the slice.
-func indentLength(line []byte) int {
+// IndentLength returns the number of space or tab bytes
+// at the beginning of the line.
+// Use [ColumnWidth] to find the number of columns that the indentation occupies,
+// since a tab advances to the next multiple of 4 columns.
+func IndentLength(line []byte) int {
 	for i, b := range line {
 		if b != ' ' && b != '\t' {
 			return i
@@ -576,6 +839,17 @@ func (span Span) Len() int {
 	return span.End - span.Start
 }
 
+// LineCount returns the number of line endings
+// in the span's slice of source.
+// For a span that starts on line n, the span ends on line n + LineCount.
+// LineCount returns zero if the span is invalid.
+func (span Span) LineCount(source []byte) int {
+	if !span.IsValid() {
+		return 0
+	}
+	return lineCount(spanSlice(source, span))
+}
+
 // Intersect returns the intersection of two spans
 // or an invalid span if none exists.
 func (span Span) Intersect(span2 Span) Span {
@@ -592,6 +866,15 @@ func (span Span) Intersect(span2 Span) Span {
 	return result
 }
 
+// ContainsOffset reports whether the given byte offset is inside the span.
+// Spans are half-open intervals:
+// Start is included in the span, but End is not,
+// so an empty span does not contain any offsets.
+// ContainsOffset returns false if the span is invalid.
+func (span Span) ContainsOffset(offset int) bool {
+	return span.IsValid() && span.Start <= offset && offset < span.End
+}
+
 // IsValid reports whether the span is valid.
 func (span Span) IsValid() bool {
 	return span.Start >= 0 && span.End >= 0 && span.Start <= span.End
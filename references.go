@@ -16,6 +16,15 @@
 
 package commonmark
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/cases"
+)
+
 // A type that implements ReferenceMatcher
 // can be checked for the presence of link reference definitions.
 type ReferenceMatcher interface {
@@ -26,9 +35,9 @@ type ReferenceMatcher interface {
 //
 // [link reference definition]: https://spec.commonmark.org/0.30/#link-reference-definition
 type LinkDefinition struct {
-	Destination  string
-	Title        string
-	TitlePresent bool
+	Destination  string `json:"destination"`
+	Title        string `json:"title,omitempty"`
+	TitlePresent bool   `json:"titlePresent,omitempty"`
 }
 
 // ReferenceMap is a mapping of [normalized labels] to link definitions.
@@ -42,6 +51,197 @@ func (m ReferenceMap) MatchReference(normalizedLabel string) bool {
 	return ok
 }
 
+// MarshalJSON encodes the map as a JSON object
+// whose keys are the normalized labels.
+func (m ReferenceMap) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]LinkDefinition(m))
+}
+
+// UnmarshalJSON decodes a JSON object into the map,
+// normalizing each label as the parser does.
+// If *m is nil, UnmarshalJSON allocates a new map.
+// Like [ReferenceMap.Extract],
+// UnmarshalJSON does not replace any existing definitions in the map
+// and uses the first definition in the object
+// when multiple labels normalize to the same label.
+// Labels that normalize to the empty string are ignored.
+func (m *ReferenceMap) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("unmarshal reference map: %w", err)
+	}
+	if tok == nil {
+		// JSON null leaves the map unchanged, like encoding/json does for maps.
+		return nil
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("unmarshal reference map: got %v instead of object", tok)
+	}
+	if *m == nil {
+		*m = make(ReferenceMap)
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("unmarshal reference map: %w", err)
+		}
+		label := normalizeLinkLabel(tok.(string))
+		var def LinkDefinition
+		if err := dec.Decode(&def); err != nil {
+			return fmt.Errorf("unmarshal reference map: label %q: %w", tok, err)
+		}
+		if _, exists := (*m)[label]; label == "" || exists {
+			continue
+		}
+		(*m)[label] = def
+	}
+	return nil
+}
+
+// normalizeLinkLabel returns the [normalized form] of a link label,
+// the form used as keys in a [ReferenceMap].
+// Runs of spaces, tabs, and line endings are collapsed to a single space,
+// leading and trailing whitespace is removed,
+// and the label is Unicode case-folded.
+//
+// [normalized form]: https://spec.commonmark.org/0.30/#matches
+func normalizeLinkLabel(label string) string {
+	sb := new(strings.Builder)
+	sb.Grow(len(label))
+	for i := 0; i < len(label); {
+		if !isSpaceTabOrLineEnding(label[i]) {
+			sb.WriteByte(label[i])
+			i++
+			continue
+		}
+		sb.WriteByte(' ')
+		for i < len(label) && isSpaceTabOrLineEnding(label[i]) {
+			i++
+		}
+	}
+	return cases.Fold().String(strings.TrimSpace(sb.String()))
+}
+
+// ResolveLink returns the definition for a [LinkKind] or [ImageKind] node.
+// For reference links, the definition is looked up in refMap.
+// Otherwise, the definition is built from the node's
+// [*Inline.LinkDestination] and [*Inline.LinkTitle].
+// ResolveLink returns the zero value if the node is not a link or image
+// or if refMap does not contain the referenced definition.
+func ResolveLink(inline *Inline, source []byte, refMap ReferenceMap) LinkDefinition {
+	if !inline.IsLinkOrImage() {
+		return LinkDefinition{}
+	}
+	if ref := inline.LinkReference(); ref != "" {
+		return refMap[ref]
+	}
+	title := inline.LinkTitle()
+	return LinkDefinition{
+		Destination:  inline.LinkDestination().Text(source),
+		Title:        title.Text(source),
+		TitlePresent: title != nil,
+	}
+}
+
+// LinkInfo describes a link, image, or autolink found by [ExtractLinks].
+type LinkInfo struct {
+	// Kind is one of [LinkKind], [ImageKind], or [AutolinkKind].
+	Kind InlineKind
+	// LinkDefinition is the resolved destination and title.
+	// For email autolinks, the destination begins with "mailto:",
+	// as in the href attribute written by [HTMLRenderer].
+	LinkDefinition
+	// Reference is the normalized label of a reference link or image.
+	// It is empty for inline links and images and for autolinks.
+	Reference string
+	// Unresolved is true if Reference is not present in the [ReferenceMap]
+	// passed to [ExtractLinks].
+	Unresolved bool
+	// Text is the link text or image description as plain text.
+	// Line breaks are replaced with spaces and raw HTML is omitted.
+	Text string
+	// BlockIndex is the index of the [RootBlock] that contains the node.
+	BlockIndex int
+	// Span is the span of the node in the Source of its [RootBlock],
+	// like the spans of the nodes themselves.
+	Span Span
+	// StartOffset and EndOffset are the byte offsets of the node
+	// from the beginning of the original source,
+	// computed by adding the StartOffset of its [RootBlock] to Span.
+	// Unless the original source contained NUL bytes
+	// (which are replaced in Source),
+	// they delimit the node's text in the original source.
+	StartOffset int64
+	EndOffset   int64
+}
+
+// ExtractLinks returns every link, image, and autolink in the given blocks
+// in the order they appear in the document.
+// Links and images are resolved in the same way as [ResolveLink].
+// Unlike most functions in this package, ExtractLinks does not take a source argument
+// because each block is read from the Source field of its [RootBlock].
+func ExtractLinks(blocks []*RootBlock, refMap ReferenceMap) []LinkInfo {
+	var links []LinkInfo
+	for i, root := range blocks {
+		source := root.Source
+		WalkPre(root.AsNode(), func(c *Cursor) bool {
+			inline := c.Node().Inline()
+			if inline == nil {
+				return true
+			}
+			info := LinkInfo{
+				Kind:       inline.Kind(),
+				BlockIndex: i,
+				Span:       inline.Span(),
+			}
+			info.StartOffset = root.StartOffset + int64(info.Span.Start)
+			info.EndOffset = root.StartOffset + int64(info.Span.End)
+			switch inline.Kind() {
+			case LinkKind, ImageKind:
+				info.LinkDefinition = ResolveLink(inline, source, refMap)
+				info.Reference = inline.LinkReference()
+				info.Unresolved = info.Reference != "" && !refMap.MatchReference(info.Reference)
+			case AutolinkKind:
+				info.Destination = inline.Child(0).Text(source)
+				if IsEmailAddress(info.Destination) {
+					info.Destination = "mailto:" + info.Destination
+				}
+			default:
+				return true
+			}
+			info.Text = plainText(source, inline)
+			links = append(links, info)
+			return true
+		})
+	}
+	return links
+}
+
+// plainText returns the text content of an inline node,
+// using the same rules as image descriptions.
+func plainText(source []byte, parent *Inline) string {
+	sb := new(strings.Builder)
+	stack := []*Inline{parent}
+	for len(stack) > 0 {
+		curr := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		switch curr.Kind() {
+		case TextKind, CharacterReferenceKind, EmojiKind:
+			sb.WriteString(curr.Text(source))
+		case IndentKind, SoftLineBreakKind, HardLineBreakKind:
+			sb.WriteByte(' ')
+		case LinkDestinationKind, LinkTitleKind, LinkLabelKind, HTMLTagKind, RawHTMLKind, DirectiveAttributesKind, WikiLinkTargetKind:
+			// Ignore.
+		default:
+			for i := len(curr.children) - 1; i >= 0; i-- {
+				stack = append(stack, curr.children[i])
+			}
+		}
+	}
+	return sb.String()
+}
+
 // Extract adds any link reference definitions contained in node to the map.
 // In case of conflicts,
 // Extract will not replace any existing definitions in the map
@@ -0,0 +1,355 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commonmark
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResolveLink(t *testing.T) {
+	const suffix = "\n\n[ref]: /ref \"Ref Title\"\n"
+	tests := []struct {
+		name  string
+		input string
+		want  LinkDefinition
+	}{
+		{
+			name:  "Inline",
+			input: "[foo](/url)",
+			want:  LinkDefinition{Destination: "/url"},
+		},
+		{
+			name:  "InlineTitle",
+			input: `[foo](/url "a &amp; b")`,
+			want: LinkDefinition{
+				Destination:  "/url",
+				Title:        "a & b",
+				TitlePresent: true,
+			},
+		},
+		{
+			name:  "InlineImage",
+			input: "![foo](/img.png)",
+			want:  LinkDefinition{Destination: "/img.png"},
+		},
+		{
+			name:  "FullReference",
+			input: "[foo][ref]",
+			want: LinkDefinition{
+				Destination:  "/ref",
+				Title:        "Ref Title",
+				TitlePresent: true,
+			},
+		},
+		{
+			name:  "CollapsedReference",
+			input: "[Ref][]",
+			want: LinkDefinition{
+				Destination:  "/ref",
+				Title:        "Ref Title",
+				TitlePresent: true,
+			},
+		},
+		{
+			name:  "ShortcutReferenceImage",
+			input: "![ref]",
+			want: LinkDefinition{
+				Destination:  "/ref",
+				Title:        "Ref Title",
+				TitlePresent: true,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input + suffix))
+			if len(blocks) == 0 || blocks[0].ChildCount() == 0 {
+				t.Fatal("no inlines parsed")
+			}
+			inline := blocks[0].Child(0).Inline()
+			if !inline.IsLinkOrImage() {
+				t.Fatalf("first inline is %v; want link or image", inline.Kind())
+			}
+			got := ResolveLink(inline, blocks[0].Source, refMap)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("ResolveLink(...) (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("NotLink", func(t *testing.T) {
+		blocks, refMap := Parse([]byte("*foo*"))
+		inline := blocks[0].Child(0).Inline()
+		if got := ResolveLink(inline, blocks[0].Source, refMap); got != (LinkDefinition{}) {
+			t.Errorf("ResolveLink(emphasis) = %+v; want zero value", got)
+		}
+	})
+}
+
+func TestLinkLabelCharacterReferences(t *testing.T) {
+	tests := []struct {
+		definition string
+		reference  string
+		want       bool
+	}{
+		{definition: "foo&amp;bar", reference: "foo&amp;bar", want: true},
+		{definition: "foo&amp;bar", reference: "FOO&AMP;BAR", want: true},
+		{definition: "foo&amp;bar", reference: "foo&bar", want: false},
+		{definition: "foo&bar", reference: "foo&amp;bar", want: false},
+		{definition: "foo&auml;bar", reference: "foo&auml;bar", want: true},
+		{definition: "foo&auml;bar", reference: "fooäbar", want: false},
+		{definition: "fooäbar", reference: "foo&auml;bar", want: false},
+		{definition: "foo&#65;bar", reference: "foo&#65;bar", want: true},
+		{definition: "foo&#65;bar", reference: "fooAbar", want: false},
+		{definition: "foo&#65;bar", reference: "foo&#x41;bar", want: false},
+		{definition: "foo&#x41;bar", reference: "foo&#X41;bar", want: true},
+		{definition: "foo\\&amp;bar", reference: "foo\\&amp;bar", want: true},
+		{definition: "foo\\&amp;bar", reference: "foo&amp;bar", want: false},
+		{definition: "foo &amp;\nbar", reference: "foo  &amp; bar", want: true},
+	}
+	forms := []struct {
+		name   string
+		format string
+	}{
+		{name: "Shortcut", format: "[%s]"},
+		{name: "Collapsed", format: "[%s][]"},
+		{name: "Full", format: "[text][%s]"},
+		{name: "MultilineFull", format: "[text][\n%s]"},
+		{name: "BlockQuote", format: "> [text][%s]"},
+	}
+	for _, test := range tests {
+		for _, form := range forms {
+			input := fmt.Sprintf(form.format, test.reference) + "\n\n[" + test.definition + "]: /url\n"
+			blocks, refMap := Parse([]byte(input))
+			links := CollectInlines(blocks[0].AsNode(), LinkKind)
+			if got := len(links) == 1; got != test.want {
+				t.Errorf("%s: definition [%s] matches %s = %t; want %t", form.name, test.definition, fmt.Sprintf(form.format, test.reference), got, test.want)
+			}
+			if len(refMap) != 1 {
+				t.Errorf("%s: [%s] produced %d definitions", form.name, test.definition, len(refMap))
+				continue
+			}
+
+			// The same label in a JSON reference map must match the same references.
+			data, err := json.Marshal(map[string]LinkDefinition{test.definition: {Destination: "/url"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var jsonRefMap ReferenceMap
+			if err := json.Unmarshal(data, &jsonRefMap); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(refMap, jsonRefMap); diff != "" {
+				t.Errorf("%s: [%s] from JSON (-parsed +json):\n%s", form.name, test.definition, diff)
+			}
+		}
+	}
+}
+
+func TestReferenceMapJSON(t *testing.T) {
+	t.Run("Marshal", func(t *testing.T) {
+		m := ReferenceMap{
+			"foo": {Destination: "/url", Title: "Title", TitlePresent: true},
+			"bar": {Destination: "/bar"},
+		}
+		got, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const want = `{"bar":{"destination":"/bar"},"foo":{"destination":"/url","title":"Title","titlePresent":true}}`
+		if string(got) != want {
+			t.Errorf("json.Marshal(...) = %s; want %s", got, want)
+		}
+	})
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		_, want := Parse([]byte("[Foo Bar]: /url \"Title\"\n[Empty]: /empty \"\"\n[ẞ]: /sharp-s\n"))
+		data, err := json.Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got ReferenceMap
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("-want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("NormalizesLabels", func(t *testing.T) {
+		const input = `{
+			"  Foo \t\n BAR ": {"destination": "/first"},
+			"foo bar": {"destination": "/second"},
+			"ẞ": {"destination": "/sharp-s"},
+			" ": {"destination": "/empty"}
+		}`
+		var got ReferenceMap
+		if err := json.Unmarshal([]byte(input), &got); err != nil {
+			t.Fatal(err)
+		}
+		want := ReferenceMap{
+			"foo bar": {Destination: "/first"},
+			"ss":      {Destination: "/sharp-s"},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("-want +got:\n%s", diff)
+		}
+		for _, label := range []string{"[foo   bar]", "[SS]"} {
+			inlines := ParseInline([]byte(label), got)
+			if len(inlines) != 1 || !inlines[0].IsLink() {
+				t.Errorf("ParseInline(%q, got) did not produce a link", label)
+			}
+		}
+	})
+
+	t.Run("KeepsExisting", func(t *testing.T) {
+		got := ReferenceMap{"foo": {Destination: "/old"}}
+		if err := json.Unmarshal([]byte(`{"FOO":{"destination":"/new"},"bar":{"destination":"/bar"}}`), &got); err != nil {
+			t.Fatal(err)
+		}
+		want := ReferenceMap{
+			"foo": {Destination: "/old"},
+			"bar": {Destination: "/bar"},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("-want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("NotObject", func(t *testing.T) {
+		var got ReferenceMap
+		if err := json.Unmarshal([]byte(`["foo"]`), &got); err == nil {
+			t.Error("json.Unmarshal did not return an error")
+		}
+	})
+}
+
+func TestExtractLinks(t *testing.T) {
+	const input = "# [Heading *link*](/h \"Title\")\n" +
+		"\n" +
+		"See [the `docs`][Docs] and ![an &amp;\nimage](/img.png).\n" +
+		"Mail <foo@example.com> or visit <https://example.com/>.\n" +
+		"\n" +
+		"- [![nested](/n.png)][docs]\n" +
+		"\n" +
+		"[docs]: /docs\n"
+	blocks, refMap := Parse([]byte(input))
+	got := ExtractLinks(blocks, refMap)
+	want := []LinkInfo{
+		{
+			Kind: LinkKind,
+			LinkDefinition: LinkDefinition{
+				Destination:  "/h",
+				Title:        "Title",
+				TitlePresent: true,
+			},
+			Text:        "Heading link",
+			BlockIndex:  0,
+			Span:        Span{Start: 2, End: 30},
+			StartOffset: 2,
+			EndOffset:   30,
+		},
+		{
+			Kind:           LinkKind,
+			LinkDefinition: LinkDefinition{Destination: "/docs"},
+			Reference:      "docs",
+			Text:           "the docs",
+			BlockIndex:     1,
+			Span:           Span{Start: 4, End: 22},
+			StartOffset:    36,
+			EndOffset:      54,
+		},
+		{
+			Kind:           ImageKind,
+			LinkDefinition: LinkDefinition{Destination: "/img.png"},
+			Text:           "an & image",
+			BlockIndex:     1,
+			Span:           Span{Start: 27, End: 54},
+			StartOffset:    59,
+			EndOffset:      86,
+		},
+		{
+			Kind:           AutolinkKind,
+			LinkDefinition: LinkDefinition{Destination: "mailto:foo@example.com"},
+			Text:           "foo@example.com",
+			BlockIndex:     1,
+			Span:           Span{Start: 61, End: 78},
+			StartOffset:    93,
+			EndOffset:      110,
+		},
+		{
+			Kind:           AutolinkKind,
+			LinkDefinition: LinkDefinition{Destination: "https://example.com/"},
+			Text:           "https://example.com/",
+			BlockIndex:     1,
+			Span:           Span{Start: 88, End: 110},
+			StartOffset:    120,
+			EndOffset:      142,
+		},
+		{
+			Kind:           LinkKind,
+			LinkDefinition: LinkDefinition{Destination: "/docs"},
+			Reference:      "docs",
+			Text:           "nested",
+			BlockIndex:     2,
+			Span:           Span{Start: 2, End: 27},
+			StartOffset:    147,
+			EndOffset:      172,
+		},
+		{
+			Kind:           ImageKind,
+			LinkDefinition: LinkDefinition{Destination: "/n.png"},
+			Text:           "nested",
+			BlockIndex:     2,
+			Span:           Span{Start: 3, End: 20},
+			StartOffset:    148,
+			EndOffset:      165,
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ExtractLinks(...) (-want +got):\n%s", diff)
+	}
+	for _, info := range got {
+		if s := spanSlice(blocks[info.BlockIndex].Source, info.Span); len(s) == 0 || (s[0] != '[' && s[0] != '!' && s[0] != '<') {
+			t.Errorf("%v span %v = %q; want start of link", info.Kind, info.Span, s)
+		}
+		if s := input[info.StartOffset:info.EndOffset]; s != string(spanSlice(blocks[info.BlockIndex].Source, info.Span)) {
+			t.Errorf("%v offsets [%d,%d) = %q; want %q", info.Kind, info.StartOffset, info.EndOffset, s, spanSlice(blocks[info.BlockIndex].Source, info.Span))
+		}
+	}
+
+	t.Run("Unresolved", func(t *testing.T) {
+		got := ExtractLinks(blocks, ReferenceMap{})
+		var unresolved []string
+		for _, info := range got {
+			if info.Unresolved {
+				unresolved = append(unresolved, info.Text)
+			}
+			if info.Unresolved && info.Destination != "" {
+				t.Errorf("unresolved link %q has destination %q", info.Text, info.Destination)
+			}
+		}
+		if diff := cmp.Diff([]string{"the docs", "nested"}, unresolved); diff != "" {
+			t.Errorf("unresolved links (-want +got):\n%s", diff)
+		}
+	})
+}
@@ -0,0 +1,233 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commonmark
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+
+	nethtml "golang.org/x/net/html"
+)
+
+// SanitizePolicy is an allow-list of HTML used by [RenderHTMLSafe].
+// Names in a policy must be lowercase.
+type SanitizePolicy struct {
+	// Elements is the list of permitted element names.
+	// Tags for other elements are removed, but their text content is kept.
+	// The content of elements like <script> or <style>
+	// is removed entirely unless the element is permitted.
+	Elements []string
+	// Attributes maps an element name to its permitted attribute names.
+	// The attributes listed under the "*" key are permitted on all elements.
+	Attributes map[string][]string
+	// URLSchemes is the list of schemes permitted
+	// in the href, src, and cite attributes.
+	// Relative URLs are always permitted.
+	URLSchemes []string
+}
+
+// DefaultSanitizePolicy returns a new policy
+// that permits the elements and attributes that [HTMLRenderer] produces,
+// a conservative set of inline formatting elements
+// (<b>, <i>, <s>, <del>, <ins>, <sub>, and <sup>),
+// and the http, https, and mailto URL schemes.
+func DefaultSanitizePolicy() SanitizePolicy {
+	return SanitizePolicy{
+		Elements: []string{
+			"a",
+			"b",
+			"blockquote",
+			"br",
+			"code",
+			"dd",
+			"del",
+			"dl",
+			"dt",
+			"em",
+			"figcaption",
+			"figure",
+			"h1",
+			"h2",
+			"h3",
+			"h4",
+			"h5",
+			"h6",
+			"hr",
+			"i",
+			"img",
+			"ins",
+			"li",
+			"ol",
+			"p",
+			"pre",
+			"s",
+			"strong",
+			"sub",
+			"sup",
+			"ul",
+		},
+		Attributes: map[string][]string{
+			"a":    {"class", "href", "title"},
+			"code": {"class"},
+			"img":  {"src", "alt", "title"},
+			"ol":   {"start"},
+		},
+		URLSchemes: []string{"http", "https", "mailto"},
+	}
+}
+
+// RenderHTMLSafe writes the given sequence of parsed blocks
+// to the given writer as HTML
+// using the default options for [HTMLRenderer],
+// then removes any elements, attributes, or URLs not permitted by the policy.
+// Comments and doctypes are always removed.
+// It will return the first error encountered, if any.
+//
+// RenderHTMLSafe does not balance tags in raw HTML.
+func RenderHTMLSafe(w io.Writer, blocks []*RootBlock, refMap ReferenceMap, policy SanitizePolicy) error {
+	return (&HTMLRenderer{ReferenceMap: refMap}).RenderSafe(w, blocks, policy)
+}
+
+// RenderSafe writes the given sequence of parsed blocks
+// to the given writer as HTML like [*HTMLRenderer.Render],
+// then removes any elements, attributes, or URLs not permitted by the policy
+// like [RenderHTMLSafe].
+// It will return the first error encountered, if any.
+func (r *HTMLRenderer) RenderSafe(w io.Writer, blocks []*RootBlock, policy SanitizePolicy) error {
+	rendered := new(bytes.Buffer)
+	if err := r.Render(rendered, blocks); err != nil {
+		return err
+	}
+	if _, err := w.Write(policy.sanitize(nil, rendered.Bytes())); err != nil {
+		return fmt.Errorf("render markdown to html: %w", err)
+	}
+	return nil
+}
+
+// sanitize appends the HTML in src to dst,
+// removing anything not permitted by the policy.
+func (policy *SanitizePolicy) sanitize(dst []byte, src []byte) []byte {
+	z := nethtml.NewTokenizer(bytes.NewReader(src))
+	// skip is the name of a disallowed element whose content is being removed.
+	skip := ""
+	for {
+		tt := z.Next()
+		if tt == nethtml.ErrorToken {
+			// src is in memory, so the only error is io.EOF.
+			return dst
+		}
+		tok := z.Token()
+		if skip != "" {
+			if tt == nethtml.EndTagToken && tok.Data == skip {
+				skip = ""
+			}
+			continue
+		}
+		switch tt {
+		case nethtml.TextToken:
+			dst = append(dst, html.EscapeString(tok.Data)...)
+		case nethtml.StartTagToken, nethtml.SelfClosingTagToken:
+			if !policy.allowsElement(tok.Data) {
+				if tt == nethtml.StartTagToken && isRawTextElement(tok.Data) {
+					skip = tok.Data
+				}
+				continue
+			}
+			dst = append(dst, '<')
+			dst = append(dst, tok.Data...)
+			for _, attr := range tok.Attr {
+				if attr.Namespace != "" || !policy.allowsAttribute(tok.Data, attr.Key, attr.Val) {
+					continue
+				}
+				dst = append(dst, ' ')
+				dst = append(dst, attr.Key...)
+				dst = append(dst, `="`...)
+				dst = append(dst, html.EscapeString(attr.Val)...)
+				dst = append(dst, '"')
+			}
+			if tt == nethtml.SelfClosingTagToken {
+				dst = append(dst, " /"...)
+			}
+			dst = append(dst, '>')
+		case nethtml.EndTagToken:
+			if policy.allowsElement(tok.Data) {
+				dst = append(dst, "</"...)
+				dst = append(dst, tok.Data...)
+				dst = append(dst, '>')
+			}
+		}
+	}
+}
+
+func (policy *SanitizePolicy) allowsElement(name string) bool {
+	return containsString(policy.Elements, name)
+}
+
+func (policy *SanitizePolicy) allowsAttribute(element, key, val string) bool {
+	if !containsString(policy.Attributes[element], key) && !containsString(policy.Attributes["*"], key) {
+		return false
+	}
+	switch key {
+	case "href", "src", "cite":
+		scheme, ok := urlScheme(val)
+		return !ok || containsString(policy.URLSchemes, scheme)
+	default:
+		return true
+	}
+}
+
+// urlScheme returns the lowercased scheme of the given URL.
+// ok is false if the URL is relative.
+// Like a browser, urlScheme ignores tabs and newlines
+// as well as leading and trailing control characters and spaces.
+func urlScheme(u string) (scheme string, ok bool) {
+	u = strings.TrimFunc(u, func(c rune) bool { return c <= ' ' })
+	u = strings.NewReplacer("\t", "", "\n", "", "\r", "").Replace(u)
+	end := strings.IndexByte(u, ':')
+	if end < 1 || !isASCIILetter(u[0]) {
+		return "", false
+	}
+	for i := 1; i < end; i++ {
+		if c := u[i]; !isASCIILetter(c) && !isASCIIDigit(c) && c != '+' && c != '-' && c != '.' {
+			return "", false
+		}
+	}
+	return strings.ToLower(u[:end]), true
+}
+
+// isRawTextElement reports whether the element with the given name
+// has its content tokenized as text rather than as HTML.
+func isRawTextElement(name string) bool {
+	switch name {
+	case "iframe", "noembed", "noframes", "noscript", "plaintext", "script", "style", "textarea", "title", "xmp":
+		return true
+	default:
+		return false
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, elem := range list {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commonmark
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/commonmark/internal/normhtml"
+	"zombiezen.com/go/commonmark/internal/spec"
+)
+
+func TestRenderHTMLSafe(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "Markdown",
+			input: "# Hi\n\n*a* **b** `c` [d](https://example.com/ \"e\") ![f](/g.png)\n\n3. x\n\n```go\ny\n```\n",
+			want: "<h1>Hi</h1>\n\n" +
+				`<p><em>a</em> <strong>b</strong> <code>c</code> <a href="https://example.com/" title="e">d</a> <img src="/g.png" alt="f"></p>` + "\n\n" +
+				`<ol start="3"><li>x</li></ol>` + "\n\n" +
+				`<pre><code class="language-go">y` + "\n</code></pre>",
+		},
+		{
+			name:  "ScriptBlock",
+			input: "<script>alert(1)</script>\n",
+			want:  "\n",
+		},
+		{
+			name:  "StyleBlock",
+			input: "<style>p { color: red }</style>\n\nHi\n",
+			want:  "\n\n\n<p>Hi</p>",
+		},
+		{
+			name:  "EventHandler",
+			input: `<img src="x.png" onerror="alert(1)">` + "\n",
+			want:  `<img src="x.png">` + "\n",
+		},
+		{
+			name:  "JavaScriptLink",
+			input: "[a](javascript:alert(1))\n",
+			want:  "<p><a>a</a></p>",
+		},
+		{
+			name:  "JavaScriptLinkWithTab",
+			input: "<a href=\"java&#9;script:alert(1)\">a</a>\n",
+			want:  "<p><a>a</a></p>",
+		},
+		{
+			name:  "JavaScriptLinkWithEntity",
+			input: "[a](javascript&colon;alert(1))\n",
+			want:  "<p><a>a</a></p>",
+		},
+		{
+			name:  "ColonInRelativeLink",
+			input: "[a](foo\\):)\n",
+			want:  `<p><a href="foo):">a</a></p>`,
+		},
+		{
+			name:  "JavaScriptRawLink",
+			input: `<a href=" JavaScript&colon;alert(1)">a</a>` + "\n",
+			want:  "<p><a>a</a></p>",
+		},
+		{
+			name:  "MailtoLink",
+			input: "<foo@example.com>\n",
+			want:  `<p><a href="mailto:foo@example.com">foo@example.com</a></p>`,
+		},
+		{
+			name:  "DisallowedElementKeepsText",
+			input: "<div>\n<marquee>Hello</marquee>\n</div>\n",
+			want:  "\nHello\n\n",
+		},
+		{
+			name:  "AllowedRawElement",
+			input: "a<sub>1</sub> <b class=\"x\">bold</b>\n",
+			want:  "<p>a<sub>1</sub> <b>bold</b></p>",
+		},
+		{
+			name:  "Comment",
+			input: "a <!-- secret --> b\n",
+			want:  "<p>a  b</p>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := Parse([]byte(test.input))
+			buf := new(bytes.Buffer)
+			if err := RenderHTMLSafe(buf, blocks, refMap, DefaultSanitizePolicy()); err != nil {
+				t.Error("RenderHTMLSafe:", err)
+			}
+			if diff := cmp.Diff(test.want, buf.String()); diff != "" {
+				t.Errorf("-want +got:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRenderSafeLinkDefs(t *testing.T) {
+	blocks, refMap := Parse([]byte("See [x].\n\n[x]: /u \"T\"\n"))
+	r := &HTMLRenderer{
+		ReferenceMap:   refMap,
+		RenderLinkDefs: true,
+	}
+	buf := new(bytes.Buffer)
+	if err := r.RenderSafe(buf, blocks, DefaultSanitizePolicy()); err != nil {
+		t.Error("RenderSafe:", err)
+	}
+	const want = `<p>See <a href="/u" title="T">x</a>.</p>` + "\n\n" +
+		`<dl><dt>[x]</dt><dd><a href="/u">/u</a>` + " \u2014 T</dd></dl>"
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Errorf("-want +got:\n%s", diff)
+	}
+}
+
+func TestRenderHTMLSafeSpec(t *testing.T) {
+	examples, err := spec.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := DefaultSanitizePolicy()
+	for _, ex := range examples {
+		if strings.Contains(ex.Markdown, "<") {
+			// Skip examples that could contain raw HTML.
+			continue
+		}
+		blocks, refMap := Parse([]byte(ex.Markdown))
+		want := new(bytes.Buffer)
+		if err := RenderHTML(want, blocks, refMap); err != nil {
+			t.Errorf("Example %d: RenderHTML: %v", ex.Example, err)
+			continue
+		}
+		got := new(bytes.Buffer)
+		if err := RenderHTMLSafe(got, blocks, refMap, policy); err != nil {
+			t.Errorf("Example %d: RenderHTMLSafe: %v", ex.Example, err)
+			continue
+		}
+		if diff := cmp.Diff(string(normhtml.NormalizeHTML(want.Bytes())), string(normhtml.NormalizeHTML(got.Bytes()))); diff != "" {
+			t.Errorf("Example %d: sanitization changed output (-want +got):\n%s", ex.Example, diff)
+		}
+	}
+}
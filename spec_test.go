@@ -42,7 +42,7 @@ func TestSpec(t *testing.T) {
 			got := string(normhtml.NormalizeHTML(buf.Bytes()))
 			want := string(normhtml.NormalizeHTML([]byte(test.HTML)))
 			if diff := cmp.Diff(want, got, cmpopts.EquateEmpty()); diff != "" {
-				t.Errorf("Input:\n%s\nOutput (-want +got):\n%s", test.Markdown, diff)
+				t.Errorf("Input:\n%s\nOutput (-want +got):\n%s\nTree:\n%s", test.Markdown, diff, dumpBlocks(blocks))
 			}
 		})
 	}
@@ -66,7 +66,7 @@ func TestGFMSpec(t *testing.T) {
 			got := string(normhtml.NormalizeHTML(buf.Bytes()))
 			want := string(normhtml.NormalizeHTML([]byte(test.HTML)))
 			if diff := cmp.Diff(want, got, cmpopts.EquateEmpty()); diff != "" {
-				t.Errorf("Input:\n%s\nOutput (-want +got):\n%s", test.Markdown, diff)
+				t.Errorf("Input:\n%s\nOutput (-want +got):\n%s\nTree:\n%s", test.Markdown, diff, dumpBlocks(blocks))
 			}
 		})
 	}
@@ -103,11 +103,20 @@ func FuzzCommonMarkJS(f *testing.F) {
 		want := string(normhtml.NormalizeHTML(rawWant))
 
 		if diff := cmp.Diff(want, got, cmpopts.EquateEmpty()); diff != "" {
-			t.Errorf("Input:\n%s\nOutput (-want +got):\n%s", markdown, diff)
+			t.Errorf("Input:\n%s\nOutput (-want +got):\n%s\nTree:\n%s", markdown, diff, dumpBlocks(blocks))
 		}
 	})
 }
 
+// dumpBlocks returns the output of [DumpTree] for each of the given blocks.
+func dumpBlocks(blocks []*RootBlock) string {
+	sb := new(strings.Builder)
+	for _, root := range blocks {
+		DumpTree(sb, root.Source, root.AsNode())
+	}
+	return sb.String()
+}
+
 func nixShellCommand(tb testing.TB, pkg string, programName string) []string {
 	tb.Helper()
 
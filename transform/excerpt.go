@@ -0,0 +1,248 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package transform
+
+import "zombiezen.com/go/commonmark"
+
+// Excerpt returns a copy of the document that is cut off
+// after approximately limit bytes of text,
+// along with whether any content was removed.
+// Like [Truncate], Excerpt does not count markup toward the limit,
+// but unlike Truncate, Excerpt only cuts text between words.
+// Code blocks, HTML blocks, code spans, images, autolinks,
+// and other nodes whose meaning would change if they were split
+// are either kept whole or removed entirely.
+// Emphasis, links, and container blocks that would be left empty by the cut
+// are removed, as is whitespace at the end of the excerpt.
+// The blocks passed in are not modified.
+func Excerpt(blocks []*commonmark.RootBlock, limit int) ([]*commonmark.RootBlock, bool) {
+	if limit <= 0 {
+		return nil, len(blocks) > 0
+	}
+	c := &cutter{remaining: limit, words: true}
+	var result []*commonmark.RootBlock
+	for _, root := range blocks {
+		c.source = root.Source
+		clone := root.Clone(false)
+		cut, keep := c.block(&clone.Block)
+		if keep {
+			result = append(result, clone)
+		}
+		if cut {
+			return result, true
+		}
+	}
+	return result, false
+}
+
+// wordEnd returns the length of the longest prefix of text
+// that is no longer than max bytes and does not end in the middle of a word,
+// not including any trailing whitespace.
+func wordEnd(text []byte, max int) int {
+	n := max
+	for n > 0 && !isSpaceOrTab(text[n]) {
+		n--
+	}
+	for n > 0 && isSpaceOrTab(text[n-1]) {
+		n--
+	}
+	return n
+}
+
+// trimWordEnd removes the text at the end of b's inline children
+// back to the last whitespace or line break,
+// so that b does not end with part of a word.
+func trimWordEnd(source []byte, b *commonmark.Block) {
+	for n := b.ChildCount(); n > 0; n = b.ChildCount() {
+		remove, done := trimInlineWordEnd(source, b.Child(n-1).Inline())
+		if remove {
+			b.RemoveChildren(n-1, n)
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// trimInlineWordEnd removes the text at the end of inline
+// back to the last whitespace or line break.
+// remove reports whether inline should be removed entirely
+// and done reports whether the whitespace was found.
+func trimInlineWordEnd(source []byte, inline *commonmark.Inline) (remove, done bool) {
+	switch k := inline.Kind(); {
+	case k == commonmark.SoftLineBreakKind,
+		k == commonmark.HardLineBreakKind,
+		k == commonmark.HTMLTagKind:
+		return false, true
+	case k == commonmark.TextKind:
+		text := source[inline.Span().Start:inline.Span().End]
+		n := len(text)
+		for n > 0 && !isSpaceOrTab(text[n-1]) {
+			n--
+		}
+		inline.TruncateText(n)
+		return n == 0, n > 0
+	case !isInlineContainer(k):
+		return true, false
+	}
+	for i := inline.ChildCount() - 1; i >= 0 && !done; i-- {
+		child := inline.Child(i)
+		if isInlineAttribute(child.Kind()) {
+			continue
+		}
+		var removeChild bool
+		removeChild, done = trimInlineWordEnd(source, child)
+		if removeChild {
+			inline.RemoveChildren(i, i+1)
+		}
+	}
+	return !inlineHasContent(inline), done
+}
+
+// trimBlockEnd removes line breaks and whitespace
+// from the end of b's inline children.
+func trimBlockEnd(source []byte, b *commonmark.Block) {
+	for n := b.ChildCount(); n > 0; n = b.ChildCount() {
+		last := b.Child(n - 1).Inline()
+		if !trimInlineNode(source, last) {
+			return
+		}
+		b.RemoveChildren(n-1, n)
+	}
+}
+
+// trimInlineEnd removes line breaks and whitespace
+// from the end of inline's children.
+func trimInlineEnd(source []byte, inline *commonmark.Inline) {
+	for n := inline.ChildCount(); n > 0; n = inline.ChildCount() {
+		i := n - 1
+		for i >= 0 && isInlineAttribute(inline.Child(i).Kind()) {
+			i--
+		}
+		if i < 0 || !trimInlineNode(source, inline.Child(i)) {
+			return
+		}
+		inline.RemoveChildren(i, i+1)
+	}
+}
+
+// trimInlineNode removes trailing whitespace from a text node
+// or from the end of an emphasis, link, or directive.
+// It reports whether the node should be removed entirely,
+// which is true for line breaks and nodes that are left empty.
+func trimInlineNode(source []byte, inline *commonmark.Inline) (remove bool) {
+	switch inline.Kind() {
+	case commonmark.SoftLineBreakKind, commonmark.HardLineBreakKind:
+		return true
+	case commonmark.TextKind:
+		text := source[inline.Span().Start:inline.Span().End]
+		n := len(text)
+		for n > 0 && isSpaceOrTab(text[n-1]) {
+			n--
+		}
+		inline.TruncateText(n)
+		return n == 0
+	default:
+		if !isInlineContainer(inline.Kind()) {
+			return false
+		}
+		trimInlineEnd(source, inline)
+		return !inlineHasContent(inline)
+	}
+}
+
+// blockHasContent reports whether b has any children
+// other than list markers.
+func blockHasContent(b *commonmark.Block) bool {
+	for i, n := 0, b.ChildCount(); i < n; i++ {
+		if b.Child(i).Block().Kind() != commonmark.ListMarkerKind {
+			return true
+		}
+	}
+	return false
+}
+
+// inlineHasContent reports whether inline has any children
+// other than link or directive attributes.
+func inlineHasContent(inline *commonmark.Inline) bool {
+	for i, n := 0, inline.ChildCount(); i < n; i++ {
+		if !isInlineAttribute(inline.Child(i).Kind()) {
+			return true
+		}
+	}
+	return false
+}
+
+// isInlineContainer reports whether nodes of the given kind
+// hold formatted text that [Excerpt] may cut.
+func isInlineContainer(k commonmark.InlineKind) bool {
+	return k == commonmark.EmphasisKind ||
+		k == commonmark.StrongKind ||
+		k == commonmark.LinkKind ||
+		k == commonmark.DirectiveKind
+}
+
+func isInlineAttribute(k commonmark.InlineKind) bool {
+	return k == commonmark.LinkDestinationKind ||
+		k == commonmark.LinkTitleKind ||
+		k == commonmark.LinkLabelKind ||
+		k == commonmark.DirectiveAttributesKind
+}
+
+// blockTextLength returns the number of bytes of text in b
+// as counted by [Excerpt].
+func blockTextLength(source []byte, b *commonmark.Block) int {
+	total := 0
+	for i, n := 0, b.ChildCount(); i < n; i++ {
+		if child := b.Child(i); child.Block() != nil {
+			total += blockTextLength(source, child.Block())
+		} else {
+			total += inlineTextLength(source, child.Inline())
+		}
+	}
+	return total
+}
+
+// inlineTextLength returns the number of bytes of text in inline
+// as counted by [Excerpt].
+func inlineTextLength(source []byte, inline *commonmark.Inline) int {
+	switch inline.Kind() {
+	case commonmark.TextKind:
+		return inline.Span().Len()
+	case commonmark.CharacterReferenceKind, commonmark.EmojiKind:
+		return len(inline.Text(source))
+	case commonmark.AutolinkKind:
+		return len(inline.Child(0).Text(source))
+	case commonmark.WikiLinkKind:
+		return inline.Child(1).Span().Len()
+	case commonmark.InfoStringKind,
+		commonmark.LinkDestinationKind,
+		commonmark.LinkTitleKind,
+		commonmark.LinkLabelKind,
+		commonmark.DirectiveAttributesKind:
+		return 0
+	}
+	total := 0
+	for i, n := 0, inline.ChildCount(); i < n; i++ {
+		total += inlineTextLength(source, inline.Child(i))
+	}
+	return total
+}
+
+func isSpaceOrTab(c byte) bool {
+	return c == ' ' || c == '\t'
+}
@@ -0,0 +1,231 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package transform
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/commonmark"
+	"zombiezen.com/go/commonmark/internal/normhtml"
+	"zombiezen.com/go/commonmark/internal/spec"
+	"zombiezen.com/go/commonmark/internal/treedump"
+)
+
+func TestExcerpt(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		limit         int
+		want          string
+		wantTruncated bool
+	}{
+		{
+			name:  "Fits",
+			input: "Hello, *World*!\n\nSecond paragraph.\n",
+			limit: 100,
+			want:  "<p>Hello, <em>World</em>!</p>\n<p>Second paragraph.</p>\n",
+		},
+		{
+			name:          "WordBoundary",
+			input:         "The quick brown fox\n",
+			limit:         12,
+			want:          "<p>The quick</p>\n",
+			wantTruncated: true,
+		},
+		{
+			name:          "AtSpace",
+			input:         "The quick brown fox\n",
+			limit:         9,
+			want:          "<p>The quick</p>\n",
+			wantTruncated: true,
+		},
+		{
+			name:          "FirstWordTooLong",
+			input:         "Hello\n",
+			limit:         3,
+			want:          "",
+			wantTruncated: true,
+		},
+		{
+			name:          "ExactBlocks",
+			input:         "Hello\n\nWorld\n",
+			limit:         5,
+			want:          "<p>Hello</p>\n",
+			wantTruncated: true,
+		},
+		{
+			name:          "Emphasis",
+			input:         "Hello, *big World*!\n",
+			limit:         10,
+			want:          "<p>Hello, <em>big</em></p>\n",
+			wantTruncated: true,
+		},
+		{
+			name:          "EmptyEmphasis",
+			input:         "Hello, *World*!\n",
+			limit:         9,
+			want:          "<p>Hello,</p>\n",
+			wantTruncated: true,
+		},
+		{
+			name:          "InsideLink",
+			input:         "See [the full docs](/docs \"Docs\") for more.\n",
+			limit:         12,
+			want:          `<p>See <a href="/docs" title="Docs">the full</a></p>` + "\n",
+			wantTruncated: true,
+		},
+		{
+			name:          "EmptyLink",
+			input:         "See [documentation](/docs) for more.\n",
+			limit:         10,
+			want:          "<p>See</p>\n",
+			wantTruncated: true,
+		},
+		{
+			name:          "InsideCodeBlock",
+			input:         "Example:\n\n```go\nfoo()\nbar()\n```\n\nAfter\n",
+			limit:         12,
+			want:          "<p>Example:</p>\n",
+			wantTruncated: true,
+		},
+		{
+			name:          "CodeBlockFits",
+			input:         "```go\nfoo()\n```\n\nAfter that\n",
+			limit:         11,
+			want:          "<pre><code class=\"language-go\">foo()\n</code></pre>\n<p>After</p>\n",
+			wantTruncated: true,
+		},
+		{
+			name:          "CodeSpan",
+			input:         "Call `foo()` now\n",
+			limit:         7,
+			want:          "<p>Call</p>\n",
+			wantTruncated: true,
+		},
+		{
+			name:          "BetweenListItems",
+			input:         "- abc\n- def\n- ghi\n\nAfter\n",
+			limit:         7,
+			want:          "<ul>\n<li>abc</li>\n<li>def</li>\n</ul>\n",
+			wantTruncated: true,
+		},
+		{
+			name:          "InsideListItem",
+			input:         "- one two\n- three four\n",
+			limit:         13,
+			want:          "<ul>\n<li>one two</li>\n<li>three</li>\n</ul>\n",
+			wantTruncated: true,
+		},
+		{
+			name:          "SoftLineBreak",
+			input:         "> foo\n> barbaz\n",
+			limit:         5,
+			want:          "<blockquote>\n<p>foo</p>\n</blockquote>\n",
+			wantTruncated: true,
+		},
+		{
+			name:          "WordAcrossEmphasis",
+			input:         "**foo**bar baz\n",
+			limit:         4,
+			want:          "",
+			wantTruncated: true,
+		},
+		{
+			name:          "WordAcrossEmphasisAfterSpace",
+			input:         "a **b foo**bar baz\n",
+			limit:         8,
+			want:          "<p>a <strong>b</strong></p>\n",
+			wantTruncated: true,
+		},
+		{
+			name:          "WordIntoEmphasis",
+			input:         "foo*bar baz*\n",
+			limit:         4,
+			want:          "",
+			wantTruncated: true,
+		},
+		{
+			name:          "CharacterReference",
+			input:         "a &copy; b\n",
+			limit:         3,
+			want:          "<p>a</p>\n",
+			wantTruncated: true,
+		},
+		{
+			name:          "Zero",
+			input:         "Hello\n",
+			limit:         0,
+			want:          "",
+			wantTruncated: true,
+		},
+		{
+			name:          "Negative",
+			input:         "foo\n",
+			limit:         -1,
+			want:          "",
+			wantTruncated: true,
+		},
+		{
+			name:  "Empty",
+			input: "",
+			limit: 0,
+			want:  "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := commonmark.Parse([]byte(test.input))
+			before := treedump.Dump(blocks)
+			excerpt, truncated := Excerpt(blocks, test.limit)
+			got := renderHTML(t, excerpt, refMap)
+			want := string(normhtml.NormalizeHTML([]byte(test.want)))
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("Excerpt(..., %d) HTML (-want +got):\n%s", test.limit, diff)
+			}
+			if truncated != test.wantTruncated {
+				t.Errorf("Excerpt(..., %d) truncated = %t; want %t", test.limit, truncated, test.wantTruncated)
+			}
+			if diff := cmp.Diff(before, treedump.Dump(blocks)); diff != "" {
+				t.Errorf("Excerpt modified its argument (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExcerptSpec(t *testing.T) {
+	examples, err := spec.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ex := range examples {
+		blocks, refMap := commonmark.Parse([]byte(ex.Markdown))
+		want := renderHTML(t, blocks, refMap)
+		excerpt, truncated := Excerpt(blocks, 1<<20)
+		if truncated {
+			t.Errorf("Example %d: Excerpt with large limit reported truncation", ex.Example)
+		}
+		if got := renderHTML(t, excerpt, refMap); got != want {
+			t.Errorf("Example %d: Excerpt with large limit changed output (-want +got):\n%s", ex.Example, cmp.Diff(want, got))
+		}
+		for limit := 0; limit < 20; limit++ {
+			// Verify that Excerpt never panics.
+			Excerpt(blocks, limit)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package transform provides structural modifications
+// for parsed CommonMark documents.
+package transform
+
+import (
+	"unicode/utf8"
+
+	"zombiezen.com/go/commonmark"
+)
+
+// A Transform modifies a CommonMark document in place.
+// It returns the document's new root blocks,
+// which may be a subslice of the blocks passed in.
+type Transform func(blocks []*commonmark.RootBlock) []*commonmark.RootBlock
+
+// Chain returns a transform that applies each of the given transforms in order.
+func Chain(transforms ...Transform) Transform {
+	return func(blocks []*commonmark.RootBlock) []*commonmark.RootBlock {
+		for _, t := range transforms {
+			blocks = t(blocks)
+		}
+		return blocks
+	}
+}
+
+// ShiftHeadings returns a transform that adds delta to the level of every heading.
+// The resulting levels are clamped to the range [1, 6].
+func ShiftHeadings(delta int) Transform {
+	return func(blocks []*commonmark.RootBlock) []*commonmark.RootBlock {
+		for _, root := range blocks {
+			commonmark.Walk(root.AsNode(), &commonmark.WalkOptions{
+				Pre: func(c *commonmark.Cursor) bool {
+					b := c.Node().Block()
+					if b == nil {
+						return false
+					}
+					if b.IsHeading() {
+						level := b.HeadingLevel() + delta
+						if level < 1 {
+							level = 1
+						} else if level > 6 {
+							level = 6
+						}
+						b.SetHeadingLevel(level)
+						return false
+					}
+					return true
+				},
+			})
+		}
+		return blocks
+	}
+}
+
+// StripImages returns a transform that removes all images from the document,
+// including their descriptions.
+func StripImages() Transform {
+	return func(blocks []*commonmark.RootBlock) []*commonmark.RootBlock {
+		for _, root := range blocks {
+			removeInlines(&root.Block, (*commonmark.Inline).IsImage)
+		}
+		return blocks
+	}
+}
+
+// StripRawHTML returns a transform that removes all HTML blocks
+// and inline raw HTML from the document.
+func StripRawHTML() Transform {
+	return func(blocks []*commonmark.RootBlock) []*commonmark.RootBlock {
+		isHTMLBlock := func(b *commonmark.Block) bool {
+			return b.Kind() == commonmark.HTMLBlockKind
+		}
+		isRawHTML := func(inline *commonmark.Inline) bool {
+			k := inline.Kind()
+			return k == commonmark.HTMLTagKind || k == commonmark.RawHTMLKind
+		}
+
+		newBlocks := blocks[:0]
+		for _, root := range blocks {
+			if isHTMLBlock(&root.Block) {
+				continue
+			}
+			removeBlocks(&root.Block, isHTMLBlock)
+			removeInlines(&root.Block, isRawHTML)
+			newBlocks = append(newBlocks, root)
+		}
+		clearRootBlocks(blocks[len(newBlocks):])
+		return newBlocks
+	}
+}
+
+// Truncate returns a transform that removes all content
+// after the first maxTextBytes bytes of text in the document.
+// Text is cut at a UTF-8 character boundary
+// and character references are never split.
+// Containers that were open at the cut (like lists or block quotes)
+// keep the content before the cut.
+// Link destinations, link titles, and code block info strings
+// do not count toward the limit.
+func Truncate(maxTextBytes int) Transform {
+	return func(blocks []*commonmark.RootBlock) []*commonmark.RootBlock {
+		if maxTextBytes <= 0 {
+			clearRootBlocks(blocks)
+			return blocks[:0]
+		}
+		c := &cutter{remaining: maxTextBytes}
+		for i, root := range blocks {
+			c.source = root.Source
+			if cut, keep := c.block(&root.Block); cut {
+				if keep {
+					i++
+				}
+				clearRootBlocks(blocks[i:])
+				return blocks[:i]
+			}
+		}
+		return blocks
+	}
+}
+
+// A cutter removes the content of a document
+// after a number of bytes of text.
+// It implements both [Truncate] and [Excerpt].
+type cutter struct {
+	source    []byte
+	remaining int
+
+	// words is true if the cutter follows the rules of [Excerpt]:
+	// text is only cut between words,
+	// code blocks, code spans, and images are kept whole,
+	// and whitespace and empty containers at the cut are removed.
+	words bool
+	// midWord is set when the cut removed a node
+	// that may continue the word before it.
+	midWord bool
+}
+
+// fits reports whether n more bytes of text fit in the remaining budget.
+func (c *cutter) fits(n int) bool {
+	return n < c.remaining || c.words && n == c.remaining
+}
+
+// cutText returns the number of bytes at the start of text to keep
+// when text does not fit in the remaining budget.
+func (c *cutter) cutText(text []byte) int {
+	if c.words {
+		return wordEnd(text, c.remaining)
+	}
+	n := c.remaining
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return n
+}
+
+// keepsWhole reports whether the cutter must not split
+// an inline node of the given kind.
+func (c *cutter) keepsWhole(k commonmark.InlineKind) bool {
+	switch k {
+	case commonmark.CharacterReferenceKind,
+		commonmark.AutolinkKind,
+		commonmark.EmojiKind,
+		commonmark.WikiLinkKind:
+		// Splitting these would change their meaning.
+		return true
+	case commonmark.CodeSpanKind, commonmark.ImageKind:
+		return c.words
+	default:
+		return false
+	}
+}
+
+// block counts the text in b against the remaining budget.
+// If the budget was exhausted inside b,
+// then block removes everything in b after the cut and reports cut = true.
+// keep reports whether b itself should be kept,
+// which is false if the cut left b empty.
+func (c *cutter) block(b *commonmark.Block) (cut, keep bool) {
+	if c.words && (b.Kind().IsCode() || b.Kind() == commonmark.HTMLBlockKind) {
+		// Code and HTML are never split.
+		if n := blockTextLength(c.source, b); c.fits(n) {
+			c.remaining -= n
+			return false, true
+		}
+		c.remaining = 0
+		return true, false
+	}
+	for i, n := 0, b.ChildCount(); i < n; i++ {
+		var childCut, childKeep bool
+		child := b.Child(i)
+		if child.Block() != nil {
+			childCut, childKeep = c.block(child.Block())
+		} else {
+			childCut, childKeep = c.inline(child.Inline())
+		}
+		if childCut {
+			if !childKeep {
+				i--
+			}
+			b.RemoveChildren(i+1, n)
+			if !c.words {
+				return true, b.ChildCount() > 0
+			}
+			if c.midWord && child.Inline() != nil {
+				trimWordEnd(c.source, b)
+				c.midWord = false
+			}
+			trimBlockEnd(c.source, b)
+			return true, blockHasContent(b)
+		}
+	}
+	return false, true
+}
+
+// inline counts the text in inline against the remaining budget.
+// Its results are the same as [*cutter.block].
+func (c *cutter) inline(inline *commonmark.Inline) (cut, keep bool) {
+	switch k := inline.Kind(); {
+	case k == commonmark.TextKind:
+		text := c.source[inline.Span().Start:inline.Span().End]
+		if c.fits(len(text)) {
+			c.remaining -= len(text)
+			return false, true
+		}
+		n := c.remaining
+		if n < len(text) {
+			n = c.cutText(text)
+			inline.TruncateText(n)
+		}
+		c.remaining = 0
+		c.midWord = n == 0 && len(text) > 0 && !isSpaceOrTab(text[0])
+		return true, n > 0
+	case c.keepsWhole(k):
+		n := inlineTextLength(c.source, inline)
+		if c.fits(n) {
+			c.remaining -= n
+			return false, true
+		}
+		keep = n == c.remaining
+		c.remaining = 0
+		c.midWord = !keep
+		return true, keep
+	case k == commonmark.InfoStringKind,
+		isInlineAttribute(k),
+		k == commonmark.SoftLineBreakKind,
+		k == commonmark.HardLineBreakKind,
+		k == commonmark.HTMLTagKind,
+		k == commonmark.RawHTMLKind:
+		return false, true
+	}
+
+	for i, n := 0, inline.ChildCount(); i < n; i++ {
+		childCut, childKeep := c.inline(inline.Child(i))
+		if !childCut {
+			continue
+		}
+		if !childKeep {
+			i--
+		}
+		// Remove the content after the cut,
+		// but retain any link or directive attributes.
+		for j := n - 1; j > i; j-- {
+			if !isInlineAttribute(inline.Child(j).Kind()) {
+				inline.RemoveChildren(j, j+1)
+			}
+		}
+		if !c.words {
+			return true, inline.ChildCount() > 0
+		}
+		trimInlineEnd(c.source, inline)
+		return true, inlineHasContent(inline)
+	}
+	return false, true
+}
+
+// removeBlocks removes all descendant blocks of parent
+// for which drop returns true.
+func removeBlocks(parent *commonmark.Block, drop func(*commonmark.Block) bool) {
+	for i := parent.ChildCount() - 1; i >= 0; i-- {
+		child := parent.Child(i).Block()
+		switch {
+		case child == nil:
+			return
+		case drop(child):
+			parent.RemoveChildren(i, i+1)
+		default:
+			removeBlocks(child, drop)
+		}
+	}
+}
+
+// removeInlines removes all descendant inline nodes of parent
+// for which drop returns true.
+func removeInlines(parent *commonmark.Block, drop func(*commonmark.Inline) bool) {
+	for i := parent.ChildCount() - 1; i >= 0; i-- {
+		switch child := parent.Child(i); {
+		case child.Block() != nil:
+			removeInlines(child.Block(), drop)
+		case drop(child.Inline()):
+			parent.RemoveChildren(i, i+1)
+		default:
+			removeInlineChildren(child.Inline(), drop)
+		}
+	}
+}
+
+func removeInlineChildren(parent *commonmark.Inline, drop func(*commonmark.Inline) bool) {
+	for i := parent.ChildCount() - 1; i >= 0; i-- {
+		if child := parent.Child(i); drop(child) {
+			parent.RemoveChildren(i, i+1)
+		} else {
+			removeInlineChildren(child, drop)
+		}
+	}
+}
+
+func clearRootBlocks(blocks []*commonmark.RootBlock) {
+	for i := range blocks {
+		blocks[i] = nil
+	}
+}
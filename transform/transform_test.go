@@ -0,0 +1,200 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package transform
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/commonmark"
+	"zombiezen.com/go/commonmark/internal/normhtml"
+	"zombiezen.com/go/commonmark/internal/spec"
+	"zombiezen.com/go/commonmark/internal/treedump"
+)
+
+func TestTransforms(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform Transform
+		input     string
+		before    string
+		after     string
+	}{
+		{
+			name:      "ShiftHeadings",
+			transform: ShiftHeadings(1),
+			input:     "# Title\n\nSetext\n======\n\n> ## Quoted\n\n- ##### Deep\n- ###### Deepest\n",
+			before: "<h1>Title</h1>\n<h1>Setext</h1>\n" +
+				"<blockquote>\n<h2>Quoted</h2>\n</blockquote>\n" +
+				"<ul>\n<li>\n<h5>Deep</h5>\n</li>\n<li>\n<h6>Deepest</h6>\n</li>\n</ul>\n",
+			after: "<h2>Title</h2>\n<h2>Setext</h2>\n" +
+				"<blockquote>\n<h3>Quoted</h3>\n</blockquote>\n" +
+				"<ul>\n<li>\n<h6>Deep</h6>\n</li>\n<li>\n<h6>Deepest</h6>\n</li>\n</ul>\n",
+		},
+		{
+			name:      "ShiftHeadingsNegative",
+			transform: ShiftHeadings(-2),
+			input:     "# One\n\n### Three\n",
+			before:    "<h1>One</h1>\n<h3>Three</h3>\n",
+			after:     "<h1>One</h1>\n<h1>Three</h1>\n",
+		},
+		{
+			name:      "StripImages",
+			transform: StripImages(),
+			input:     "Look: ![a cat](cat.png) and [![logo](logo.png) home](/).\n",
+			before:    `<p>Look: <img src="cat.png" alt="a cat"> and <a href="/"><img src="logo.png" alt="logo"> home</a>.</p>` + "\n",
+			after:     `<p>Look:  and <a href="/"> home</a>.</p>` + "\n",
+		},
+		{
+			name:      "StripRawHTML",
+			transform: StripRawHTML(),
+			input:     "<div>\nblock\n</div>\n\nHello <b>World</b>!\n\n> <!-- comment -->\n>\n> quoted\n",
+			before: "<div>\nblock\n</div>\n<p>Hello <b>World</b>!</p>\n" +
+				"<blockquote>\n<!-- comment -->\n<p>quoted</p>\n</blockquote>\n",
+			after: "<p>Hello World!</p>\n" +
+				"<blockquote>\n<p>quoted</p>\n</blockquote>\n",
+		},
+		{
+			name:      "TruncateParagraph",
+			transform: Truncate(8),
+			input:     "Hello, *World*!\n\nSecond paragraph.\n",
+			before:    "<p>Hello, <em>World</em>!</p>\n<p>Second paragraph.</p>\n",
+			after:     "<p>Hello, <em>W</em></p>\n",
+		},
+		{
+			name:      "TruncateExact",
+			transform: Truncate(5),
+			input:     "Hello\n\nWorld\n",
+			before:    "<p>Hello</p>\n<p>World</p>\n",
+			after:     "<p>Hello</p>\n",
+		},
+		{
+			name:      "TruncateList",
+			transform: Truncate(6),
+			input:     "- abc\n- def\n  - ghi\n- jkl\n\nAfter\n",
+			before:    "<ul>\n<li>abc</li>\n<li>def\n<ul>\n<li>ghi</li>\n</ul>\n</li>\n<li>jkl</li>\n</ul>\n<p>After</p>\n",
+			after:     "<ul>\n<li>abc</li>\n<li>def</li>\n</ul>\n",
+		},
+		{
+			name:      "TruncateBlockQuote",
+			transform: Truncate(4),
+			input:     "> foo\n> bar\n>\n> baz\n",
+			before:    "<blockquote>\n<p>foo\nbar</p>\n<p>baz</p>\n</blockquote>\n",
+			after:     "<blockquote>\n<p>foo\nb</p>\n</blockquote>\n",
+		},
+		{
+			name:      "TruncateLink",
+			transform: Truncate(3),
+			input:     "[hello](/url \"title\") world\n",
+			before:    `<p><a href="/url" title="title">hello</a> world</p>` + "\n",
+			after:     `<p><a href="/url" title="title">hel</a></p>` + "\n",
+		},
+		{
+			name:      "TruncateUTF8",
+			transform: Truncate(2),
+			input:     "aé\n",
+			before:    "<p>aé</p>\n",
+			after:     "<p>a</p>\n",
+		},
+		{
+			name:      "TruncateCharacterReference",
+			transform: Truncate(2),
+			input:     "a&copy;b\n\nc\n",
+			before:    "<p>a©b</p>\n<p>c</p>\n",
+			after:     "<p>a</p>\n",
+		},
+		{
+			name:      "TruncateCodeBlock",
+			transform: Truncate(6),
+			input:     "```go\nfoo()\nbar()\n```\n",
+			before:    "<pre><code class=\"language-go\">foo()\nbar()\n</code></pre>\n",
+			after:     "<pre><code class=\"language-go\">foo()\n</code></pre>\n",
+		},
+		{
+			name:      "TruncateZero",
+			transform: Truncate(0),
+			input:     "Hello\n",
+			before:    "<p>Hello</p>\n",
+			after:     "",
+		},
+		{
+			name:      "TruncateLarge",
+			transform: Truncate(100),
+			input:     "Hello\n",
+			before:    "<p>Hello</p>\n",
+			after:     "<p>Hello</p>\n",
+		},
+		{
+			name:      "Chain",
+			transform: Chain(StripImages(), ShiftHeadings(1), Truncate(5)),
+			input:     "# ![x](x.png)Title\n\nBody\n",
+			before:    "<h1><img src=\"x.png\" alt=\"x\">Title</h1>\n<p>Body</p>\n",
+			after:     "<h2>Title</h2>\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, refMap := commonmark.Parse([]byte(test.input))
+			got := renderHTML(t, blocks, refMap)
+			want := string(normhtml.NormalizeHTML([]byte(test.before)))
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("before transform (-want +got):\n%s", diff)
+			}
+			blocks = test.transform(blocks)
+			got = renderHTML(t, blocks, refMap)
+			want = string(normhtml.NormalizeHTML([]byte(test.after)))
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("after transform (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTransformClone(t *testing.T) {
+	examples, err := spec.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transform := Chain(StripImages(), StripRawHTML(), ShiftHeadings(2), Truncate(20))
+	for _, ex := range examples {
+		blocks, refMap := commonmark.Parse([]byte(ex.Markdown))
+		want := renderHTML(t, blocks, refMap)
+		wantTree := treedump.Dump(blocks)
+		clones := make([]*commonmark.RootBlock, len(blocks))
+		for i, root := range blocks {
+			clones[i] = root.Clone(false)
+		}
+		transform(clones)
+		if got := renderHTML(t, blocks, refMap); got != want {
+			t.Errorf("Example %d: transforming clone changed original (-want +got):\n%s", ex.Example, cmp.Diff(want, got))
+		}
+		if diff := cmp.Diff(wantTree, treedump.Dump(blocks)); diff != "" {
+			t.Errorf("Example %d: transforming clone changed original tree (-want +got):\n%s", ex.Example, diff)
+		}
+	}
+}
+
+func renderHTML(tb testing.TB, blocks []*commonmark.RootBlock, refMap commonmark.ReferenceMap) string {
+	tb.Helper()
+	buf := new(bytes.Buffer)
+	if err := commonmark.RenderHTML(buf, blocks, refMap); err != nil {
+		tb.Fatal("RenderHTML:", err)
+	}
+	return string(normhtml.NormalizeHTML(buf.Bytes()))
+}
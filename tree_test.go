@@ -0,0 +1,99 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commonmark_test
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/commonmark"
+	"zombiezen.com/go/commonmark/internal/spec"
+	"zombiezen.com/go/commonmark/internal/treedump"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+// TestTrees compares the parsed tree of each spec example
+// against golden files in testdata/trees.
+// Run with -update to regenerate the golden files.
+func TestTrees(t *testing.T) {
+	examples, err := spec.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sections []string
+	dumps := make(map[string]*strings.Builder)
+	for _, ex := range examples {
+		sb := dumps[ex.Section]
+		if sb == nil {
+			sb = new(strings.Builder)
+			dumps[ex.Section] = sb
+			sections = append(sections, ex.Section)
+		} else {
+			sb.WriteString("\n")
+		}
+		blocks, _ := commonmark.Parse([]byte(ex.Markdown))
+		fmt.Fprintf(sb, "# Example %d\n# %q\n", ex.Example, ex.Markdown)
+		sb.WriteString(treedump.Dump(blocks))
+	}
+
+	dir := filepath.Join("testdata", "trees")
+	if *updateGolden {
+		if err := os.MkdirAll(dir, 0o777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, section := range sections {
+		section := section
+		t.Run(section, func(t *testing.T) {
+			path := filepath.Join(dir, treeGoldenName(section))
+			got := dumps[section].String()
+			if *updateGolden {
+				if err := os.WriteFile(path, []byte(got), 0o666); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create)", err)
+			}
+			if diff := cmp.Diff(string(want), got); diff != "" {
+				t.Errorf("tree for %s (-want +got):\n%s", path, diff)
+			}
+		})
+	}
+}
+
+// treeGoldenName returns the golden file name for a spec section.
+func treeGoldenName(section string) string {
+	var sb strings.Builder
+	for _, c := range strings.ToLower(section) {
+		switch {
+		case 'a' <= c && c <= 'z' || '0' <= c && c <= '9':
+			sb.WriteRune(c)
+		case sb.Len() > 0 && !strings.HasSuffix(sb.String(), "-"):
+			sb.WriteByte('-')
+		}
+	}
+	return strings.TrimSuffix(sb.String(), "-") + ".txt"
+}
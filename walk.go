@@ -21,6 +21,7 @@ type Cursor struct {
 	node   Node
 	parent Node
 	block  *Block
+	inline *Inline
 	index  int
 }
 
@@ -35,9 +36,24 @@ func (c *Cursor) Parent() Node {
 	return c.parent
 }
 
+// BlockParent returns the nearest [Block] ancestor of the current [Node]
+// or nil if the current [Node] is the root of the traversal.
+func (c *Cursor) BlockParent() *Block {
+	return c.block
+}
+
 // ParentBlock returns the nearest [Block] ancestor of the current [Node].
+//
+// Deprecated: Use [*Cursor.BlockParent].
 func (c *Cursor) ParentBlock() *Block {
-	return c.block
+	return c.BlockParent()
+}
+
+// InlineParent returns the nearest [Inline] ancestor of the current [Node]
+// or nil if the current [Node] is a [Block]
+// or an [Inline] whose parent is a [Block].
+func (c *Cursor) InlineParent() *Inline {
+	return c.inline
 }
 
 // Index returns the index >= 0 of the current [Node]
@@ -50,11 +66,16 @@ func (c *Cursor) Index() int {
 // WalkOptions is the set of parameters to [Walk].
 type WalkOptions struct {
 	// If Pre is not nil, it is called for each node before the node's children are traversed (pre-order).
-	// If Pre returns false, no children are traversed, and Post is not called for that node.
+	// If Pre returns false, no children are traversed,
+	// and Post is not called for that node unless PostAfterSkip is true.
 	Pre func(c *Cursor) bool
 	// If Post is not nil, it is called for each node after the node's children are traversed (post-order).
 	// If Post returns false, traversal is terminated and Walk returns immediately.
 	Post func(c *Cursor) bool
+	// If PostAfterSkip is true, then Post is called for every node visited by Pre,
+	// including nodes for which Pre returned false.
+	// This is useful for Post functions that must undo state set up by Pre.
+	PostAfterSkip bool
 
 	// If ChildCount is not nil, it will be used instead of [Node.ChildCount].
 	ChildCount func(Node) int
@@ -64,6 +85,10 @@ type WalkOptions struct {
 
 // Walk traverses a [Node] recursively, starting with root,
 // and calling [WalkOptions.Pre] and [WalkOptions.Post].
+// Children are visited in order.
+// For the nodes produced by the parser,
+// this means that [WalkOptions.Pre] visits inline nodes
+// in ascending order of their [Span] Start positions.
 func Walk(root Node, opts *WalkOptions) {
 	type walkFrame struct {
 		Cursor
@@ -94,27 +119,114 @@ func Walk(root Node, opts *WalkOptions) {
 			continue
 		}
 
+		curr.post = true
 		if opts.Pre != nil {
 			*cursor = curr.Cursor
 			if !opts.Pre(cursor) {
+				if opts.PostAfterSkip {
+					stack = append(stack, curr)
+				}
 				continue
 			}
 		}
-		curr.post = true
 		stack = append(stack, curr)
 		for i := childCount(curr.node) - 1; i >= 0; i-- {
 			currBlock := curr.block
 			if b := curr.node.Block(); b != nil {
 				currBlock = b
 			}
+			currInline := curr.inline
+			if inline := curr.node.Inline(); inline != nil {
+				currInline = inline
+			}
 			stack = append(stack, walkFrame{
 				Cursor: Cursor{
 					parent: curr.node,
 					node:   getChild(curr.node, i),
 					block:  currBlock,
+					inline: currInline,
 					index:  i,
 				},
 			})
 		}
 	}
 }
+
+// WalkPre traverses a [Node] recursively, starting with root,
+// calling fn for each node before the node's children are traversed.
+// If fn returns false, the node's children are not traversed.
+// It is equivalent to calling [Walk] with fn as [WalkOptions.Pre].
+func WalkPre(root Node, fn func(c *Cursor) bool) {
+	Walk(root, &WalkOptions{Pre: fn})
+}
+
+// WalkPost traverses a [Node] recursively, starting with root,
+// calling fn for each node after the node's children are traversed.
+// If fn returns false, traversal is terminated and WalkPost returns immediately.
+// It is equivalent to calling [Walk] with fn as [WalkOptions.Post].
+func WalkPost(root Node, fn func(c *Cursor) bool) {
+	Walk(root, &WalkOptions{Post: fn})
+}
+
+// WalkAll calls [WalkPre] for each root block in order.
+// Each root block is visited as the root of a separate traversal,
+// so [*Cursor.Index] returns a value < 0 for the root blocks.
+func WalkAll(roots []*RootBlock, fn func(c *Cursor) bool) {
+	for _, root := range roots {
+		WalkPre(root.AsNode(), fn)
+	}
+}
+
+// CollectBlocks returns the blocks in the tree rooted at root
+// whose kind is one of the given kinds, in pre-order.
+// If no kinds are given, CollectBlocks returns all blocks in the tree.
+func CollectBlocks(root Node, kinds ...BlockKind) []*Block {
+	var result []*Block
+	WalkPre(root, func(c *Cursor) bool {
+		b := c.Node().Block()
+		if b == nil {
+			return true
+		}
+		if len(kinds) == 0 || containsBlockKind(kinds, b.Kind()) {
+			result = append(result, b)
+		}
+		return true
+	})
+	return result
+}
+
+// CollectInlines returns the inlines in the tree rooted at root
+// whose kind is one of the given kinds, in pre-order.
+// If no kinds are given, CollectInlines returns all inlines in the tree.
+func CollectInlines(root Node, kinds ...InlineKind) []*Inline {
+	var result []*Inline
+	WalkPre(root, func(c *Cursor) bool {
+		inline := c.Node().Inline()
+		if inline == nil {
+			return true
+		}
+		if len(kinds) == 0 || containsInlineKind(kinds, inline.Kind()) {
+			result = append(result, inline)
+		}
+		return true
+	})
+	return result
+}
+
+func containsBlockKind(kinds []BlockKind, k BlockKind) bool {
+	for _, elem := range kinds {
+		if elem == k {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInlineKind(kinds []InlineKind, k InlineKind) bool {
+	for _, elem := range kinds {
+		if elem == k {
+			return true
+		}
+	}
+	return false
+}
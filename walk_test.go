@@ -0,0 +1,303 @@
+// Copyright 2024 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commonmark
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/commonmark/internal/spec"
+)
+
+func TestWalkInlineOrder(t *testing.T) {
+	inputs := []string{
+		"Hello, *emphasized **strong `code` text** and [a *link*](/url \"title\")*!\n",
+		"[full *reference*][ref] and ![image **alt**][ref] and [ref]\n\n[ref]: /url\n",
+		"_a `b` c_ <http://example.com/> &amp; <span>raw</span>  \nnext line\\\nlast\n",
+		"# Heading with *emphasis* and `code`\n",
+		"- list *item*\n  > quoted [link](</a b> 'title')\n",
+	}
+	for _, input := range inputs {
+		blocks, _ := Parse([]byte(input))
+		for _, root := range blocks {
+			var prev *Inline
+			Walk(root.AsNode(), &WalkOptions{
+				Pre: func(c *Cursor) bool {
+					curr := c.Node().Inline()
+					if curr == nil || !curr.Span().IsValid() {
+						return true
+					}
+					if prev != nil && curr.Span().Start < prev.Span().Start {
+						t.Errorf("In %q: visited %v node at %v after %v node at %v",
+							input, curr.Kind(), curr.Span(), prev.Kind(), prev.Span())
+					}
+					prev = curr
+					return true
+				},
+			})
+			if prev == nil {
+				t.Errorf("In %q: no inline nodes visited", input)
+			}
+		}
+	}
+}
+
+func TestWalkPostAfterSkip(t *testing.T) {
+	const input = "*a* b\n"
+	blocks, _ := Parse([]byte(input))
+	skipEmphasis := func(got *[]string) func(c *Cursor) bool {
+		return func(c *Cursor) bool {
+			*got = append(*got, "pre "+nodeKindString(c.Node()))
+			return c.Node().Inline().Kind() != EmphasisKind
+		}
+	}
+	recordPost := func(got *[]string) func(c *Cursor) bool {
+		return func(c *Cursor) bool {
+			*got = append(*got, "post "+nodeKindString(c.Node()))
+			return true
+		}
+	}
+	tests := []struct {
+		postAfterSkip bool
+		want          []string
+	}{
+		{
+			postAfterSkip: false,
+			want: []string{
+				"pre ParagraphKind",
+				"pre EmphasisKind",
+				"pre TextKind",
+				"post TextKind",
+				"post ParagraphKind",
+			},
+		},
+		{
+			postAfterSkip: true,
+			want: []string{
+				"pre ParagraphKind",
+				"pre EmphasisKind",
+				"post EmphasisKind",
+				"pre TextKind",
+				"post TextKind",
+				"post ParagraphKind",
+			},
+		},
+	}
+	for _, test := range tests {
+		var got []string
+		Walk(blocks[0].AsNode(), &WalkOptions{
+			Pre:           skipEmphasis(&got),
+			Post:          recordPost(&got),
+			PostAfterSkip: test.postAfterSkip,
+		})
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("PostAfterSkip=%t (-want +got):\n%s", test.postAfterSkip, diff)
+		}
+	}
+}
+
+func TestCursorParents(t *testing.T) {
+	const input = "> *a [b `c`](/u)*\n"
+	blocks, _ := Parse([]byte(input))
+	kindOrNil := func(n Node) string {
+		if n == (Node{}) {
+			return "nil"
+		}
+		return nodeKindString(n)
+	}
+	var got []string
+	WalkPre(blocks[0].AsNode(), func(c *Cursor) bool {
+		got = append(got, fmt.Sprintf("%s block=%s inline=%s",
+			nodeKindString(c.Node()),
+			kindOrNil(c.BlockParent().AsNode()),
+			kindOrNil(c.InlineParent().AsNode())))
+		if c.ParentBlock() != c.BlockParent() {
+			t.Errorf("At %v: ParentBlock() = %p; BlockParent() = %p",
+				nodeKindString(c.Node()), c.ParentBlock(), c.BlockParent())
+		}
+		return true
+	})
+	want := []string{
+		"BlockQuoteKind block=nil inline=nil",
+		"ParagraphKind block=BlockQuoteKind inline=nil",
+		"EmphasisKind block=ParagraphKind inline=nil",
+		"TextKind block=ParagraphKind inline=EmphasisKind",
+		"LinkKind block=ParagraphKind inline=EmphasisKind",
+		"TextKind block=ParagraphKind inline=LinkKind",
+		"CodeSpanKind block=ParagraphKind inline=LinkKind",
+		"TextKind block=ParagraphKind inline=CodeSpanKind",
+		"LinkDestinationKind block=ParagraphKind inline=LinkKind",
+		"TextKind block=ParagraphKind inline=LinkDestinationKind",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+}
+
+func TestWalkWrappers(t *testing.T) {
+	const input = "# Hello *World*\n\n- a\n- [b](/url)\n"
+	blocks, _ := Parse([]byte(input))
+	record := func(got *[]string) func(c *Cursor) bool {
+		return func(c *Cursor) bool {
+			*got = append(*got, nodeKindString(c.Node()))
+			return true
+		}
+	}
+
+	t.Run("WalkPre", func(t *testing.T) {
+		for _, root := range blocks {
+			var want, got []string
+			Walk(root.AsNode(), &WalkOptions{Pre: record(&want)})
+			WalkPre(root.AsNode(), record(&got))
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("-Walk +WalkPre:\n%s", diff)
+			}
+		}
+	})
+
+	t.Run("WalkPost", func(t *testing.T) {
+		for _, root := range blocks {
+			var want, got []string
+			Walk(root.AsNode(), &WalkOptions{Post: record(&want)})
+			WalkPost(root.AsNode(), record(&got))
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("-Walk +WalkPost:\n%s", diff)
+			}
+		}
+	})
+
+	t.Run("WalkPostStop", func(t *testing.T) {
+		n := 0
+		WalkPost(blocks[0].AsNode(), func(c *Cursor) bool {
+			n++
+			return false
+		})
+		if n != 1 {
+			t.Errorf("fn called %d times; want 1", n)
+		}
+	})
+
+	t.Run("WalkAll", func(t *testing.T) {
+		var want []string
+		for _, root := range blocks {
+			Walk(root.AsNode(), &WalkOptions{Pre: record(&want)})
+		}
+		var got []string
+		var roots int
+		WalkAll(blocks, func(c *Cursor) bool {
+			if c.Index() < 0 {
+				roots++
+			}
+			return record(&got)(c)
+		})
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("-Walk +WalkAll:\n%s", diff)
+		}
+		if roots != len(blocks) {
+			t.Errorf("visited %d nodes with a negative index; want %d", roots, len(blocks))
+		}
+	})
+
+	t.Run("WalkAllSkip", func(t *testing.T) {
+		var got []string
+		WalkAll(blocks, func(c *Cursor) bool {
+			got = append(got, nodeKindString(c.Node()))
+			return false
+		})
+		want := []string{"ATXHeadingKind", "ListKind"}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("(-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestCollect(t *testing.T) {
+	const input = "# Hello *World*\n\n- a\n- [b](/url) *c*\n\n```\ncode\n```\n"
+	blocks, _ := Parse([]byte(input))
+	var gotBlocks, gotInlines []string
+	for _, root := range blocks {
+		for _, b := range CollectBlocks(root.AsNode(), ListItemKind, FencedCodeBlockKind) {
+			gotBlocks = append(gotBlocks, b.Kind().String())
+		}
+		for _, inline := range CollectInlines(root.AsNode(), EmphasisKind, LinkKind) {
+			gotInlines = append(gotInlines, inline.Kind().String())
+		}
+	}
+	wantBlocks := []string{"ListItemKind", "ListItemKind", "FencedCodeBlockKind"}
+	if diff := cmp.Diff(wantBlocks, gotBlocks); diff != "" {
+		t.Errorf("CollectBlocks(...) (-want +got):\n%s", diff)
+	}
+	wantInlines := []string{"EmphasisKind", "LinkKind", "EmphasisKind"}
+	if diff := cmp.Diff(wantInlines, gotInlines); diff != "" {
+		t.Errorf("CollectInlines(...) (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectSpec(t *testing.T) {
+	examples, err := spec.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ex := range examples {
+		blocks, _ := Parse([]byte(ex.Markdown))
+		for _, root := range blocks {
+			var wantBlocks []*Block
+			var wantInlines []*Inline
+			var visit func(n Node)
+			visit = func(n Node) {
+				if b := n.Block(); b != nil {
+					wantBlocks = append(wantBlocks, b)
+				} else if inline := n.Inline(); inline != nil {
+					wantInlines = append(wantInlines, inline)
+				}
+				for i, nchildren := 0, n.ChildCount(); i < nchildren; i++ {
+					visit(n.Child(i))
+				}
+			}
+			visit(root.AsNode())
+
+			if got := CollectBlocks(root.AsNode()); !equalPointers(got, wantBlocks) {
+				t.Errorf("Example %d: CollectBlocks(...) returned %d blocks; want %d", ex.Example, len(got), len(wantBlocks))
+			}
+			if got := CollectInlines(root.AsNode()); !equalPointers(got, wantInlines) {
+				t.Errorf("Example %d: CollectInlines(...) returned %d inlines; want %d", ex.Example, len(got), len(wantInlines))
+			}
+			var wantText []*Inline
+			for _, inline := range wantInlines {
+				if k := inline.Kind(); k == TextKind || k == SoftLineBreakKind {
+					wantText = append(wantText, inline)
+				}
+			}
+			if got := CollectInlines(root.AsNode(), TextKind, SoftLineBreakKind); !equalPointers(got, wantText) {
+				t.Errorf("Example %d: CollectInlines(..., TextKind, SoftLineBreakKind) returned %d inlines; want %d", ex.Example, len(got), len(wantText))
+			}
+		}
+	}
+}
+
+func equalPointers[T any](a, b []*T) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}